@@ -0,0 +1,595 @@
+// Handles the admin dashboard, a set of server-rendered pages for managing users, chirps, and sessions and watching how Chirpy is doing.
+//
+//	Every page needs an admin's session cookie or access token. Actions are sent with HTMX, which adds the CSRF token like the web pages
+
+package apiConfig
+
+import (
+	"embed"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/trolfu/boot-dev-web-servers-course/database"
+)
+
+// Most users shown for a search, so a broad one doesn't render every account
+const adminUserLimit = 100
+
+// Number of recent audit events shown on the overview
+const adminOverviewEvents = 10
+
+// Size of the requests chart, in SVG units. Each minute of history gets an equal width bar
+const (
+	requestChartWidth  = 600
+	requestChartHeight = 160
+)
+
+//go:embed admin/*.html admin/assets
+var adminFiles embed.FS
+
+var adminFuncs = template.FuncMap{"time": formatAdminTime, "userRef": newAdminUserRef}
+
+// Each page is parsed with the layout and the shared tables, since every page defines its own `content`
+var adminPages = map[string]*template.Template{
+	"overview": parseAdminPage("overview.html"),
+	"users":    parseAdminPage("users.html"),
+	"user":     parseAdminPage("user.html"),
+	"chirps":   parseAdminPage("chirps.html"),
+	"tokens":   parseAdminPage("tokens.html"),
+	"metrics":  parseAdminPage("metrics.html"),
+	"audit":    parseAdminPage("audit.html"),
+}
+
+func parseAdminPage(page string) *template.Template {
+	return template.Must(template.New(page).Funcs(adminFuncs).ParseFS(adminFiles, "admin/layout.html", "admin/tables.html", "admin/"+page))
+}
+
+// Formats times on the dashboard, to the minute, in UTC
+func formatAdminTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.UTC().Format("2006-01-02 15:04 UTC")
+}
+
+// A user linked to from a table, by their email if they still exist
+type adminUserRef struct {
+	Emails map[int]string
+	Id     int
+}
+
+func newAdminUserRef(emails map[int]string, id int) adminUserRef {
+	return adminUserRef{Emails: emails, Id: id}
+}
+
+// What a dashboard page is rendered with
+type adminPage struct {
+	Title     string
+	Section   string // The navigation link that's highlighted
+	Admin     database.User
+	CSRFToken string // Sent back by HTMX with every request
+	Now       time.Time
+	Emails    map[int]string // Every user's email by id, for showing who chirped or did what
+	Stats     adminStats
+	Query     string          // The user search
+	Users     []database.User // Users matching the search
+	More      bool            // Whether more users matched than are shown
+	Profile   database.User   // The user shown, or whose chirps are listed
+	Sessions  []database.Session
+	Tokens    []database.RefreshToken // Refresh tokens that have been replaced
+	Chirps    chirpPage
+	Sweeps    tokenSweepSummary
+	Hits      int
+	Requests  requestChart
+	Events    []database.AuditEvent
+}
+
+// Totals shown on the overview and metrics pages
+type adminStats struct {
+	Users        int
+	ChirpyRed    int
+	Disabled     int
+	Admins       int
+	Chirps       int
+	Sessions     int // Unexpired sessions
+	Revoked      int // Replaced refresh tokens kept to detect reuse
+	Requests     int // In the last `requestHistoryMinutes` minutes
+	ServerErrors int
+}
+
+// A bar chart of requests per minute, drawn as SVG. Each bar stacks successful requests, then client errors, then server errors
+type requestChart struct {
+	Width  int
+	Height int
+	Max    int // The most requests in a minute, which reaches the top of the chart
+	From   time.Time
+	To     time.Time
+	Bars   []requestBar
+}
+
+type requestBar struct {
+	requestMinute
+	Segments []chartSegment
+}
+
+type chartSegment struct {
+	Class  string
+	X      int
+	Y      string
+	Width  int
+	Height string
+}
+
+// Lays out the request history as bars scaled to the busiest minute
+func newRequestChart(history []requestMinute) requestChart {
+	chart := requestChart{Width: requestChartWidth, Height: requestChartHeight, Bars: []requestBar{}}
+	for _, minute := range history {
+		chart.Max = max(chart.Max, minute.Requests)
+	}
+	if len(history) > 0 {
+		chart.From, chart.To = history[0].Start, history[len(history)-1].Start
+	}
+	barWidth := requestChartWidth / max(len(history), 1)
+	for i, minute := range history {
+		bar := requestBar{requestMinute: minute, Segments: []chartSegment{}}
+		top := float64(requestChartHeight)
+		counts := []struct {
+			class string
+			count int
+		}{
+			{"ok", minute.Requests - minute.ClientErrors - minute.ServerErrors},
+			{"client-error", minute.ClientErrors},
+			{"server-error", minute.ServerErrors},
+		}
+		for _, segment := range counts {
+			if segment.count == 0 {
+				continue
+			}
+			height := float64(segment.count) / float64(chart.Max) * requestChartHeight
+			top -= height
+			bar.Segments = append(bar.Segments, chartSegment{
+				Class:  segment.class,
+				X:      i * barWidth,
+				Y:      strconv.FormatFloat(top, 'f', 1, 64),
+				Width:  barWidth - 1,
+				Height: strconv.FormatFloat(height, 'f', 1, 64),
+			})
+		}
+		chart.Bars = append(chart.Bars, bar)
+	}
+	return chart
+}
+
+// Only lets admins through to the dashboard. Logged out browsers are sent to the login page, to come back once they've logged in.
+//
+//	Scoped credentials, like API keys and OAuth grants, aren't accepted
+func (config *apiConfig) MiddlewareAdminDashboard(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		caller, found, status, err := config.authenticateRequest(request)
+		if !found || (err != nil && status == http.StatusUnauthorized) {
+			webRedirect(writer, request, "/login?"+url.Values{"next": {request.URL.RequestURI()}}.Encode())
+			return
+		}
+		if err != nil {
+			http.Error(writer, err.Error(), status)
+			return
+		}
+		if caller.Scopes != nil {
+			http.Error(writer, "Log in to use the admin dashboard. API keys aren't accepted", http.StatusForbidden)
+			return
+		}
+		if !database.RoleAtLeast(caller.Role, database.RoleAdmin) {
+			http.Error(writer, "Not allowed", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(writer, withPrincipal(request, caller))
+	})
+}
+
+// Serves the dashboard's embedded stylesheet
+func (config *apiConfig) AdminAssets() http.Handler {
+	assets, err := fs.Sub(adminFiles, "admin/assets")
+	if err != nil {
+		panic(err) // The directory is embedded, so this can't happen
+	}
+	return http.StripPrefix("/admin/assets/", http.FileServer(http.FS(assets)))
+}
+
+// Starts building a dashboard page for the request. Returns every user as well, which most pages need
+func (config *apiConfig) newAdminPage(request *http.Request, title string, section string) (adminPage, []database.User, error) {
+	page := adminPage{Title: title, Section: section, Now: time.Now().UTC(), Emails: map[int]string{}}
+	users, err := config.db.GetUsers()
+	if err != nil {
+		return page, nil, fmt.Errorf("Error getting users: %w", err)
+	}
+	caller, _ := principalFrom(request)
+	for _, user := range users {
+		page.Emails[user.Id] = user.Email
+		if user.Id == caller.UserId {
+			page.Admin = user
+		}
+	}
+	if cookie, err := request.Cookie(csrfCookieName); err == nil {
+		page.CSRFToken = cookie.Value
+	}
+	return page, users, nil
+}
+
+func renderAdminPage(writer http.ResponseWriter, status int, name string, page adminPage) {
+	setWebHeaders(writer)
+	writer.WriteHeader(status)
+	err := adminPages[name].ExecuteTemplate(writer, "layout.html", page)
+	if err != nil {
+		log.Printf("Error rendering admin %s page: %v", name, err)
+	}
+}
+
+// Counts the users by plan, status, and role
+func countUsers(users []database.User) adminStats {
+	stats := adminStats{Users: len(users)}
+	for _, user := range users {
+		if user.IsChirpyRed {
+			stats.ChirpyRed++
+		}
+		if user.Disabled {
+			stats.Disabled++
+		}
+		if user.Role == database.RoleAdmin {
+			stats.Admins++
+		}
+	}
+	return stats
+}
+
+// Shows totals for users, chirps, and sessions, and the most recent audit events
+func (config *apiConfig) AdminOverview(writer http.ResponseWriter, request *http.Request) {
+	page, users, err := config.newAdminPage(request, "Overview", "overview")
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page.Stats = countUsers(users)
+
+	chirps, err := config.db.GetChirps()
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Error getting chirps: %v", err), http.StatusInternalServerError)
+		return
+	}
+	page.Stats.Chirps = len(chirps)
+	sessions, err := config.db.GetSessions()
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Error getting sessions: %v", err), http.StatusInternalServerError)
+		return
+	}
+	for _, session := range sessions {
+		if page.Now.Before(session.ExpiresAt) {
+			page.Stats.Sessions++
+		}
+	}
+	revoked, err := config.db.GetRotatedRefreshTokens()
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Error getting refresh tokens: %v", err), http.StatusInternalServerError)
+		return
+	}
+	page.Stats.Revoked = len(revoked)
+	for _, minute := range config.requests.history(page.Now) {
+		page.Stats.Requests += minute.Requests
+		page.Stats.ServerErrors += minute.ServerErrors
+	}
+
+	page.Events, err = config.db.GetAuditEvents(adminOverviewEvents)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Error getting audit events: %v", err), http.StatusInternalServerError)
+		return
+	}
+	renderAdminPage(writer, http.StatusOK, "overview", page)
+}
+
+// Lists users, or searches them with `?q=`, which matches part of an email address or a user's id
+func (config *apiConfig) AdminUsers(writer http.ResponseWriter, request *http.Request) {
+	page, users, err := config.newAdminPage(request, "Users", "users")
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page.Query = strings.TrimSpace(request.URL.Query().Get("q"))
+	query := strings.ToLower(page.Query)
+	page.Users = []database.User{}
+	for _, user := range users {
+		if query != "" && strconv.Itoa(user.Id) != query &&
+			!strings.Contains(strings.ToLower(user.Email), query) && !strings.Contains(strings.ToLower(user.PendingEmail), query) {
+			continue
+		}
+		if len(page.Users) == adminUserLimit {
+			page.More = true
+			break
+		}
+		page.Users = append(page.Users, user)
+	}
+	renderAdminPage(writer, http.StatusOK, "users", page)
+}
+
+// Shows a user with their sessions and newest chirps, and the actions an admin can take on their account
+func (config *apiConfig) AdminUser(writer http.ResponseWriter, request *http.Request) {
+	user, found := config.getAdminUser(writer, request)
+	if !found {
+		return
+	}
+	page, _, err := config.newAdminPage(request, user.Email, "users")
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page.Profile = user
+	page.Sessions, err = config.db.GetUserSessions(user.Id)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Error getting sessions: %v", err), http.StatusInternalServerError)
+		return
+	}
+	page.Chirps, err = config.getAdminChirpPage(strconv.Itoa(user.Id), 0)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Error getting chirps: %v", err), http.StatusInternalServerError)
+		return
+	}
+	renderAdminPage(writer, http.StatusOK, "user", page)
+}
+
+// Gets the user in the route's `userId`, responding with an error if there isn't one
+func (config *apiConfig) getAdminUser(writer http.ResponseWriter, request *http.Request) (user database.User, found bool) {
+	userId, err := strconv.Atoi(chi.URLParam(request, "userId"))
+	if err != nil {
+		http.NotFound(writer, request)
+		return database.User{}, false
+	}
+	user, found, err = config.db.GetUser(userId)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Error getting user: %v", err), http.StatusInternalServerError)
+		return database.User{}, false
+	}
+	if !found {
+		http.NotFound(writer, request)
+		return database.User{}, false
+	}
+	return user, true
+}
+
+// Gets a page of chirps like the timeline's, linking to the next page of the dashboard's chirps instead
+func (config *apiConfig) getAdminChirpPage(authorId string, before int) (chirpPage, error) {
+	page, err := config.getChirpPage(authorId, before, 0)
+	if page.NextURL != "" {
+		page.NextURL = "/admin" + page.NextURL
+	}
+	return page, err
+}
+
+// Lists chirps, newest first, a page at a time. `?author_id=` limits them to one user's, and `?before=` is the id of the last chirp on the previous page
+func (config *apiConfig) AdminChirps(writer http.ResponseWriter, request *http.Request) {
+	page, _, err := config.newAdminPage(request, "Chirps", "chirps")
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	before := 0
+	if beforeParam := request.URL.Query().Get("before"); beforeParam != "" {
+		before, err = strconv.Atoi(beforeParam)
+		if err != nil || before < 1 {
+			http.Error(writer, "Invalid before", http.StatusBadRequest)
+			return
+		}
+	}
+	authorId := request.URL.Query().Get("author_id")
+	if authorId != "" {
+		id, err := strconv.Atoi(authorId)
+		if err != nil || page.Emails[id] == "" {
+			http.Error(writer, "Invalid author_id", http.StatusBadRequest)
+			return
+		}
+		page.Profile = database.User{Id: id, Email: page.Emails[id]}
+	}
+	page.Chirps, err = config.getAdminChirpPage(authorId, before)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Error getting chirps: %v", err), http.StatusInternalServerError)
+		return
+	}
+	renderAdminPage(writer, http.StatusOK, "chirps", page)
+}
+
+// Lists every session and the revoked refresh tokens, with the expired token sweeps
+func (config *apiConfig) AdminTokens(writer http.ResponseWriter, request *http.Request) {
+	page, _, err := config.newAdminPage(request, "Tokens", "tokens")
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page.Sessions, err = config.db.GetSessions()
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Error getting sessions: %v", err), http.StatusInternalServerError)
+		return
+	}
+	page.Tokens, err = config.db.GetRotatedRefreshTokens()
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Error getting refresh tokens: %v", err), http.StatusInternalServerError)
+		return
+	}
+	page.Sweeps = config.tokenSweeps.summary()
+	renderAdminPage(writer, http.StatusOK, "tokens", page)
+}
+
+// Charts the requests handled over the last hour, alongside the app's visits, the users by plan, and the token sweeps
+func (config *apiConfig) AdminMetrics(writer http.ResponseWriter, request *http.Request) {
+	page, users, err := config.newAdminPage(request, "Metrics", "metrics")
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page.Stats = countUsers(users)
+	history := config.requests.history(page.Now)
+	for _, minute := range history {
+		page.Stats.Requests += minute.Requests
+		page.Stats.ServerErrors += minute.ServerErrors
+	}
+	page.Requests = newRequestChart(history)
+	page.Hits = config.fileserverHits
+	page.Sweeps = config.tokenSweeps.summary()
+	renderAdminPage(writer, http.StatusOK, "metrics", page)
+}
+
+// Lists the most recent audit events, newest first. `?limit=` sets how many, and 0 lists every event
+func (config *apiConfig) AdminAudit(writer http.ResponseWriter, request *http.Request) {
+	page, _, err := config.newAdminPage(request, "Audit log", "audit")
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	limit := defaultAuditEventLimit
+	if limitParam := request.URL.Query().Get("limit"); limitParam != "" {
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil || limit < 0 {
+			http.Error(writer, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	page.Events, err = config.db.GetAuditEvents(limit)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Error getting audit events: %v", err), http.StatusInternalServerError)
+		return
+	}
+	renderAdminPage(writer, http.StatusOK, "audit", page)
+}
+
+// Gives a user Chirpy Red, like a Polka payment would
+func (config *apiConfig) AdminUpgradeUser(writer http.ResponseWriter, request *http.Request) {
+	config.setChirpyRed(writer, request, true)
+}
+
+// Takes Chirpy Red away from a user
+func (config *apiConfig) AdminDowngradeUser(writer http.ResponseWriter, request *http.Request) {
+	config.setChirpyRed(writer, request, false)
+}
+
+func (config *apiConfig) setChirpyRed(writer http.ResponseWriter, request *http.Request, chirpyRed bool) {
+	user, found := config.getAdminUser(writer, request)
+	if !found {
+		return
+	}
+	var err error
+	details := "Upgraded to Chirpy Red"
+	if chirpyRed {
+		user, err = config.db.UpgradeUser(user.Id)
+	} else {
+		user, err = config.db.DowngradeUser(user.Id)
+		details = "Removed Chirpy Red"
+	}
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Error changing plan: %v", err), http.StatusInternalServerError)
+		return
+	}
+	config.audit(request, "user.chirpy_red", fmt.Sprintf("user:%d", user.Id), details)
+	webRedirect(writer, request, fmt.Sprintf("/admin/users/%d", user.Id))
+}
+
+// Disables a user's account, revoking their sessions so they're logged out everywhere. Admins can't disable themselves
+func (config *apiConfig) AdminDisableUser(writer http.ResponseWriter, request *http.Request) {
+	config.setUserDisabled(writer, request, true)
+}
+
+// Lets a disabled user log in again
+func (config *apiConfig) AdminEnableUser(writer http.ResponseWriter, request *http.Request) {
+	config.setUserDisabled(writer, request, false)
+}
+
+func (config *apiConfig) setUserDisabled(writer http.ResponseWriter, request *http.Request, disabled bool) {
+	user, found := config.getAdminUser(writer, request)
+	if !found {
+		return
+	}
+	caller, _ := principalFrom(request)
+	if disabled && user.Id == caller.UserId {
+		http.Error(writer, "You can't disable your own account", http.StatusBadRequest)
+		return
+	}
+	user, err := config.db.SetUserDisabled(user.Id, disabled)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Error updating user: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !disabled {
+		config.audit(request, "user.enable", fmt.Sprintf("user:%d", user.Id), "")
+		webRedirect(writer, request, fmt.Sprintf("/admin/users/%d", user.Id))
+		return
+	}
+	revoked, err := config.db.DeleteUserSessions(user.Id)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Error revoking sessions: %v", err), http.StatusInternalServerError)
+		return
+	}
+	config.audit(request, "user.disable", fmt.Sprintf("user:%d", user.Id), fmt.Sprintf("Revoked %d refresh tokens", revoked))
+	webRedirect(writer, request, fmt.Sprintf("/admin/users/%d", user.Id))
+}
+
+// Deletes any user's chirp. The empty response replaces the chirp's row on the page
+func (config *apiConfig) AdminDeleteChirp(writer http.ResponseWriter, request *http.Request) {
+	chirpId, err := strconv.Atoi(chi.URLParam(request, "chirpId"))
+	if err != nil {
+		http.NotFound(writer, request)
+		return
+	}
+	chirp, found, err := config.db.GetChirp(chirpId)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Error getting chirp: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.NotFound(writer, request)
+		return
+	}
+	_, err = config.db.DeleteChirp(chirp.Id)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Error deleting chirp: %v", err), http.StatusInternalServerError)
+		return
+	}
+	config.audit(request, "chirp.delete", fmt.Sprintf("chirp:%d", chirp.Id), fmt.Sprintf("Deleted a chirp by user %d: %q", chirp.AuthorId, chirp.Body))
+	setWebHeaders(writer)
+	writer.WriteHeader(http.StatusOK)
+}
+
+// Revokes any user's session. The empty response replaces the session's row on the page
+func (config *apiConfig) AdminRevokeSession(writer http.ResponseWriter, request *http.Request) {
+	sessionId := chi.URLParam(request, "sessionId")
+	session, found, err := config.db.GetSession(sessionId)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Error getting session: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.NotFound(writer, request)
+		return
+	}
+	_, err = config.db.DeleteRefreshTokenFamily(session.Id)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Error revoking session: %v", err), http.StatusInternalServerError)
+		return
+	}
+	config.audit(request, "session.revoke", "session:"+session.Id, fmt.Sprintf("Revoked a session of user %d", session.UserId))
+	setWebHeaders(writer)
+	writer.WriteHeader(http.StatusOK)
+}
+
+// Sweeps expired tokens from the tokens page, like /admin/refresh-tokens/sweep
+func (config *apiConfig) AdminSweepTokens(writer http.ResponseWriter, request *http.Request) {
+	sweep, err := config.sweepRefreshTokens()
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Error sweeping refresh tokens: %v", err), http.StatusInternalServerError)
+		return
+	}
+	config.audit(request, "refresh_tokens.sweep", "refresh_tokens", fmt.Sprintf("Pruned %d expired tokens", sweep.Pruned))
+	webRedirect(writer, request, "/admin/tokens")
+}
@@ -0,0 +1,202 @@
+package apiConfig
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/trolfu/boot-dev-web-servers-course/database"
+)
+
+// Serves the admin dashboard under /admin, alongside the web pages for logging in
+func newAdminRouter(config apiConfig) http.Handler {
+	dashboard := chi.NewRouter()
+	dashboard.Use(config.MiddlewareAdminDashboard)
+	dashboard.Handle("/assets/*", config.AdminAssets())
+	dashboard.Get("/", config.AdminOverview)
+	dashboard.Get("/users", config.AdminUsers)
+	dashboard.Get("/users/{userId}", config.AdminUser)
+	dashboard.Post("/users/{userId}/upgrade", config.AdminUpgradeUser)
+	dashboard.Post("/users/{userId}/downgrade", config.AdminDowngradeUser)
+	dashboard.Post("/users/{userId}/disable", config.AdminDisableUser)
+	dashboard.Post("/users/{userId}/enable", config.AdminEnableUser)
+	dashboard.Get("/chirps", config.AdminChirps)
+	dashboard.Delete("/chirps/{chirpId}", config.AdminDeleteChirp)
+	dashboard.Get("/tokens", config.AdminTokens)
+	dashboard.Post("/tokens/sweep", config.AdminSweepTokens)
+	dashboard.Delete("/sessions/{sessionId}", config.AdminRevokeSession)
+	dashboard.Get("/metrics", config.AdminMetrics)
+	dashboard.Get("/audit", config.AdminAudit)
+
+	router := chi.NewRouter()
+	router.Mount("/admin", dashboard)
+	router.Mount("/", newWebRouter(config))
+	return router
+}
+
+// Logs in on the login page, returning the session's cookies
+func webLogin(t *testing.T, router http.Handler, email string, password string) []*http.Cookie {
+	response := postLoginForm(router, "/login", url.Values{"email": {email}, "password": {password}})
+	if response.Code != http.StatusSeeOther {
+		t.Fatalf("Error logging in as %s: %v %s", email, response.Code, response.Body)
+	}
+	return response.Result().Cookies()
+}
+
+func TestAdminDashboardRequiresAdmin(t *testing.T) {
+	config, _, _ := newTestAuthConfig(t)
+	router := newAdminRouter(config)
+
+	response := browse(router, http.MethodGet, "/admin/users?q=a", nil, nil, false)
+	if response.Code != http.StatusSeeOther || response.Header().Get("Location") != "/login?next=%2Fadmin%2Fusers%3Fq%3Da" {
+		t.Fatalf("Expected a logged out browser to be sent to the login page: %v %v", response.Code, response.Header())
+	}
+	if browse(router, http.MethodGet, "/admin/assets/admin.css", nil, nil, false).Code != http.StatusSeeOther {
+		t.Fatal("Expected the dashboard's assets to need a login too")
+	}
+
+	user, err := config.db.CreateUser("admin@example.com", "password")
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	cookies := webLogin(t, router, "admin@example.com", "password")
+	if browse(router, http.MethodGet, "/admin", nil, cookies, false).Code != http.StatusForbidden {
+		t.Fatal("Expected a user without the admin role to be forbidden")
+	}
+
+	// The role is carried by the access token, so it applies from the next login
+	_, err = config.db.SetUserRole(user.Id, database.RoleAdmin)
+	if err != nil {
+		t.Fatalf("Error setting role: %v", err)
+	}
+	response = postLoginForm(router, "/login?next=%2Fadmin%2Fusers", url.Values{"email": {"admin@example.com"}, "password": {"password"}})
+	if response.Code != http.StatusSeeOther || response.Header().Get("Location") != "/admin/users" {
+		t.Fatalf("Expected logging in to go on to the dashboard: %v %v", response.Code, response.Header())
+	}
+	cookies = response.Result().Cookies()
+	response = browse(router, http.MethodGet, "/admin", nil, cookies, false)
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), "Overview") {
+		t.Fatalf("Overview not shown to an admin: %v %s", response.Code, response.Body)
+	}
+	response = browse(router, http.MethodGet, "/admin/assets/admin.css", nil, cookies, false)
+	if response.Code != http.StatusOK || !strings.HasPrefix(response.Header().Get("Content-Type"), "text/css") {
+		t.Fatalf("Stylesheet not served: %v %v", response.Code, response.Header())
+	}
+
+	response = postLoginForm(router, "/login?next=https%3A%2F%2Fevil.example.com", url.Values{"email": {"admin@example.com"}, "password": {"password"}})
+	if response.Header().Get("Location") != "/" {
+		t.Fatalf("Expected a next page on another site to be ignored, actual: %v", response.Header().Get("Location"))
+	}
+}
+
+func TestAdminDashboard(t *testing.T) {
+	config, _, _ := newTestAuthConfig(t)
+	router := newAdminRouter(config)
+
+	admin, err := config.db.CreateUser("admin@example.com", "password")
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	_, err = config.db.SetUserRole(admin.Id, database.RoleAdmin)
+	if err != nil {
+		t.Fatalf("Error setting role: %v", err)
+	}
+	other, err := config.db.CreateUser("other@example.com", "password")
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	chirp, err := config.db.CreateChirp("Moderate me", other.Id)
+	if err != nil {
+		t.Fatalf("Error creating chirp: %v", err)
+	}
+	cookies := webLogin(t, router, "admin@example.com", "password")
+	otherCookies := webLogin(t, router, "other@example.com", "password")
+
+	response := browse(router, http.MethodGet, "/admin/users?q=OTHER", nil, cookies, false)
+	body := response.Body.String()
+	if response.Code != http.StatusOK || !strings.Contains(body, `<a href="/admin/users/2">other@example.com</a>`) || strings.Contains(body, `<a href="/admin/users/1">`) {
+		t.Fatalf("User search shown incorrectly: %v %s", response.Code, body)
+	}
+	response = browse(router, http.MethodGet, "/admin/users/2", nil, cookies, false)
+	body = response.Body.String()
+	if response.Code != http.StatusOK || !strings.Contains(body, "Moderate me") || !strings.Contains(body, `hx-delete="/admin/sessions/`) {
+		t.Fatalf("User shown without their chirps and sessions: %v %s", response.Code, body)
+	}
+	if browse(router, http.MethodGet, "/admin/users/3", nil, cookies, false).Code != http.StatusNotFound {
+		t.Fatal("Expected a user that doesn't exist to be not found")
+	}
+
+	// Actions need the CSRF token, which HTMX sends
+	if browse(router, http.MethodPost, "/admin/users/2/upgrade", nil, cookies, false).Code != http.StatusForbidden {
+		t.Fatal("Expected an upgrade without the CSRF token to be forbidden")
+	}
+	response = browse(router, http.MethodPost, "/admin/users/2/upgrade", nil, cookies, true)
+	if response.Header().Get("HX-Redirect") != "/admin/users/2" {
+		t.Fatalf("Error upgrading user: %v %s", response.Code, response.Body)
+	}
+	if user, _, _ := config.db.GetUser(other.Id); !user.IsChirpyRed {
+		t.Fatal("User not upgraded to Chirpy Red")
+	}
+	browse(router, http.MethodPost, "/admin/users/2/downgrade", nil, cookies, true)
+	if user, _, _ := config.db.GetUser(other.Id); user.IsChirpyRed {
+		t.Fatal("User still on Chirpy Red after a downgrade")
+	}
+
+	if browse(router, http.MethodPost, "/admin/users/1/disable", nil, cookies, true).Code != http.StatusBadRequest {
+		t.Fatal("Expected an admin disabling themselves to be refused")
+	}
+	response = browse(router, http.MethodPost, "/admin/users/2/disable", nil, cookies, true)
+	if response.Header().Get("HX-Redirect") != "/admin/users/2" {
+		t.Fatalf("Error disabling user: %v %s", response.Code, response.Body)
+	}
+	response = browse(router, http.MethodGet, "/", nil, otherCookies, false)
+	if strings.Contains(response.Body.String(), "other@example.com") {
+		t.Fatal("Disabled user still logged in")
+	}
+	response = postLoginForm(router, "/login", url.Values{"email": {"other@example.com"}, "password": {"password"}})
+	if response.Code != http.StatusForbidden || !strings.Contains(response.Body.String(), accountDisabledMessage) {
+		t.Fatalf("Expected a disabled user's login to be refused: %v %s", response.Code, response.Body)
+	}
+	browse(router, http.MethodPost, "/admin/users/2/enable", nil, cookies, true)
+	webLogin(t, router, "other@example.com", "password")
+
+	response = browse(router, http.MethodGet, "/admin/chirps?author_id=2", nil, cookies, false)
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), "Moderate me") {
+		t.Fatalf("Chirps shown incorrectly: %v %s", response.Code, response.Body)
+	}
+	if browse(router, http.MethodDelete, "/admin/chirps/1", nil, cookies, true).Code != http.StatusOK {
+		t.Fatal("Error deleting chirp")
+	}
+	if _, found, _ := config.db.GetChirp(chirp.Id); found {
+		t.Fatal("Deleted chirp still found")
+	}
+
+	sessions, err := config.db.GetUserSessions(other.Id)
+	if err != nil || len(sessions) != 1 {
+		t.Fatalf("Expected the user's new session, actual: %v, %v", sessions, err)
+	}
+	response = browse(router, http.MethodGet, "/admin/tokens", nil, cookies, false)
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), sessions[0].Id) {
+		t.Fatalf("Sessions shown incorrectly: %v %s", response.Code, response.Body)
+	}
+	if browse(router, http.MethodDelete, "/admin/sessions/"+sessions[0].Id, nil, cookies, true).Code != http.StatusOK {
+		t.Fatal("Error revoking session")
+	}
+	if _, found, _ := config.db.GetSession(sessions[0].Id); found {
+		t.Fatal("Revoked session still found")
+	}
+
+	response = browse(router, http.MethodGet, "/admin/metrics", nil, cookies, false)
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), "<svg") {
+		t.Fatalf("Metrics shown without a chart: %v %s", response.Code, response.Body)
+	}
+	response = browse(router, http.MethodGet, "/admin/audit", nil, cookies, false)
+	body = response.Body.String()
+	for _, action := range []string{"user.chirpy_red", "user.disable", "user.enable", "chirp.delete", "session.revoke"} {
+		if !strings.Contains(body, action) {
+			t.Fatalf("Audit log missing %s: %s", action, body)
+		}
+	}
+}
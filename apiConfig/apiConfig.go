@@ -9,18 +9,37 @@ import (
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/trolfu/boot-dev-web-servers-course/database"
+	"github.com/trolfu/boot-dev-web-servers-course/mailer"
 )
 
 type apiConfig struct {
 	fileserverHits int
-	db             database.DB
-	// There has to be a more secure way of doing this
-	jwtSecret   string
-	polkaApiKey string
+	db             database.Store
+	snapshots      *database.Snapshots
+	tokenSweeps    *tokenSweepStats
+	requests       *requestStats
+	loginThrottle  *loginThrottle
+	keyring        *Keyring
+	mailer         mailer.Mailer
+	restrictions   UnverifiedRestrictions
+	passwordPolicy PasswordPolicy
+	polkaApiKey    string
 }
 
-func NewAPIConfig(dbPath string, jwtSecret string, polkaApiKey string) apiConfig {
-	return apiConfig{fileserverHits: 0, db: database.NewDB(dbPath), jwtSecret: jwtSecret, polkaApiKey: polkaApiKey}
+func NewAPIConfig(db database.Store, snapshots *database.Snapshots, keyring *Keyring, mailer mailer.Mailer, restrictions UnverifiedRestrictions, passwordPolicy PasswordPolicy, polkaApiKey string) apiConfig {
+	return apiConfig{
+		fileserverHits: 0,
+		db:             db,
+		snapshots:      snapshots,
+		tokenSweeps:    newTokenSweepStats(),
+		requests:       newRequestStats(),
+		loginThrottle:  newLoginThrottle(),
+		keyring:        keyring,
+		mailer:         mailer,
+		restrictions:   restrictions,
+		passwordPolicy: passwordPolicy,
+		polkaApiKey:    polkaApiKey,
+	}
 }
 
 func respondWithError(writer http.ResponseWriter, statusCode int, errorText string) {
@@ -44,20 +63,21 @@ func respondWithSuccess(writer http.ResponseWriter, statusCode int, payload inte
 }
 
 // Defines the process for Chirpy JWT construction
-func (config *apiConfig) createSignedJWT(issuer string, timeoutSeconds int, userId int) (string, error) {
-	unsignedToken := jwt.NewWithClaims(
-		jwt.SigningMethodHS256,
-		jwt.RegisteredClaims{
+func (config *apiConfig) createSignedJWT(issuer string, timeoutSeconds int, user database.User, sessionId string) (string, error) {
+	return config.keyring.sign(newAccessClaims(issuer, timeoutSeconds, user, sessionId))
+}
+
+// Builds the claims of a token for the user's session, expiring after `timeoutSeconds`
+func newAccessClaims(issuer string, timeoutSeconds int, user database.User, sessionId string) accessClaims {
+	return accessClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
 			Issuer:    issuer,
+			Audience:  jwt.ClaimStrings{accessTokenAudience},
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Second * time.Duration(timeoutSeconds)).UTC()),
 			IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
-			Subject:   strconv.Itoa(userId),
+			Subject:   strconv.Itoa(user.Id),
 		},
-	)
-	signedToken, err := unsignedToken.SignedString([]byte(config.jwtSecret))
-
-	if err != nil {
-		return "", err
+		SessionId: sessionId,
+		Role:      user.Role,
 	}
-	return signedToken, nil
 }
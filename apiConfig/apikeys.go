@@ -0,0 +1,159 @@
+// Handles personal API keys, which let bots and integrations act for a user without their password
+
+package apiConfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/trolfu/boot-dev-web-servers-course/database"
+)
+
+const (
+	apiKeyPrefix        = "chirpy_" // Marks personal API keys, so they're recognizable if they leak
+	apiKeyPrefixLength  = len(apiKeyPrefix) + 8
+	maxApiKeyNameLength = 64
+)
+
+// Looks up a personal API key. The caller gets the key owner's current role and the key's scopes.
+//
+//	Returns the status code to respond with if the key isn't valid
+func (config *apiConfig) authenticateApiKey(key string) (principal, int, error) {
+	apiKey, found, err := config.db.GetApiKey(key)
+	if err != nil {
+		return principal{}, http.StatusInternalServerError, fmt.Errorf("Error getting API key: %w", err)
+	}
+	if !found {
+		return principal{}, http.StatusUnauthorized, fmt.Errorf("Invalid API key")
+	}
+	user, found, err := config.db.GetUser(apiKey.UserId)
+	if err != nil {
+		return principal{}, http.StatusInternalServerError, fmt.Errorf("Error getting user: %w", err)
+	}
+	if !found || user.Disabled {
+		return principal{}, http.StatusUnauthorized, fmt.Errorf("Invalid API key")
+	}
+	// Never nil, so a key without scopes can't be mistaken for an access token
+	scopes := append([]string{}, apiKey.Scopes...)
+	return principal{UserId: user.Id, Role: user.Role, Scopes: scopes, ApiKeyId: apiKey.Id}, http.StatusOK, nil
+}
+
+// Checks the requested scopes are defined, and puts them in the order of `database.AllScopes` without duplicates
+func normalizeScopes(requested []string) ([]string, error) {
+	for _, scope := range requested {
+		if !database.ValidScope(scope) {
+			return nil, fmt.Errorf("Unknown scope %q", scope)
+		}
+	}
+	scopes := []string{}
+	for _, scope := range database.AllScopes() {
+		if slices.Contains(requested, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes, nil
+}
+
+// Creates a personal API key for the caller with the requested name and scopes.
+//
+//	Responds with the key, which is only ever shown here
+func (config *apiConfig) CreateApiKey(writer http.ResponseWriter, request *http.Request) {
+	type createRequest struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+	}
+	type createResponse struct {
+		database.ApiKey
+		Key string `json:"key"`
+	}
+	writer.Header().Set("Content-Type", "application/json")
+
+	caller, _ := principalFrom(request)
+	body := createRequest{}
+	err := json.NewDecoder(request.Body).Decode(&body)
+	if err != nil {
+		respondWithError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	name := strings.TrimSpace(body.Name)
+	if name == "" || len(name) > maxApiKeyNameLength {
+		respondWithError(writer, http.StatusBadRequest, fmt.Sprintf("Name must be 1 to %d characters", maxApiKeyNameLength))
+		return
+	}
+	scopes, err := normalizeScopes(body.Scopes)
+	if err != nil {
+		respondWithError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(scopes) == 0 {
+		respondWithError(writer, http.StatusBadRequest, fmt.Sprintf("Choose at least one scope from %s", strings.Join(database.AllScopes(), ", ")))
+		return
+	}
+
+	secret, err := randomToken()
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error creating API key: %v", err))
+		return
+	}
+	id, err := randomToken()
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error creating API key: %v", err))
+		return
+	}
+	key := apiKeyPrefix + secret
+	apiKey := database.ApiKey{
+		Id:        id,
+		UserId:    caller.UserId,
+		Name:      name,
+		Prefix:    key[:apiKeyPrefixLength],
+		Scopes:    scopes,
+		CreatedAt: time.Now().UTC(),
+	}
+	err = config.db.CreateApiKey(key, apiKey)
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error creating API key: %v", err))
+		return
+	}
+	config.audit(request, "api_key.create", "api_key:"+apiKey.Id, fmt.Sprintf("Created %q with scopes %s", apiKey.Name, strings.Join(apiKey.Scopes, " ")))
+	respondWithSuccess(writer, http.StatusCreated, createResponse{ApiKey: apiKey, Key: key})
+}
+
+// Lists the caller's API keys, oldest first. The keys themselves aren't included
+func (config *apiConfig) GetApiKeys(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+
+	caller, _ := principalFrom(request)
+
+	apiKeys, err := config.db.GetUserApiKeys(caller.UserId)
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error getting API keys: %v", err))
+		return
+	}
+	respondWithSuccess(writer, http.StatusOK, apiKeys)
+}
+
+// Revokes one of the caller's API keys. It stops working immediately
+func (config *apiConfig) DeleteApiKey(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+
+	caller, _ := principalFrom(request)
+
+	// Other users' keys are reported as missing, so key ids can't be probed
+	keyId := chi.URLParam(request, "apiKeyId")
+	err := config.db.DeleteApiKey(caller.UserId, keyId)
+	if err == database.ErrApiKeyNotFound {
+		respondWithError(writer, http.StatusNotFound, "API key not found")
+		return
+	}
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error revoking API key: %v", err))
+		return
+	}
+	config.audit(request, "api_key.revoke", "api_key:"+keyId, "")
+	respondWithSuccess(writer, http.StatusOK, nil)
+}
@@ -0,0 +1,123 @@
+package apiConfig
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/trolfu/boot-dev-web-servers-course/database"
+)
+
+func TestApiKeys(t *testing.T) {
+	config, sessionId, _ := newTestAuthConfig(t)
+	user, err := config.db.CreateUser("bot@example.com", "password")
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+
+	for name, body := range map[string]string{
+		"no name":       `{"name": " ", "scopes": ["chirps:write"]}`,
+		"no scopes":     `{"name": "Bot", "scopes": []}`,
+		"unknown scope": `{"name": "Bot", "scopes": ["admin"]}`,
+		"read scope":    `{"name": "Bot", "scopes": ["chirps:read"]}`,
+	} {
+		response := sendAs(config, config.CreateApiKey, user.Id, body)
+		if response.Code != http.StatusBadRequest {
+			t.Fatalf("Expected a key with %s to be rejected, actual: %v", name, response.Code)
+		}
+	}
+
+	created := struct {
+		database.ApiKey
+		Key string `json:"key"`
+	}{}
+	response := sendAs(config, config.CreateApiKey, user.Id, `{"name": "Bot", "scopes": ["chirps:write", "chirps:write"]}`)
+	if response.Code != http.StatusCreated {
+		t.Fatalf("Error creating API key: %v %s", response.Code, response.Body)
+	}
+	err = json.NewDecoder(response.Body).Decode(&created)
+	if err != nil {
+		t.Fatalf("Error decoding API key: %v", err)
+	}
+	if !strings.HasPrefix(created.Key, created.Prefix) || created.Name != "Bot" || strings.Join(created.Scopes, " ") != "chirps:write" {
+		t.Fatalf("API key created with incorrect data: %+v", created)
+	}
+
+	listed := []map[string]interface{}{}
+	response = sendAs(config, config.GetApiKeys, user.Id, "")
+	err = json.NewDecoder(response.Body).Decode(&listed)
+	if err != nil {
+		t.Fatalf("Error decoding API keys: %v", err)
+	}
+	if len(listed) != 1 || listed[0]["id"] != created.Id {
+		t.Fatalf("API keys listed incorrectly: %v", listed)
+	}
+	if _, found := listed[0]["key"]; found {
+		t.Fatal("API key shown again after creation")
+	}
+
+	status, caller, found := serveWithAuth(config.MiddlewareRequireAuth, "ApiKey "+created.Key)
+	if status != http.StatusOK || !found || caller.UserId != user.Id || caller.ApiKeyId != created.Id || caller.SessionId != "" {
+		t.Fatalf("Valid API key rejected: %v, %+v", status, caller)
+	}
+	requireScope := func(scope string) func(http.Handler) http.Handler {
+		return func(handler http.Handler) http.Handler {
+			return config.MiddlewareRequireAuth(config.MiddlewareRequireScope(scope)(handler))
+		}
+	}
+	requireFullAccess := func(handler http.Handler) http.Handler {
+		return config.MiddlewareRequireAuth(config.MiddlewareRequireFullAccess(handler))
+	}
+	status, _, _ = serveWithAuth(requireScope(database.ScopeChirpsWrite), "ApiKey "+created.Key)
+	if status != http.StatusOK {
+		t.Fatalf("API key rejected for a scope it has: %v", status)
+	}
+	status, _, _ = serveWithAuth(requireScope(database.ScopeProfileWrite), "ApiKey "+created.Key)
+	if status != http.StatusForbidden {
+		t.Fatalf("Expected API key to be forbidden without the scope, actual: %v", status)
+	}
+	status, _, _ = serveWithAuth(requireFullAccess, "ApiKey "+created.Key)
+	if status != http.StatusForbidden {
+		t.Fatalf("Expected API key to be forbidden from account routes, actual: %v", status)
+	}
+
+	// Access tokens aren't limited by scopes
+	accessToken, err := config.createSignedJWT(accessTokenIssuer, accessTokenTimeoutSeconds, database.User{Id: 1}, sessionId)
+	if err != nil {
+		t.Fatalf("Error creating access token: %v", err)
+	}
+	status, _, _ = serveWithAuth(requireScope(database.ScopeProfileWrite), "Bearer "+accessToken)
+	if status != http.StatusOK {
+		t.Fatalf("Access token rejected by a scope check: %v", status)
+	}
+	status, _, _ = serveWithAuth(requireFullAccess, "Bearer "+accessToken)
+	if status != http.StatusOK {
+		t.Fatalf("Access token rejected from account routes: %v", status)
+	}
+
+	// Other users can't revoke the key
+	if deleteApiKeyAs(config, user.Id+1, created.Id).Code != http.StatusNotFound {
+		t.Fatal("Another user revoked the API key")
+	}
+	if deleteApiKeyAs(config, user.Id, created.Id).Code != http.StatusOK {
+		t.Fatal("Error revoking API key")
+	}
+	status, _, _ = serveWithAuth(config.MiddlewareRequireAuth, "ApiKey "+created.Key)
+	if status != http.StatusUnauthorized {
+		t.Fatalf("Expected a revoked API key to be unauthorized, actual: %v", status)
+	}
+}
+
+// Revokes an API key as the user through the router, so the key id is read from the path
+func deleteApiKeyAs(config apiConfig, userId int, keyId string) *httptest.ResponseRecorder {
+	router := chi.NewRouter()
+	router.Delete("/api-keys/{apiKeyId}", config.DeleteApiKey)
+	request := httptest.NewRequest(http.MethodDelete, "/api-keys/"+keyId, nil)
+	request = withPrincipal(request, principal{UserId: userId})
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	return recorder
+}
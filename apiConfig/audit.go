@@ -0,0 +1,56 @@
+package apiConfig
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/trolfu/boot-dev-web-servers-course/database"
+)
+
+// Number of audit events listed when the request doesn't ask for a number
+const defaultAuditEventLimit = 100
+
+// Records a privileged action taken by the caller.
+//
+//	Failing to record the event doesn't undo the action, which has already happened, so the failure is only logged
+func (config *apiConfig) audit(request *http.Request, action string, target string, details string) {
+	caller, _ := principalFrom(request)
+	event := database.AuditEvent{
+		CreatedAt: time.Now().UTC(),
+		ActorId:   caller.UserId,
+		Action:    action,
+		Target:    target,
+		Details:   details,
+		IpAddress: clientIp(request),
+	}
+	log.Printf("AUDIT: user %d %s %s from %s %q", event.ActorId, event.Action, event.Target, event.IpAddress, event.Details)
+	_, err := config.db.CreateAuditEvent(event)
+	if err != nil {
+		log.Printf("Error recording audit event: %v", err)
+	}
+}
+
+// Lists the most recent audit events, newest first. `?limit=` sets how many, and 0 lists every event
+func (config *apiConfig) GetAuditEvents(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+
+	limit := defaultAuditEventLimit
+	if limitParam := request.URL.Query().Get("limit"); limitParam != "" {
+		parsed, err := strconv.Atoi(limitParam)
+		if err != nil || parsed < 0 {
+			respondWithError(writer, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+		limit = parsed
+	}
+
+	events, err := config.db.GetAuditEvents(limit)
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error getting audit events: %v", err))
+		return
+	}
+	respondWithSuccess(writer, http.StatusOK, events)
+}
@@ -1,33 +1,42 @@
 package apiConfig
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"log"
+	"net"
 	"net/http"
-	"strconv"
-	"strings"
+	"time"
 
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/trolfu/boot-dev-web-servers-course/database"
 )
 
 var (
 	accessTokenIssuer          = "chirpy-access"
-	accessTokenTimeoutSeconds  = 60 * 60 // 1hr
-	refreshTokenIssuer         = "chirpy-refresh"
+	accessTokenAudience        = "chirpy-api"
+	accessTokenTimeoutSeconds  = 60 * 60           // 1hr
 	refreshTokenTimeoutSeconds = 60 * 60 * 24 * 60 // 60 days
 )
 
-// Login a user via the request body
+// Shown to disabled users when they log in with the right password, and only then, so it can't be used to find accounts
+const accountDisabledMessage = "This account has been disabled"
+
+// Login a user via the request body.
+//
+//	Users with two-factor authentication get a challenge token instead of login tokens, to trade for them at /api/login/2fa.
+//	With `"cookies": true`, browsers get the tokens as session cookies instead of in the response.
+//	Repeated failures from the same email or IP address have to wait longer and longer between attempts, and are eventually locked out
 func (config *apiConfig) Login(writer http.ResponseWriter, request *http.Request) {
 	type loginRequest struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		Cookies  bool   `json:"cookies"`
 	}
-	type loginResponse struct {
-		database.User
-		Token        string `json:"token"`
-		RefreshToken string `json:"refresh_token"`
+	type challengeResponse struct {
+		TwoFactorRequired bool   `json:"two_factor_required"`
+		ChallengeToken    string `json:"challenge_token"`
 	}
 
 	writer.Header().Set("Content-Type", "application/json")
@@ -40,131 +49,267 @@ func (config *apiConfig) Login(writer http.ResponseWriter, request *http.Request
 		return
 	}
 
+	accountKey := accountThrottleKey(login.Email)
+	if wait := config.reserveLoginAttempt(request, accountKey); wait > 0 {
+		respondThrottled(writer, wait)
+		return
+	}
 	user, err := config.db.ValidateCredentials(login.Email, login.Password)
+	if err == database.ErrInvalidCredentials {
+		config.recordLoginFailure(request, accountKey)
+		respondUnauthorized(writer, "Invalid email or password")
+		return
+	}
+	config.releaseLoginAttempt(request, accountKey)
 	if err != nil {
-		respondWithError(writer, http.StatusUnauthorized, err.Error())
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error validating credentials: %v", err))
+		return
+	}
+	config.loginThrottle.reset(accountKey)
+	if user.Disabled {
+		respondWithError(writer, http.StatusForbidden, accountDisabledMessage)
 		return
 	}
 
-	accessToken, err := config.createSignedJWT(accessTokenIssuer, accessTokenTimeoutSeconds, user.Id)
+	twoFactor, _, err := config.db.GetTwoFactor(user.Id)
 	if err != nil {
-		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error creating access token: %v", err))
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error getting two-factor settings: %v", err))
 		return
 	}
-	refreshToken, err := config.createSignedJWT(refreshTokenIssuer, refreshTokenTimeoutSeconds, user.Id)
-	if err != nil {
-		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error creating refres token: %v", err))
+	if twoFactor.Enabled {
+		challengeToken, err := config.createTwoFactorChallenge(user.Id)
+		if err != nil {
+			respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error creating challenge token: %v", err))
+			return
+		}
+		respondWithSuccess(writer, http.StatusOK, challengeResponse{TwoFactorRequired: true, ChallengeToken: challengeToken})
 		return
 	}
-
-	respondWithSuccess(writer, http.StatusOK, loginResponse{User: user, Token: accessToken, RefreshToken: refreshToken})
+	config.respondWithLogin(writer, request, user, login.Cookies)
 }
 
-func (config *apiConfig) RefreshAuth(writer http.ResponseWriter, request *http.Request) {
-	type refreshResponse struct {
-		Token string `json:"token"`
-	}
-
-	auth := request.Header.Get("Authorization")
-	if auth == "" {
-		respondWithError(writer, http.StatusUnauthorized, "Missing authorization")
-		return
+// Starts a new session for the user and responds with its access and refresh tokens.
+//
+//	With `cookies`, the tokens are set as session cookies and the response has the session's CSRF token instead
+func (config *apiConfig) respondWithLogin(writer http.ResponseWriter, request *http.Request, user database.User, cookies bool) {
+	type loginResponse struct {
+		database.User
+		Token        string `json:"token,omitempty"`
+		RefreshToken string `json:"refresh_token,omitempty"`
+		CSRFToken    string `json:"csrf_token,omitempty"`
 	}
 
-	authToken := strings.TrimPrefix(auth, "Bearer ")
-	jwtToken, err := config.parseJWT(authToken)
+	accessToken, refreshToken, err := config.startSession(user, request)
 	if err != nil {
 		respondWithError(writer, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	if !jwtToken.Valid {
-		respondWithError(writer, http.StatusUnauthorized, "Invalid token signature")
+	if cookies {
+		csrfToken, err := setSessionCookies(writer, accessToken, refreshToken)
+		if err != nil {
+			respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error creating CSRF token: %v", err))
+			return
+		}
+		respondWithSuccess(writer, http.StatusOK, loginResponse{User: user, CSRFToken: csrfToken})
 		return
 	}
-	issuer, err := jwtToken.Claims.GetIssuer()
+	respondWithSuccess(writer, http.StatusOK, loginResponse{User: user, Token: accessToken, RefreshToken: refreshToken})
+}
+
+// Starts a new session for the user, returning its first access token and refresh token
+func (config *apiConfig) startSession(user database.User, request *http.Request) (accessToken string, refreshToken string, err error) {
+	refreshToken, sessionId, err := config.createRefreshToken(user.Id, request)
 	if err != nil {
-		respondWithError(writer, http.StatusUnauthorized, err.Error())
-		return
+		return "", "", fmt.Errorf("Error creating refresh token: %w", err)
 	}
-	if issuer != refreshTokenIssuer {
-		respondWithError(writer, http.StatusUnauthorized, "Invalid token issuer")
-		return
+	accessToken, err = config.createSignedJWT(accessTokenIssuer, accessTokenTimeoutSeconds, user, sessionId)
+	if err != nil {
+		return "", "", fmt.Errorf("Error creating access token: %w", err)
+	}
+	return accessToken, refreshToken, nil
+}
+
+// Checks a login made on one of Chirpy's pages, where users with two-factor authentication enter their code along with their password.
+//
+//	Throttled like /api/login. If the login fails, returns the status to respond with and a message to show the user.
+//	Errors are only returned for failures that aren't the user's
+func (config *apiConfig) checkFormLogin(request *http.Request, email string, password string, code string) (user database.User, status int, message string, err error) {
+	accountKey := accountThrottleKey(email)
+	if wait := config.reserveLoginAttempt(request, accountKey); wait > 0 {
+		return database.User{}, http.StatusTooManyRequests, "Too many failed attempts. Try again later", nil
+	}
+	user, err = config.db.ValidateCredentials(email, password)
+	if err == database.ErrInvalidCredentials {
+		config.recordLoginFailure(request, accountKey)
+		return database.User{}, http.StatusUnauthorized, "Invalid email or password", nil
 	}
-	alreadyRevoked, err := config.db.IsTokenRevoked(authToken)
+	config.releaseLoginAttempt(request, accountKey)
 	if err != nil {
-		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error checking if the token was already revoked %v", err))
-		return
+		return database.User{}, http.StatusInternalServerError, "", fmt.Errorf("Error validating credentials: %w", err)
 	}
-	if alreadyRevoked {
-		respondWithError(writer, http.StatusUnauthorized, "Token previously revoked")
-		return
+	config.loginThrottle.reset(accountKey)
+	if user.Disabled {
+		return database.User{}, http.StatusForbidden, accountDisabledMessage, nil
 	}
 
-	strId, err := jwtToken.Claims.GetSubject()
+	twoFactor, _, err := config.db.GetTwoFactor(user.Id)
 	if err != nil {
-		respondWithError(writer, http.StatusInternalServerError, err.Error())
-		return
+		return database.User{}, http.StatusInternalServerError, "", fmt.Errorf("Error getting two-factor settings: %w", err)
 	}
-	userId, err := strconv.Atoi(strId)
-	if err != nil {
-		respondWithError(writer, http.StatusInternalServerError, err.Error())
-		return
+	if !twoFactor.Enabled {
+		return user, http.StatusOK, "", nil
+	}
+	throttleKey := twoFactorThrottleKey(user.Id)
+	if wait := config.reserveLoginAttempt(request, throttleKey); wait > 0 {
+		return database.User{}, http.StatusTooManyRequests, "Too many failed attempts. Try again later", nil
 	}
-	newAccessToken, err := config.createSignedJWT(accessTokenIssuer, accessTokenTimeoutSeconds, userId)
+	err = config.useTwoFactorCode(user.Id, code)
+	if err == errInvalidTwoFactorCode {
+		config.recordLoginFailure(request, throttleKey)
+		return database.User{}, http.StatusUnauthorized, "Enter a valid code from your authenticator app or a recovery code", nil
+	}
+	config.releaseLoginAttempt(request, throttleKey)
 	if err != nil {
-		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error creating new access token: %v", err))
-		return
+		return database.User{}, http.StatusInternalServerError, "", fmt.Errorf("Error checking code: %w", err)
 	}
-	respondWithSuccess(writer, http.StatusOK, refreshResponse{newAccessToken})
+	config.loginThrottle.reset(throttleKey)
+	return user, http.StatusOK, "", nil
 }
 
-func (config *apiConfig) RevokeAuth(writer http.ResponseWriter, request *http.Request) {
-	auth := request.Header.Get("Authorization")
-	if auth == "" {
-		respondWithError(writer, http.StatusUnauthorized, "Missing authorization")
+// Issues a new access token and replaces the refresh token with a new one.
+//
+//	Sessions refreshed with the refresh cookie get new cookies, and the response only has the new CSRF token.
+//	A refresh token that was already replaced has been stolen or replayed, so every token from the same login is revoked
+func (config *apiConfig) RefreshAuth(writer http.ResponseWriter, request *http.Request) {
+	type refreshResponse struct {
+		Token        string `json:"token,omitempty"`
+		RefreshToken string `json:"refresh_token,omitempty"`
+		CSRFToken    string `json:"csrf_token,omitempty"`
+	}
+
+	caller, _ := principalFrom(request)
+	newRefreshToken, err := randomToken()
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error creating refresh token: %v", err))
+		return
+	}
+	now := time.Now().UTC()
+	refreshToken, err := config.db.RotateRefreshToken(caller.RefreshToken, newRefreshToken, database.RefreshToken{
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Second * time.Duration(refreshTokenTimeoutSeconds)),
+		UserAgent: request.UserAgent(),
+		IpAddress: clientIp(request),
+	})
+	if err == database.ErrRefreshTokenReused {
+		log.Printf("SECURITY: reused refresh token for user %d from %s (%s). Revoked token family %s",
+			refreshToken.UserId, request.RemoteAddr, request.UserAgent(), refreshToken.FamilyId)
+		respondWithError(writer, http.StatusUnauthorized, "Invalid refresh token")
+		return
+	}
+	if err == database.ErrRefreshTokenNotFound || err == database.ErrRefreshTokenExpired {
+		respondWithError(writer, http.StatusUnauthorized, "Invalid refresh token")
+		return
+	}
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error rotating refresh token: %v", err))
 		return
 	}
 
-	authToken := strings.TrimPrefix(auth, "Bearer ")
-	jwtToken, err := config.parseJWT(authToken)
+	// The user is read again so the new access token carries their current role
+	user, found, err := config.db.GetUser(refreshToken.UserId)
 	if err != nil {
-		respondWithError(writer, http.StatusInternalServerError, err.Error())
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error getting user: %v", err))
 		return
 	}
-	issuer, err := jwtToken.Claims.GetIssuer()
+	if !found || user.Disabled {
+		respondWithError(writer, http.StatusUnauthorized, "Invalid refresh token")
+		return
+	}
+	newAccessToken, err := config.createSignedJWT(accessTokenIssuer, accessTokenTimeoutSeconds, user, refreshToken.FamilyId)
 	if err != nil {
-		respondWithError(writer, http.StatusInternalServerError, err.Error())
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error creating new access token: %v", err))
 		return
 	}
-	if issuer != refreshTokenIssuer {
-		respondWithError(writer, http.StatusUnauthorized, "Invalid token type")
+	if caller.Cookie {
+		csrfToken, err := setSessionCookies(writer, newAccessToken, newRefreshToken)
+		if err != nil {
+			respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error creating CSRF token: %v", err))
+			return
+		}
+		respondWithSuccess(writer, http.StatusOK, refreshResponse{CSRFToken: csrfToken})
 		return
 	}
+	respondWithSuccess(writer, http.StatusOK, refreshResponse{Token: newAccessToken, RefreshToken: newRefreshToken})
+}
 
-	err = config.db.RevokeToken(authToken)
+// Revokes a refresh token, along with every other token from the same login, so none of them can be used again.
+//
+//	Browser sessions have their cookies removed too, logging them out
+func (config *apiConfig) RevokeAuth(writer http.ResponseWriter, request *http.Request) {
+	caller, _ := principalFrom(request)
+	_, err := config.db.DeleteRefreshTokenFamily(caller.SessionId)
 	if err != nil {
 		respondWithError(writer, http.StatusInternalServerError, err.Error())
 		return
 	}
+	if caller.Cookie {
+		clearSessionCookies(writer)
+	}
 	respondWithSuccess(writer, http.StatusOK, nil)
 }
 
-// Parses the JWT acquired from the authorization header
+// Creates a random refresh token for the user, starting a new token family, and stores its hash along with the requesting client
 //
-//	`token` is the raw auth token in the http header
-//	Returns the parsed JWT with claims if successful. Returns an error if parsing the token errored
-func (config *apiConfig) parseJWT(token string) (*jwt.Token, error) {
-	type claims struct {
-		jwt.RegisteredClaims
+//	Returns the plaintext token, which is only ever given to the client, and the family id, which identifies the new session
+func (config *apiConfig) createRefreshToken(userId int, request *http.Request) (token string, sessionId string, err error) {
+	return config.createGrantRefreshToken(userId, request, "", "")
+}
+
+// Like `createRefreshToken`, for a session granted to the OAuth client `clientId` and limited to the space separated `scope`
+func (config *apiConfig) createGrantRefreshToken(userId int, request *http.Request, clientId string, scope string) (token string, sessionId string, err error) {
+	token, err = randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	sessionId, err = randomToken()
+	if err != nil {
+		return "", "", err
 	}
 
-	parsedToken, err := jwt.ParseWithClaims(token, &claims{}, func(t *jwt.Token) (interface{}, error) {
-		return []byte(config.jwtSecret), nil
+	now := time.Now().UTC()
+	err = config.db.CreateRefreshToken(token, database.RefreshToken{
+		UserId:          userId,
+		FamilyId:        sessionId,
+		FamilyCreatedAt: now,
+		CreatedAt:       now,
+		ExpiresAt:       now.Add(time.Second * time.Duration(refreshTokenTimeoutSeconds)),
+		UserAgent:       request.UserAgent(),
+		IpAddress:       clientIp(request),
+		ClientId:        clientId,
+		Scope:           scope,
 	})
 	if err != nil {
-		return nil, err
+		return "", "", err
 	}
+	return token, sessionId, nil
+}
 
-	return parsedToken, nil
+// Generates 32 random bytes, hex encoded
+func randomToken() (string, error) {
+	tokenBytes := make([]byte, 32)
+	_, err := rand.Read(tokenBytes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(tokenBytes), nil
+}
+
+// Gets the address the request came from, without the port
+func clientIp(request *http.Request) string {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return host
 }
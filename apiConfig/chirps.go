@@ -19,52 +19,50 @@ func (config *apiConfig) CreateChirp(writer http.ResponseWriter, request *http.R
 		Body string `json:"body"`
 	}
 
-	auth := request.Header.Get("Authorization")
-	if auth == "" {
-		respondWithError(writer, http.StatusUnauthorized, "Missing authorization")
-		return
-	}
-	authToken := strings.TrimPrefix(auth, "Bearer ")
-	parsedToken, err := config.parseJWT(authToken)
-	if err != nil {
-		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error parsing authorization token: %v", err))
-		return
-	}
-
 	writer.Header().Set("Content-Type", "application/json")
 
+	caller, _ := principalFrom(request)
+
 	decoder := json.NewDecoder(request.Body)
 	incommingChirp := chirpRequest{}
-	err = decoder.Decode(&incommingChirp)
+	err := decoder.Decode(&incommingChirp)
 
 	// Check failure conditions
 	if err != nil {
 		respondWithError(writer, http.StatusInternalServerError, err.Error())
 		return
 	}
-	if len(incommingChirp.Body) > 140 {
-		respondWithError(writer, http.StatusBadRequest, "Chirp is too long")
-		return
-	}
-
-	// Valid chirp
-	body := cleanChirpBody(incommingChirp.Body)
-	authorIdStr, err := parsedToken.Claims.GetSubject()
+	chirp, status, err := config.postChirp(caller.UserId, incommingChirp.Body)
 	if err != nil {
-		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error getting user id: %v", err))
+		respondWithError(writer, status, err.Error())
 		return
 	}
-	authorId, err := strconv.Atoi(authorIdStr)
-	if err != nil {
-		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error parsing user id: %v", err))
-		return
+	respondWithSuccess(writer, http.StatusCreated, chirp)
+}
+
+// Checks a new chirp, cleans its body, and saves it for the author.
+//
+//	Returns the status code to respond with if the chirp can't be posted
+func (config *apiConfig) postChirp(authorId int, body string) (database.Chirp, int, error) {
+	if len(body) > 140 {
+		return database.Chirp{}, http.StatusBadRequest, fmt.Errorf("Chirp is too long")
+	}
+	if config.restrictions.PostChirps {
+		verified, err := config.emailVerified(authorId)
+		if err != nil {
+			return database.Chirp{}, http.StatusInternalServerError, fmt.Errorf("Error getting user: %w", err)
+		}
+		if !verified {
+			return database.Chirp{}, http.StatusForbidden, fmt.Errorf("Verify your email to post chirps")
+		}
 	}
-	chirp, err := config.db.CreateChirp(body, authorId)
 
+	// Valid chirp
+	chirp, err := config.db.CreateChirp(cleanChirpBody(body), authorId)
 	if err != nil {
-		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error creating chirp: %v", err))
+		return database.Chirp{}, http.StatusInternalServerError, fmt.Errorf("Error creating chirp: %w", err)
 	}
-	respondWithSuccess(writer, http.StatusCreated, chirp)
+	return chirp, http.StatusCreated, nil
 }
 
 // Get a single chirp by id
@@ -171,29 +169,11 @@ func (config *apiConfig) DeleteChirp(writer http.ResponseWriter, request *http.R
 		return
 	}
 
-	auth := request.Header.Get("Authorization")
-	if auth == "" {
-		respondWithError(writer, http.StatusUnauthorized, "Unauthorized")
-		return
-	}
-	authToken := strings.TrimPrefix(auth, "Bearer ")
-	jwt, err := config.parseJWT(authToken)
-	if err != nil {
-		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error parsing auth token: %v", err))
-		return
-	}
-	userIdStr, err := jwt.Claims.GetSubject()
-	if err != nil {
-		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error reading token info: %v", err))
-		return
-	}
-	userId, err := strconv.Atoi(userIdStr)
-	if err != nil {
-		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error parsing user id from auth token: %v", err))
-		return
-	}
+	caller, _ := principalFrom(request)
 
-	if chirp.AuthorId != userId {
+	// Moderators can delete anyone's chirps
+	moderating := chirp.AuthorId != caller.UserId
+	if moderating && !database.RoleAtLeast(caller.Role, database.RoleModerator) {
 		respondWithError(writer, http.StatusForbidden, "Not allowed")
 		return
 	}
@@ -208,6 +188,9 @@ func (config *apiConfig) DeleteChirp(writer http.ResponseWriter, request *http.R
 		return
 	}
 
+	if moderating {
+		config.audit(request, "chirp.delete", fmt.Sprintf("chirp:%d", chirp.Id), fmt.Sprintf("Deleted a chirp by user %d: %q", chirp.AuthorId, chirp.Body))
+	}
 	respondWithSuccess(writer, http.StatusOK, "deleted")
 }
 
@@ -0,0 +1,118 @@
+// Handles cookie sessions for browsers, which keep their tokens out of reach of scripts and guard against CSRF with double-submit tokens
+
+package apiConfig
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+)
+
+const (
+	sessionCookieName   = "chirpy_session" // Holds the access token
+	refreshCookieName   = "chirpy_refresh" // Holds the refresh token, and is only sent to /api/refresh and /api/revoke
+	csrfCookieName      = "chirpy_csrf"    // Readable by Chirpy's pages, which send it back in the CSRF header
+	csrfHeaderName      = "X-CSRF-Token"
+	loginCSRFCookieName = "chirpy_login_csrf" // Ties the login and signup forms to the browser that loaded them
+	loginCSRFField      = "csrf_token"
+)
+
+// Sets the cookies for a browser session, and returns the new CSRF token pages have to send with state-changing requests
+func setSessionCookies(writer http.ResponseWriter, accessToken string, refreshToken string) (csrfToken string, err error) {
+	csrfToken, err = randomToken()
+	if err != nil {
+		return "", err
+	}
+	http.SetCookie(writer, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    accessToken,
+		Path:     "/",
+		MaxAge:   accessTokenTimeoutSeconds,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode, // Sent when following a link to Chirpy, so pages load logged in
+	})
+	http.SetCookie(writer, &http.Cookie{
+		Name:     refreshCookieName,
+		Value:    refreshToken,
+		Path:     "/api",
+		MaxAge:   refreshTokenTimeoutSeconds,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.SetCookie(writer, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    csrfToken,
+		Path:     "/",
+		MaxAge:   refreshTokenTimeoutSeconds,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return csrfToken, nil
+}
+
+// Removes a browser session's cookies
+func clearSessionCookies(writer http.ResponseWriter) {
+	for _, cookie := range []struct{ name, path string }{{sessionCookieName, "/"}, {refreshCookieName, "/api"}, {csrfCookieName, "/"}} {
+		http.SetCookie(writer, &http.Cookie{Name: cookie.name, Value: "", Path: cookie.path, MaxAge: -1, Secure: true})
+	}
+}
+
+// Checks a state-changing request made with session cookies sends the session's CSRF token in the CSRF header.
+//
+//	Other sites can make the browser send the cookies, but can't read the CSRF cookie to copy it into the header
+func checkCSRF(request *http.Request) error {
+	switch request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return nil
+	}
+	cookie, err := request.Cookie(csrfCookieName)
+	header := request.Header.Get(csrfHeaderName)
+	if err != nil || cookie.Value == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(header)) != 1 {
+		return fmt.Errorf("Missing or invalid %s header", csrfHeaderName)
+	}
+	return nil
+}
+
+// Gets the token the login and signup forms send back, setting its cookie if the browser doesn't have one yet.
+//
+//	There's no session to tie these forms to, so without it any site could post them, logging a browser into the site's own account
+func loginFormToken(writer http.ResponseWriter, request *http.Request) (string, error) {
+	if cookie, err := request.Cookie(loginCSRFCookieName); err == nil && cookie.Value != "" {
+		return cookie.Value, nil
+	}
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	http.SetCookie(writer, &http.Cookie{
+		Name:     loginCSRFCookieName,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token, nil
+}
+
+// Checks a login or signup form sends back the token from its cookie. Other sites can't read the cookie to copy it into the form
+func checkLoginFormToken(request *http.Request) error {
+	cookie, err := request.Cookie(loginCSRFCookieName)
+	field := request.PostFormValue(loginCSRFField)
+	if err != nil || cookie.Value == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(field)) != 1 {
+		return fmt.Errorf("Missing or invalid form token. Reload the page and try again")
+	}
+	return nil
+}
+
+// Reports whether the request carries a browser session's cookies. Cross-origin requests like that aren't allowed
+func HasSessionCookie(request *http.Request) bool {
+	for _, name := range []string{sessionCookieName, refreshCookieName} {
+		if cookie, err := request.Cookie(name); err == nil && cookie.Value != "" {
+			return true
+		}
+	}
+	return false
+}
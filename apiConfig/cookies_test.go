@@ -0,0 +1,124 @@
+package apiConfig
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Runs a request with the cookies through `middleware`, returning the response status and the principal it passed on
+func serveWithCookies(middleware func(http.Handler) http.Handler, method string, cookies []*http.Cookie, csrfToken string) (status int, caller principal, found bool) {
+	handler := middleware(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		caller, found = principalFrom(request)
+	}))
+	request := httptest.NewRequest(method, "/", nil)
+	for _, cookie := range cookies {
+		request.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+	}
+	if csrfToken != "" {
+		request.Header.Set(csrfHeaderName, csrfToken)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	return recorder.Code, caller, found
+}
+
+func TestCookieSessions(t *testing.T) {
+	config, _, _ := newTestAuthConfig(t)
+	user, err := config.db.CreateUser("browser@example.com", "password")
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+
+	response := sendAs(config, config.Login, 0, `{"email": "browser@example.com", "password": "password", "cookies": true}`)
+	if response.Code != http.StatusOK {
+		t.Fatalf("Error logging in: %v %s", response.Code, response.Body)
+	}
+	body := map[string]interface{}{}
+	err = json.NewDecoder(response.Body).Decode(&body)
+	if err != nil {
+		t.Fatalf("Error decoding login: %v", err)
+	}
+	if _, found := body["token"]; found || body["csrf_token"] == "" {
+		t.Fatalf("Expected only a CSRF token in a cookie login's response: %v", body)
+	}
+	cookies := response.Result().Cookies()
+	byName := map[string]*http.Cookie{}
+	for _, cookie := range cookies {
+		byName[cookie.Name] = cookie
+	}
+	session, refresh, csrf := byName[sessionCookieName], byName[refreshCookieName], byName[csrfCookieName]
+	if session == nil || !session.HttpOnly || !session.Secure || session.SameSite != http.SameSiteLaxMode {
+		t.Fatalf("Session cookie set incorrectly: %+v", session)
+	}
+	if refresh == nil || !refresh.HttpOnly || !refresh.Secure || refresh.Path != "/api" {
+		t.Fatalf("Refresh cookie set incorrectly: %+v", refresh)
+	}
+	if csrf == nil || csrf.HttpOnly || csrf.Value != body["csrf_token"] {
+		t.Fatalf("CSRF cookie set incorrectly: %+v", csrf)
+	}
+
+	status, caller, found := serveWithCookies(config.MiddlewareRequireAuth, http.MethodGet, cookies, "")
+	if status != http.StatusOK || !found || caller.UserId != user.Id || !caller.Cookie {
+		t.Fatalf("Session cookie rejected: %v, %+v", status, caller)
+	}
+	status, _, _ = serveWithCookies(config.MiddlewareRequireAuth, http.MethodPost, cookies, "")
+	if status != http.StatusForbidden {
+		t.Fatalf("Expected a state-changing request without a CSRF token to be forbidden, actual: %v", status)
+	}
+	status, _, _ = serveWithCookies(config.MiddlewareRequireAuth, http.MethodPost, cookies, "wrong")
+	if status != http.StatusForbidden {
+		t.Fatalf("Expected a wrong CSRF token to be forbidden, actual: %v", status)
+	}
+	status, _, _ = serveWithCookies(config.MiddlewareRequireAuth, http.MethodPost, cookies, csrf.Value)
+	if status != http.StatusOK {
+		t.Fatalf("State-changing request with the CSRF token rejected: %v", status)
+	}
+	status, _, _ = serveWithCookies(config.MiddlewareRequireAuth, http.MethodGet, []*http.Cookie{refresh}, "")
+	if status != http.StatusUnauthorized {
+		t.Fatalf("Expected the refresh cookie to be rejected as an access token, actual: %v", status)
+	}
+
+	// Refreshing with the cookie rotates the cookies
+	status, _, _ = serveWithCookies(config.MiddlewareRequireRefreshToken, http.MethodPost, cookies, "")
+	if status != http.StatusForbidden {
+		t.Fatalf("Expected a refresh without a CSRF token to be forbidden, actual: %v", status)
+	}
+	status, caller, _ = serveWithCookies(config.MiddlewareRequireRefreshToken, http.MethodPost, cookies, csrf.Value)
+	if status != http.StatusOK || !caller.Cookie {
+		t.Fatalf("Refresh cookie rejected: %v, %+v", status, caller)
+	}
+	recorder := httptest.NewRecorder()
+	config.RefreshAuth(recorder, withPrincipal(httptest.NewRequest(http.MethodPost, "/api/refresh", nil), caller))
+	if recorder.Code != http.StatusOK || len(recorder.Result().Cookies()) != 3 {
+		t.Fatalf("Error refreshing cookie session: %v, %v", recorder.Code, recorder.Result().Cookies())
+	}
+
+	recorder = httptest.NewRecorder()
+	config.RevokeAuth(recorder, withPrincipal(httptest.NewRequest(http.MethodPost, "/api/revoke", nil), caller))
+	for _, cookie := range recorder.Result().Cookies() {
+		if cookie.MaxAge >= 0 {
+			t.Fatalf("Cookie not removed on logout: %+v", cookie)
+		}
+	}
+	status, _, _ = serveWithCookies(config.MiddlewareRequireAuth, http.MethodGet, cookies, "")
+	if status != http.StatusUnauthorized {
+		t.Fatalf("Expected a revoked session's cookie to be unauthorized, actual: %v", status)
+	}
+}
+
+func TestHasSessionCookie(t *testing.T) {
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	if HasSessionCookie(request) {
+		t.Fatal("Request without cookies reported as having a session")
+	}
+	request.AddCookie(&http.Cookie{Name: csrfCookieName, Value: "token"})
+	if HasSessionCookie(request) {
+		t.Fatal("CSRF cookie alone reported as a session")
+	}
+	request.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "token"})
+	if !HasSessionCookie(request) {
+		t.Fatal("Session cookie not detected")
+	}
+}
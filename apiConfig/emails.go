@@ -0,0 +1,159 @@
+package apiConfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/trolfu/boot-dev-web-servers-course/database"
+	"github.com/trolfu/boot-dev-web-servers-course/mailer"
+)
+
+var emailVerificationTimeoutSeconds = 60 * 60 * 24 // 24 hours
+
+// What users who haven't verified their email can't do. Everything is allowed by default
+type UnverifiedRestrictions struct {
+	PostChirps bool // Unverified users can't post chirps
+	ChirpyRed  bool // Unverified users can't be upgraded to Chirpy Red
+}
+
+// Parses a comma separated list of restrictions for unverified users: `chirps` and `upgrades`
+func ParseUnverifiedRestrictions(list string) (UnverifiedRestrictions, error) {
+	restrictions := UnverifiedRestrictions{}
+	for _, name := range strings.Split(list, ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+		case "chirps":
+			restrictions.PostChirps = true
+		case "upgrades":
+			restrictions.ChirpyRed = true
+		default:
+			return UnverifiedRestrictions{}, fmt.Errorf("unknown restriction '%s'", name)
+		}
+	}
+	return restrictions, nil
+}
+
+// Creates a one-time token for the user and returns it in plaintext
+func (config *apiConfig) createOneTimeToken(userId int, purpose string, email string, timeoutSeconds int) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+	err = config.db.CreateOneTimeToken(token, database.OneTimeToken{
+		UserId:    userId,
+		Purpose:   purpose,
+		Email:     email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Second * time.Duration(timeoutSeconds)),
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Emails a verification token to `email`, which must be the user's email or pending email
+func (config *apiConfig) sendEmailVerification(userId int, email string) error {
+	token, err := config.createOneTimeToken(userId, database.PurposeEmailVerification, email, emailVerificationTimeoutSeconds)
+	if err != nil {
+		return err
+	}
+	return config.mailer.Send(mailer.Message{
+		To:      email,
+		Subject: "Verify your Chirpy email address",
+		Body: fmt.Sprintf("Confirm that this is your email address by sending this token to /api/email-verification/confirm within %d hours:\n\n%s\n",
+			emailVerificationTimeoutSeconds/60/60, token),
+	})
+}
+
+// Sends the verification email in the background so the response doesn't wait on the mail server
+func (config *apiConfig) sendEmailVerificationLater(userId int, email string) {
+	go func() {
+		err := config.sendEmailVerification(userId, email)
+		if err != nil {
+			log.Printf("Error sending email verification to user %d: %v", userId, err)
+		}
+	}()
+}
+
+// Sends the caller a new verification token for their pending email, or for their current email if it isn't verified
+func (config *apiConfig) RequestEmailVerification(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+
+	caller, _ := principalFrom(request)
+	user, found, err := config.db.GetUser(caller.UserId)
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error getting user: %v", err))
+		return
+	}
+	if !found {
+		respondWithError(writer, http.StatusNotFound, database.ErrUserNotFound.Error())
+		return
+	}
+
+	email := user.PendingEmail
+	if email == "" && !user.EmailVerified {
+		email = user.Email
+	}
+	if email == "" {
+		respondWithError(writer, http.StatusConflict, "Email is already verified")
+		return
+	}
+	err = config.sendEmailVerification(user.Id, email)
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error sending email verification: %v", err))
+		return
+	}
+	respondWithSuccess(writer, http.StatusAccepted, struct{}{})
+}
+
+// Verifies the email a verification token was sent to. A pending email replaces the user's current one
+func (config *apiConfig) ConfirmEmailVerification(writer http.ResponseWriter, request *http.Request) {
+	type confirmRequest struct {
+		Token string `json:"token"`
+	}
+	writer.Header().Set("Content-Type", "application/json")
+
+	body := confirmRequest{}
+	err := json.NewDecoder(request.Body).Decode(&body)
+	if err != nil || body.Token == "" {
+		respondWithError(writer, http.StatusBadRequest, "A token is required")
+		return
+	}
+
+	verification, err := config.db.ConsumeOneTimeToken(body.Token, database.PurposeEmailVerification, time.Now().UTC())
+	if err == database.ErrOneTimeTokenNotFound || err == database.ErrOneTimeTokenExpired {
+		respondWithError(writer, http.StatusBadRequest, "Invalid or expired verification token")
+		return
+	}
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error using verification token: %v", err))
+		return
+	}
+
+	user, err := config.db.VerifyEmail(verification.UserId, verification.Email)
+	if err == database.ErrEmailChanged || err == database.ErrUserNotFound {
+		respondWithError(writer, http.StatusBadRequest, "Invalid or expired verification token")
+		return
+	}
+	if err == database.ErrEmailInUse {
+		respondWithError(writer, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error verifying email: %v", err))
+		return
+	}
+	respondWithSuccess(writer, http.StatusOK, user)
+}
+
+// Reports whether the user has verified their email
+func (config *apiConfig) emailVerified(userId int) (bool, error) {
+	user, _, err := config.db.GetUser(userId)
+	return user.EmailVerified, err
+}
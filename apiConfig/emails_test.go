@@ -0,0 +1,155 @@
+package apiConfig
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/trolfu/boot-dev-web-servers-course/database"
+	"github.com/trolfu/boot-dev-web-servers-course/mailer"
+)
+
+// Waits for the mailer to have sent `count` messages, since verification emails are sent in the background
+func waitForMessages(t *testing.T, recorder *recordingMailer, count int) []mailer.Message {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		recorder.mux.Lock()
+		messages := append([]mailer.Message{}, recorder.messages...)
+		recorder.mux.Unlock()
+		if len(messages) >= count {
+			return messages
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d emails, actual: %+v", count, messages)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Gets the token from a verification or reset email, which ends with it
+func messageToken(message mailer.Message) string {
+	lines := strings.Split(strings.TrimSpace(message.Body), "\n")
+	return lines[len(lines)-1]
+}
+
+func decodeUser(t *testing.T, response *httptest.ResponseRecorder) database.User {
+	user := database.User{}
+	err := json.Unmarshal(response.Body.Bytes(), &user)
+	if err != nil {
+		t.Fatalf("Error decoding user: %v %s", err, response.Body)
+	}
+	return user
+}
+
+func TestEmailVerification(t *testing.T) {
+	config, _, _ := newTestAuthConfig(t)
+	recorder := &recordingMailer{mux: &sync.Mutex{}}
+	config.mailer = recorder
+
+	response := sendAs(config, config.CreateUser, 0, `{"email": "verify@example.com", "password": "correct horse battery"}`)
+	if response.Code != http.StatusCreated {
+		t.Fatalf("Error signing up: %v %s", response.Code, response.Body)
+	}
+	user := decodeUser(t, response)
+	messages := waitForMessages(t, recorder, 1)
+	if messages[0].To != "verify@example.com" {
+		t.Fatalf("Expected the verification email to go to the new user, actual: %+v", messages[0])
+	}
+
+	if postJSON(config.ConfirmEmailVerification, `{"token": "wrong"}`) != http.StatusBadRequest {
+		t.Fatal("Expected an unknown verification token to be refused")
+	}
+	response = sendAs(config, config.ConfirmEmailVerification, 0, `{"token": "`+messageToken(messages[0])+`"}`)
+	if response.Code != http.StatusOK || !decodeUser(t, response).EmailVerified {
+		t.Fatalf("Error confirming email: %v %s", response.Code, response.Body)
+	}
+
+	_, err := config.db.CreateUser("taken@example.com", "correct horse battery")
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	response = sendAs(config, config.UpdateUser, user.Id, `{"email": "taken@example.com", "password": "a whole new password"}`)
+	if response.Code != http.StatusConflict {
+		t.Fatalf("Expected a taken email to conflict: %v %s", response.Code, response.Body)
+	}
+	_, err = config.db.ValidateCredentials("verify@example.com", "correct horse battery")
+	if err != nil {
+		t.Fatalf("Password changed even though the email was taken: %v", err)
+	}
+
+	// A new email is pending until it's confirmed, and the old one keeps working until then
+	response = sendAs(config, config.UpdateUser, user.Id, `{"email": "changed@example.com"}`)
+	if response.Code != http.StatusOK {
+		t.Fatalf("Error changing email: %v %s", response.Code, response.Body)
+	}
+	if user := decodeUser(t, response); user.Email != "verify@example.com" || user.PendingEmail != "changed@example.com" {
+		t.Fatalf("New email not held as pending: %+v", user)
+	}
+	messages = waitForMessages(t, recorder, 2)
+	if messages[1].To != "changed@example.com" {
+		t.Fatalf("Expected the verification email to go to the new address, actual: %+v", messages[1])
+	}
+	_, err = config.db.ValidateCredentials("verify@example.com", "correct horse battery")
+	if err != nil {
+		t.Fatalf("Old email stopped working before the new one was confirmed: %v", err)
+	}
+
+	response = sendAs(config, config.ConfirmEmailVerification, 0, `{"token": "`+messageToken(messages[1])+`"}`)
+	if response.Code != http.StatusOK {
+		t.Fatalf("Error confirming new email: %v %s", response.Code, response.Body)
+	}
+	if user := decodeUser(t, response); user.Email != "changed@example.com" || user.PendingEmail != "" || !user.EmailVerified {
+		t.Fatalf("Confirmed email didn't replace the old one: %+v", user)
+	}
+	_, err = config.db.ValidateCredentials("changed@example.com", "correct horse battery")
+	if err != nil {
+		t.Fatalf("Error logging in with the new email: %v", err)
+	}
+	if _, err = config.db.ValidateCredentials("verify@example.com", "correct horse battery"); err != database.ErrInvalidCredentials {
+		t.Fatalf("Expected the old email to stop working, actual: %v", err)
+	}
+}
+
+func TestUnverifiedRestrictions(t *testing.T) {
+	config, _, _ := newTestAuthConfig(t)
+	config.restrictions = UnverifiedRestrictions{PostChirps: true, ChirpyRed: true}
+	config.polkaApiKey = "polka-key"
+	user, err := config.db.CreateUser("unverified@example.com", "password")
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+
+	upgrade := func() int {
+		request := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"event": "user.upgraded", "data": {"user_id": 1}}`))
+		request.Header.Set("Authorization", "ApiKey polka-key")
+		recorder := httptest.NewRecorder()
+		config.UpgradeUser(recorder, request)
+		return recorder.Code
+	}
+
+	response := sendAs(config, config.CreateChirp, user.Id, `{"body": "Unverified chirp"}`)
+	if response.Code != http.StatusForbidden || !strings.Contains(response.Body.String(), "Verify your email") {
+		t.Fatalf("Expected an unverified user's chirp to be refused: %v %s", response.Code, response.Body)
+	}
+	if status := upgrade(); status != http.StatusForbidden {
+		t.Fatalf("Expected an unverified user's upgrade to be refused, actual: %v", status)
+	}
+	if user, _, _ := config.db.GetUser(user.Id); user.IsChirpyRed {
+		t.Fatal("Unverified user upgraded to Chirpy Red")
+	}
+
+	_, err = config.db.VerifyEmail(user.Id, user.Email)
+	if err != nil {
+		t.Fatalf("Error verifying email: %v", err)
+	}
+	if response := sendAs(config, config.CreateChirp, user.Id, `{"body": "Verified chirp"}`); response.Code != http.StatusCreated {
+		t.Fatalf("Error posting chirp once verified: %v %s", response.Code, response.Body)
+	}
+	if status := upgrade(); status != http.StatusOK {
+		t.Fatalf("Error upgrading once verified: %v", status)
+	}
+}
@@ -0,0 +1,212 @@
+// Manages the keys JWTs are signed and verified with
+
+package apiConfig
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// The key id of the shared HS256 secret. Tokens signed with it before key ids existed have no `kid` header
+const secretKeyId = "secret"
+
+// A key JWTs can be verified with, and signed with if the private key is known
+type signingKey struct {
+	id      string
+	method  jwt.SigningMethod
+	private crypto.PrivateKey // nil for keys that can only verify
+	public  crypto.PublicKey  // For HS256, the shared secret
+}
+
+// The keys accepted for JWTs. New tokens are signed with the active key, and every other key stays valid until it's removed.
+//
+//	Asymmetric keys are published at /.well-known/jwks.json so other services can verify tokens without the secret
+type Keyring struct {
+	keys   map[string]signingKey
+	active string
+}
+
+// Loads the keyring from the PEM files in `dir`, plus the shared HS256 `secret` if it isn't empty.
+//
+//	Each file's name, without the `.pem` extension, is its key id. Files hold a PKCS#8 or PKCS#1 private key (RS256 or EdDSA),
+//	or a PKIX public key for a retiring key that should verify tokens but no longer sign them.
+//	`activeKeyId` picks the signing key. If it's empty, the last private key by name is used, then the secret
+func LoadKeyring(dir string, activeKeyId string, secret string) (*Keyring, error) {
+	keyring := &Keyring{keys: map[string]signingKey{}}
+	if secret != "" {
+		keyring.keys[secretKeyId] = signingKey{id: secretKeyId, method: jwt.SigningMethodHS256, private: []byte(secret), public: []byte(secret)}
+	}
+
+	if dir != "" {
+		paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+		if err != nil {
+			return nil, err
+		}
+		slices.Sort(paths)
+		for _, path := range paths {
+			key, err := readPEMKey(path)
+			if err != nil {
+				return nil, fmt.Errorf("loading key %s: %w", path, err)
+			}
+			keyring.keys[key.id] = key
+			if key.private != nil {
+				keyring.active = key.id
+			}
+		}
+	}
+	if keyring.active == "" && secret != "" {
+		keyring.active = secretKeyId
+	}
+
+	if activeKeyId != "" {
+		key, found := keyring.keys[activeKeyId]
+		if !found {
+			return nil, fmt.Errorf("active key %s not found", activeKeyId)
+		}
+		if key.private == nil {
+			return nil, fmt.Errorf("active key %s has no private key", activeKeyId)
+		}
+		keyring.active = activeKeyId
+	}
+	if keyring.active == "" {
+		return nil, errors.New("no signing key: set JWT_SECRET or add a private key to the key directory")
+	}
+	return keyring, nil
+}
+
+func readPEMKey(path string) (signingKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return signingKey{}, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return signingKey{}, errors.New("no PEM data found")
+	}
+
+	key := signingKey{id: strings.TrimSuffix(filepath.Base(path), ".pem")}
+	switch block.Type {
+	case "PRIVATE KEY":
+		key.private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key.private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		key.public, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return signingKey{}, fmt.Errorf("unsupported PEM block %s", block.Type)
+	}
+	if err != nil {
+		return signingKey{}, err
+	}
+	if signer, ok := key.private.(crypto.Signer); ok {
+		key.public = signer.Public()
+	}
+
+	switch key.public.(type) {
+	case *rsa.PublicKey:
+		key.method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		key.method = jwt.SigningMethodEdDSA
+	default:
+		return signingKey{}, fmt.Errorf("unsupported key type %T", key.public)
+	}
+	return key, nil
+}
+
+// Signs the claims with the active key, naming it in the `kid` header
+func (keyring *Keyring) sign(claims jwt.Claims) (string, error) {
+	key := keyring.keys[keyring.active]
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.id
+	return token.SignedString(key.private)
+}
+
+// Finds the key a token was signed with. Used as the `jwt.Keyfunc` when parsing tokens
+func (keyring *Keyring) verificationKey(token *jwt.Token) (interface{}, error) {
+	keyId, _ := token.Header["kid"].(string)
+	if keyId == "" {
+		keyId = secretKeyId
+	}
+	key, found := keyring.keys[keyId]
+	if !found {
+		return nil, fmt.Errorf("unknown key %s", keyId)
+	}
+	// The key decides the algorithm, so a public key can't be passed off as an HMAC secret
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("key %s doesn't use %s", keyId, token.Method.Alg())
+	}
+	return key.public, nil
+}
+
+// The signing algorithms of every key
+func (keyring *Keyring) methods() []string {
+	methods := []string{}
+	for _, key := range keyring.keys {
+		if !slices.Contains(methods, key.method.Alg()) {
+			methods = append(methods, key.method.Alg())
+		}
+	}
+	return methods
+}
+
+// A public key in JSON Web Key format
+type jsonWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyId     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	Curve     string `json:"crv,omitempty"` // EdDSA
+	X         string `json:"x,omitempty"`   // EdDSA public key
+	N         string `json:"n,omitempty"`   // RSA modulus
+	E         string `json:"e,omitempty"`   // RSA exponent
+}
+
+// The public half of every asymmetric key, ordered by key id. The HS256 secret is never published
+func (keyring *Keyring) publicKeys() []jsonWebKey {
+	encode := base64.RawURLEncoding.EncodeToString
+	keys := []jsonWebKey{}
+	for _, key := range keyring.keys {
+		jwk := jsonWebKey{KeyId: key.id, Use: "sig", Algorithm: key.method.Alg()}
+		switch public := key.public.(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = encode(public.N.Bytes())
+			jwk.E = encode(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = encode(public)
+		default:
+			continue
+		}
+		keys = append(keys, jwk)
+	}
+	slices.SortFunc(keys, func(a, b jsonWebKey) int {
+		return strings.Compare(a.KeyId, b.KeyId)
+	})
+	return keys
+}
+
+// Publishes the public keys tokens can be verified with, as a JSON Web Key Set
+func (config *apiConfig) GetJWKS(writer http.ResponseWriter, request *http.Request) {
+	type keySet struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "public, max-age=300")
+	respondWithSuccess(writer, http.StatusOK, keySet{Keys: config.keyring.publicKeys()})
+}
@@ -0,0 +1,187 @@
+package apiConfig
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Writes `key` to `<dir>/<keyId>.pem`, as a private key or, for a public key, a verify-only key
+func writeTestKey(t *testing.T, dir string, keyId string, key interface{}) {
+	var block *pem.Block
+	switch key.(type) {
+	case *rsa.PublicKey, ed25519.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			t.Fatalf("Error encoding public key: %v", err)
+		}
+		block = &pem.Block{Type: "PUBLIC KEY", Bytes: der}
+	default:
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatalf("Error encoding private key: %v", err)
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	}
+	err := os.WriteFile(filepath.Join(dir, keyId+".pem"), pem.EncodeToMemory(block), 0600)
+	if err != nil {
+		t.Fatalf("Error writing key: %v", err)
+	}
+}
+
+func parseTestToken(keyring *Keyring, token string) (*jwt.Token, error) {
+	return jwt.Parse(token, keyring.verificationKey, jwt.WithValidMethods(keyring.methods()))
+}
+
+func TestKeyringRotation(t *testing.T) {
+	dir := t.TempDir()
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	writeTestKey(t, dir, "2024-01", edKey)
+
+	oldKeyring, err := LoadKeyring(dir, "", "testing-secret")
+	if err != nil {
+		t.Fatalf("Error loading keyring: %v", err)
+	}
+	oldToken, err := oldKeyring.sign(jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))})
+	if err != nil {
+		t.Fatalf("Error signing token: %v", err)
+	}
+	legacyToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{}).SignedString([]byte("testing-secret"))
+	if err != nil {
+		t.Fatalf("Error signing token: %v", err)
+	}
+
+	// A newer key takes over signing, and the older key still verifies the tokens it signed
+	writeTestKey(t, dir, "2024-02", rsaKey)
+	keyring, err := LoadKeyring(dir, "", "testing-secret")
+	if err != nil {
+		t.Fatalf("Error loading keyring: %v", err)
+	}
+	newToken, err := keyring.sign(jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))})
+	if err != nil {
+		t.Fatalf("Error signing token: %v", err)
+	}
+	parsed, err := parseTestToken(keyring, newToken)
+	if err != nil {
+		t.Fatalf("Error verifying new token: %v", err)
+	}
+	if parsed.Header["kid"] != "2024-02" || parsed.Method.Alg() != "RS256" {
+		t.Fatalf("New token not signed with the newest key: %v", parsed.Header)
+	}
+	for name, token := range map[string]string{"older key": oldToken, "secret without a key id": legacyToken} {
+		_, err = parseTestToken(keyring, token)
+		if err != nil {
+			t.Fatalf("Error verifying token signed with the %s: %v", name, err)
+		}
+	}
+
+	// Replacing the old key with its public half stops it signing, but not verifying
+	writeTestKey(t, dir, "2024-01", edKey.Public())
+	_, err = LoadKeyring(dir, "2024-01", "")
+	if err == nil {
+		t.Fatal("Activated a key without a private key")
+	}
+	keyring, err = LoadKeyring(dir, "", "")
+	if err != nil {
+		t.Fatalf("Error loading keyring: %v", err)
+	}
+	_, err = parseTestToken(keyring, oldToken)
+	if err != nil {
+		t.Fatalf("Error verifying token signed with a verify-only key: %v", err)
+	}
+	_, err = parseTestToken(keyring, legacyToken)
+	if err == nil {
+		t.Fatal("Verified a token signed with a secret that was removed")
+	}
+
+	// Retiring a key invalidates its tokens
+	err = os.Remove(filepath.Join(dir, "2024-01.pem"))
+	if err != nil {
+		t.Fatalf("Error removing key: %v", err)
+	}
+	keyring, err = LoadKeyring(dir, "", "")
+	if err != nil {
+		t.Fatalf("Error loading keyring: %v", err)
+	}
+	_, err = parseTestToken(keyring, oldToken)
+	if err == nil {
+		t.Fatal("Verified a token signed with a retired key")
+	}
+}
+
+func TestKeyringRejectsAlgorithmConfusion(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	writeTestKey(t, dir, "rsa", rsaKey)
+	keyring, err := LoadKeyring(dir, "", "testing-secret")
+	if err != nil {
+		t.Fatalf("Error loading keyring: %v", err)
+	}
+
+	// An HS256 token claiming to be signed by the RSA key, using the public key as the HMAC secret
+	publicDer, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatalf("Error encoding public key: %v", err)
+	}
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{})
+	forged.Header["kid"] = "rsa"
+	forgedToken, err := forged.SignedString(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDer}))
+	if err != nil {
+		t.Fatalf("Error signing token: %v", err)
+	}
+	_, err = parseTestToken(keyring, forgedToken)
+	if err == nil {
+		t.Fatal("Verified an HS256 token against an RSA key")
+	}
+}
+
+func TestKeyringPublicKeys(t *testing.T) {
+	dir := t.TempDir()
+	edPublic, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	writeTestKey(t, dir, "a-ed25519", edKey)
+	writeTestKey(t, dir, "b-rsa", rsaKey)
+	keyring, err := LoadKeyring(dir, "", "testing-secret")
+	if err != nil {
+		t.Fatalf("Error loading keyring: %v", err)
+	}
+
+	keys := keyring.publicKeys()
+	if len(keys) != 2 {
+		t.Fatalf("Expected 2 published keys, without the secret, actual: %+v", keys)
+	}
+	if keys[0].KeyId != "a-ed25519" || keys[0].KeyType != "OKP" || keys[0].Algorithm != "EdDSA" || keys[0].X == "" {
+		t.Fatalf("Ed25519 key published incorrectly: %+v", keys[0])
+	}
+	if keys[0].X != base64.RawURLEncoding.EncodeToString(edPublic) {
+		t.Fatalf("Published the wrong Ed25519 public key: %+v", keys[0])
+	}
+	if keys[1].KeyId != "b-rsa" || keys[1].KeyType != "RSA" || keys[1].Algorithm != "RS256" || keys[1].E != "AQAB" {
+		t.Fatalf("RSA key published incorrectly: %+v", keys[1])
+	}
+}
@@ -3,8 +3,84 @@ package apiConfig
 import (
 	"fmt"
 	"net/http"
+	"sync"
+	"time"
 )
 
+// Number of minutes of request counts kept for the admin dashboard's charts
+const requestHistoryMinutes = 60
+
+// Counts of the requests handled, a minute at a time, for the last `requestHistoryMinutes` minutes
+type requestStats struct {
+	mux     *sync.Mutex
+	minutes [requestHistoryMinutes]requestMinute // Indexed by the minute since the epoch, wrapping around
+}
+
+// The requests handled in one minute, by the class of their response status
+type requestMinute struct {
+	Start        time.Time
+	Requests     int
+	ClientErrors int // 4xx responses
+	ServerErrors int // 5xx responses
+}
+
+func newRequestStats() *requestStats {
+	return &requestStats{mux: &sync.Mutex{}}
+}
+
+// Counts a request that was responded to with `status` at `now`
+func (stats *requestStats) record(now time.Time, status int) {
+	start := now.UTC().Truncate(time.Minute)
+	stats.mux.Lock()
+	defer stats.mux.Unlock()
+	minute := &stats.minutes[(start.Unix()/60)%requestHistoryMinutes]
+	if !minute.Start.Equal(start) {
+		*minute = requestMinute{Start: start}
+	}
+	minute.Requests++
+	if status >= 500 {
+		minute.ServerErrors++
+	} else if status >= 400 {
+		minute.ClientErrors++
+	}
+}
+
+// Gets the counts for each of the last `requestHistoryMinutes` minutes up to `now`, oldest first. Minutes without requests are included
+func (stats *requestStats) history(now time.Time) []requestMinute {
+	current := now.UTC().Truncate(time.Minute)
+	stats.mux.Lock()
+	defer stats.mux.Unlock()
+	history := make([]requestMinute, requestHistoryMinutes)
+	for i := range history {
+		start := current.Add(-time.Duration(requestHistoryMinutes-1-i) * time.Minute)
+		history[i] = requestMinute{Start: start}
+		if minute := stats.minutes[(start.Unix()/60)%requestHistoryMinutes]; minute.Start.Equal(start) {
+			history[i] = minute
+		}
+	}
+	return history
+}
+
+// Remembers the status a handler responded with
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	recorder.status = status
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+// Counts every request by its response status, for the admin dashboard's charts
+func (config *apiConfig) MiddlewareRecordRequests(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: writer, status: http.StatusOK}
+		handler.ServeHTTP(recorder, request)
+		config.requests.record(time.Now(), recorder.status)
+	})
+}
+
 func (config *apiConfig) MiddlewareIncrementMetrics(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
 		config.fileserverHits++
@@ -21,23 +97,9 @@ func (config *apiConfig) ApiMetrics(writer http.ResponseWriter, request *http.Re
 	}
 }
 
-func (config *apiConfig) AdminApiMetrics(writer http.ResponseWriter, request *http.Request) {
-	writer.Header().Set("Content-Type", "text/html")
-	writer.WriteHeader(http.StatusOK)
-	// There has to be a better way of doing this
-	writer.Write([]byte(
-		fmt.Sprintf("<html>"+
-			"<body>"+
-			"<h1>Welcome, Chirpy Admin</h1>"+
-			"<p>Chirpy has been visited %d times!</p>"+
-			"</body>"+
-
-			"</html>",
-			config.fileserverHits)))
-}
-
 func (config *apiConfig) ResetMetrics(writer http.ResponseWriter, request *http.Request) {
 	writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	writer.WriteHeader(http.StatusOK)
 	config.fileserverHits = 0
+	config.audit(request, "metrics.reset", "metrics", "")
 }
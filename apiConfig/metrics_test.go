@@ -0,0 +1,40 @@
+package apiConfig
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRequestStats(t *testing.T) {
+	stats := newRequestStats()
+	now := time.Date(2024, 1, 1, 12, 30, 15, 0, time.UTC)
+	stats.record(now.Add(-requestHistoryMinutes*time.Minute), http.StatusOK) // Too old to be shown, and overwritten below
+	stats.record(now.Add(-2*time.Minute), http.StatusOK)
+	stats.record(now, http.StatusOK)
+	stats.record(now, http.StatusNotFound)
+	stats.record(now, http.StatusInternalServerError)
+
+	history := stats.history(now)
+	if len(history) != requestHistoryMinutes {
+		t.Fatalf("Expected %d minutes of history, actual: %d", requestHistoryMinutes, len(history))
+	}
+	current, earlier := history[len(history)-1], history[len(history)-3]
+	if !current.Start.Equal(now.Truncate(time.Minute)) || current.Requests != 3 || current.ClientErrors != 1 || current.ServerErrors != 1 {
+		t.Fatalf("Current minute counted incorrectly: %+v", current)
+	}
+	if earlier.Requests != 1 || history[len(history)-2].Requests != 0 {
+		t.Fatalf("Earlier minutes counted incorrectly: %+v", history[len(history)-3:])
+	}
+	if history[0].Requests != 0 {
+		t.Fatalf("Minute from over an hour ago still counted: %+v", history[0])
+	}
+
+	chart := newRequestChart(history)
+	if chart.Max != 3 || len(chart.Bars) != requestHistoryMinutes || len(chart.Bars[len(chart.Bars)-1].Segments) != 3 {
+		t.Fatalf("Chart laid out incorrectly: %+v", chart)
+	}
+	if top := chart.Bars[len(chart.Bars)-1].Segments[2]; top.Class != "server-error" || top.Y != "0.0" {
+		t.Fatalf("Busiest minute's bar doesn't reach the top of the chart: %+v", top)
+	}
+}
@@ -0,0 +1,623 @@
+// Handles the OAuth2 authorization server, which lets third-party apps act for a user with the scopes the user approved.
+//
+//	Apps get authorization codes with PKCE (RFC 7636) from /oauth/authorize, trade them for tokens at /oauth/token, and revoke tokens at /oauth/revoke (RFC 7009)
+
+package apiConfig
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/trolfu/boot-dev-web-servers-course/database"
+)
+
+var authorizationCodeTimeoutSeconds = 60 * 5 // 5 min
+
+const (
+	maxOAuthClientNameLength = 64
+	maxRedirectURIs          = 10
+	minCodeVerifierLength    = 43 // RFC 7636 code verifiers are 43 to 128 characters
+	maxCodeVerifierLength    = 128
+)
+
+// What each scope lets an app do, as shown on the consent page
+var scopeDescriptions = map[string]string{
+	database.ScopeChirpsWrite:  "Post and delete chirps as you",
+	database.ScopeProfileWrite: "Change your email and password",
+}
+
+//go:embed oauth_consent.html
+var oauthPageSource string
+
+var oauthPages = template.Must(template.New("oauth").Parse(oauthPageSource))
+
+// The parameters of an authorization request, carried through the consent form
+type authorizationRequest struct {
+	ClientId      string
+	RedirectURI   string
+	Scope         string // As requested, space separated
+	Scopes        []string
+	State         string
+	CodeChallenge string
+}
+
+// An error response from the token and revocation endpoints, as defined by RFC 6749
+type oauthError struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+// Checks a redirect URI can be registered. It has to be an absolute https URL without a fragment. http is only allowed for loopback addresses, for apps running on the user's machine
+func validRedirectURI(raw string) error {
+	parsed, err := url.Parse(raw)
+	if err != nil || !parsed.IsAbs() || parsed.Host == "" || strings.Contains(raw, "#") {
+		return fmt.Errorf("Redirect URI %q must be an absolute URL without a fragment", raw)
+	}
+	if parsed.Scheme == "https" {
+		return nil
+	}
+	host := parsed.Hostname()
+	ip := net.ParseIP(host)
+	if parsed.Scheme == "http" && (host == "localhost" || (ip != nil && ip.IsLoopback())) {
+		return nil
+	}
+	return fmt.Errorf("Redirect URI %q must use https, or http on a loopback address", raw)
+}
+
+// Computes the PKCE S256 challenge for a code verifier
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Registers an OAuth client owned by the caller.
+//
+//	Confidential clients get a secret, which is only ever shown here
+func (config *apiConfig) CreateOAuthClient(writer http.ResponseWriter, request *http.Request) {
+	type createRequest struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Confidential bool     `json:"confidential"`
+	}
+	type createResponse struct {
+		database.OAuthClient
+		ClientSecret string `json:"client_secret,omitempty"`
+	}
+	writer.Header().Set("Content-Type", "application/json")
+
+	caller, _ := principalFrom(request)
+	body := createRequest{}
+	err := json.NewDecoder(request.Body).Decode(&body)
+	if err != nil {
+		respondWithError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	name := strings.TrimSpace(body.Name)
+	if name == "" || len(name) > maxOAuthClientNameLength {
+		respondWithError(writer, http.StatusBadRequest, fmt.Sprintf("Name must be 1 to %d characters", maxOAuthClientNameLength))
+		return
+	}
+	if len(body.RedirectURIs) == 0 || len(body.RedirectURIs) > maxRedirectURIs {
+		respondWithError(writer, http.StatusBadRequest, fmt.Sprintf("Register 1 to %d redirect URIs", maxRedirectURIs))
+		return
+	}
+	for _, redirectURI := range body.RedirectURIs {
+		err = validRedirectURI(redirectURI)
+		if err != nil {
+			respondWithError(writer, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	id, err := randomToken()
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error creating client: %v", err))
+		return
+	}
+	secret := ""
+	if body.Confidential {
+		secret, err = randomToken()
+		if err != nil {
+			respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error creating client: %v", err))
+			return
+		}
+	}
+	client := database.OAuthClient{
+		Id:           id,
+		OwnerId:      caller.UserId,
+		Name:         name,
+		RedirectURIs: body.RedirectURIs,
+		Confidential: body.Confidential,
+		CreatedAt:    time.Now().UTC(),
+	}
+	err = config.db.CreateOAuthClient(secret, client)
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error creating client: %v", err))
+		return
+	}
+	config.audit(request, "oauth_client.create", "oauth_client:"+client.Id, fmt.Sprintf("Registered %q redirecting to %s", client.Name, strings.Join(client.RedirectURIs, " ")))
+	respondWithSuccess(writer, http.StatusCreated, createResponse{OAuthClient: client, ClientSecret: secret})
+}
+
+// Lists the OAuth clients the caller registered, oldest first. Secrets aren't included
+func (config *apiConfig) GetOAuthClients(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+
+	caller, _ := principalFrom(request)
+
+	clients, err := config.db.GetUserOAuthClients(caller.UserId)
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error getting clients: %v", err))
+		return
+	}
+	respondWithSuccess(writer, http.StatusOK, clients)
+}
+
+// Deletes one of the caller's OAuth clients. Every token issued to it stops working immediately
+func (config *apiConfig) DeleteOAuthClient(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+
+	caller, _ := principalFrom(request)
+
+	// Other users' clients are reported as missing, like API keys
+	clientId := chi.URLParam(request, "clientId")
+	err := config.db.DeleteOAuthClient(caller.UserId, clientId)
+	if err == database.ErrOAuthClientNotFound {
+		respondWithError(writer, http.StatusNotFound, "Client not found")
+		return
+	}
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error deleting client: %v", err))
+		return
+	}
+	config.audit(request, "oauth_client.delete", "oauth_client:"+clientId, "")
+	respondWithSuccess(writer, http.StatusOK, nil)
+}
+
+// Checks the parameters of an authorization request.
+//
+//	Until the client and redirect URI are known to be good, errors can't be sent back to the client, so `redirectable` is false and they're shown to the user instead.
+//	Later errors are returned as an RFC 6749 error code to redirect back with
+func (config *apiConfig) parseAuthorizationRequest(values url.Values) (authRequest authorizationRequest, client database.OAuthClient, redirectable bool, err error) {
+	authRequest = authorizationRequest{
+		ClientId:      values.Get("client_id"),
+		RedirectURI:   values.Get("redirect_uri"),
+		Scope:         values.Get("scope"),
+		State:         values.Get("state"),
+		CodeChallenge: values.Get("code_challenge"),
+	}
+	client, found, err := config.db.GetOAuthClient(authRequest.ClientId)
+	if err != nil {
+		return authRequest, client, false, fmt.Errorf("Error getting client: %w", err)
+	}
+	if !found {
+		return authRequest, client, false, fmt.Errorf("Unknown client")
+	}
+	// The redirect URI can only be left out when the client has just one
+	if authRequest.RedirectURI == "" && len(client.RedirectURIs) == 1 {
+		authRequest.RedirectURI = client.RedirectURIs[0]
+	}
+	registered := false
+	for _, redirectURI := range client.RedirectURIs {
+		registered = registered || redirectURI == authRequest.RedirectURI
+	}
+	if !registered {
+		return authRequest, client, false, fmt.Errorf("The redirect URI isn't registered for %s", client.Name)
+	}
+
+	if values.Get("response_type") != "code" {
+		return authRequest, client, true, fmt.Errorf("unsupported_response_type")
+	}
+	if authRequest.CodeChallenge == "" || values.Get("code_challenge_method") != "S256" {
+		return authRequest, client, true, fmt.Errorf("invalid_request")
+	}
+	authRequest.Scopes, err = normalizeScopes(strings.Fields(authRequest.Scope))
+	if err != nil || len(authRequest.Scopes) == 0 {
+		return authRequest, client, true, fmt.Errorf("invalid_scope")
+	}
+	return authRequest, client, true, nil
+}
+
+// Sends the user back to the client's redirect URI with `params` added to its query
+func redirectToClient(writer http.ResponseWriter, request *http.Request, redirectURI string, params url.Values) {
+	target, err := url.Parse(redirectURI)
+	if err != nil {
+		showOAuthError(writer, http.StatusBadRequest, "The redirect URI is invalid")
+		return
+	}
+	query := target.Query()
+	for key, values := range params {
+		for _, value := range values {
+			if value != "" {
+				query.Add(key, value)
+			}
+		}
+	}
+	target.RawQuery = query.Encode()
+	http.Redirect(writer, request, target.String(), http.StatusSeeOther)
+}
+
+// Shows an authorization error to the user, for requests that can't be redirected back to the client
+func showOAuthError(writer http.ResponseWriter, status int, message string) {
+	setOAuthPageHeaders(writer)
+	writer.WriteHeader(status)
+	err := oauthPages.ExecuteTemplate(writer, "error", message)
+	if err != nil {
+		log.Printf("Error rendering OAuth error page: %v", err)
+	}
+}
+
+// Shows the consent page, asking the user to log in and approve the client's request
+func showConsentPage(writer http.ResponseWriter, status int, authRequest authorizationRequest, client database.OAuthClient, email string, message string) {
+	type consentPage struct {
+		ClientName string
+		Scopes     []string
+		Request    authorizationRequest
+		Email      string
+		Error      string
+	}
+	page := consentPage{ClientName: client.Name, Request: authRequest, Email: email, Error: message}
+	for _, scope := range authRequest.Scopes {
+		page.Scopes = append(page.Scopes, scopeDescriptions[scope])
+	}
+	setOAuthPageHeaders(writer)
+	writer.WriteHeader(status)
+	err := oauthPages.ExecuteTemplate(writer, "consent", page)
+	if err != nil {
+		log.Printf("Error rendering consent page: %v", err)
+	}
+}
+
+// Keeps the authorization pages out of caches and frames, so the consent form can't be clickjacked
+func setOAuthPageHeaders(writer http.ResponseWriter) {
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.Header().Set("X-Frame-Options", "DENY")
+	writer.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; frame-ancestors 'none'")
+}
+
+// Starts an authorization request, showing the user the consent page for the client and the scopes it asked for
+func (config *apiConfig) Authorize(writer http.ResponseWriter, request *http.Request) {
+	authRequest, client, redirectable, err := config.parseAuthorizationRequest(request.URL.Query())
+	if err != nil && !redirectable {
+		showOAuthError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		redirectToClient(writer, request, authRequest.RedirectURI, url.Values{"error": {err.Error()}, "state": {authRequest.State}})
+		return
+	}
+	showConsentPage(writer, http.StatusOK, authRequest, client, "", "")
+}
+
+// Handles the consent form. If the user logs in and approves, an authorization code is sent to the client's redirect URI.
+//
+//	Logging in here is throttled like /api/login, and users with two-factor authentication have to enter a code
+func (config *apiConfig) ApproveAuthorization(writer http.ResponseWriter, request *http.Request) {
+	err := request.ParseForm()
+	if err != nil {
+		showOAuthError(writer, http.StatusBadRequest, "Invalid form")
+		return
+	}
+	authRequest, client, redirectable, err := config.parseAuthorizationRequest(request.PostForm)
+	if err != nil && !redirectable {
+		showOAuthError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		redirectToClient(writer, request, authRequest.RedirectURI, url.Values{"error": {err.Error()}, "state": {authRequest.State}})
+		return
+	}
+	if request.PostForm.Get("action") == "deny" {
+		redirectToClient(writer, request, authRequest.RedirectURI, url.Values{"error": {"access_denied"}, "state": {authRequest.State}})
+		return
+	}
+
+	email := request.PostForm.Get("email")
+	user, status, message, err := config.checkFormLogin(request, email, request.PostForm.Get("password"), request.PostForm.Get("code"))
+	if err != nil {
+		showOAuthError(writer, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if message != "" {
+		showConsentPage(writer, status, authRequest, client, email, message)
+		return
+	}
+
+	code, err := randomToken()
+	if err != nil {
+		showOAuthError(writer, http.StatusInternalServerError, fmt.Sprintf("Error creating authorization code: %v", err))
+		return
+	}
+	now := time.Now().UTC()
+	err = config.db.CreateAuthorizationCode(code, database.AuthorizationCode{
+		ClientId:      client.Id,
+		UserId:        user.Id,
+		RedirectURI:   authRequest.RedirectURI,
+		Scopes:        authRequest.Scopes,
+		CodeChallenge: authRequest.CodeChallenge,
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(time.Second * time.Duration(authorizationCodeTimeoutSeconds)),
+	})
+	if err != nil {
+		showOAuthError(writer, http.StatusInternalServerError, fmt.Sprintf("Error creating authorization code: %v", err))
+		return
+	}
+	request = withPrincipal(request, principal{UserId: user.Id, Role: user.Role})
+	config.audit(request, "oauth.authorize", "oauth_client:"+client.Id, fmt.Sprintf("Granted %q %s", client.Name, strings.Join(authRequest.Scopes, " ")))
+	redirectToClient(writer, request, authRequest.RedirectURI, url.Values{"code": {code}, "state": {authRequest.State}})
+}
+
+func respondWithOAuthError(writer http.ResponseWriter, status int, code string, description string) {
+	if status == http.StatusUnauthorized {
+		writer.Header().Set("WWW-Authenticate", `Basic realm="chirpy"`)
+	}
+	data, _ := json.Marshal(oauthError{Error: code, Description: description})
+	writer.WriteHeader(status)
+	writer.Write(data)
+}
+
+// Authenticates the client making a token or revocation request, with HTTP Basic auth or the `client_id` and `client_secret` form fields.
+//
+//	Responds with an `invalid_client` error and returns false if the client can't be authenticated
+func (config *apiConfig) authenticateClient(writer http.ResponseWriter, request *http.Request) (database.OAuthClient, bool) {
+	id, secret, basic := request.BasicAuth()
+	if basic {
+		// RFC 6749 has clients form-encode their credentials before Basic encoding them
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		id, secret = request.PostForm.Get("client_id"), request.PostForm.Get("client_secret")
+	}
+	client, err := config.db.ValidateOAuthClient(id, secret)
+	if err == database.ErrInvalidClient {
+		respondWithOAuthError(writer, http.StatusUnauthorized, "invalid_client", "Invalid client credentials")
+		return database.OAuthClient{}, false
+	}
+	if err != nil {
+		respondWithOAuthError(writer, http.StatusInternalServerError, "server_error", fmt.Sprintf("Error validating client: %v", err))
+		return database.OAuthClient{}, false
+	}
+	return client, true
+}
+
+// Trades an authorization code or refresh token for a new access token and refresh token, limited to the scopes the user approved
+func (config *apiConfig) OAuthToken(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.Header().Set("Pragma", "no-cache")
+
+	err := request.ParseForm()
+	if err != nil {
+		respondWithOAuthError(writer, http.StatusBadRequest, "invalid_request", "Invalid form")
+		return
+	}
+	client, ok := config.authenticateClient(writer, request)
+	if !ok {
+		return
+	}
+
+	switch request.PostForm.Get("grant_type") {
+	case "authorization_code":
+		config.grantAuthorizationCode(writer, request, client)
+	case "refresh_token":
+		config.grantRefreshToken(writer, request, client)
+	default:
+		respondWithOAuthError(writer, http.StatusBadRequest, "unsupported_grant_type", "Use authorization_code or refresh_token")
+	}
+}
+
+// Trades an authorization code for tokens, after checking it was issued to the client for the same redirect URI and that the PKCE verifier matches.
+//
+//	The code is only used up once those checks pass, so a client that sees someone else's code can't burn it.
+//	A code used a second time has been stolen or replayed, so the tokens it was first traded for are revoked
+func (config *apiConfig) grantAuthorizationCode(writer http.ResponseWriter, request *http.Request, client database.OAuthClient) {
+	code := request.PostForm.Get("code")
+	authorizationCode, found, err := config.db.GetAuthorizationCode(code)
+	if err != nil {
+		respondWithOAuthError(writer, http.StatusInternalServerError, "server_error", fmt.Sprintf("Error getting authorization code: %v", err))
+		return
+	}
+	if !found {
+		respondWithOAuthError(writer, http.StatusBadRequest, "invalid_grant", "Invalid or expired authorization code")
+		return
+	}
+	if authorizationCode.FamilyId != "" {
+		config.revokeReusedAuthorizationCode(request, client, authorizationCode.FamilyId)
+		respondWithOAuthError(writer, http.StatusBadRequest, "invalid_grant", "Invalid or expired authorization code")
+		return
+	}
+	now := time.Now().UTC()
+	if !now.Before(authorizationCode.ExpiresAt) || authorizationCode.ClientId != client.Id || authorizationCode.RedirectURI != request.PostForm.Get("redirect_uri") {
+		respondWithOAuthError(writer, http.StatusBadRequest, "invalid_grant", "Invalid or expired authorization code")
+		return
+	}
+	verifier := request.PostForm.Get("code_verifier")
+	if len(verifier) < minCodeVerifierLength || len(verifier) > maxCodeVerifierLength ||
+		subtle.ConstantTimeCompare([]byte(pkceChallenge(verifier)), []byte(authorizationCode.CodeChallenge)) != 1 {
+		respondWithOAuthError(writer, http.StatusBadRequest, "invalid_grant", "Code verifier doesn't match the code challenge")
+		return
+	}
+
+	user, found, err := config.db.GetUser(authorizationCode.UserId)
+	if err != nil {
+		respondWithOAuthError(writer, http.StatusInternalServerError, "server_error", fmt.Sprintf("Error getting user: %v", err))
+		return
+	}
+	if !found || user.Disabled {
+		respondWithOAuthError(writer, http.StatusBadRequest, "invalid_grant", "Invalid or expired authorization code")
+		return
+	}
+	scope := strings.Join(authorizationCode.Scopes, " ")
+	refreshToken, sessionId, err := config.createGrantRefreshToken(user.Id, request, client.Id, scope)
+	if err != nil {
+		respondWithOAuthError(writer, http.StatusInternalServerError, "server_error", fmt.Sprintf("Error creating refresh token: %v", err))
+		return
+	}
+
+	// The tokens are only handed out once the code is used up with their family, so if another request used it first, both are revoked
+	used, err := config.db.ConsumeAuthorizationCode(code, now, sessionId)
+	if err != nil {
+		_, revokeErr := config.db.DeleteRefreshTokenFamily(sessionId)
+		if revokeErr != nil {
+			log.Printf("Error revoking unused token family %s: %v", sessionId, revokeErr)
+		}
+	}
+	if err == database.ErrAuthorizationCodeReused {
+		config.revokeReusedAuthorizationCode(request, client, used.FamilyId)
+		respondWithOAuthError(writer, http.StatusBadRequest, "invalid_grant", "Invalid or expired authorization code")
+		return
+	}
+	if err == database.ErrAuthorizationCodeNotFound || err == database.ErrAuthorizationCodeExpired {
+		respondWithOAuthError(writer, http.StatusBadRequest, "invalid_grant", "Invalid or expired authorization code")
+		return
+	}
+	if err != nil {
+		respondWithOAuthError(writer, http.StatusInternalServerError, "server_error", fmt.Sprintf("Error using authorization code: %v", err))
+		return
+	}
+	config.respondWithGrant(writer, user, sessionId, refreshToken, client.Id, scope)
+}
+
+// Revokes the refresh token family an authorization code was first traded for, after the code was used again
+func (config *apiConfig) revokeReusedAuthorizationCode(request *http.Request, client database.OAuthClient, familyId string) {
+	if familyId == "" {
+		return
+	}
+	revoked, err := config.db.DeleteRefreshTokenFamily(familyId)
+	if err != nil {
+		log.Printf("Error revoking token family %s after its authorization code was reused: %v", familyId, err)
+		return
+	}
+	log.Printf("SECURITY: reused authorization code presented by OAuth client %s from %s. Revoked token family %s (%d tokens)",
+		client.Id, request.RemoteAddr, familyId, revoked)
+}
+
+// Trades a refresh token issued to the client for new tokens with the same scopes, rotating it like /api/refresh
+func (config *apiConfig) grantRefreshToken(writer http.ResponseWriter, request *http.Request, client database.OAuthClient) {
+	token := request.PostForm.Get("refresh_token")
+	current, found, err := config.db.GetRefreshToken(token)
+	if err != nil {
+		respondWithOAuthError(writer, http.StatusInternalServerError, "server_error", fmt.Sprintf("Error getting refresh token: %v", err))
+		return
+	}
+	if !found || current.ClientId != client.Id {
+		respondWithOAuthError(writer, http.StatusBadRequest, "invalid_grant", "Invalid refresh token")
+		return
+	}
+
+	newRefreshToken, err := randomToken()
+	if err != nil {
+		respondWithOAuthError(writer, http.StatusInternalServerError, "server_error", fmt.Sprintf("Error creating refresh token: %v", err))
+		return
+	}
+	now := time.Now().UTC()
+	refreshToken, err := config.db.RotateRefreshToken(token, newRefreshToken, database.RefreshToken{
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Second * time.Duration(refreshTokenTimeoutSeconds)),
+		UserAgent: request.UserAgent(),
+		IpAddress: clientIp(request),
+	})
+	if err == database.ErrRefreshTokenReused {
+		log.Printf("SECURITY: reused refresh token for user %d by OAuth client %s from %s. Revoked token family %s",
+			refreshToken.UserId, client.Id, request.RemoteAddr, refreshToken.FamilyId)
+		respondWithOAuthError(writer, http.StatusBadRequest, "invalid_grant", "Invalid refresh token")
+		return
+	}
+	if err == database.ErrRefreshTokenNotFound || err == database.ErrRefreshTokenExpired {
+		respondWithOAuthError(writer, http.StatusBadRequest, "invalid_grant", "Invalid refresh token")
+		return
+	}
+	if err != nil {
+		respondWithOAuthError(writer, http.StatusInternalServerError, "server_error", fmt.Sprintf("Error rotating refresh token: %v", err))
+		return
+	}
+
+	user, found, err := config.db.GetUser(refreshToken.UserId)
+	if err != nil {
+		respondWithOAuthError(writer, http.StatusInternalServerError, "server_error", fmt.Sprintf("Error getting user: %v", err))
+		return
+	}
+	if !found || user.Disabled {
+		respondWithOAuthError(writer, http.StatusBadRequest, "invalid_grant", "Invalid refresh token")
+		return
+	}
+	config.respondWithGrant(writer, user, refreshToken.FamilyId, newRefreshToken, client.Id, refreshToken.Scope)
+}
+
+// Responds with an access token for the client's session, limited to the space separated `scope`, and the session's refresh token
+func (config *apiConfig) respondWithGrant(writer http.ResponseWriter, user database.User, sessionId string, refreshToken string, clientId string, scope string) {
+	type tokenResponse struct {
+		AccessToken  string `json:"access_token"`
+		TokenType    string `json:"token_type"`
+		ExpiresIn    int    `json:"expires_in"`
+		RefreshToken string `json:"refresh_token"`
+		Scope        string `json:"scope"`
+	}
+
+	claims := newAccessClaims(accessTokenIssuer, accessTokenTimeoutSeconds, user, sessionId)
+	claims.ClientId = clientId
+	claims.Scope = scope
+	accessToken, err := config.keyring.sign(claims)
+	if err != nil {
+		respondWithOAuthError(writer, http.StatusInternalServerError, "server_error", fmt.Sprintf("Error creating access token: %v", err))
+		return
+	}
+	respondWithSuccess(writer, http.StatusOK, tokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    bearerScheme,
+		ExpiresIn:    accessTokenTimeoutSeconds,
+		RefreshToken: refreshToken,
+		Scope:        scope,
+	})
+}
+
+// Revokes a refresh token or access token issued to the client, along with every other token from the same grant.
+//
+//	Responds with success for tokens that are already invalid or weren't issued to the client, as RFC 7009 requires
+func (config *apiConfig) RevokeOAuthToken(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+
+	err := request.ParseForm()
+	if err != nil {
+		respondWithOAuthError(writer, http.StatusBadRequest, "invalid_request", "Invalid form")
+		return
+	}
+	client, ok := config.authenticateClient(writer, request)
+	if !ok {
+		return
+	}
+
+	token := request.PostForm.Get("token")
+	sessionId := ""
+	refreshToken, found, err := config.db.GetRefreshToken(token)
+	if err != nil {
+		respondWithOAuthError(writer, http.StatusInternalServerError, "server_error", fmt.Sprintf("Error getting refresh token: %v", err))
+		return
+	}
+	if found && refreshToken.ClientId == client.Id {
+		sessionId = refreshToken.FamilyId
+	} else if caller, _, err := config.authenticateAccessToken(token); err == nil && caller.ClientId == client.Id {
+		sessionId = caller.SessionId
+	}
+	if sessionId != "" {
+		_, err = config.db.DeleteRefreshTokenFamily(sessionId)
+		if err != nil {
+			respondWithOAuthError(writer, http.StatusInternalServerError, "server_error", fmt.Sprintf("Error revoking token: %v", err))
+			return
+		}
+	}
+	respondWithSuccess(writer, http.StatusOK, struct{}{})
+}
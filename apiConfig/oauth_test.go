@@ -0,0 +1,262 @@
+package apiConfig
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/trolfu/boot-dev-web-servers-course/database"
+)
+
+func TestValidRedirectURI(t *testing.T) {
+	for redirectURI, valid := range map[string]bool{
+		"https://app.example.com/callback":   true,
+		"http://127.0.0.1:8000/callback":     true,
+		"http://localhost/callback":          true,
+		"http://app.example.com/callback":    false,
+		"https://app.example.com/callback#x": false,
+		"/callback":                          false,
+		"javascript:alert(1)":                false,
+	} {
+		err := validRedirectURI(redirectURI)
+		if (err == nil) != valid {
+			t.Fatalf("Expected %q valid: %v, actual error: %v", redirectURI, valid, err)
+		}
+	}
+}
+
+// A third-party app using Chirpy's authorization server, with a callback that records what Chirpy redirects back with
+type fakeOAuthClient struct {
+	id          string
+	secret      string
+	redirectURI string
+	callbacks   chan url.Values
+}
+
+func newFakeOAuthClient(t *testing.T, config apiConfig, ownerId int) fakeOAuthClient {
+	callbacks := make(chan url.Values, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		callbacks <- request.URL.Query()
+	}))
+	t.Cleanup(server.Close)
+
+	created := struct {
+		database.OAuthClient
+		ClientSecret string `json:"client_secret"`
+	}{}
+	response := sendAs(config, config.CreateOAuthClient, ownerId, `{"name": "Fake App", "redirect_uris": ["`+server.URL+`/callback"], "confidential": true}`)
+	if response.Code != http.StatusCreated {
+		t.Fatalf("Error registering client: %v %s", response.Code, response.Body)
+	}
+	err := json.NewDecoder(response.Body).Decode(&created)
+	if err != nil {
+		t.Fatalf("Error decoding client: %v", err)
+	}
+	if created.ClientSecret == "" {
+		t.Fatal("Confidential client registered without a secret")
+	}
+	return fakeOAuthClient{id: created.Id, secret: created.ClientSecret, redirectURI: server.URL + "/callback", callbacks: callbacks}
+}
+
+// Approves or denies an authorization request on the consent page, returning what the client's callback received
+func (client fakeOAuthClient) authorize(t *testing.T, chirpy *httptest.Server, form url.Values) url.Values {
+	response, err := http.PostForm(chirpy.URL+"/oauth/authorize", form)
+	if err != nil {
+		t.Fatalf("Error submitting consent form: %v", err)
+	}
+	response.Body.Close()
+	select {
+	case callback := <-client.callbacks:
+		return callback
+	default:
+		t.Fatalf("Client wasn't redirected to: %v", response.StatusCode)
+		return nil
+	}
+}
+
+// Sends a request to the token or revocation endpoint, authenticated with the client's credentials
+func (client fakeOAuthClient) post(t *testing.T, endpoint string, form url.Values) (int, map[string]interface{}) {
+	request, _ := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.SetBasicAuth(client.id, client.secret)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("Error calling %s: %v", endpoint, err)
+	}
+	defer response.Body.Close()
+	body := map[string]interface{}{}
+	json.NewDecoder(response.Body).Decode(&body)
+	return response.StatusCode, body
+}
+
+// Calls the API with an access token
+func callWithToken(t *testing.T, method string, endpoint string, accessToken string, body string) int {
+	request, _ := http.NewRequest(method, endpoint, strings.NewReader(body))
+	request.Header.Set("Authorization", "Bearer "+accessToken)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("Error calling %s: %v", endpoint, err)
+	}
+	response.Body.Close()
+	return response.StatusCode
+}
+
+func TestOAuthAuthorizationCodeFlow(t *testing.T) {
+	config, _, _ := newTestAuthConfig(t)
+	user, err := config.db.CreateUser("oauth@example.com", "password")
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+
+	router := chi.NewRouter()
+	router.Get("/oauth/authorize", config.Authorize)
+	router.Post("/oauth/authorize", config.ApproveAuthorization)
+	router.Post("/oauth/token", config.OAuthToken)
+	router.Post("/oauth/revoke", config.RevokeOAuthToken)
+	router.Group(func(authRouter chi.Router) {
+		authRouter.Use(config.MiddlewareRequireAuth)
+		authRouter.With(config.MiddlewareRequireScope(database.ScopeChirpsWrite)).Post("/api/chirps", config.CreateChirp)
+		authRouter.With(config.MiddlewareRequireScope(database.ScopeProfileWrite)).Put("/api/users", config.UpdateUser)
+	})
+	router.With(config.MiddlewareRequireRefreshToken).Post("/api/refresh", config.RefreshAuth)
+	chirpy := httptest.NewServer(router)
+	defer chirpy.Close()
+
+	client := newFakeOAuthClient(t, config, user.Id)
+	verifier := strings.Repeat("v", minCodeVerifierLength)
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {client.id},
+		"redirect_uri":          {client.redirectURI},
+		"scope":                 {database.ScopeChirpsWrite},
+		"state":                 {"xyz"},
+		"code_challenge":        {pkceChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	withParams := func(extra url.Values) url.Values {
+		form := url.Values{}
+		for key, values := range params {
+			form[key] = values
+		}
+		for key, values := range extra {
+			form[key] = values
+		}
+		return form
+	}
+
+	// Errors before the redirect URI is known are shown to the user, later ones go back to the client
+	response, err := http.Get(chirpy.URL + "/oauth/authorize?" + withParams(url.Values{"redirect_uri": {"https://evil.example.com/"}}).Encode())
+	if err != nil || response.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected an unregistered redirect URI to be shown as an error: %v, %v", response.StatusCode, err)
+	}
+	response, err = http.Get(chirpy.URL + "/oauth/authorize?" + withParams(url.Values{"scope": {"admin"}}).Encode())
+	if err != nil {
+		t.Fatalf("Error starting authorization: %v", err)
+	}
+	if callback := <-client.callbacks; callback.Get("error") != "invalid_scope" || callback.Get("state") != "xyz" {
+		t.Fatalf("Expected an invalid scope error, actual: %v", callback)
+	}
+	response, err = http.Get(chirpy.URL + "/oauth/authorize?" + params.Encode())
+	if err != nil || response.StatusCode != http.StatusOK || response.Header.Get("X-Frame-Options") != "DENY" {
+		t.Fatalf("Error showing consent page: %v, %v", response.StatusCode, err)
+	}
+
+	callback := client.authorize(t, chirpy, withParams(url.Values{"action": {"deny"}}))
+	if callback.Get("error") != "access_denied" || callback.Get("code") != "" {
+		t.Fatalf("Expected a denied request to be reported to the client, actual: %v", callback)
+	}
+	response, err = http.PostForm(chirpy.URL+"/oauth/authorize", withParams(url.Values{"action": {"approve"}, "email": {user.Email}, "password": {"wrong"}}))
+	if err != nil || response.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected a wrong password to be rejected: %v, %v", response.StatusCode, err)
+	}
+
+	// Failed exchanges don't use the code up, so another client that sees it can't burn it
+	approve := withParams(url.Values{"action": {"approve"}, "email": {user.Email}, "password": {"password"}})
+	callback = client.authorize(t, chirpy, approve)
+	if callback.Get("state") != "xyz" || callback.Get("code") == "" {
+		t.Fatalf("Expected a code and the state, actual: %v", callback)
+	}
+	exchange := url.Values{"grant_type": {"authorization_code"}, "code": {callback.Get("code")}, "redirect_uri": {client.redirectURI}, "code_verifier": {strings.Repeat("w", minCodeVerifierLength)}}
+	status, body := client.post(t, chirpy.URL+"/oauth/token", exchange)
+	if status != http.StatusBadRequest || body["error"] != "invalid_grant" {
+		t.Fatalf("Expected a wrong verifier to be rejected: %v, %v", status, body)
+	}
+	exchange.Set("code_verifier", verifier)
+	other := newFakeOAuthClient(t, config, user.Id)
+	status, body = other.post(t, chirpy.URL+"/oauth/token", exchange)
+	if status != http.StatusBadRequest || body["error"] != "invalid_grant" {
+		t.Fatalf("Expected another client's code to be rejected: %v, %v", status, body)
+	}
+	wrongSecret := client
+	wrongSecret.secret = "wrong"
+	status, body = wrongSecret.post(t, chirpy.URL+"/oauth/token", exchange)
+	if status != http.StatusUnauthorized || body["error"] != "invalid_client" {
+		t.Fatalf("Expected a wrong client secret to be rejected: %v, %v", status, body)
+	}
+	status, body = client.post(t, chirpy.URL+"/oauth/token", exchange)
+	if status != http.StatusOK || body["scope"] != database.ScopeChirpsWrite || body["token_type"] != "Bearer" {
+		t.Fatalf("Error exchanging code: %v, %v", status, body)
+	}
+	accessToken, _ := body["access_token"].(string)
+	refreshToken, _ := body["refresh_token"].(string)
+
+	if status = callWithToken(t, http.MethodPost, chirpy.URL+"/api/chirps", accessToken, `{"body": "Posted by an app"}`); status != http.StatusCreated {
+		t.Fatalf("Error posting chirp with a granted scope: %v", status)
+	}
+	if status = callWithToken(t, http.MethodPut, chirpy.URL+"/api/users", accessToken, `{"email": "stolen@example.com", "password": "password"}`); status != http.StatusForbidden {
+		t.Fatalf("Expected a scope that wasn't granted to be forbidden, actual: %v", status)
+	}
+	// Refreshing at /api/refresh would drop the scopes
+	if status = callWithToken(t, http.MethodPost, chirpy.URL+"/api/refresh", refreshToken, ""); status != http.StatusUnauthorized {
+		t.Fatalf("Expected a client's refresh token to be rejected at /api/refresh, actual: %v", status)
+	}
+
+	status, body = client.post(t, chirpy.URL+"/oauth/token", url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refreshToken}})
+	if status != http.StatusOK || body["scope"] != database.ScopeChirpsWrite || body["refresh_token"] == refreshToken {
+		t.Fatalf("Error refreshing tokens: %v, %v", status, body)
+	}
+	accessToken, _ = body["access_token"].(string)
+	refreshToken, _ = body["refresh_token"].(string)
+
+	status, _ = client.post(t, chirpy.URL+"/oauth/revoke", url.Values{"token": {refreshToken}})
+	if status != http.StatusOK {
+		t.Fatalf("Error revoking token: %v", status)
+	}
+	if status = callWithToken(t, http.MethodPost, chirpy.URL+"/api/chirps", accessToken, `{"body": "Posted by an app"}`); status != http.StatusUnauthorized {
+		t.Fatalf("Expected a revoked grant's access token to be unauthorized, actual: %v", status)
+	}
+	status, body = client.post(t, chirpy.URL+"/oauth/token", url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refreshToken}})
+	if status != http.StatusBadRequest || body["error"] != "invalid_grant" {
+		t.Fatalf("Expected a revoked refresh token to be rejected: %v, %v", status, body)
+	}
+	// Revoking an unknown token still succeeds
+	status, _ = client.post(t, chirpy.URL+"/oauth/revoke", url.Values{"token": {"unknown"}})
+	if status != http.StatusOK {
+		t.Fatalf("Expected revoking an unknown token to succeed, actual: %v", status)
+	}
+
+	// A code used twice has been stolen or replayed, so the tokens it was traded for are revoked
+	callback = client.authorize(t, chirpy, approve)
+	exchange.Set("code", callback.Get("code"))
+	status, body = client.post(t, chirpy.URL+"/oauth/token", exchange)
+	if status != http.StatusOK {
+		t.Fatalf("Error exchanging code: %v, %v", status, body)
+	}
+	accessToken, _ = body["access_token"].(string)
+	refreshToken, _ = body["refresh_token"].(string)
+	status, body = client.post(t, chirpy.URL+"/oauth/token", exchange)
+	if status != http.StatusBadRequest || body["error"] != "invalid_grant" {
+		t.Fatalf("Expected a used code to be rejected: %v, %v", status, body)
+	}
+	if status = callWithToken(t, http.MethodPost, chirpy.URL+"/api/chirps", accessToken, `{"body": "Posted by an app"}`); status != http.StatusUnauthorized {
+		t.Fatalf("Expected the replayed code's access token to be revoked, actual: %v", status)
+	}
+	status, body = client.post(t, chirpy.URL+"/oauth/token", url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refreshToken}})
+	if status != http.StatusBadRequest || body["error"] != "invalid_grant" {
+		t.Fatalf("Expected the replayed code's refresh token to be revoked: %v, %v", status, body)
+	}
+}
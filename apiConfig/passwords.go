@@ -0,0 +1,159 @@
+package apiConfig
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/trolfu/boot-dev-web-servers-course/database"
+	"github.com/trolfu/boot-dev-web-servers-course/mailer"
+)
+
+var passwordResetTimeoutSeconds = 60 * 30 // 30 min
+
+// Passwords are hashed on every login, so very long ones are refused to keep that cheap
+const maxPasswordLength = 256
+
+// What new passwords have to satisfy. A password can never be the user's email
+type PasswordPolicy struct {
+	MinLength    int  // In characters
+	RejectCommon bool // Refuse passwords on the bundled list of common passwords
+}
+
+var DefaultPasswordPolicy = PasswordPolicy{MinLength: 8, RejectCommon: true}
+
+//go:embed common_passwords.txt
+var commonPasswordList string
+
+// The bundled common passwords, lowercased
+var commonPasswords = sync.OnceValue(func() map[string]bool {
+	passwords := map[string]bool{}
+	for _, password := range strings.Split(commonPasswordList, "\n") {
+		if password = strings.TrimSpace(password); password != "" {
+			passwords[strings.ToLower(password)] = true
+		}
+	}
+	return passwords
+})
+
+// Checks a new password for the user with `email` against the policy.
+//
+//	Returns a message for the user saying what's wrong, or an empty string if the password is allowed
+func (policy PasswordPolicy) check(password string, email string) string {
+	length := utf8.RuneCountInString(password)
+	if length < policy.MinLength {
+		return fmt.Sprintf("Password must be at least %d characters", policy.MinLength)
+	}
+	if length > maxPasswordLength {
+		return fmt.Sprintf("Password must be at most %d characters", maxPasswordLength)
+	}
+	if strings.EqualFold(password, email) {
+		return "Password can't be your email"
+	}
+	if policy.RejectCommon && commonPasswords()[strings.ToLower(password)] {
+		return "Password is too common"
+	}
+	return ""
+}
+
+// Emails a password reset token to the user with the email in the request body.
+//
+//	Always responds with 202 Accepted, whether or not the account exists, so the endpoint can't be used to find accounts.
+//	The token is created and sent in the background for the same reason
+func (config *apiConfig) RequestPasswordReset(writer http.ResponseWriter, request *http.Request) {
+	type resetRequest struct {
+		Email string `json:"email"`
+	}
+	writer.Header().Set("Content-Type", "application/json")
+
+	body := resetRequest{}
+	err := json.NewDecoder(request.Body).Decode(&body)
+	if err != nil || body.Email == "" {
+		respondWithError(writer, http.StatusBadRequest, "An email is required")
+		return
+	}
+
+	go func() {
+		err := config.sendPasswordReset(body.Email)
+		if err != nil {
+			log.Printf("Error sending password reset: %v", err)
+		}
+	}()
+	respondWithSuccess(writer, http.StatusAccepted, struct{}{})
+}
+
+// Creates a password reset token for the user with `email`, if there is one, and emails it to them
+func (config *apiConfig) sendPasswordReset(email string) error {
+	user, found, err := config.db.GetUserByEmail(email)
+	if err != nil || !found {
+		return err
+	}
+
+	token, err := config.createOneTimeToken(user.Id, database.PurposePasswordReset, user.Email, passwordResetTimeoutSeconds)
+	if err != nil {
+		return err
+	}
+
+	return config.mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your Chirpy password",
+		Body: fmt.Sprintf("Someone asked to reset the password for your Chirpy account. If it wasn't you, you can ignore this email.\n\n"+
+			"To choose a new password, send this token to /api/password-reset/confirm within %d minutes:\n\n%s\n",
+			passwordResetTimeoutSeconds/60, token),
+	})
+}
+
+// Sets a new password using a password reset token, then revokes every one of the user's sessions
+func (config *apiConfig) ConfirmPasswordReset(writer http.ResponseWriter, request *http.Request) {
+	type confirmRequest struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	writer.Header().Set("Content-Type", "application/json")
+
+	body := confirmRequest{}
+	err := json.NewDecoder(request.Body).Decode(&body)
+	if err != nil || body.Token == "" || body.Password == "" {
+		respondWithError(writer, http.StatusBadRequest, "A token and a new password are required")
+		return
+	}
+
+	// The email is only known once the token is used, so it's checked separately after
+	if problem := config.passwordPolicy.check(body.Password, ""); problem != "" {
+		respondWithError(writer, http.StatusBadRequest, problem)
+		return
+	}
+
+	resetToken, err := config.db.ConsumeOneTimeToken(body.Token, database.PurposePasswordReset, time.Now().UTC())
+	if err == database.ErrOneTimeTokenNotFound || err == database.ErrOneTimeTokenExpired {
+		respondWithError(writer, http.StatusBadRequest, "Invalid or expired password reset token")
+		return
+	}
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error using password reset token: %v", err))
+		return
+	}
+	if problem := config.passwordPolicy.check(body.Password, resetToken.Email); problem != "" {
+		respondWithError(writer, http.StatusBadRequest, problem+". Request a new password reset to try again")
+		return
+	}
+
+	_, err = config.db.UpdateUser(resetToken.UserId, "", body.Password)
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error updating password: %v", err))
+		return
+	}
+	// Whoever knew the old password may still be logged in
+	_, err = config.db.DeleteUserSessions(resetToken.UserId)
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error revoking sessions: %v", err))
+		return
+	}
+	respondWithSuccess(writer, http.StatusOK, struct{}{})
+}
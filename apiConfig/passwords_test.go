@@ -0,0 +1,99 @@
+package apiConfig
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/trolfu/boot-dev-web-servers-course/mailer"
+)
+
+// Keeps sent messages in memory so tests can read them
+type recordingMailer struct {
+	mux      *sync.Mutex
+	messages []mailer.Message
+}
+
+func (recorder *recordingMailer) Send(message mailer.Message) error {
+	recorder.mux.Lock()
+	defer recorder.mux.Unlock()
+	recorder.messages = append(recorder.messages, message)
+	return nil
+}
+
+// Posts a JSON body to a handler and returns the response status
+func postJSON(handler http.HandlerFunc, body string) int {
+	request := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	recorder := httptest.NewRecorder()
+	handler(recorder, request)
+	return recorder.Code
+}
+
+func TestPasswordReset(t *testing.T) {
+	config, sessionId, _ := newTestAuthConfig(t)
+	recorder := &recordingMailer{mux: &sync.Mutex{}}
+	config.mailer = recorder
+	user, err := config.db.CreateUser("reset@example.com", "old-password")
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	// The test config's session belongs to user 1
+	if user.Id != 1 {
+		t.Fatalf("Expected the first user to have id 1, got %d", user.Id)
+	}
+
+	err = config.sendPasswordReset("missing@example.com")
+	if err != nil || len(recorder.messages) != 0 {
+		t.Fatalf("Reset for a missing account sent mail: %v, %v", err, recorder.messages)
+	}
+
+	err = config.sendPasswordReset(user.Email)
+	if err != nil {
+		t.Fatalf("Error sending password reset: %v", err)
+	}
+	if len(recorder.messages) != 1 || recorder.messages[0].To != user.Email {
+		t.Fatalf("Expected one reset email to %s, got %+v", user.Email, recorder.messages)
+	}
+	lines := strings.Split(strings.TrimSpace(recorder.messages[0].Body), "\n")
+	token := lines[len(lines)-1]
+
+	status := postJSON(config.ConfirmPasswordReset, `{"token": "wrong", "password": "new-password"}`)
+	if status != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for an unknown token, got %d", status)
+	}
+	status = postJSON(config.ConfirmPasswordReset, `{"token": "`+token+`", "password": "new-password"}`)
+	if status != http.StatusOK {
+		t.Fatalf("Expected 200 for the reset token, got %d", status)
+	}
+	status = postJSON(config.ConfirmPasswordReset, `{"token": "`+token+`", "password": "another-password"}`)
+	if status != http.StatusBadRequest {
+		t.Fatalf("Expected a used token to be rejected, got %d", status)
+	}
+
+	_, err = config.db.ValidateCredentials(user.Email, "new-password")
+	if err != nil {
+		t.Fatalf("New password rejected: %v", err)
+	}
+	_, found, err := config.db.GetSession(sessionId)
+	if err != nil || found {
+		t.Fatalf("Expected the user's sessions to be revoked: %v, %v", found, err)
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	policy := DefaultPasswordPolicy
+	rejected := []string{"", "short", "Password123", "QWERTYUIOP", "Someone@Example.com", strings.Repeat("a", maxPasswordLength+1)}
+	for _, password := range rejected {
+		if policy.check(password, "someone@example.com") == "" {
+			t.Fatalf("Password %q allowed", password)
+		}
+	}
+	if problem := policy.check("plenty of entropy here", "someone@example.com"); problem != "" {
+		t.Fatalf("Good password rejected: %s", problem)
+	}
+	if problem := (PasswordPolicy{MinLength: 4}).check("password", "someone@example.com"); problem != "" {
+		t.Fatalf("Common password rejected with the common password check off: %s", problem)
+	}
+}
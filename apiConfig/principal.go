@@ -0,0 +1,282 @@
+// Authenticates requests and passes the caller to handlers through the request context
+
+package apiConfig
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Authorization header schemes
+const (
+	bearerScheme = "Bearer"
+	apiKeyScheme = "ApiKey"
+)
+
+// The authenticated caller of a request
+type principal struct {
+	UserId    int
+	Role      string // Read from the access token, so a role change applies once the caller refreshes
+	SessionId string // The refresh token family the caller's credentials were issued from
+	// The plaintext refresh token presented to a refresh-token-only route. Empty for access tokens
+	RefreshToken string
+	// What the caller's credentials allow. nil for access tokens from a login, which allow everything the user can do
+	Scopes   []string
+	ApiKeyId string // The personal API key the caller authenticated with, if any
+	ClientId string // The OAuth client the caller's access token was issued to, if any
+	Cookie   bool   // The caller authenticated with a browser session's cookies rather than a header
+}
+
+type principalContextKey struct{}
+
+// Claims carried by access tokens
+type accessClaims struct {
+	jwt.RegisteredClaims
+	SessionId string `json:"sid"` // The refresh token family the access token was issued from
+	Role      string `json:"role"`
+	// The OAuth client the access token was issued to, and the space separated scopes it's limited to. Empty for logins
+	ClientId string `json:"client_id,omitempty"`
+	Scope    string `json:"scope,omitempty"`
+}
+
+// Gets the caller authenticated by the auth middleware.
+//
+//	`found` is false if the route allows anonymous requests and the caller didn't authenticate
+func principalFrom(request *http.Request) (caller principal, found bool) {
+	caller, found = request.Context().Value(principalContextKey{}).(principal)
+	return caller, found
+}
+
+func withPrincipal(request *http.Request, caller principal) *http.Request {
+	return request.WithContext(context.WithValue(request.Context(), principalContextKey{}, caller))
+}
+
+// Checks if the caller's credentials grant `scope`
+func (caller principal) allows(scope string) bool {
+	return caller.Scopes == nil || slices.Contains(caller.Scopes, scope)
+}
+
+// Rejects requests without a valid access token or API key, from the authorization header or a session cookie
+func (config *apiConfig) MiddlewareRequireAuth(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		caller, found, status, err := config.authenticateRequest(request)
+		if !found {
+			respondUnauthorized(writer, "Missing authorization")
+			return
+		}
+		if err != nil {
+			respondAuthError(writer, status, err)
+			return
+		}
+		handler.ServeHTTP(writer, withPrincipal(request, caller))
+	})
+}
+
+// Authenticates requests with an access token or API key, and passes requests without one through anonymously.
+//
+//	Credentials that are present but invalid are still rejected
+func (config *apiConfig) MiddlewareOptionalAuth(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		caller, found, status, err := config.authenticateRequest(request)
+		if !found {
+			handler.ServeHTTP(writer, request)
+			return
+		}
+		if err != nil {
+			respondAuthError(writer, status, err)
+			return
+		}
+		handler.ServeHTTP(writer, withPrincipal(request, caller))
+	})
+}
+
+// Rejects callers whose credentials don't grant `scope`. Must run after `MiddlewareRequireAuth`
+func (config *apiConfig) MiddlewareRequireScope(scope string) func(http.Handler) http.Handler {
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			caller, found := principalFrom(request)
+			if !found {
+				respondUnauthorized(writer, "Missing authorization")
+				return
+			}
+			if !caller.allows(scope) {
+				writer.Header().Set("Content-Type", "application/json")
+				respondWithError(writer, http.StatusForbidden, fmt.Sprintf("Missing scope %s", scope))
+				return
+			}
+			handler.ServeHTTP(writer, request)
+		})
+	}
+}
+
+// Rejects callers with scoped credentials, like API keys, for routes that manage the account itself.
+//
+//	Must run after `MiddlewareRequireAuth`
+func (config *apiConfig) MiddlewareRequireFullAccess(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		caller, found := principalFrom(request)
+		if !found {
+			respondUnauthorized(writer, "Missing authorization")
+			return
+		}
+		if caller.Scopes != nil {
+			writer.Header().Set("Content-Type", "application/json")
+			respondWithError(writer, http.StatusForbidden, "Log in to use this route. API keys aren't accepted")
+			return
+		}
+		handler.ServeHTTP(writer, request)
+	})
+}
+
+// Rejects requests without an unexpired refresh token, from the authorization header or the refresh cookie. Access tokens aren't accepted.
+//
+//	Refresh tokens that were already rotated are let through, so the handler can detect their reuse
+func (config *apiConfig) MiddlewareRequireRefreshToken(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		token, found := bearerToken(request)
+		fromCookie := false
+		if cookie, err := request.Cookie(refreshCookieName); !found && err == nil && cookie.Value != "" {
+			token, found, fromCookie = cookie.Value, true, true
+		}
+		if !found {
+			respondUnauthorized(writer, "Missing authorization")
+			return
+		}
+		if fromCookie {
+			err := checkCSRF(request)
+			if err != nil {
+				respondAuthError(writer, http.StatusForbidden, err)
+				return
+			}
+		}
+		refreshToken, found, err := config.db.GetRefreshToken(token)
+		if err != nil {
+			respondAuthError(writer, http.StatusInternalServerError, fmt.Errorf("Error getting refresh token: %w", err))
+			return
+		}
+		// Tokens issued to OAuth clients are only refreshed at /oauth/token, which keeps them limited to their scopes
+		if !found || !time.Now().Before(refreshToken.ExpiresAt) || refreshToken.ClientId != "" {
+			respondUnauthorized(writer, "Invalid refresh token")
+			return
+		}
+		caller := principal{UserId: refreshToken.UserId, SessionId: refreshToken.FamilyId, RefreshToken: token, Cookie: fromCookie}
+		handler.ServeHTTP(writer, withPrincipal(request, caller))
+	})
+}
+
+// Validates an access token's signature, expiration, issuer, and audience, and checks its session hasn't been revoked.
+//
+//	Returns the caller if successful. Otherwise returns the status code to respond with
+func (config *apiConfig) authenticateAccessToken(token string) (principal, int, error) {
+	claims := accessClaims{}
+	_, err := jwt.ParseWithClaims(token, &claims, config.keyring.verificationKey,
+		jwt.WithValidMethods(config.keyring.methods()),
+		jwt.WithIssuer(accessTokenIssuer),
+		jwt.WithAudience(accessTokenAudience),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return principal{}, http.StatusUnauthorized, fmt.Errorf("Invalid access token: %w", err)
+	}
+	userId, err := strconv.Atoi(claims.Subject)
+	if err != nil || claims.SessionId == "" {
+		return principal{}, http.StatusUnauthorized, fmt.Errorf("Invalid access token")
+	}
+
+	// Revoking a session revokes the access tokens issued from it
+	session, found, err := config.db.GetSession(claims.SessionId)
+	if err != nil {
+		return principal{}, http.StatusInternalServerError, fmt.Errorf("Error getting session: %w", err)
+	}
+	if !found || session.UserId != userId || session.ClientId != claims.ClientId || !time.Now().Before(session.ExpiresAt) {
+		return principal{}, http.StatusUnauthorized, fmt.Errorf("Session has been revoked")
+	}
+	caller := principal{UserId: userId, Role: claims.Role, SessionId: claims.SessionId, ClientId: claims.ClientId}
+	if claims.ClientId != "" {
+		// Never nil, so a client granted no scopes can't be mistaken for a login
+		caller.Scopes = append([]string{}, strings.Fields(claims.Scope)...)
+	}
+	return caller, http.StatusOK, nil
+}
+
+// Authenticates the request with the credentials in its authorization header, or else with its session cookie.
+//
+//	`found` is false if the request has neither. State-changing requests made with the session cookie need a CSRF token as well
+func (config *apiConfig) authenticateRequest(request *http.Request) (caller principal, found bool, status int, err error) {
+	if scheme, credentials, found := authorizationCredentials(request); found {
+		caller, status, err = config.authenticate(scheme, credentials)
+		return caller, true, status, err
+	}
+	cookie, err := request.Cookie(sessionCookieName)
+	if err != nil || cookie.Value == "" {
+		return principal{}, false, http.StatusUnauthorized, nil
+	}
+	err = checkCSRF(request)
+	if err != nil {
+		return principal{}, true, http.StatusForbidden, err
+	}
+	caller, status, err = config.authenticateAccessToken(cookie.Value)
+	caller.Cookie = true
+	return caller, true, status, err
+}
+
+// Authenticates `Bearer` access tokens and `ApiKey` personal API keys
+func (config *apiConfig) authenticate(scheme string, credentials string) (principal, int, error) {
+	if scheme == apiKeyScheme {
+		return config.authenticateApiKey(credentials)
+	}
+	return config.authenticateAccessToken(credentials)
+}
+
+// Gets the scheme and credentials from a `Bearer` or `ApiKey` authorization header.
+//
+//	The scheme is returned as one of the two constants, whatever its case in the header
+func authorizationCredentials(request *http.Request) (scheme string, credentials string, found bool) {
+	if token, found := bearerToken(request); found {
+		return bearerScheme, token, true
+	}
+	if key, found := apiKeyCredentials(request); found {
+		return apiKeyScheme, key, true
+	}
+	return "", "", false
+}
+
+// Gets the token from a `Bearer` authorization header
+func bearerToken(request *http.Request) (token string, found bool) {
+	scheme, token, found := strings.Cut(request.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, bearerScheme) || token == "" {
+		return "", false
+	}
+	return token, true
+}
+
+// Gets the key from an `ApiKey` authorization header
+func apiKeyCredentials(request *http.Request) (key string, found bool) {
+	scheme, key, found := strings.Cut(request.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, apiKeyScheme) || key == "" {
+		return "", false
+	}
+	return key, true
+}
+
+func respondUnauthorized(writer http.ResponseWriter, errorText string) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("WWW-Authenticate", `Bearer realm="chirpy"`)
+	respondWithError(writer, http.StatusUnauthorized, errorText)
+}
+
+func respondAuthError(writer http.ResponseWriter, status int, err error) {
+	if status == http.StatusUnauthorized {
+		respondUnauthorized(writer, err.Error())
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	respondWithError(writer, status, err.Error())
+}
@@ -0,0 +1,150 @@
+package apiConfig
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/trolfu/boot-dev-web-servers-course/database"
+	"github.com/trolfu/boot-dev-web-servers-course/mailer"
+)
+
+// Creates an API config backed by an empty database, with a refresh token for user 1
+func newTestAuthConfig(t *testing.T) (config apiConfig, sessionId string, refreshToken string) {
+	keyring, err := LoadKeyring("", "", "testing-secret")
+	if err != nil {
+		t.Fatalf("Error loading keyring: %v", err)
+	}
+	config = NewAPIConfig(database.NewDB(filepath.Join(t.TempDir(), "database.json")), nil, keyring, mailer.LogMailer{}, UnverifiedRestrictions{}, DefaultPasswordPolicy, "")
+	refreshToken, sessionId, err = config.createRefreshToken(1, httptest.NewRequest(http.MethodPost, "/api/login", nil))
+	if err != nil {
+		t.Fatalf("Error creating refresh token: %v", err)
+	}
+	return config, sessionId, refreshToken
+}
+
+// Runs a request with the authorization header through `middleware`, returning the response status and the principal it passed on
+func serveWithAuth(middleware func(http.Handler) http.Handler, authorization string) (status int, caller principal, found bool) {
+	handler := middleware(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		caller, found = principalFrom(request)
+	}))
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	if authorization != "" {
+		request.Header.Set("Authorization", authorization)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	return recorder.Code, caller, found
+}
+
+func TestRequireAuth(t *testing.T) {
+	config, sessionId, refreshToken := newTestAuthConfig(t)
+	accessToken, err := config.createSignedJWT(accessTokenIssuer, accessTokenTimeoutSeconds, database.User{Id: 1}, sessionId)
+	if err != nil {
+		t.Fatalf("Error creating access token: %v", err)
+	}
+
+	status, caller, found := serveWithAuth(config.MiddlewareRequireAuth, "Bearer "+accessToken)
+	if status != http.StatusOK || !found || caller.UserId != 1 || caller.SessionId != sessionId {
+		t.Fatalf("Valid access token rejected: %v, %+v", status, caller)
+	}
+
+	otherIssuer, err := config.createSignedJWT("chirpy-refresh", accessTokenTimeoutSeconds, database.User{Id: 1}, sessionId)
+	if err != nil {
+		t.Fatalf("Error creating token: %v", err)
+	}
+	otherAudience, err := config.keyring.sign(accessClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    accessTokenIssuer,
+			Audience:  jwt.ClaimStrings{"another-service"},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+			Subject:   "1",
+		},
+		SessionId: sessionId,
+	})
+	if err != nil {
+		t.Fatalf("Error creating token: %v", err)
+	}
+	for name, authorization := range map[string]string{
+		"missing":        "",
+		"wrong scheme":   "Basic " + accessToken,
+		"API key scheme": "ApiKey " + accessToken,
+		"refresh token":  "Bearer " + refreshToken,
+		"wrong issuer":   "Bearer " + otherIssuer,
+		"wrong audience": "Bearer " + otherAudience,
+	} {
+		status, _, _ := serveWithAuth(config.MiddlewareRequireAuth, authorization)
+		if status != http.StatusUnauthorized {
+			t.Fatalf("Expected %s authorization to be unauthorized, actual: %v", name, status)
+		}
+	}
+
+	// Revoking the session revokes its access tokens
+	_, err = config.db.DeleteRefreshTokenFamily(sessionId)
+	if err != nil {
+		t.Fatalf("Error revoking session: %v", err)
+	}
+	status, _, _ = serveWithAuth(config.MiddlewareRequireAuth, "Bearer "+accessToken)
+	if status != http.StatusUnauthorized {
+		t.Fatalf("Expected a revoked session's access token to be unauthorized, actual: %v", status)
+	}
+}
+
+func TestOptionalAuth(t *testing.T) {
+	config, _, _ := newTestAuthConfig(t)
+
+	status, _, found := serveWithAuth(config.MiddlewareOptionalAuth, "")
+	if status != http.StatusOK || found {
+		t.Fatalf("Anonymous request not passed through: %v, %v", status, found)
+	}
+	status, _, _ = serveWithAuth(config.MiddlewareOptionalAuth, "Bearer invalid")
+	if status != http.StatusUnauthorized {
+		t.Fatalf("Expected an invalid access token to be unauthorized, actual: %v", status)
+	}
+}
+
+func TestRequireRefreshToken(t *testing.T) {
+	config, sessionId, refreshToken := newTestAuthConfig(t)
+	accessToken, err := config.createSignedJWT(accessTokenIssuer, accessTokenTimeoutSeconds, database.User{Id: 1}, sessionId)
+	if err != nil {
+		t.Fatalf("Error creating access token: %v", err)
+	}
+
+	status, caller, found := serveWithAuth(config.MiddlewareRequireRefreshToken, "Bearer "+refreshToken)
+	if status != http.StatusOK || !found || caller.UserId != 1 || caller.RefreshToken != refreshToken {
+		t.Fatalf("Valid refresh token rejected: %v, %+v", status, caller)
+	}
+	status, _, _ = serveWithAuth(config.MiddlewareRequireRefreshToken, "Bearer "+accessToken)
+	if status != http.StatusUnauthorized {
+		t.Fatalf("Expected an access token to be unauthorized, actual: %v", status)
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	config, sessionId, _ := newTestAuthConfig(t)
+	requireAdmin := func(handler http.Handler) http.Handler {
+		return config.MiddlewareRequireAuth(config.MiddlewareRequireAdmin(handler))
+	}
+
+	for role, expected := range map[string]int{
+		database.RoleUser:      http.StatusForbidden,
+		database.RoleModerator: http.StatusForbidden,
+		database.RoleAdmin:     http.StatusOK,
+	} {
+		accessToken, err := config.createSignedJWT(accessTokenIssuer, accessTokenTimeoutSeconds, database.User{Id: 1, Role: role}, sessionId)
+		if err != nil {
+			t.Fatalf("Error creating access token: %v", err)
+		}
+		status, _, _ := serveWithAuth(requireAdmin, "Bearer "+accessToken)
+		if status != expected {
+			t.Fatalf("Expected status %v for the %s role, actual: %v", expected, role, status)
+		}
+	}
+	status, _, _ := serveWithAuth(requireAdmin, "")
+	if status != http.StatusUnauthorized {
+		t.Fatalf("Expected a missing access token to be unauthorized, actual: %v", status)
+	}
+}
@@ -0,0 +1,83 @@
+package apiConfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/trolfu/boot-dev-web-servers-course/database"
+)
+
+// Rejects callers without the admin role. Must run after `MiddlewareRequireAuth`
+func (config *apiConfig) MiddlewareRequireAdmin(handler http.Handler) http.Handler {
+	return config.requireRole(database.RoleAdmin, handler)
+}
+
+func (config *apiConfig) requireRole(role string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		caller, found := principalFrom(request)
+		if !found {
+			respondUnauthorized(writer, "Missing authorization")
+			return
+		}
+		if !database.RoleAtLeast(caller.Role, role) {
+			writer.Header().Set("Content-Type", "application/json")
+			respondWithError(writer, http.StatusForbidden, "Not allowed")
+			return
+		}
+		handler.ServeHTTP(writer, request)
+	})
+}
+
+// Sets a user's role from the request body.
+//
+//	Lowering a role also revokes the user's sessions, since their access tokens carry the old role until they expire
+func (config *apiConfig) SetUserRole(writer http.ResponseWriter, request *http.Request) {
+	type roleRequest struct {
+		Role string `json:"role"`
+	}
+	writer.Header().Set("Content-Type", "application/json")
+
+	userId, err := strconv.Atoi(chi.URLParam(request, "userId"))
+	if err != nil {
+		respondWithError(writer, http.StatusBadRequest, "Invalid user id")
+		return
+	}
+	body := roleRequest{}
+	err = json.NewDecoder(request.Body).Decode(&body)
+	if err != nil {
+		respondWithError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	previous, found, err := config.db.GetUser(userId)
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error getting user: %v", err))
+		return
+	}
+	if !found {
+		respondWithError(writer, http.StatusNotFound, "User not found")
+		return
+	}
+	user, err := config.db.SetUserRole(userId, body.Role)
+	if err == database.ErrInvalidRole {
+		respondWithError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error setting role: %v", err))
+		return
+	}
+	config.audit(request, "user.role", fmt.Sprintf("user:%d", userId), fmt.Sprintf("Changed role from %s to %s", previous.Role, user.Role))
+
+	if !database.RoleAtLeast(user.Role, previous.Role) {
+		_, err = config.db.DeleteUserSessions(userId)
+		if err != nil {
+			respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error revoking sessions: %v", err))
+			return
+		}
+	}
+	respondWithSuccess(writer, http.StatusOK, user)
+}
@@ -0,0 +1,76 @@
+package apiConfig
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/trolfu/boot-dev-web-servers-course/database"
+)
+
+// Lists the caller's active sessions, most recently used first
+func (config *apiConfig) GetSessions(writer http.ResponseWriter, request *http.Request) {
+	type sessionResponse struct {
+		database.Session
+		Current bool `json:"current"` // True for the session the request was made from
+	}
+	writer.Header().Set("Content-Type", "application/json")
+
+	caller, _ := principalFrom(request)
+
+	sessions, err := config.db.GetUserSessions(caller.UserId)
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error getting sessions: %v", err))
+		return
+	}
+	now := time.Now()
+	active := []sessionResponse{}
+	for _, session := range sessions {
+		if now.Before(session.ExpiresAt) {
+			active = append(active, sessionResponse{Session: session, Current: session.Id == caller.SessionId})
+		}
+	}
+	respondWithSuccess(writer, http.StatusOK, active)
+}
+
+// Revokes one of the caller's sessions, along with the access tokens issued from it
+func (config *apiConfig) DeleteSession(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+
+	caller, _ := principalFrom(request)
+
+	// Other users' sessions are reported as missing, so session ids can't be probed
+	session, found, err := config.db.GetSession(chi.URLParam(request, "sessionId"))
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error getting session: %v", err))
+		return
+	}
+	if !found || session.UserId != caller.UserId {
+		respondWithError(writer, http.StatusNotFound, "Session not found")
+		return
+	}
+	_, err = config.db.DeleteRefreshTokenFamily(session.Id)
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error revoking session: %v", err))
+		return
+	}
+	respondWithSuccess(writer, http.StatusOK, nil)
+}
+
+// Revokes every one of the caller's sessions, including the one the request was made from
+func (config *apiConfig) DeleteSessions(writer http.ResponseWriter, request *http.Request) {
+	type revokeResponse struct {
+		Revoked int `json:"revoked"` // The number of refresh tokens removed
+	}
+	writer.Header().Set("Content-Type", "application/json")
+
+	caller, _ := principalFrom(request)
+
+	revoked, err := config.db.DeleteUserSessions(caller.UserId)
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error revoking sessions: %v", err))
+		return
+	}
+	respondWithSuccess(writer, http.StatusOK, revokeResponse{Revoked: revoked})
+}
@@ -0,0 +1,58 @@
+package apiConfig
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/trolfu/boot-dev-web-servers-course/database"
+)
+
+// Lists the database snapshots, newest first
+func (config *apiConfig) GetSnapshots(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+
+	snapshots, err := config.snapshots.List()
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error listing snapshots: %v", err))
+		return
+	}
+	respondWithSuccess(writer, http.StatusOK, snapshots)
+}
+
+// Takes a snapshot of the database
+func (config *apiConfig) CreateSnapshot(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+
+	snapshot, err := config.snapshots.Create(config.db)
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error creating snapshot: %v", err))
+		return
+	}
+	config.audit(request, "snapshot.create", "snapshot:"+snapshot.Name, "")
+	respondWithSuccess(writer, http.StatusCreated, snapshot)
+}
+
+// Replaces the database contents with a snapshot. The snapshot is verified before anything is changed
+func (config *apiConfig) RestoreSnapshot(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+
+	name := chi.URLParam(request, "snapshotName")
+	err := config.snapshots.Restore(config.db, name)
+	if errors.Is(err, database.ErrSnapshotNotFound) {
+		respondWithError(writer, http.StatusNotFound, err.Error())
+		return
+	}
+	if errors.Is(err, database.ErrSnapshotCorrupt) || errors.Is(err, database.ErrSchemaTooNew) {
+		respondWithError(writer, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error restoring snapshot: %v", err))
+		return
+	}
+	// Recorded after restoring, since the restore replaces the audit log with the snapshot's
+	config.audit(request, "snapshot.restore", "snapshot:"+name, "")
+	respondWithSuccess(writer, http.StatusOK, struct{}{})
+}
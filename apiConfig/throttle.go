@@ -0,0 +1,254 @@
+// Slows down and locks out repeated failed logins from the same account or IP address
+
+package apiConfig
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// How many failures a key gets before backing off, and before it's locked out
+type throttleLimits struct {
+	freeAttempts int
+	lockoutAfter int
+}
+
+var (
+	accountThrottleLimits = throttleLimits{freeAttempts: 3, lockoutAfter: 10}
+	ipThrottleLimits      = throttleLimits{freeAttempts: 10, lockoutAfter: 100}
+	loginBackoffBase      = time.Second      // The wait after the first failure past the free attempts. It doubles with each failure after that
+	loginBackoffMax       = 5 * time.Minute  // The longest wait before a lockout
+	loginLockoutDuration  = 15 * time.Minute // How long a locked out key has to wait
+	loginFailureWindow    = time.Hour        // Failures are forgotten after this long without another one
+)
+
+// Failed attempts from one account or IP address
+type loginFailures struct {
+	Key          string    `json:"key"` // `account:<email>`, `two_factor:<user id>`, or `ip:<address>`
+	Failures     int       `json:"failures"`
+	LastFailure  time.Time `json:"last_failure"`
+	BlockedUntil time.Time `json:"blocked_until"`
+	Locked       bool      `json:"locked"` // Reached the lockout threshold, rather than just backing off
+	inFlight     int       // Attempts still being checked, which haven't failed or been released yet
+}
+
+// A key to throttle, with the limits for its kind
+type throttledKey struct {
+	key    string
+	limits throttleLimits
+}
+
+// Tracks failed login attempts in memory. Restarting the server clears them
+type loginThrottle struct {
+	mux       *sync.Mutex
+	entries   map[string]*loginFailures
+	lastPrune time.Time
+}
+
+func newLoginThrottle() *loginThrottle {
+	return &loginThrottle{mux: &sync.Mutex{}, entries: map[string]*loginFailures{}}
+}
+
+func accountThrottleKey(email string) string {
+	return "account:" + strings.ToLower(email)
+}
+
+func twoFactorThrottleKey(userId int) string {
+	return "two_factor:" + strconv.Itoa(userId)
+}
+
+func ipThrottleKey(request *http.Request) string {
+	return "ip:" + clientIp(request)
+}
+
+// How long until every one of `keys` can try again. 0 means they can now
+func (throttle *loginThrottle) retryAfter(now time.Time, keys ...string) time.Duration {
+	throttle.mux.Lock()
+	defer throttle.mux.Unlock()
+	wait := time.Duration(0)
+	for _, key := range keys {
+		entry, found := throttle.entries[key]
+		if found && now.Before(entry.BlockedUntil) {
+			wait = max(wait, entry.BlockedUntil.Sub(now))
+		}
+	}
+	return wait
+}
+
+// Reserves an attempt for every one of `keys`, checking and counting it in one step so concurrent guesses can't all get through before the first one fails.
+//
+//	A key with attempts in flight that would use up its free attempts has to wait for them to finish, so past that only one guess at a time is checked.
+//	Returns how long to wait instead if any key can't try now, in which case nothing is reserved. Otherwise every attempt must end with `fail` or `release`
+func (throttle *loginThrottle) reserve(now time.Time, keys ...throttledKey) time.Duration {
+	throttle.mux.Lock()
+	defer throttle.mux.Unlock()
+	wait := time.Duration(0)
+	for _, key := range keys {
+		entry, found := throttle.entries[key.key]
+		if !found {
+			continue
+		}
+		if now.Before(entry.BlockedUntil) {
+			wait = max(wait, entry.BlockedUntil.Sub(now))
+		}
+		if entry.inFlight > 0 && entry.Failures+entry.inFlight >= key.limits.freeAttempts {
+			wait = max(wait, loginBackoffBase)
+		}
+	}
+	if wait > 0 {
+		return wait
+	}
+	for _, key := range keys {
+		entry, found := throttle.entries[key.key]
+		if !found {
+			entry = &loginFailures{Key: key.key}
+			throttle.entries[key.key] = entry
+		}
+		entry.inFlight++
+	}
+	return 0
+}
+
+// Ends reserved attempts for `keys` that didn't fail
+func (throttle *loginThrottle) release(keys ...string) {
+	throttle.mux.Lock()
+	defer throttle.mux.Unlock()
+	for _, key := range keys {
+		if entry, found := throttle.entries[key]; found {
+			entry.inFlight = max(entry.inFlight-1, 0)
+		}
+	}
+}
+
+// Records a failed attempt for `key`, ending its reservation, and makes it wait before the next one.
+//
+//	Returns true if this failure locked the key out
+func (throttle *loginThrottle) fail(key string, limits throttleLimits, now time.Time) (locked bool) {
+	throttle.mux.Lock()
+	defer throttle.mux.Unlock()
+	throttle.prune(now)
+
+	entry, found := throttle.entries[key]
+	if !found {
+		entry = &loginFailures{Key: key}
+		throttle.entries[key] = entry
+	}
+	entry.inFlight = max(entry.inFlight-1, 0)
+	entry.Failures++
+	entry.LastFailure = now
+
+	if entry.Failures >= limits.lockoutAfter {
+		entry.BlockedUntil = now.Add(loginLockoutDuration)
+		locked = !entry.Locked
+		entry.Locked = true
+		return locked
+	}
+	if entry.Failures > limits.freeAttempts {
+		doublings := float64(entry.Failures - limits.freeAttempts - 1)
+		backoff := time.Duration(float64(loginBackoffBase) * math.Pow(2, doublings))
+		entry.BlockedUntil = now.Add(min(backoff, loginBackoffMax))
+	}
+	return false
+}
+
+// Forgets the failures for `key`, after it logs in successfully
+func (throttle *loginThrottle) reset(key string) (found bool) {
+	throttle.mux.Lock()
+	defer throttle.mux.Unlock()
+	_, found = throttle.entries[key]
+	delete(throttle.entries, key)
+	return found
+}
+
+// Removes keys that are no longer blocked and haven't failed recently. Must be called with the lock held
+func (throttle *loginThrottle) prune(now time.Time) {
+	if now.Sub(throttle.lastPrune) < loginFailureWindow/4 {
+		return
+	}
+	throttle.lastPrune = now
+	for key, entry := range throttle.entries {
+		if entry.inFlight == 0 && now.After(entry.BlockedUntil) && now.Sub(entry.LastFailure) > loginFailureWindow {
+			delete(throttle.entries, key)
+		}
+	}
+}
+
+// Copies the keys that are blocked at `now`, ordered by key
+func (throttle *loginThrottle) blocked(now time.Time) []loginFailures {
+	throttle.mux.Lock()
+	defer throttle.mux.Unlock()
+	blocked := []loginFailures{}
+	for _, entry := range throttle.entries {
+		if now.Before(entry.BlockedUntil) {
+			blocked = append(blocked, *entry)
+		}
+	}
+	slices.SortFunc(blocked, func(a, b loginFailures) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	return blocked
+}
+
+// Responds with 429 Too Many Requests, saying how long to wait
+func respondThrottled(writer http.ResponseWriter, wait time.Duration) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	respondWithError(writer, http.StatusTooManyRequests, "Too many failed attempts. Try again later")
+}
+
+// The keys a login attempt for `key` is throttled by: the key itself and the request's IP address
+func loginThrottleKeys(request *http.Request, key string) []throttledKey {
+	return []throttledKey{{key, accountThrottleLimits}, {ipThrottleKey(request), ipThrottleLimits}}
+}
+
+// Reserves a login attempt for `key` and the request's IP address before the password or code is checked.
+//
+//	Returns how long to wait if either is throttled. Otherwise the attempt must end with `recordLoginFailure` or `releaseLoginAttempt`
+func (config *apiConfig) reserveLoginAttempt(request *http.Request, key string) time.Duration {
+	return config.loginThrottle.reserve(time.Now().UTC(), loginThrottleKeys(request, key)...)
+}
+
+// Ends a reserved login attempt that didn't fail, whether it succeeded or couldn't be checked
+func (config *apiConfig) releaseLoginAttempt(request *http.Request, key string) {
+	config.loginThrottle.release(key, ipThrottleKey(request))
+}
+
+// Records a failed login for `key` and for the request's IP address, and records any lockout it causes
+func (config *apiConfig) recordLoginFailure(request *http.Request, key string) {
+	now := time.Now().UTC()
+	for _, failure := range loginThrottleKeys(request, key) {
+		if !config.loginThrottle.fail(failure.key, failure.limits, now) {
+			continue
+		}
+		log.Printf("SECURITY: locked out %s for %v after repeated failed logins", failure.key, loginLockoutDuration)
+		config.audit(request, "login.lockout", failure.key, fmt.Sprintf("Locked out for %v after repeated failed logins", loginLockoutDuration))
+	}
+}
+
+// Lists the accounts and IP addresses currently waiting to try logging in again, whether backing off or locked out
+func (config *apiConfig) GetLockouts(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+	respondWithSuccess(writer, http.StatusOK, config.loginThrottle.blocked(time.Now().UTC()))
+}
+
+// Clears the failed logins for an account or IP address, lifting any lockout
+func (config *apiConfig) DeleteLockout(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+
+	key := chi.URLParam(request, "key")
+	if !config.loginThrottle.reset(key) {
+		respondWithError(writer, http.StatusNotFound, fmt.Sprintf("No failed logins for '%s'", key))
+		return
+	}
+	config.audit(request, "login.unlock", key, "")
+	respondWithSuccess(writer, http.StatusOK, struct{}{})
+}
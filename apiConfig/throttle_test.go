@@ -0,0 +1,106 @@
+package apiConfig
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoginThrottleBackoff(t *testing.T) {
+	throttle := newLoginThrottle()
+	limits := throttleLimits{freeAttempts: 2, lockoutAfter: 5}
+	now := time.Now()
+
+	expectedWaits := []time.Duration{0, 0, loginBackoffBase, 2 * loginBackoffBase}
+	for i, expected := range expectedWaits {
+		if throttle.fail("account:foobar@example.com", limits, now) {
+			t.Fatalf("Locked out after %d failures", i+1)
+		}
+		if wait := throttle.retryAfter(now, "account:foobar@example.com"); wait != expected {
+			t.Fatalf("After %d failures: expected to wait %v, actual %v", i+1, expected, wait)
+		}
+	}
+	if !throttle.fail("account:foobar@example.com", limits, now) {
+		t.Fatal("Not locked out at the lockout threshold")
+	}
+	if throttle.fail("account:foobar@example.com", limits, now) {
+		t.Fatal("Lockout reported twice")
+	}
+	if wait := throttle.retryAfter(now, "ip:192.0.2.1", "account:foobar@example.com"); wait != loginLockoutDuration {
+		t.Fatalf("Expected to wait out the lockout, actual %v", wait)
+	}
+	if blocked := throttle.blocked(now); len(blocked) != 1 || !blocked[0].Locked {
+		t.Fatalf("Expected one locked key, actual %+v", blocked)
+	}
+
+	throttle.reset("account:foobar@example.com")
+	if wait := throttle.retryAfter(now, "account:foobar@example.com"); wait != 0 {
+		t.Fatalf("Reset key still waiting %v", wait)
+	}
+}
+
+func TestLoginFailuresUniform(t *testing.T) {
+	config, _, _ := newTestAuthConfig(t)
+	_, err := config.db.CreateUser("foobar@example.com", "password")
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+
+	wrongPassword := sendAs(config, config.Login, 0, `{"email": "foobar@example.com", "password": "wrong"}`)
+	missingUser := sendAs(config, config.Login, 0, `{"email": "missing@example.com", "password": "wrong"}`)
+	if wrongPassword.Code != http.StatusUnauthorized || wrongPassword.Body.String() != missingUser.Body.String() {
+		t.Fatalf("Login failures differ: %d %s, %d %s", wrongPassword.Code, wrongPassword.Body, missingUser.Code, missingUser.Body)
+	}
+
+	for i := 0; i < accountThrottleLimits.freeAttempts; i++ {
+		sendAs(config, config.Login, 0, `{"email": "FOOBAR@example.com", "password": "wrong"}`)
+	}
+	throttled := sendAs(config, config.Login, 0, `{"email": "foobar@example.com", "password": "password"}`)
+	if throttled.Code != http.StatusTooManyRequests || throttled.Header().Get("Retry-After") == "" {
+		t.Fatalf("Expected a throttled login, actual %d %s", throttled.Code, throttled.Body)
+	}
+}
+
+func TestLoginThrottleConcurrentGuesses(t *testing.T) {
+	config, _, _ := newTestAuthConfig(t)
+	_, err := config.db.CreateUser("foobar@example.com", "password")
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	// Short backoffs, so the guessers keep trying until the account is locked out
+	base, longest := loginBackoffBase, loginBackoffMax
+	loginBackoffBase, loginBackoffMax = time.Millisecond, time.Millisecond
+	t.Cleanup(func() { loginBackoffBase, loginBackoffMax = base, longest })
+
+	lockedOut := func() bool {
+		return config.loginThrottle.retryAfter(time.Now().UTC(), accountThrottleKey("foobar@example.com")) > loginBackoffMax
+	}
+
+	// Every guess is checked against the password hash, which is slow enough for the guesses to overlap
+	guessed := make(chan int, 1000)
+	deadline := time.Now().Add(10 * time.Second)
+	waitGroup := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for !lockedOut() && time.Now().Before(deadline) {
+				response := sendAs(config, config.Login, 0, `{"email": "foobar@example.com", "password": "wrong"}`)
+				if response.Code == http.StatusUnauthorized {
+					guessed <- 1
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+	waitGroup.Wait()
+	close(guessed)
+
+	if !lockedOut() {
+		t.Fatalf("Account not locked out after %d guesses", len(guessed))
+	}
+	if len(guessed) > accountThrottleLimits.lockoutAfter {
+		t.Fatalf("Expected at most %d guesses to be checked, actual: %d", accountThrottleLimits.lockoutAfter, len(guessed))
+	}
+}
@@ -0,0 +1,102 @@
+package apiConfig
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Running totals of expired refresh token sweeps, shown on the admin metrics page
+type tokenSweepStats struct {
+	mux        *sync.Mutex
+	sweeps     int
+	pruned     int
+	lastSweep  time.Time
+	lastPruned int
+}
+
+// The result of a single expired refresh token sweep
+type tokenSweep struct {
+	Pruned  int       `json:"pruned"`
+	SweptAt time.Time `json:"swept_at"`
+}
+
+func newTokenSweepStats() *tokenSweepStats {
+	return &tokenSweepStats{mux: &sync.Mutex{}}
+}
+
+// A copy of the sweep totals, for the admin dashboard
+type tokenSweepSummary struct {
+	Sweeps     int
+	Pruned     int
+	LastSweep  time.Time // Zero if there hasn't been a sweep
+	LastPruned int
+}
+
+func (stats *tokenSweepStats) summary() tokenSweepSummary {
+	stats.mux.Lock()
+	defer stats.mux.Unlock()
+	return tokenSweepSummary{Sweeps: stats.sweeps, Pruned: stats.pruned, LastSweep: stats.lastSweep, LastPruned: stats.lastPruned}
+}
+
+// Removes refresh tokens, one-time tokens, and authorization codes that have expired and records the sweep
+func (config *apiConfig) sweepRefreshTokens() (tokenSweep, error) {
+	sweptAt := time.Now().UTC()
+	pruned, err := config.db.PruneRefreshTokens(sweptAt)
+	if err != nil {
+		return tokenSweep{}, err
+	}
+	prunedOneTime, err := config.db.PruneOneTimeTokens(sweptAt)
+	if err != nil {
+		return tokenSweep{}, err
+	}
+	prunedCodes, err := config.db.PruneAuthorizationCodes(sweptAt)
+	if err != nil {
+		return tokenSweep{}, err
+	}
+	pruned += prunedOneTime + prunedCodes
+
+	stats := config.tokenSweeps
+	stats.mux.Lock()
+	defer stats.mux.Unlock()
+	stats.sweeps++
+	stats.pruned += pruned
+	stats.lastSweep = sweptAt
+	stats.lastPruned = pruned
+	return tokenSweep{Pruned: pruned, SweptAt: sweptAt}, nil
+}
+
+// Sweeps expired refresh tokens every `interval` until `ctx` is cancelled
+func (config *apiConfig) RunTokenJanitor(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// A failed sweep leaves the tokens in place for the next one
+			_, err := config.sweepRefreshTokens()
+			if err != nil {
+				log.Printf("Error sweeping refresh tokens: %v", err)
+			}
+		}
+	}
+}
+
+// Sweeps expired refresh tokens immediately instead of waiting for the janitor
+func (config *apiConfig) SweepRefreshTokens(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+
+	sweep, err := config.sweepRefreshTokens()
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error sweeping refresh tokens: %v", err))
+		return
+	}
+	config.audit(request, "refresh_tokens.sweep", "refresh_tokens", fmt.Sprintf("Pruned %d expired tokens", sweep.Pruned))
+	respondWithSuccess(writer, http.StatusOK, sweep)
+}
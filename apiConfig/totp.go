@@ -0,0 +1,100 @@
+// Generates and checks time-based one-time passwords (RFC 6238), as shown by authenticator apps
+
+package apiConfig
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	totpIssuer        = "Chirpy"
+	totpPeriodSeconds = 30
+	totpDigits        = 6
+	totpSkewSteps     = 1 // Codes from this many steps before or after the current one are accepted, for clock drift
+)
+
+// Secrets are shared with authenticator apps as unpadded base32
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Creates a random 160 bit TOTP secret, base32 encoded
+func newTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// The `otpauth://` URI authenticator apps scan to add the secret, labelled with the user's email
+func totpURI(secret string, email string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", totpIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriodSeconds))
+	return fmt.Sprintf("otpauth://totp/%s:%s?%s", url.PathEscape(totpIssuer), url.PathEscape(email), query.Encode())
+}
+
+// The time step `now` falls in
+func totpStep(now time.Time) int64 {
+	return now.Unix() / totpPeriodSeconds
+}
+
+// Calculates the code for a time step (RFC 4226 HOTP, with the step as the counter)
+func totpCode(secret []byte, step int64) string {
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulus := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%modulus)
+}
+
+// Checks a code against a base32 secret at `now`.
+//
+//	Returns the time step the code is for, so the caller can stop it being used again
+func verifyTOTP(secret string, code string, now time.Time) (step int64, ok bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := totpStep(now)
+	// Every candidate is checked, so the time taken doesn't depend on which one matched
+	for candidate := current - totpSkewSteps; candidate <= current+totpSkewSteps; candidate++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, candidate)), []byte(code)) == 1 {
+			step, ok = candidate, true
+		}
+	}
+	return step, ok
+}
+
+// Reports whether `code` looks like a TOTP code rather than a recovery code
+func isTOTPCode(code string) bool {
+	if len(code) != totpDigits {
+		return false
+	}
+	for _, digit := range code {
+		if digit < '0' || digit > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,334 @@
+package apiConfig
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/skip2/go-qrcode"
+	"github.com/trolfu/boot-dev-web-servers-course/database"
+)
+
+var (
+	twoFactorChallengeIssuer         = "chirpy-2fa"
+	twoFactorChallengeAudience       = "chirpy-login"
+	twoFactorChallengeTimeoutSeconds = 60 * 5 // 5 min
+	recoveryCodeCount                = 10
+)
+
+var errInvalidTwoFactorCode = errors.New("Invalid two-factor code")
+
+// Creates a set of random recovery codes formatted like `abcde-fghij`
+func newRecoveryCodes() ([]string, error) {
+	const alphabet = "abcdefghijklmnopqrstuvwxyz234567"
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		random := make([]byte, 10)
+		_, err := rand.Read(random)
+		if err != nil {
+			return nil, err
+		}
+		for j := range random {
+			random[j] = alphabet[int(random[j])%len(alphabet)]
+		}
+		codes[i] = string(random[:5]) + "-" + string(random[5:])
+	}
+	return codes, nil
+}
+
+// Puts a recovery code in the form its hash is stored in, so case, spaces, and dashes don't matter
+func normalizeRecoveryCode(code string) string {
+	return strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(code))
+}
+
+// Checks a TOTP code or recovery code for a user with two-factor authentication enabled, and uses it up.
+//
+//	Errors with `errInvalidTwoFactorCode` for a wrong, reused, or used up code
+func (config *apiConfig) useTwoFactorCode(userId int, code string) error {
+	if !isTOTPCode(code) {
+		remaining, err := config.db.UseRecoveryCode(userId, normalizeRecoveryCode(code))
+		if err == database.ErrRecoveryCodeNotFound {
+			return errInvalidTwoFactorCode
+		}
+		if err == nil {
+			log.Printf("SECURITY: user %d used a recovery code. %d left", userId, remaining)
+		}
+		return err
+	}
+
+	twoFactor, found, err := config.db.GetTwoFactor(userId)
+	if err != nil {
+		return err
+	}
+	if !found || !twoFactor.Enabled {
+		return errInvalidTwoFactorCode
+	}
+	step, ok := verifyTOTP(twoFactor.Secret, code, time.Now())
+	if !ok {
+		return errInvalidTwoFactorCode
+	}
+	err = config.db.UseTwoFactorStep(userId, step)
+	if err == database.ErrTwoFactorCodeReused || err == database.ErrTwoFactorNotFound {
+		return errInvalidTwoFactorCode
+	}
+	return err
+}
+
+// Creates the token a user with two-factor authentication gets after entering their password, to trade for login tokens with a code
+func (config *apiConfig) createTwoFactorChallenge(userId int) (string, error) {
+	return config.keyring.sign(jwt.RegisteredClaims{
+		Issuer:    twoFactorChallengeIssuer,
+		Audience:  jwt.ClaimStrings{twoFactorChallengeAudience},
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Second * time.Duration(twoFactorChallengeTimeoutSeconds)).UTC()),
+		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
+		Subject:   strconv.Itoa(userId),
+	})
+}
+
+// Checks a two-factor challenge token and returns the id of the user it was issued to
+func (config *apiConfig) verifyTwoFactorChallenge(token string) (int, error) {
+	claims := jwt.RegisteredClaims{}
+	_, err := jwt.ParseWithClaims(token, &claims, config.keyring.verificationKey,
+		jwt.WithValidMethods(config.keyring.methods()),
+		jwt.WithIssuer(twoFactorChallengeIssuer),
+		jwt.WithAudience(twoFactorChallengeAudience),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(claims.Subject)
+}
+
+// Reports whether the caller has two-factor authentication on, and how many recovery codes they have left
+func (config *apiConfig) GetTwoFactor(writer http.ResponseWriter, request *http.Request) {
+	type twoFactorResponse struct {
+		Enabled                bool `json:"enabled"`
+		RecoveryCodesRemaining int  `json:"recovery_codes_remaining"`
+	}
+	writer.Header().Set("Content-Type", "application/json")
+
+	caller, _ := principalFrom(request)
+	twoFactor, _, err := config.db.GetTwoFactor(caller.UserId)
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error getting two-factor settings: %v", err))
+		return
+	}
+	response := twoFactorResponse{Enabled: twoFactor.Enabled}
+	if twoFactor.Enabled {
+		response.RecoveryCodesRemaining = len(twoFactor.RecoveryCodes)
+	}
+	respondWithSuccess(writer, http.StatusOK, response)
+}
+
+// Starts two-factor enrollment with a new TOTP secret, returned along with its `otpauth://` URI and a QR code of the URI.
+//
+//	Two-factor authentication isn't on until the enrollment is confirmed with a code from the authenticator
+func (config *apiConfig) EnrollTwoFactor(writer http.ResponseWriter, request *http.Request) {
+	type enrollResponse struct {
+		Secret string `json:"secret"`
+		URI    string `json:"otpauth_uri"`
+		QRCode []byte `json:"qr_png"` // Base64 encoded PNG
+	}
+	writer.Header().Set("Content-Type", "application/json")
+
+	caller, _ := principalFrom(request)
+	user, found, err := config.db.GetUser(caller.UserId)
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error getting user: %v", err))
+		return
+	}
+	if !found {
+		respondWithError(writer, http.StatusNotFound, database.ErrUserNotFound.Error())
+		return
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error creating secret: %v", err))
+		return
+	}
+	err = config.db.StartTwoFactorEnrollment(database.TwoFactor{UserId: user.Id, Secret: secret, CreatedAt: time.Now().UTC()})
+	if err == database.ErrTwoFactorEnabled {
+		respondWithError(writer, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error starting enrollment: %v", err))
+		return
+	}
+
+	uri := totpURI(secret, user.Email)
+	qrCode, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error creating QR code: %v", err))
+		return
+	}
+	respondWithSuccess(writer, http.StatusOK, enrollResponse{Secret: secret, URI: uri, QRCode: qrCode})
+}
+
+// Turns on two-factor authentication once the caller enters a code from their authenticator.
+//
+//	Responds with the recovery codes, which are only ever shown here
+func (config *apiConfig) ConfirmTwoFactor(writer http.ResponseWriter, request *http.Request) {
+	type confirmRequest struct {
+		Code string `json:"code"`
+	}
+	type confirmResponse struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	writer.Header().Set("Content-Type", "application/json")
+
+	caller, _ := principalFrom(request)
+	body := confirmRequest{}
+	err := json.NewDecoder(request.Body).Decode(&body)
+	if err != nil {
+		respondWithError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	twoFactor, found, err := config.db.GetTwoFactor(caller.UserId)
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error getting two-factor settings: %v", err))
+		return
+	}
+	if !found {
+		respondWithError(writer, http.StatusBadRequest, "Start enrollment first")
+		return
+	}
+	if twoFactor.Enabled {
+		respondWithError(writer, http.StatusConflict, database.ErrTwoFactorEnabled.Error())
+		return
+	}
+	step, ok := verifyTOTP(twoFactor.Secret, body.Code, time.Now())
+	if !ok {
+		respondWithError(writer, http.StatusBadRequest, errInvalidTwoFactorCode.Error())
+		return
+	}
+
+	recoveryCodes, err := newRecoveryCodes()
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error creating recovery codes: %v", err))
+		return
+	}
+	normalized := make([]string, len(recoveryCodes))
+	for i, code := range recoveryCodes {
+		normalized[i] = normalizeRecoveryCode(code)
+	}
+	err = config.db.EnableTwoFactor(caller.UserId, step, normalized)
+	if err == database.ErrTwoFactorEnabled || err == database.ErrTwoFactorNotFound {
+		respondWithError(writer, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error enabling two-factor: %v", err))
+		return
+	}
+	config.audit(request, "two_factor.enable", fmt.Sprintf("user:%d", caller.UserId), "")
+	respondWithSuccess(writer, http.StatusOK, confirmResponse{RecoveryCodes: recoveryCodes})
+}
+
+// Turns off two-factor authentication. The caller must enter a code from their authenticator or a recovery code
+func (config *apiConfig) DisableTwoFactor(writer http.ResponseWriter, request *http.Request) {
+	type disableRequest struct {
+		Code string `json:"code"`
+	}
+	writer.Header().Set("Content-Type", "application/json")
+
+	caller, _ := principalFrom(request)
+	body := disableRequest{}
+	err := json.NewDecoder(request.Body).Decode(&body)
+	if err != nil {
+		respondWithError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Shares the login throttle, so a stolen access token can't be used to guess codes either
+	throttleKey := twoFactorThrottleKey(caller.UserId)
+	if wait := config.reserveLoginAttempt(request, throttleKey); wait > 0 {
+		respondThrottled(writer, wait)
+		return
+	}
+	err = config.useTwoFactorCode(caller.UserId, body.Code)
+	if err == errInvalidTwoFactorCode {
+		config.recordLoginFailure(request, throttleKey)
+		respondWithError(writer, http.StatusForbidden, err.Error())
+		return
+	}
+	config.releaseLoginAttempt(request, throttleKey)
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error checking code: %v", err))
+		return
+	}
+	_, err = config.db.DeleteTwoFactor(caller.UserId)
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error disabling two-factor: %v", err))
+		return
+	}
+	config.audit(request, "two_factor.disable", fmt.Sprintf("user:%d", caller.UserId), "")
+	respondWithSuccess(writer, http.StatusOK, struct{}{})
+}
+
+// Finishes logging in a user with two-factor authentication, trading the challenge token from /api/login and a code for login tokens.
+//
+//	The code can be from the user's authenticator or one of their recovery codes
+func (config *apiConfig) LoginTwoFactor(writer http.ResponseWriter, request *http.Request) {
+	type challengeRequest struct {
+		ChallengeToken string `json:"challenge_token"`
+		Code           string `json:"code"`
+		Cookies        bool   `json:"cookies"` // Like /api/login
+	}
+	writer.Header().Set("Content-Type", "application/json")
+
+	body := challengeRequest{}
+	err := json.NewDecoder(request.Body).Decode(&body)
+	if err != nil {
+		respondWithError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	userId, err := config.verifyTwoFactorChallenge(body.ChallengeToken)
+	if err != nil {
+		respondUnauthorized(writer, "Invalid or expired challenge token")
+		return
+	}
+	throttleKey := twoFactorThrottleKey(userId)
+	if wait := config.reserveLoginAttempt(request, throttleKey); wait > 0 {
+		respondThrottled(writer, wait)
+		return
+	}
+	err = config.useTwoFactorCode(userId, body.Code)
+	if err == errInvalidTwoFactorCode {
+		config.recordLoginFailure(request, throttleKey)
+		respondUnauthorized(writer, err.Error())
+		return
+	}
+	config.releaseLoginAttempt(request, throttleKey)
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error checking code: %v", err))
+		return
+	}
+	config.loginThrottle.reset(throttleKey)
+
+	user, found, err := config.db.GetUser(userId)
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error getting user: %v", err))
+		return
+	}
+	if !found {
+		respondUnauthorized(writer, "Invalid or expired challenge token")
+		return
+	}
+	if user.Disabled {
+		respondWithError(writer, http.StatusForbidden, accountDisabledMessage)
+		return
+	}
+	config.respondWithLogin(writer, request, user, body.Cookies)
+}
@@ -0,0 +1,111 @@
+package apiConfig
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B, SHA1, truncated to 6 digits
+	secret := []byte("12345678901234567890")
+	vectors := map[int64]string{59: "287082", 1111111109: "081804", 1234567890: "005924", 2000000000: "279037"}
+	for unix, expected := range vectors {
+		code := totpCode(secret, totpStep(time.Unix(unix, 0)))
+		if code != expected {
+			t.Fatalf("Code at %d: expected %s, actual %s", unix, expected, code)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret, err := newTOTPSecret()
+	if err != nil {
+		t.Fatalf("Error creating secret: %v", err)
+	}
+	key, _ := totpEncoding.DecodeString(secret)
+	now := time.Now()
+
+	step, ok := verifyTOTP(secret, totpCode(key, totpStep(now)-1), now)
+	if !ok || step != totpStep(now)-1 {
+		t.Fatal("Code from the previous step rejected")
+	}
+	_, ok = verifyTOTP(secret, totpCode(key, totpStep(now)-2), now)
+	if ok {
+		t.Fatal("Code from two steps ago accepted")
+	}
+}
+
+// Sends a JSON request to a handler as the given user, returning the response
+func sendAs(config apiConfig, handler http.HandlerFunc, userId int, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	request = withPrincipal(request, principal{UserId: userId})
+	recorder := httptest.NewRecorder()
+	handler(recorder, request)
+	return recorder
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	config, _, _ := newTestAuthConfig(t)
+	user, err := config.db.CreateUser("twofactor@example.com", "password")
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+
+	enrolled := struct {
+		Secret string `json:"secret"`
+		URI    string `json:"otpauth_uri"`
+		QRCode []byte `json:"qr_png"`
+	}{}
+	response := sendAs(config, config.EnrollTwoFactor, user.Id, "")
+	json.Unmarshal(response.Body.Bytes(), &enrolled)
+	if response.Code != http.StatusOK || !strings.HasPrefix(enrolled.URI, "otpauth://totp/") || len(enrolled.QRCode) == 0 {
+		t.Fatalf("Enrollment failed: %d %s", response.Code, response.Body)
+	}
+	key, _ := totpEncoding.DecodeString(enrolled.Secret)
+	now := time.Now()
+
+	confirmed := struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{}
+	response = sendAs(config, config.ConfirmTwoFactor, user.Id, `{"code": "`+totpCode(key, totpStep(now)-1)+`"}`)
+	json.Unmarshal(response.Body.Bytes(), &confirmed)
+	if response.Code != http.StatusOK || len(confirmed.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("Confirmation failed: %d %s", response.Code, response.Body)
+	}
+
+	challenge := struct {
+		TwoFactorRequired bool   `json:"two_factor_required"`
+		ChallengeToken    string `json:"challenge_token"`
+		Token             string `json:"token"`
+	}{}
+	response = sendAs(config, config.Login, 0, `{"email": "twofactor@example.com", "password": "password"}`)
+	json.Unmarshal(response.Body.Bytes(), &challenge)
+	if !challenge.TwoFactorRequired || challenge.ChallengeToken == "" || challenge.Token != "" {
+		t.Fatalf("Login didn't ask for a second factor: %s", response.Body)
+	}
+	_, _, err = config.authenticateAccessToken(challenge.ChallengeToken)
+	if err == nil {
+		t.Fatal("Challenge token accepted as an access token")
+	}
+
+	login := func(code string) int {
+		return sendAs(config, config.LoginTwoFactor, 0, `{"challenge_token": "`+challenge.ChallengeToken+`", "code": "`+code+`"}`).Code
+	}
+	if status := login(totpCode(key, totpStep(now)-1)); status != http.StatusUnauthorized {
+		t.Fatalf("Code used to confirm enrollment accepted again: %d", status)
+	}
+	if status := login(totpCode(key, totpStep(now))); status != http.StatusOK {
+		t.Fatalf("Current code rejected: %d", status)
+	}
+	recoveryCode := strings.ToUpper(confirmed.RecoveryCodes[0])
+	if status := login(recoveryCode); status != http.StatusOK {
+		t.Fatalf("Recovery code rejected: %d", status)
+	}
+	if status := login(recoveryCode); status != http.StatusUnauthorized {
+		t.Fatalf("Recovery code accepted twice: %d", status)
+	}
+}
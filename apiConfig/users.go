@@ -4,10 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"strconv"
-	"strings"
 
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/trolfu/boot-dev-web-servers-course/database"
 )
 
@@ -28,73 +25,81 @@ func (config *apiConfig) CreateUser(writer http.ResponseWriter, request *http.Re
 		return
 	}
 
-	// Should there be logic to change status code based on error? (ex. email already used vs JSON error)
+	if problem := config.passwordPolicy.check(incommingUser.Password, incommingUser.Email); problem != "" {
+		respondWithError(writer, http.StatusBadRequest, problem)
+		return
+	}
 	user, err := config.db.CreateUser(incommingUser.Email, incommingUser.Password)
+	if err == database.ErrInvalidEmail {
+		respondWithError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err == database.ErrEmailInUse {
+		respondWithError(writer, http.StatusConflict, err.Error())
+		return
+	}
 	if err != nil {
 		respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error creating user: %v", err))
 		return
 	}
+	config.sendEmailVerificationLater(user.Id, user.Email)
 	respondWithSuccess(writer, http.StatusCreated, user)
 }
 
-// Updates the user with values specified from the request
+// Updates the user with values specified from the request.
+//
+//	A new email is held as the user's pending email, and replaces their current one once it's verified
 func (config *apiConfig) UpdateUser(writer http.ResponseWriter, request *http.Request) {
-	type claims struct {
-		jwt.RegisteredClaims
-	}
 	type requestBody struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
 	}
 	writer.Header().Set("Content-Type", "application/json")
 
-	auth := request.Header.Get("Authorization")
-	if auth == "" {
-		respondWithError(writer, http.StatusUnauthorized, "Invalid authorization")
-		return
-	}
-	authToken := strings.TrimPrefix(auth, "Bearer ")
+	caller, _ := principalFrom(request)
 
-	jwtToken, err := jwt.ParseWithClaims(authToken, &claims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(config.jwtSecret), nil
-	})
-	if err != nil {
-		respondWithError(writer, http.StatusUnauthorized, err.Error())
-		return
-	}
-	issuer, err := jwtToken.Claims.GetIssuer()
+	decoder := json.NewDecoder(request.Body)
+	body := requestBody{}
+	err := decoder.Decode(&body)
 	if err != nil {
-		respondWithError(writer, http.StatusUnauthorized, fmt.Sprintf("Error parsing token type: %v", err))
+		respondWithError(writer, http.StatusInternalServerError, err.Error())
 		return
 	}
-	if issuer != accessTokenIssuer {
-		respondWithError(writer, http.StatusUnauthorized, "Invalid access token issuer")
+
+	if body.Email != "" && !database.ValidEmail(body.Email) {
+		respondWithError(writer, http.StatusBadRequest, database.ErrInvalidEmail.Error())
 		return
 	}
-	strId, err := jwtToken.Claims.GetSubject()
+	current, _, err := config.db.GetUser(caller.UserId)
 	if err != nil {
 		respondWithError(writer, http.StatusInternalServerError, err.Error())
 		return
 	}
-	userId, err := strconv.Atoi(strId)
-	if err != nil {
-		respondWithError(writer, http.StatusInternalServerError, err.Error())
-		return
+	if body.Password != "" {
+		// The password can't be the current email or the new one
+		problem := config.passwordPolicy.check(body.Password, current.Email)
+		if problem == "" && body.Email != "" {
+			problem = config.passwordPolicy.check(body.Password, body.Email)
+		}
+		if problem != "" {
+			respondWithError(writer, http.StatusBadRequest, problem)
+			return
+		}
 	}
 
-	decoder := json.NewDecoder(request.Body)
-	body := requestBody{}
-	err = decoder.Decode(&body)
-	if err != nil {
-		respondWithError(writer, http.StatusInternalServerError, err.Error())
+	// Both change together, so a taken email doesn't leave the password changed
+	user, err := config.db.ChangeCredentials(caller.UserId, body.Email, body.Password)
+	if err == database.ErrEmailInUse {
+		respondWithError(writer, http.StatusConflict, err.Error())
 		return
 	}
-
-	user, err := config.db.UpdateUser(userId, body.Email, body.Password)
 	if err != nil {
 		respondWithError(writer, http.StatusInternalServerError, err.Error())
 		return
 	}
+	if user.PendingEmail != "" && user.PendingEmail != current.PendingEmail {
+		config.sendEmailVerificationLater(user.Id, user.PendingEmail)
+	}
 	respondWithSuccess(writer, http.StatusOK, user)
 }
 
@@ -107,9 +112,8 @@ func (config *apiConfig) UpgradeUser(writer http.ResponseWriter, request *http.R
 		} `json:"data"`
 	}
 
-	auth := request.Header.Get("Authorization")
-	apiKey := strings.TrimPrefix(auth, "ApiKey ")
-	if auth == "" || apiKey == "" {
+	apiKey, found := apiKeyCredentials(request)
+	if !found {
 		respondWithError(writer, http.StatusUnauthorized, "Not authorized")
 		return
 	}
@@ -131,6 +135,19 @@ func (config *apiConfig) UpgradeUser(writer http.ResponseWriter, request *http.R
 		return
 	}
 
+	if config.restrictions.ChirpyRed {
+		user, found, err := config.db.GetUser(upReq.Data.UserId)
+		if err != nil {
+			respondWithError(writer, http.StatusInternalServerError, fmt.Sprintf("Error getting user: %v", err))
+			return
+		}
+		// Polka retries failed webhooks, so the upgrade goes through once the email is verified
+		if found && !user.EmailVerified {
+			respondWithError(writer, http.StatusForbidden, "User's email isn't verified")
+			return
+		}
+	}
+
 	upgradedUser, err := config.db.UpgradeUser(upReq.Data.UserId)
 	if err == database.ErrUserNotFound {
 		respondWithError(writer, http.StatusNotFound, database.ErrUserNotFound.Error())
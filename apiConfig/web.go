@@ -0,0 +1,418 @@
+// Handles Chirpy's web pages, which are rendered on the server and updated with HTMX.
+//
+//	Pages authenticate with the cookies of a browser session, and use the same database functions as the JSON API
+
+package apiConfig
+
+import (
+	"embed"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/trolfu/boot-dev-web-servers-course/database"
+)
+
+// Number of chirps loaded at a time as the timeline is scrolled
+const webChirpPageSize = 20
+
+//go:embed web/*.html
+var webFiles embed.FS
+
+// Each page is parsed with the layout and the chirp partials, since every page defines its own `content`
+var webPages = map[string]*template.Template{
+	"timeline": parseWebPage("timeline.html"),
+	"profile":  parseWebPage("profile.html"),
+	"login":    parseWebPage("login.html"),
+}
+
+var webPartials = template.Must(template.ParseFS(webFiles, "web/chirps.html"))
+
+func parseWebPage(page string) *template.Template {
+	return template.Must(template.ParseFS(webFiles, "web/layout.html", "web/chirps.html", "web/"+page))
+}
+
+// What a page is rendered with
+type webPage struct {
+	Title     string
+	User      *database.User // The logged in user, or nil
+	CSRFToken string         // Sent back by HTMX with every request
+	Chirps    chirpPage
+	Profile   database.User // The user whose profile is shown
+	Signup    bool          // Whether the login form signs up a new user instead
+	Email     string        // Filled back into the login form
+	FormToken string        // Sent back by the login form, which has no session to check CSRF with
+	Error     string
+}
+
+// A page of chirps, newest first
+type chirpPage struct {
+	Items   []chirpItem
+	NextURL string // Loads the next page. Empty on the last page
+}
+
+type chirpItem struct {
+	Chirp database.Chirp
+	Own   bool // Whether the logged in user wrote the chirp, and can delete it
+}
+
+// Authenticates page requests with the session cookie. Requests without a valid one are shown the pages logged out.
+//
+//	State-changing requests from a logged in browser need the CSRF token, like the JSON API
+func (config *apiConfig) MiddlewareWebSession(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		cookie, err := request.Cookie(sessionCookieName)
+		if err != nil || cookie.Value == "" {
+			handler.ServeHTTP(writer, request)
+			return
+		}
+		caller, _, err := config.authenticateAccessToken(cookie.Value)
+		if err != nil || caller.ClientId != "" {
+			handler.ServeHTTP(writer, request)
+			return
+		}
+		err = checkCSRF(request)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusForbidden)
+			return
+		}
+		caller.Cookie = true
+		handler.ServeHTTP(writer, withPrincipal(request, caller))
+	})
+}
+
+// Starts building a page for the request, with the logged in user if there is one
+func (config *apiConfig) newWebPage(request *http.Request, title string) (webPage, error) {
+	page := webPage{Title: title}
+	caller, found := principalFrom(request)
+	if !found {
+		return page, nil
+	}
+	user, found, err := config.db.GetUser(caller.UserId)
+	if err != nil {
+		return page, fmt.Errorf("Error getting user: %w", err)
+	}
+	if found {
+		page.User = &user
+	}
+	if cookie, err := request.Cookie(csrfCookieName); err == nil {
+		page.CSRFToken = cookie.Value
+	}
+	return page, nil
+}
+
+// Gets a page of chirps older than the chirp with id `before`, or the newest chirps if it's 0. If `authorId` isn't empty, only the author's chirps are included
+func (config *apiConfig) getChirpPage(authorId string, before int, viewerId int) (chirpPage, error) {
+	chirps, err := config.getChirps(authorId)
+	if err != nil {
+		return chirpPage{}, err
+	}
+	chirps = sortChirpsById(chirps, "desc")
+
+	page := chirpPage{Items: []chirpItem{}}
+	for _, chirp := range chirps {
+		if before > 0 && chirp.Id >= before {
+			continue
+		}
+		if len(page.Items) == webChirpPageSize {
+			next := url.Values{"before": {strconv.Itoa(page.Items[len(page.Items)-1].Chirp.Id)}}
+			if authorId != "" {
+				next.Set("author_id", authorId)
+			}
+			page.NextURL = "/chirps?" + next.Encode()
+			break
+		}
+		page.Items = append(page.Items, chirpItem{Chirp: chirp, Own: viewerId != 0 && chirp.AuthorId == viewerId})
+	}
+	return page, nil
+}
+
+func setWebHeaders(writer http.ResponseWriter) {
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.Header().Set("X-Frame-Options", "DENY")
+}
+
+func renderWebPage(writer http.ResponseWriter, status int, name string, page webPage) {
+	setWebHeaders(writer)
+	writer.WriteHeader(status)
+	err := webPages[name].ExecuteTemplate(writer, "layout.html", page)
+	if err != nil {
+		log.Printf("Error rendering %s page: %v", name, err)
+	}
+}
+
+func renderWebPartial(writer http.ResponseWriter, status int, name string, data interface{}) {
+	setWebHeaders(writer)
+	writer.WriteHeader(status)
+	err := webPartials.ExecuteTemplate(writer, name, data)
+	if err != nil {
+		log.Printf("Error rendering %s: %v", name, err)
+	}
+}
+
+// Sends the browser to another page, with HTMX's redirect header for HTMX requests
+func webRedirect(writer http.ResponseWriter, request *http.Request, target string) {
+	if request.Header.Get("HX-Request") == "true" {
+		writer.Header().Set("HX-Redirect", target)
+		writer.WriteHeader(http.StatusOK)
+		return
+	}
+	http.Redirect(writer, request, target, http.StatusSeeOther)
+}
+
+// Shows the newest chirps, with a compose box for logged in users
+func (config *apiConfig) WebTimeline(writer http.ResponseWriter, request *http.Request) {
+	page, err := config.newWebPage(request, "Home")
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	caller, _ := principalFrom(request)
+	page.Chirps, err = config.getChirpPage("", 0, caller.UserId)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Error getting chirps: %v", err), http.StatusInternalServerError)
+		return
+	}
+	renderWebPage(writer, http.StatusOK, "timeline", page)
+}
+
+// Shows a user's chirps
+func (config *apiConfig) WebProfile(writer http.ResponseWriter, request *http.Request) {
+	userId, err := strconv.Atoi(chi.URLParam(request, "userId"))
+	if err != nil {
+		http.NotFound(writer, request)
+		return
+	}
+	profile, found, err := config.db.GetUser(userId)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Error getting user: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.NotFound(writer, request)
+		return
+	}
+	page, err := config.newWebPage(request, fmt.Sprintf("User %d", profile.Id))
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page.Profile = profile
+	caller, _ := principalFrom(request)
+	page.Chirps, err = config.getChirpPage(strconv.Itoa(profile.Id), 0, caller.UserId)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Error getting chirps: %v", err), http.StatusInternalServerError)
+		return
+	}
+	renderWebPage(writer, http.StatusOK, "profile", page)
+}
+
+// Renders the next page of chirps as the timeline or a profile is scrolled.
+//
+//	`?before=` is the id of the last chirp already shown, and `?author_id=` limits the chirps to one user's
+func (config *apiConfig) WebChirps(writer http.ResponseWriter, request *http.Request) {
+	before, err := strconv.Atoi(request.URL.Query().Get("before"))
+	if err != nil || before < 1 {
+		http.Error(writer, "Invalid before", http.StatusBadRequest)
+		return
+	}
+	caller, _ := principalFrom(request)
+	page, err := config.getChirpPage(request.URL.Query().Get("author_id"), before, caller.UserId)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Error getting chirps: %v", err), http.StatusInternalServerError)
+		return
+	}
+	renderWebPartial(writer, http.StatusOK, "chirps", page)
+}
+
+// Posts a chirp from the compose box and renders it, to be added to the top of the timeline.
+//
+//	Problems with the chirp are shown under the compose box instead
+func (config *apiConfig) WebPostChirp(writer http.ResponseWriter, request *http.Request) {
+	caller, found := principalFrom(request)
+	if !found {
+		webRedirect(writer, request, "/login")
+		return
+	}
+	chirp, status, err := config.postChirp(caller.UserId, request.PostFormValue("body"))
+	if status == http.StatusInternalServerError {
+		http.Error(writer, err.Error(), status)
+		return
+	}
+	if err != nil {
+		// HTMX doesn't swap error responses, so the problem is sent as a success aimed at the compose box
+		writer.Header().Set("HX-Retarget", "#compose-error")
+		writer.Header().Set("HX-Reswap", "innerHTML")
+		setWebHeaders(writer)
+		writer.WriteHeader(http.StatusOK)
+		template.HTMLEscape(writer, []byte(err.Error()))
+		return
+	}
+	renderWebPartial(writer, http.StatusOK, "posted", chirpItem{Chirp: chirp, Own: true})
+}
+
+// Deletes one of the logged in user's chirps. The empty response replaces the chirp on the page
+func (config *apiConfig) WebDeleteChirp(writer http.ResponseWriter, request *http.Request) {
+	caller, found := principalFrom(request)
+	if !found {
+		webRedirect(writer, request, "/login")
+		return
+	}
+	chirpId, err := strconv.Atoi(chi.URLParam(request, "chirpId"))
+	if err != nil {
+		http.NotFound(writer, request)
+		return
+	}
+	chirp, found, err := config.db.GetChirp(chirpId)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Error getting chirp: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.NotFound(writer, request)
+		return
+	}
+	if chirp.AuthorId != caller.UserId {
+		http.Error(writer, "Not allowed", http.StatusForbidden)
+		return
+	}
+	_, err = config.db.DeleteChirp(chirp.Id)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Error deleting chirp: %v", err), http.StatusInternalServerError)
+		return
+	}
+	setWebHeaders(writer)
+	writer.WriteHeader(http.StatusOK)
+}
+
+// Gets the page to go to after logging in, from `?next=`. Only paths on Chirpy are accepted, so the login page can't send users to other sites.
+//
+//	Browsers drop tabs and newlines from URLs and treat backslashes like slashes, so `/\t/evil.example` would be followed to `//evil.example`. Any of those characters rejects the path
+func nextPath(request *http.Request) string {
+	next := request.URL.Query().Get("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.ContainsRune(next, '\\') {
+		return "/"
+	}
+	for _, char := range next {
+		if char < 0x20 || char == 0x7f {
+			return "/"
+		}
+	}
+	parsed, err := url.Parse(next)
+	if err != nil || parsed.Scheme != "" || parsed.Host != "" {
+		return "/"
+	}
+	return next
+}
+
+// Shows the login form. Logged in users are sent on to `?next=`, or the timeline
+func (config *apiConfig) WebLoginPage(writer http.ResponseWriter, request *http.Request) {
+	if _, found := principalFrom(request); found {
+		webRedirect(writer, request, nextPath(request))
+		return
+	}
+	renderLoginPage(writer, request, http.StatusOK, webPage{Title: "Log in"})
+}
+
+// Renders the login or signup form with its form token
+func renderLoginPage(writer http.ResponseWriter, request *http.Request, status int, page webPage) {
+	token, err := loginFormToken(writer, request)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Error creating form token: %v", err), http.StatusInternalServerError)
+		return
+	}
+	page.FormToken = token
+	renderWebPage(writer, status, "login", page)
+}
+
+// Logs in from the login form, starting a browser session with cookies and going on to `?next=`
+func (config *apiConfig) WebLogin(writer http.ResponseWriter, request *http.Request) {
+	err := checkLoginFormToken(request)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusForbidden)
+		return
+	}
+	email := request.PostFormValue("email")
+	user, status, message, err := config.checkFormLogin(request, email, request.PostFormValue("password"), request.PostFormValue("code"))
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if message != "" {
+		renderLoginPage(writer, request, status, webPage{Title: "Log in", Email: email, Error: message})
+		return
+	}
+	config.startWebSession(writer, request, user, nextPath(request))
+}
+
+// Shows the signup form. Logged in users are sent to the timeline
+func (config *apiConfig) WebSignupPage(writer http.ResponseWriter, request *http.Request) {
+	if _, found := principalFrom(request); found {
+		webRedirect(writer, request, "/")
+		return
+	}
+	renderLoginPage(writer, request, http.StatusOK, webPage{Title: "Sign up", Signup: true})
+}
+
+// Creates a user from the signup form and logs them in. New passwords have to satisfy the password policy, like /api/users
+func (config *apiConfig) WebSignup(writer http.ResponseWriter, request *http.Request) {
+	err := checkLoginFormToken(request)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusForbidden)
+		return
+	}
+	email, password := request.PostFormValue("email"), request.PostFormValue("password")
+	page := webPage{Title: "Sign up", Signup: true, Email: email}
+	if problem := config.passwordPolicy.check(password, email); problem != "" {
+		page.Error = problem
+		renderLoginPage(writer, request, http.StatusBadRequest, page)
+		return
+	}
+	user, err := config.db.CreateUser(email, password)
+	if err == database.ErrInvalidEmail || err == database.ErrEmailInUse {
+		page.Error = err.Error()
+		renderLoginPage(writer, request, http.StatusBadRequest, page)
+		return
+	}
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Error creating user: %v", err), http.StatusInternalServerError)
+		return
+	}
+	config.sendEmailVerificationLater(user.Id, user.Email)
+	config.startWebSession(writer, request, user, "/")
+}
+
+// Starts a browser session for the user and sends them to `target`
+func (config *apiConfig) startWebSession(writer http.ResponseWriter, request *http.Request, user database.User, target string) {
+	accessToken, refreshToken, err := config.startSession(user, request)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = setSessionCookies(writer, accessToken, refreshToken)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Error creating CSRF token: %v", err), http.StatusInternalServerError)
+		return
+	}
+	webRedirect(writer, request, target)
+}
+
+// Logs out, revoking the browser's session and removing its cookies
+func (config *apiConfig) WebLogout(writer http.ResponseWriter, request *http.Request) {
+	caller, found := principalFrom(request)
+	if found {
+		_, err := config.db.DeleteRefreshTokenFamily(caller.SessionId)
+		if err != nil {
+			http.Error(writer, fmt.Sprintf("Error revoking session: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	clearSessionCookies(writer)
+	webRedirect(writer, request, "/")
+}
@@ -0,0 +1,211 @@
+package apiConfig
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func newWebRouter(config apiConfig) http.Handler {
+	router := chi.NewRouter()
+	router.Use(config.MiddlewareWebSession)
+	router.Get("/", config.WebTimeline)
+	router.Get("/users/{userId}", config.WebProfile)
+	router.Get("/chirps", config.WebChirps)
+	router.Post("/chirps", config.WebPostChirp)
+	router.Delete("/chirps/{chirpId}", config.WebDeleteChirp)
+	router.Get("/login", config.WebLoginPage)
+	router.Post("/login", config.WebLogin)
+	router.Post("/signup", config.WebSignup)
+	router.Post("/logout", config.WebLogout)
+	return router
+}
+
+// Sends a request to the web pages as a browser with the cookies. HTMX requests send the CSRF cookie back in the CSRF header, like the layout sets up
+func browse(router http.Handler, method string, path string, form url.Values, cookies []*http.Cookie, htmx bool) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, cookie := range cookies {
+		request.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+		if htmx && cookie.Name == csrfCookieName {
+			request.Header.Set(csrfHeaderName, cookie.Value)
+		}
+	}
+	if htmx {
+		request.Header.Set("HX-Request", "true")
+	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+// Posts the login or signup form at `path` like a browser that just loaded it, sending back the form token from its cookie
+func postLoginForm(router http.Handler, path string, form url.Values) *httptest.ResponseRecorder {
+	cookies := browse(router, http.MethodGet, "/login", nil, nil, false).Result().Cookies()
+	for _, cookie := range cookies {
+		if cookie.Name == loginCSRFCookieName {
+			form.Set(loginCSRFField, cookie.Value)
+		}
+	}
+	return browse(router, http.MethodPost, path, form, cookies, false)
+}
+
+func TestWebPages(t *testing.T) {
+	config, _, _ := newTestAuthConfig(t)
+	router := newWebRouter(config)
+
+	response := postLoginForm(router, "/signup", url.Values{"email": {"web@example.com"}, "password": {"password"}})
+	if response.Code != http.StatusBadRequest || !strings.Contains(response.Body.String(), "common") {
+		t.Fatalf("Expected a common password to be refused at signup: %v %s", response.Code, response.Body)
+	}
+	response = postLoginForm(router, "/signup", url.Values{"email": {"web@example.com"}, "password": {"correct horse battery"}})
+	if response.Code != http.StatusSeeOther || response.Header().Get("Location") != "/" || len(response.Result().Cookies()) != 3 {
+		t.Fatalf("Error signing up: %v %v", response.Code, response.Result().Cookies())
+	}
+	cookies := response.Result().Cookies()
+
+	response = browse(router, http.MethodGet, "/login", nil, cookies, false)
+	if response.Code != http.StatusSeeOther {
+		t.Fatalf("Expected a logged in user to be sent to the timeline from the login page, actual: %v", response.Code)
+	}
+	response = browse(router, http.MethodGet, "/", nil, cookies, false)
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), `hx-post="/chirps"`) || !strings.Contains(response.Body.String(), "web@example.com") {
+		t.Fatalf("Timeline not shown logged in: %v %s", response.Code, response.Body)
+	}
+	if !strings.Contains(response.Body.String(), `integrity="sha384-`) {
+		t.Fatal("Expected HTMX to be loaded with its integrity hash, so a compromised CDN can't run scripts on logged in pages")
+	}
+
+	if browse(router, http.MethodPost, "/chirps", url.Values{"body": {"Forged"}}, cookies, false).Code != http.StatusForbidden {
+		t.Fatal("Expected a chirp posted without the CSRF token to be forbidden")
+	}
+	response = browse(router, http.MethodPost, "/chirps", url.Values{"body": {strings.Repeat("a", 141)}}, cookies, true)
+	if response.Header().Get("HX-Retarget") != "#compose-error" || !strings.Contains(response.Body.String(), "Chirp is too long") {
+		t.Fatalf("Expected a long chirp's error to be shown under the compose box: %v %s", response.Header(), response.Body)
+	}
+	for i := 1; i <= webChirpPageSize+5; i++ {
+		response = browse(router, http.MethodPost, "/chirps", url.Values{"body": {fmt.Sprintf("Chirp %d", i)}}, cookies, true)
+		if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), fmt.Sprintf("Chirp %d", i)) {
+			t.Fatalf("Error posting chirp: %v %s", response.Code, response.Body)
+		}
+	}
+	if !strings.Contains(response.Body.String(), `hx-delete="/chirps/`) {
+		t.Fatal("Posted chirp rendered without a delete button")
+	}
+
+	// The timeline shows a page of chirps, then loads the rest as it's scrolled
+	response = browse(router, http.MethodGet, "/", nil, nil, false)
+	body := response.Body.String()
+	if strings.Count(body, `class="chirp"`) != webChirpPageSize || !strings.Contains(body, "Chirp 25") || strings.Contains(body, "Chirp 5<") {
+		t.Fatalf("Timeline's first page shown incorrectly: %s", body)
+	}
+	if strings.Contains(body, "hx-delete") || strings.Contains(body, `hx-post="/chirps"`) {
+		t.Fatal("Logged out timeline shown with a compose box or delete buttons")
+	}
+	response = browse(router, http.MethodGet, "/chirps?before=6", nil, nil, true)
+	body = response.Body.String()
+	if strings.Count(body, `class="chirp"`) != 5 || strings.Contains(body, "hx-trigger") {
+		t.Fatalf("Last page of chirps loaded incorrectly: %s", body)
+	}
+
+	response = browse(router, http.MethodGet, "/users/1", nil, cookies, false)
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), "This is you") || !strings.Contains(response.Body.String(), `author_id=1`) {
+		t.Fatalf("Profile shown incorrectly: %v %s", response.Code, response.Body)
+	}
+
+	other, err := config.db.CreateUser("other@example.com", "password")
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	othersChirp, err := config.db.CreateChirp("Not yours", other.Id)
+	if err != nil {
+		t.Fatalf("Error creating chirp: %v", err)
+	}
+	if browse(router, http.MethodDelete, fmt.Sprintf("/chirps/%d", othersChirp.Id), nil, cookies, true).Code != http.StatusForbidden {
+		t.Fatal("Deleted another user's chirp")
+	}
+	if browse(router, http.MethodDelete, "/chirps/1", nil, cookies, true).Code != http.StatusOK {
+		t.Fatal("Error deleting own chirp")
+	}
+	if _, found, _ := config.db.GetChirp(1); found {
+		t.Fatal("Deleted chirp still found")
+	}
+
+	response = browse(router, http.MethodPost, "/logout", nil, cookies, true)
+	if response.Header().Get("HX-Redirect") != "/" {
+		t.Fatalf("Error logging out: %v %v", response.Code, response.Header())
+	}
+	response = browse(router, http.MethodGet, "/", nil, cookies, false)
+	if strings.Contains(response.Body.String(), `hx-post="/chirps"`) {
+		t.Fatal("Timeline still shown logged in after logging out")
+	}
+
+	// Another site posting the forms can't read the form token's cookie, so it can't log the browser into its own account
+	forged := url.Values{"email": {"web@example.com"}, "password": {"correct horse battery"}}
+	if browse(router, http.MethodPost, "/login", forged, nil, false).Code != http.StatusForbidden {
+		t.Fatal("Expected a login without the form token to be forbidden")
+	}
+	forged.Set(loginCSRFField, "guessed")
+	if browse(router, http.MethodPost, "/login", forged, []*http.Cookie{{Name: loginCSRFCookieName, Value: "other"}}, false).Code != http.StatusForbidden {
+		t.Fatal("Expected a login with a form token that doesn't match its cookie to be forbidden")
+	}
+	if browse(router, http.MethodPost, "/signup", url.Values{"email": {"forged@example.com"}, "password": {"correct horse battery"}}, nil, false).Code != http.StatusForbidden {
+		t.Fatal("Expected a signup without the form token to be forbidden")
+	}
+	response = browse(router, http.MethodGet, "/login", nil, nil, false)
+	cookies = response.Result().Cookies()
+	if len(cookies) != 1 || !strings.Contains(response.Body.String(), `name="csrf_token" value="`+cookies[0].Value+`"`) {
+		t.Fatalf("Login form shown without its form token: %v %s", cookies, response.Body)
+	}
+
+	response = postLoginForm(router, "/login", url.Values{"email": {"web@example.com"}, "password": {"wrong"}})
+	if response.Code != http.StatusUnauthorized || !strings.Contains(response.Body.String(), "Invalid email or password") {
+		t.Fatalf("Expected a wrong password to be shown on the login page: %v", response.Code)
+	}
+	response = postLoginForm(router, "/login", url.Values{"email": {"web@example.com"}, "password": {"correct horse battery"}})
+	if response.Code != http.StatusSeeOther || len(response.Result().Cookies()) != 3 {
+		t.Fatalf("Error logging in: %v", response.Code)
+	}
+}
+
+func TestNextPath(t *testing.T) {
+	for next, expected := range map[string]string{
+		"/admin/users?q=a":        "/admin/users?q=a",
+		"/users/2":                "/users/2",
+		"":                        "/",
+		"https://evil.example":    "/",
+		"//evil.example":          "/",
+		"/\\evil.example":         "/",
+		"/\t/evil.example":        "/",
+		"/\n/evil.example":        "/",
+		"/\r/evil.example":        "/",
+		"/users/\x7f":             "/",
+		"javascript:alert(1)":     "/",
+		"evil.example/after-path": "/",
+	} {
+		request := httptest.NewRequest(http.MethodGet, "/login?"+url.Values{"next": {next}}.Encode(), nil)
+		if actual := nextPath(request); actual != expected {
+			t.Fatalf("Expected next %q to go to %q, actual: %q", next, expected, actual)
+		}
+	}
+
+	// Logged in users are redirected straight away, so a link to the login page is enough to try it
+	config, _, _ := newTestAuthConfig(t)
+	router := newWebRouter(config)
+	_, err := config.db.CreateUser("user@example.com", "password")
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	cookies := webLogin(t, router, "user@example.com", "password")
+	for _, query := range []string{"next=%2F%09%2Fevil.example", "next=%2F%0A%2Fevil.example", "next=%2F%5Cevil.example"} {
+		response := browse(router, http.MethodGet, "/login?"+query, nil, cookies, false)
+		if response.Code != http.StatusSeeOther || response.Header().Get("Location") != "/" {
+			t.Fatalf("Expected ?%s to be ignored: %v %v", query, response.Code, response.Header())
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// Defines the ApiKey type and database functions for personal API keys
+
+package database
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"time"
+)
+
+var ErrApiKeyNotFound = errors.New("API key not found")
+
+// What scoped credentials, like API keys, can be allowed to do
+const (
+	ScopeChirpsWrite  = "chirps:write"  // Posting and deleting chirps
+	ScopeProfileWrite = "profile:write" // Changing the user's email and password
+)
+
+var scopes = []string{ScopeChirpsWrite, ScopeProfileWrite}
+
+// Reports whether `scope` is one of the defined scopes
+func ValidScope(scope string) bool {
+	return slices.Contains(scopes, scope)
+}
+
+// Lists every defined scope, in the order they should be shown
+func AllScopes() []string {
+	return slices.Clone(scopes)
+}
+
+// A long-lived key a user created for a bot or integration. Only the key's hash is stored, like refresh tokens
+type ApiKey struct {
+	Id        string    `json:"id"` // Identifies the key in listings and revocations, since the key itself is only shown once
+	UserId    int       `json:"user_id"`
+	Name      string    `json:"name"`
+	Prefix    string    `json:"prefix"` // The start of the key, so the user can tell their keys apart
+	Scopes    []string  `json:"scopes"` // What the key is allowed to do
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Gets a copy of the API key with the given hash, or nil if there isn't one
+func (dbStructure *DBStructure) findApiKey(keyHash string) *ApiKey {
+	apiKey, found := dbStructure.ApiKeys[keyHash]
+	if !found {
+		return nil
+	}
+	apiKey.Scopes = slices.Clone(apiKey.Scopes)
+	return &apiKey
+}
+
+// Orders API keys oldest first, by id for keys created at the same time
+func sortApiKeys(apiKeys []ApiKey) {
+	slices.SortFunc(apiKeys, func(a, b ApiKey) int {
+		if c := a.CreatedAt.Compare(b.CreatedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Id, b.Id)
+	})
+}
+
+// Stores a new API key.
+//
+//	`key` is the plaintext key given to the user. Only its hash is saved
+func (db *DB) CreateApiKey(key string, apiKey ApiKey) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.putApiKey(hashToken(key), apiKey)
+	})
+}
+
+// Gets the API key matching the plaintext `key`
+func (db *DB) GetApiKey(key string) (apiKey ApiKey, found bool, err error) {
+	err = db.View(func(tx *Tx) error {
+		existing := tx.data.findApiKey(hashToken(key))
+		if existing != nil {
+			apiKey, found = *existing, true
+		}
+		return nil
+	})
+	if err != nil || !found {
+		return ApiKey{}, false, err
+	}
+	return apiKey, true, nil
+}
+
+// Lists the user's API keys, oldest first
+func (db *DB) GetUserApiKeys(userId int) ([]ApiKey, error) {
+	apiKeys := []ApiKey{}
+	err := db.View(func(tx *Tx) error {
+		for keyHash, apiKey := range tx.data.ApiKeys {
+			if apiKey.UserId == userId {
+				apiKeys = append(apiKeys, *tx.data.findApiKey(keyHash))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortApiKeys(apiKeys)
+	return apiKeys, nil
+}
+
+// Revokes one of the user's API keys.
+//
+//	Errors with `ErrApiKeyNotFound` if the user has no key with the id
+func (db *DB) DeleteApiKey(userId int, id string) error {
+	return db.Update(func(tx *Tx) error {
+		for keyHash, apiKey := range tx.data.ApiKeys {
+			if apiKey.UserId == userId && apiKey.Id == id {
+				return tx.deleteApiKey(keyHash)
+			}
+		}
+		return ErrApiKeyNotFound
+	})
+}
@@ -0,0 +1,71 @@
+package database
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestApiKeys(t *testing.T) {
+	testDb := NewDB("./testdatabase.json")
+
+	err := cleanupDbFile(testDb.path)
+	if err != nil {
+		t.Fatalf("Error cleaning up database file: %v", err)
+	}
+	testApiKeys(t, testDb)
+}
+
+// API key behavior shared by the database backends
+func testApiKeys(t *testing.T, store Store) {
+	now := time.Now().UTC()
+	err := store.CreateApiKey("chirpy_second", ApiKey{Id: "second", UserId: 3, Name: "Second", Prefix: "chirpy_s", Scopes: []string{"chirps:read"}, CreatedAt: now.Add(time.Minute)})
+	if err != nil {
+		t.Fatalf("Error creating API key: %v", err)
+	}
+	err = store.CreateApiKey("chirpy_first", ApiKey{Id: "first", UserId: 3, Name: "First", Prefix: "chirpy_f", Scopes: []string{"chirps:read", "chirps:write"}, CreatedAt: now})
+	if err != nil {
+		t.Fatalf("Error creating API key: %v", err)
+	}
+	err = store.CreateApiKey("chirpy_other", ApiKey{Id: "other", UserId: 4, Name: "Other", Prefix: "chirpy_o", Scopes: []string{}, CreatedAt: now})
+	if err != nil {
+		t.Fatalf("Error creating API key: %v", err)
+	}
+
+	apiKey, found, err := store.GetApiKey("chirpy_first")
+	if err != nil || !found {
+		t.Fatalf("Error getting API key: %v, %v", found, err)
+	}
+	if apiKey.Id != "first" || apiKey.UserId != 3 || apiKey.Name != "First" || !slices.Equal(apiKey.Scopes, []string{"chirps:read", "chirps:write"}) {
+		t.Fatalf("API key read back with incorrect data: %+v", apiKey)
+	}
+	_, found, err = store.GetApiKey("first")
+	if err != nil || found {
+		t.Fatalf("Found an API key by its id: %v, %v", found, err)
+	}
+
+	apiKeys, err := store.GetUserApiKeys(3)
+	if err != nil {
+		t.Fatalf("Error listing API keys: %v", err)
+	}
+	if len(apiKeys) != 2 || apiKeys[0].Id != "first" || apiKeys[1].Id != "second" {
+		t.Fatalf("API keys listed incorrectly: %+v", apiKeys)
+	}
+
+	err = store.DeleteApiKey(3, "other")
+	if err != ErrApiKeyNotFound {
+		t.Fatalf("Expected another user's key to be missing, actual: %v", err)
+	}
+	err = store.DeleteApiKey(3, "first")
+	if err != nil {
+		t.Fatalf("Error deleting API key: %v", err)
+	}
+	_, found, err = store.GetApiKey("chirpy_first")
+	if err != nil || found {
+		t.Fatalf("Deleted API key still found: %v, %v", found, err)
+	}
+	apiKeys, err = store.GetUserApiKeys(3)
+	if err != nil || len(apiKeys) != 1 {
+		t.Fatalf("Deleted API key still listed: %+v, %v", apiKeys, err)
+	}
+}
@@ -0,0 +1,58 @@
+// Defines the AuditEvent type and database functions for recording privileged actions
+
+package database
+
+import (
+	"sort"
+	"time"
+)
+
+const auditEventSequence = "audit_events"
+
+// A record of a privileged action
+type AuditEvent struct {
+	Id        int       `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	ActorId   int       `json:"actor_id"` // The user who acted, or 0 for the command line
+	Action    string    `json:"action"`   // What was done, e.g. `user.role` or `chirp.delete`
+	Target    string    `json:"target"`   // What it was done to, e.g. `user:3`
+	Details   string    `json:"details"`
+	IpAddress string    `json:"ip_address"`
+}
+
+// Records an audit event with the next id in the audit event sequence
+func (db *DB) CreateAuditEvent(event AuditEvent) (AuditEvent, error) {
+	err := db.Update(func(tx *Tx) error {
+		id, err := tx.nextId(auditEventSequence)
+		if err != nil {
+			return err
+		}
+		event.Id = id
+		return tx.putAuditEvent(event)
+	})
+	if err != nil {
+		return AuditEvent{}, err
+	}
+	return event, nil
+}
+
+// Gets the most recent audit events, newest first. A `limit` of 0 gets every event
+func (db *DB) GetAuditEvents(limit int) ([]AuditEvent, error) {
+	events := []AuditEvent{}
+	err := db.View(func(tx *Tx) error {
+		for _, event := range tx.data.AuditEvents {
+			events = append(events, event)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Id > events[j].Id
+	})
+	if limit > 0 && len(events) > limit {
+		events = events[:limit]
+	}
+	return events, nil
+}
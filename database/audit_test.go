@@ -0,0 +1,46 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAuditEvents(t *testing.T) {
+	testDb := NewDB("./testdatabase.json")
+
+	err := cleanupDbFile(testDb.path)
+	if err != nil {
+		t.Fatalf("Error cleaning up database file: %v", err)
+	}
+	testAuditEvents(t, testDb)
+}
+
+// Audit event behavior shared by the database backends
+func testAuditEvents(t *testing.T, store Store) {
+	now := time.Now().UTC().Truncate(time.Second)
+	for _, action := range []string{"first", "second", "third"} {
+		_, err := store.CreateAuditEvent(AuditEvent{CreatedAt: now, ActorId: 1, Action: action, Target: "user:2", IpAddress: "192.0.2.1"})
+		if err != nil {
+			t.Fatalf("Error creating audit event: %v", err)
+		}
+	}
+
+	events, err := store.GetAuditEvents(2)
+	if err != nil {
+		t.Fatalf("Error getting audit events: %v", err)
+	}
+	if len(events) != 2 || events[0].Action != "third" || events[1].Action != "second" {
+		t.Fatalf("Expected the two newest events, newest first, actual: %+v", events)
+	}
+	if events[0].Id != 3 || !events[0].CreatedAt.Equal(now) || events[0].Target != "user:2" || events[0].IpAddress != "192.0.2.1" {
+		t.Fatalf("Audit event read back with incorrect data: %+v", events[0])
+	}
+
+	events, err = store.GetAuditEvents(0)
+	if err != nil {
+		t.Fatalf("Error getting audit events: %v", err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("Expected every audit event, actual: %+v", events)
+	}
+}
@@ -8,21 +8,26 @@ type Chirp struct {
 	AuthorId int    `json:"author_id"`
 }
 
-// Creates a new chirp and saves it to the database
-func (db *DB) CreateChirp(body string, authorId int) (Chirp, error) {
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return Chirp{}, err
-	}
-	if dbStructure.Chirps == nil {
-		dbStructure.Chirps = map[int]Chirp{}
+// Gets a copy of the chirp with the given id, or nil if there isn't one
+func (dbStructure *DBStructure) findChirp(id int) *Chirp {
+	chirp, found := dbStructure.Chirps[id]
+	if !found {
+		return nil
 	}
+	return &chirp
+}
 
-	id := len(dbStructure.Chirps) + 1 // TODO: Delete operation breaks this method of id determination. Need to update
-	chirp := Chirp{Id: id, Body: body, AuthorId: authorId}
-
-	dbStructure.Chirps[chirp.Id] = chirp
-	err = db.writeDB(dbStructure)
+// Creates a new chirp and saves it to the database
+func (db *DB) CreateChirp(body string, authorId int) (Chirp, error) {
+	chirp := Chirp{Body: body, AuthorId: authorId}
+	err := db.Update(func(tx *Tx) error {
+		id, err := tx.nextId(chirpSequence)
+		if err != nil {
+			return err
+		}
+		chirp.Id = id
+		return tx.putChirp(chirp)
+	})
 	if err != nil {
 		return Chirp{}, err
 	}
@@ -32,56 +37,43 @@ func (db *DB) CreateChirp(body string, authorId int) (Chirp, error) {
 
 // Gets a chirp by its id, if it exists
 func (db *DB) GetChirp(id int) (chirp Chirp, found bool, err error) {
-	dbStructure, err := db.loadDB()
-	if err != nil {
+	err = db.View(func(tx *Tx) error {
+		chirp, found = tx.data.Chirps[id]
+		return nil
+	})
+	if err != nil || !found {
 		return Chirp{}, false, err
 	}
-
-	if dbStructure.Chirps == nil || len(dbStructure.Chirps) == 0 {
-		return Chirp{}, false, nil
-	}
-	chirp, found = dbStructure.Chirps[id]
-	if !found {
-		return Chirp{}, false, nil
-	}
 	return chirp, true, nil
 }
 
 // Gets all of the existing Chirps
 func (db *DB) GetChirps() ([]Chirp, error) {
-	dbStructure, err := db.loadDB()
+	chirps := []Chirp{}
+	err := db.View(func(tx *Tx) error {
+		for _, chirp := range tx.data.Chirps {
+			chirps = append(chirps, chirp)
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	if dbStructure.Chirps == nil || len(dbStructure.Chirps) == 0 {
-		return []Chirp{}, nil
-	}
-
-	chirps := []Chirp{}
-	for _, chirp := range dbStructure.Chirps {
-		chirps = append(chirps, chirp)
-	}
-
 	return chirps, nil
 }
 
 // Gets chirps with a specific user/author id
 func (db *DB) GetUserChirps(authorId int) ([]Chirp, error) {
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return nil, err
-	}
-
-	if dbStructure.Chirps == nil || len(dbStructure.Chirps) == 0 {
-		return []Chirp{}, nil
-	}
-
 	chirps := []Chirp{}
-	for _, chirp := range dbStructure.Chirps {
-		if chirp.AuthorId == authorId {
-			chirps = append(chirps, chirp)
+	err := db.View(func(tx *Tx) error {
+		for id := range tx.data.chirpsByAuthor[authorId] {
+			chirps = append(chirps, tx.data.Chirps[id])
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return chirps, nil
@@ -92,24 +84,15 @@ func (db *DB) GetUserChirps(authorId int) ([]Chirp, error) {
 //	`success` is true if the chirp was removed from the database, and false if the chirp was not found, the delete failed, or an error occurred.
 //	`err` is nil if the database was loaded and updated successfully, or has error information if those operations errored
 func (db *DB) DeleteChirp(chirpId int) (success bool, err error) {
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return false, err
-	}
-
-	if dbStructure.Chirps == nil || len(dbStructure.Chirps) == 0 {
-		return false, nil
-	}
-
-	if _, found := dbStructure.Chirps[chirpId]; !found {
-		return false, nil
-	}
-
-	delete(dbStructure.Chirps, chirpId)
-
-	err = db.writeDB(dbStructure)
+	err = db.Update(func(tx *Tx) error {
+		if _, found := tx.data.Chirps[chirpId]; !found {
+			return nil
+		}
+		success = true
+		return tx.deleteChirp(chirpId)
+	})
 	if err != nil {
 		return false, err
 	}
-	return true, nil
+	return success, nil
 }
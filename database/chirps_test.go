@@ -199,3 +199,41 @@ func TestDeleteChirp(t *testing.T) {
 		t.Fatal("Failed to delete the chirp")
 	}
 }
+
+func TestCreateChirpAfterDeleteDoesNotReuseId(t *testing.T) {
+	testDb := NewDB("./testdatabase.json")
+
+	err := cleanupDbFile(testDb.path)
+	if err != nil {
+		t.Fatalf("Error cleaning up database file: %v", err)
+	}
+
+	first, err := testDb.CreateChirp("First chirp", 10)
+	if err != nil {
+		t.Fatalf("Error creating first chirp: %v", err)
+	}
+	second, err := testDb.CreateChirp("Second chirp", 10)
+	if err != nil {
+		t.Fatalf("Error creating second chirp: %v", err)
+	}
+	_, err = testDb.DeleteChirp(first.Id)
+	if err != nil {
+		t.Fatalf("Error deleting chirp: %v", err)
+	}
+
+	third, err := testDb.CreateChirp("Third chirp", 10)
+	if err != nil {
+		t.Fatalf("Error creating third chirp: %v", err)
+	}
+	if third.Id == first.Id || third.Id == second.Id {
+		t.Fatalf("Chirp id %v was reused", third.Id)
+	}
+
+	chirp, found, err := testDb.GetChirp(second.Id)
+	if err != nil {
+		t.Fatalf("Error getting chirp: %v", err)
+	}
+	if !found || chirp.Body != second.Body {
+		t.Fatal("Existing chirp was overwritten")
+	}
+}
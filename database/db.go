@@ -3,98 +3,400 @@
 package database
 
 import (
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"log"
+	"maps"
 	"os"
+	"path/filepath"
 	"sync"
 	"time"
 )
 
 type DB struct {
-	path string
-	mux  *sync.RWMutex
+	path    string
+	mux     *sync.RWMutex
+	journal *journal // nil when journaling is disabled
+	stop    chan struct{}
+	workers *sync.WaitGroup
+
+	// In-memory copy of the database, loaded on first use. Guarded by `mux`
+	state         *DBStructure
+	dirty         bool // true if `state` has changes that haven't been written to the database file
+	flushInterval time.Duration
+	// Size, modification time, and checksum of the database file when it was last read or written, used to detect external edits
+	fileSize     int64
+	fileModTime  time.Time
+	fileChecksum [sha256.Size]byte
 }
 
 type DBStructure struct {
-	Chirps            map[int]Chirp        `json:"chirps"`
-	Users             []internalUser       `json:"users"`
-	RevokedUserTokens map[string]time.Time `json:"revoked_user_tokens"`
+	SchemaVersion      int                            `json:"schema_version"`
+	Chirps             map[int]Chirp                  `json:"chirps"`
+	Users              map[int]internalUser           `json:"users"`
+	RefreshTokens      map[string]RefreshToken        `json:"refresh_tokens"` // Keyed by token hash
+	AuditEvents        map[int]AuditEvent             `json:"audit_events"`
+	OneTimeTokens      map[string]OneTimeToken        `json:"one_time_tokens"`     // Keyed by token hash
+	TwoFactor          map[int]TwoFactor              `json:"two_factor"`          // Keyed by user id
+	ApiKeys            map[string]ApiKey              `json:"api_keys"`            // Keyed by key hash
+	OAuthClients       map[string]internalOAuthClient `json:"oauth_clients"`       // Keyed by client id
+	AuthorizationCodes map[string]AuthorizationCode   `json:"authorization_codes"` // Keyed by code hash
+	Sequences          map[string]int                 `json:"sequences"`
+	indexes
+}
+
+// Options for opening a JSON file database
+type Options struct {
+	// Record mutations in an append-only journal instead of rewriting the database file on every change
+	Journal bool
+	// How often the journal is folded back into the database file. Zero disables periodic compaction
+	CompactInterval time.Duration
+	// How often changes are written to the database file. Zero writes every change as it's made.
+	// Ignored when journaling, where every change is journaled immediately and `CompactInterval` controls file writes
+	FlushInterval time.Duration
+}
+
+func NewDB(path string) *DB {
+	return &DB{path: path, mux: &sync.RWMutex{}, workers: &sync.WaitGroup{}}
 }
 
-func NewDB(path string) DB {
-	return DB{path: path, mux: &sync.RWMutex{}}
+// Opens the database at `path` with the provided options.
+//
+//	If journaling is enabled, any journal left behind by a previous run is replayed and compacted before returning.
+//	Errors if the journal can't be recovered, in which case the database must not be used
+func OpenDB(path string, opts Options) (*DB, error) {
+	db := NewDB(path)
+	db.stop = make(chan struct{})
+
+	if !opts.Journal {
+		db.flushInterval = opts.FlushInterval
+		if db.flushInterval > 0 {
+			db.runPeriodically(db.flushInterval, db.Flush)
+		}
+		return db, nil
+	}
+
+	journal, err := openJournal(path + ".journal")
+	if err != nil {
+		return nil, err
+	}
+	db.journal = journal
+
+	err = db.Compact()
+	if err != nil {
+		journal.close()
+		return nil, err
+	}
+
+	if opts.CompactInterval > 0 {
+		db.runPeriodically(opts.CompactInterval, db.Compact)
+	}
+	return db, nil
 }
 
-// Ensures a database file exists. If one does not exist, one is created with the minimum required JSON
+// Stops background work and writes any pending changes to the database file
+func (db *DB) Close() error {
+	if db.stop != nil {
+		close(db.stop)
+		db.workers.Wait()
+	}
+
+	if db.journal == nil {
+		return db.Flush()
+	}
+	err := db.Compact()
+	closeErr := db.journal.close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// Ensures a database file exists. If one does not exist, one is created with the minimum required JSON.
+//
+//	The caller must hold the write lock, otherwise a concurrent writer's changes could be replaced by the empty file
 func (db *DB) ensureDB() error {
 	_, err := os.Stat(db.path)
 
 	if errors.Is(err, os.ErrNotExist) {
-		f, err := os.Create(db.path)
-		if err != nil {
-			return err
-		}
+		// Minimum JSON required to not error while parsing, and to not be treated as an old file needing migration
+		return writeFileAtomic(db.path, []byte(fmt.Sprintf(`{"schema_version": %d}`, CurrentSchemaVersion())))
+	}
 
-		_, err = f.WriteString("{}") // Minimum JSON required to not error while parsing
-		if err != nil {
-			return err
+	return err
+}
+
+// Gets the current database data, including any journaled changes.
+//
+//	The returned maps are shared with the in-memory copy and must not be modified
+func (db *DB) loadDB() (dbStructure DBStructure, err error) {
+	err = db.View(func(tx *Tx) error {
+		dbStructure = *tx.data
+		return nil
+	})
+	return dbStructure, err
+}
+
+// Writes the database structure to disk, replacing the existing file, any journaled changes, and the in-memory copy
+func (db *DB) writeDB(dbStructure DBStructure) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	err := db.writeState(dbStructure)
+	if err != nil {
+		return err
+	}
+	dbStructure.buildIndexes()
+	db.state = &dbStructure
+	db.dirty = false
+	return nil
+}
+
+// Copies every record in the database
+func (db *DB) Export() (dbStructure DBStructure, err error) {
+	err = db.View(func(tx *Tx) error {
+		dbStructure = DBStructure{
+			SchemaVersion:      tx.data.SchemaVersion,
+			Chirps:             maps.Clone(tx.data.Chirps),
+			Users:              maps.Clone(tx.data.Users),
+			RefreshTokens:      maps.Clone(tx.data.RefreshTokens),
+			AuditEvents:        maps.Clone(tx.data.AuditEvents),
+			OneTimeTokens:      maps.Clone(tx.data.OneTimeTokens),
+			TwoFactor:          maps.Clone(tx.data.TwoFactor),
+			ApiKeys:            maps.Clone(tx.data.ApiKeys),
+			OAuthClients:       maps.Clone(tx.data.OAuthClients),
+			AuthorizationCodes: maps.Clone(tx.data.AuthorizationCodes),
+			Sequences:          maps.Clone(tx.data.Sequences),
 		}
 		return nil
+	})
+	return dbStructure, err
+}
+
+// Replaces every record in the database with the contents of `dbStructure`, which must not be modified afterwards
+func (db *DB) Import(dbStructure DBStructure) error {
+	return db.writeDB(dbStructure)
+}
+
+// Writes any changes that are only held in memory to the database file
+func (db *DB) Flush() error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	if !db.dirty {
+		return nil
 	}
+	err := db.writeState(*db.state)
+	if err != nil {
+		return err
+	}
+	db.dirty = false
+	return nil
+}
 
-	return err
+// Folds the journal into the database file and truncates it. Does nothing if journaling is disabled
+func (db *DB) Compact() error {
+	if db.journal == nil {
+		return nil
+	}
+
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	err := db.refreshLocked()
+	if err != nil {
+		return err
+	}
+	return db.writeState(*db.state)
 }
 
-// Gets the current database data from the file on disk
-func (db *DB) loadDB() (DBStructure, error) {
+// Calls `fn` every `interval` until the database is closed
+func (db *DB) runPeriodically(interval time.Duration, fn func() error) {
+	db.workers.Add(1)
+	go func() {
+		defer db.workers.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-db.stop:
+				return
+			case <-ticker.C:
+				// Failures leave the pending changes in place, so it's safe to try again on the next tick
+				err := fn()
+				if err != nil {
+					log.Printf("Error persisting database %s: %v", db.path, err)
+				}
+			}
+		}
+	}()
+}
+
+// Loads the database into memory if it hasn't been loaded, or reloads it if the file was changed outside of this DB
+func (db *DB) refresh() error {
+	info, err := os.Stat(db.path)
+	if err == nil {
+		db.mux.RLock()
+		current := db.state != nil && db.matchesFile(info)
+		db.mux.RUnlock()
+		if current {
+			return nil
+		}
+	}
+
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	return db.refreshLocked()
+}
+
+// Same as `refresh`, but the caller must hold the write lock
+func (db *DB) refreshLocked() error {
 	err := db.ensureDB()
 	if err != nil {
-		return DBStructure{}, err
+		return err
 	}
 
-	db.mux.RLock()
-	defer db.mux.RUnlock() // Is there a way to unlock immediately after the read is complete without needing to call multiple unlocks?
+	info, err := os.Stat(db.path)
+	if err != nil {
+		return err
+	}
+	if db.state != nil && db.matchesFile(info) {
+		return nil
+	}
 
 	data, err := os.ReadFile(db.path)
 	if err != nil {
-		return DBStructure{}, err
+		return err
 	}
+	checksum := sha256.Sum256(data)
+	if db.state != nil && checksum == db.fileChecksum {
+		// Touched but not changed
+		db.rememberFile(info, checksum)
+		return nil
+	}
+	if db.state != nil && db.dirty {
+		log.Printf("WARNING: %s was changed on disk while it had unsaved changes. Keeping the in-memory copy", db.path)
+		db.rememberFile(info, checksum)
+		return nil
+	}
+
+	migrated, report, err := db.migrate(data)
+	if err != nil {
+		return err
+	}
+	dbStructure, err := db.decodeState(migrated)
+	if err != nil {
+		return err
+	}
+	db.state = &dbStructure
+	if len(report.Applied) > 0 {
+		return db.writeState(dbStructure)
+	}
+	db.rememberFile(info, checksum)
+	return nil
+}
+
+func (db *DB) matchesFile(info os.FileInfo) bool {
+	return info.Size() == db.fileSize && info.ModTime().Equal(db.fileModTime)
+}
+
+func (db *DB) rememberFile(info os.FileInfo, checksum [sha256.Size]byte) {
+	db.fileSize = info.Size()
+	db.fileModTime = info.ModTime()
+	db.fileChecksum = checksum
+}
 
+// Decodes the database file contents and replays the journal. The caller must hold the write lock
+func (db *DB) decodeState(data []byte) (DBStructure, error) {
 	dbStructure := DBStructure{}
-	err = json.Unmarshal(data, &dbStructure)
+	err := json.Unmarshal(data, &dbStructure)
 	if err != nil {
 		return DBStructure{}, err
 	}
 
+	if db.journal != nil {
+		err = db.journal.replay(&dbStructure)
+		if err != nil {
+			return DBStructure{}, err
+		}
+	}
+	dbStructure.buildIndexes()
 	return dbStructure, nil
 }
 
-// Writes the database structure to disk
-func (db *DB) writeDB(dbStructure DBStructure) error {
-	err := db.ensureDB()
+// Atomically replaces the database file and truncates the journal. The caller must hold the write lock
+func (db *DB) writeState(dbStructure DBStructure) error {
+	dbStructure.SchemaVersion = CurrentSchemaVersion()
+	data, err := json.MarshalIndent(dbStructure, "", "\t")
 	if err != nil {
 		return err
 	}
 
-	data, err := json.MarshalIndent(dbStructure, "", "\t")
+	err = writeFileAtomic(db.path, data)
 	if err != nil {
 		return err
 	}
+	info, err := os.Stat(db.path)
+	if err != nil {
+		return err
+	}
+	db.rememberFile(info, sha256.Sum256(data))
 
-	db.mux.Lock()
-	defer db.mux.Unlock()
-	file, err := os.OpenFile(db.path, os.O_WRONLY|os.O_TRUNC, 0644)
+	if db.journal != nil {
+		return db.journal.truncate()
+	}
+	return nil
+}
+
+// Writes data to a temporary file next to `path`, syncs it, and renames it over `path`.
+//
+//	A crash at any point leaves either the old or the new file in place, never a partially written one
+func writeFileAtomic(path string, data []byte) (err error) {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	_, err = tmp.Write(data)
 	if err != nil {
 		return err
 	}
-	_, err = file.Write(data)
+	err = tmp.Sync()
 	if err != nil {
 		return err
 	}
-	err = file.Close()
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(tmp.Name(), 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), path)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return syncDir(dir)
+}
+
+// Syncs a directory so a rename inside it is durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
 }
@@ -3,7 +3,10 @@ package database
 import (
 	"errors"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestLoadEmptyDB(t *testing.T) {
@@ -99,3 +102,103 @@ func cleanupDbFile(path string) error {
 	}
 	return nil
 }
+
+func TestWriteDBIsAtomic(t *testing.T) {
+	testDb := NewDB("./testdatabase.json")
+
+	err := cleanupDbFile(testDb.path)
+	if err != nil {
+		t.Fatalf("Error cleaning up database file: %v", err)
+	}
+
+	err = testDb.writeDB(DBStructure{Chirps: map[int]Chirp{1: {Id: 1, Body: "First chirp"}}})
+	if err != nil {
+		t.Fatalf("Error writing database: %v", err)
+	}
+
+	tempFiles, err := filepath.Glob(testDb.path + ".tmp-*")
+	if err != nil {
+		t.Fatalf("Error listing temporary files: %v", err)
+	}
+	if len(tempFiles) != 0 {
+		t.Fatalf("Temporary files left behind: %v", tempFiles)
+	}
+}
+
+func TestReloadsAfterExternalEdit(t *testing.T) {
+	testDb := NewDB("./testdatabase.json")
+
+	err := cleanupDbFile(testDb.path)
+	if err != nil {
+		t.Fatalf("Error cleaning up database file: %v", err)
+	}
+
+	_, err = testDb.CreateChirp("Cached chirp", 1)
+	if err != nil {
+		t.Fatalf("Error creating chirp: %v", err)
+	}
+
+	err = os.WriteFile(testDb.path, []byte(`{"chirps": {"7": {"id": 7, "body": "Edited by hand", "author_id": 2}}}`), 0644)
+	if err != nil {
+		t.Fatalf("Error editing database file: %v", err)
+	}
+	// Make sure the edit is visible even on file systems with coarse modification times
+	future := time.Now().Add(time.Minute)
+	err = os.Chtimes(testDb.path, future, future)
+	if err != nil {
+		t.Fatalf("Error touching database file: %v", err)
+	}
+
+	chirps, err := testDb.GetChirps()
+	if err != nil {
+		t.Fatalf("Error getting chirps: %v", err)
+	}
+	if len(chirps) != 1 || chirps[0].Body != "Edited by hand" {
+		t.Fatalf("External edit was not picked up: %v", chirps)
+	}
+}
+
+func TestFlushIntervalBatchesWrites(t *testing.T) {
+	path := "./testdatabase.json"
+	err := cleanupDbFile(path)
+	if err != nil {
+		t.Fatalf("Error cleaning up database file: %v", err)
+	}
+
+	testDb, err := OpenDB(path, Options{FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+
+	chirp, err := testDb.CreateChirp("Batched chirp", 1)
+	if err != nil {
+		t.Fatalf("Error creating chirp: %v", err)
+	}
+	_, found, err := testDb.GetChirp(chirp.Id)
+	if err != nil {
+		t.Fatalf("Error getting chirp: %v", err)
+	}
+	if !found {
+		t.Fatal("Unflushed chirp was not served from memory")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Error reading database file: %v", err)
+	}
+	if strings.Contains(string(data), chirp.Body) {
+		t.Fatal("Database file was written before the flush interval")
+	}
+
+	err = testDb.Close()
+	if err != nil {
+		t.Fatalf("Error closing database: %v", err)
+	}
+	data, err = os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Error reading database file: %v", err)
+	}
+	if !strings.Contains(string(data), chirp.Body) {
+		t.Fatal("Pending changes were not written when the database was closed")
+	}
+}
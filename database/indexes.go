@@ -0,0 +1,93 @@
+// Defines the in-memory secondary indexes kept alongside the database structure
+
+package database
+
+import (
+	"log"
+	"strings"
+)
+
+// Secondary indexes over a DBStructure. They aren't persisted and are rebuilt whenever the structure is loaded
+type indexes struct {
+	userIdsByEmail        map[string]int                 // Lowercased email -> user id
+	chirpsByAuthor        map[int]map[int]struct{}       // Author id -> set of chirp ids
+	refreshTokensByFamily map[string]map[string]struct{} // Family id -> set of refresh token hashes
+}
+
+// Normalizes an email for comparison. Emails are unique regardless of case
+func normalizeEmail(email string) string {
+	return strings.ToLower(email)
+}
+
+// Rebuilds every index from the structure's records.
+//
+//	If two existing users share an email ignoring case, the lower id keeps the email in the index
+func (dbStructure *DBStructure) buildIndexes() {
+	dbStructure.indexes = indexes{
+		userIdsByEmail:        map[string]int{},
+		chirpsByAuthor:        map[int]map[int]struct{}{},
+		refreshTokensByFamily: map[string]map[string]struct{}{},
+	}
+
+	for id, intUsr := range dbStructure.Users {
+		email := normalizeEmail(intUsr.Email)
+		if existing, found := dbStructure.userIdsByEmail[email]; found {
+			log.Printf("WARNING: users %d and %d share the email %s", min(id, existing), max(id, existing), email)
+			id = min(id, existing)
+		}
+		dbStructure.userIdsByEmail[email] = id
+	}
+	for _, chirp := range dbStructure.Chirps {
+		dbStructure.indexChirp(nil, &chirp)
+	}
+	for tokenHash, refreshToken := range dbStructure.RefreshTokens {
+		dbStructure.indexRefreshToken(tokenHash, nil, &refreshToken)
+	}
+}
+
+// Moves a user's index entries from `previous` to `current`. Either may be nil for an insert or delete
+func (dbStructure *DBStructure) indexUser(previous *internalUser, current *internalUser) {
+	if previous != nil {
+		email := normalizeEmail(previous.Email)
+		if dbStructure.userIdsByEmail[email] == previous.Id {
+			delete(dbStructure.userIdsByEmail, email)
+		}
+	}
+	if current != nil {
+		dbStructure.userIdsByEmail[normalizeEmail(current.Email)] = current.Id
+	}
+}
+
+// Moves a chirp's index entries from `previous` to `current`. Either may be nil for an insert or delete
+func (dbStructure *DBStructure) indexChirp(previous *Chirp, current *Chirp) {
+	if previous != nil {
+		authored := dbStructure.chirpsByAuthor[previous.AuthorId]
+		delete(authored, previous.Id)
+		if len(authored) == 0 {
+			delete(dbStructure.chirpsByAuthor, previous.AuthorId)
+		}
+	}
+	if current != nil {
+		if dbStructure.chirpsByAuthor[current.AuthorId] == nil {
+			dbStructure.chirpsByAuthor[current.AuthorId] = map[int]struct{}{}
+		}
+		dbStructure.chirpsByAuthor[current.AuthorId][current.Id] = struct{}{}
+	}
+}
+
+// Moves a refresh token's index entries from `previous` to `current`. Either may be nil for an insert or delete
+func (dbStructure *DBStructure) indexRefreshToken(tokenHash string, previous *RefreshToken, current *RefreshToken) {
+	if previous != nil {
+		family := dbStructure.refreshTokensByFamily[previous.FamilyId]
+		delete(family, tokenHash)
+		if len(family) == 0 {
+			delete(dbStructure.refreshTokensByFamily, previous.FamilyId)
+		}
+	}
+	if current != nil {
+		if dbStructure.refreshTokensByFamily[current.FamilyId] == nil {
+			dbStructure.refreshTokensByFamily[current.FamilyId] = map[string]struct{}{}
+		}
+		dbStructure.refreshTokensByFamily[current.FamilyId][tokenHash] = struct{}{}
+	}
+}
@@ -0,0 +1,115 @@
+package database
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestEmailsUniqueIgnoringCase(t *testing.T) {
+	testDb := NewDB("./testdatabase.json")
+
+	err := cleanupDbFile(testDb.path)
+	if err != nil {
+		t.Fatalf("Error cleaning up database file: %v", err)
+	}
+
+	first, err := testDb.CreateUser("foobar@example.com", "foobar")
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	_, err = testDb.CreateUser("FooBar@Example.com", "foobar")
+	if err != ErrEmailInUse {
+		t.Fatalf("Expected an email in use error, actual: %v", err)
+	}
+
+	second, err := testDb.CreateUser("other@example.com", "foobar")
+	if err != nil {
+		t.Fatalf("Error creating second user: %v", err)
+	}
+	_, err = testDb.UpdateUser(second.Id, "FOOBAR@example.com", "")
+	if err != ErrEmailInUse {
+		t.Fatalf("Expected an email in use error on update, actual: %v", err)
+	}
+
+	user, err := testDb.ValidateCredentials("FOOBAR@EXAMPLE.COM", "foobar")
+	if err != nil {
+		t.Fatalf("Error validating credentials with a differently cased email: %v", err)
+	}
+	if user.Id != first.Id {
+		t.Fatal("Validated credentials for the wrong user")
+	}
+}
+
+func TestUpdateUserEmailMovesIndex(t *testing.T) {
+	testDb := NewDB("./testdatabase.json")
+
+	err := cleanupDbFile(testDb.path)
+	if err != nil {
+		t.Fatalf("Error cleaning up database file: %v", err)
+	}
+
+	user, err := testDb.CreateUser("before@example.com", "foobar")
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	_, err = testDb.UpdateUser(user.Id, "after@example.com", "")
+	if err != nil {
+		t.Fatalf("Error updating user: %v", err)
+	}
+
+	// The old email is free again
+	_, err = testDb.CreateUser("before@example.com", "foobar")
+	if err != nil {
+		t.Fatalf("Error reusing the old email: %v", err)
+	}
+	_, err = testDb.ValidateCredentials("after@example.com", "foobar")
+	if err != nil {
+		t.Fatalf("Error validating credentials with the new email: %v", err)
+	}
+}
+
+func TestChirpAuthorIndex(t *testing.T) {
+	testDb := NewDB("./testdatabase.json")
+
+	err := cleanupDbFile(testDb.path)
+	if err != nil {
+		t.Fatalf("Error cleaning up database file: %v", err)
+	}
+
+	err = testDb.writeDB(DBStructure{Chirps: map[int]Chirp{
+		1: {Id: 1, Body: "First chirp", AuthorId: 5},
+		2: {Id: 2, Body: "Second chirp", AuthorId: 7},
+	}})
+	if err != nil {
+		t.Fatalf("Error writing initial data to database: %v", err)
+	}
+
+	created, err := testDb.CreateChirp("Third chirp", 5)
+	if err != nil {
+		t.Fatalf("Error creating chirp: %v", err)
+	}
+	_, err = testDb.DeleteChirp(1)
+	if err != nil {
+		t.Fatalf("Error deleting chirp: %v", err)
+	}
+
+	errAbort := errors.New("abort")
+	err = testDb.Update(func(tx *Tx) error {
+		err := tx.putChirp(Chirp{Id: 10, Body: "Rolled back", AuthorId: 5})
+		if err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if err != errAbort {
+		t.Fatalf("Expected the transaction error, actual: %v", err)
+	}
+
+	chirps, err := testDb.GetUserChirps(5)
+	if err != nil {
+		t.Fatalf("Error getting user chirps: %v", err)
+	}
+	if len(chirps) != 1 || chirps[0].Id != created.Id {
+		t.Fatalf("Unexpected chirps for author: %v", chirps)
+	}
+}
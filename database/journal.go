@@ -0,0 +1,358 @@
+// Defines the append-only journal of mutations used by the JSON file database.
+//
+//	Each transaction is written as a single line holding an array of its entries, so a crash mid-append can only leave a torn final line, which is discarded
+
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+var ErrJournalCorrupt = errors.New("database journal is corrupt")
+
+const (
+	journalPut    = "put"
+	journalDelete = "delete"
+
+	chirpsTable             = "chirps"
+	usersTable              = "users"
+	revokedUserTokensTable  = "revoked_user_tokens"
+	refreshTokensTable      = "refresh_tokens"
+	auditEventsTable        = "audit_events"
+	oneTimeTokensTable      = "one_time_tokens"
+	twoFactorTable          = "two_factor"
+	apiKeysTable            = "api_keys"
+	oauthClientsTable       = "oauth_clients"
+	authorizationCodesTable = "authorization_codes"
+	sequencesTable          = "sequences"
+)
+
+// A single mutation of a database record. Entries hold complete values, so replaying one more than once is harmless
+type journalEntry struct {
+	Op    string      `json:"op"`
+	Table string      `json:"table"`
+	Key   string      `json:"key"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// A journal entry as read back from disk, with the value left undecoded until the table is known
+type storedJournalEntry struct {
+	Op    string          `json:"op"`
+	Table string          `json:"table"`
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+type journal struct {
+	path string
+	file *os.File
+	size int64
+}
+
+func putEntry(table string, key string, value interface{}) journalEntry {
+	return journalEntry{Op: journalPut, Table: table, Key: key, Value: value}
+}
+
+func deleteEntry(table string, key string) journalEntry {
+	return journalEntry{Op: journalDelete, Table: table, Key: key}
+}
+
+// Opens the journal at `path`, creating it if it doesn't exist.
+//
+//	A partially written final transaction, left by a crash mid-append, is discarded since it was never acknowledged
+func openJournal(path string) (*journal, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	size := int64(len(data))
+	if lastNewline := bytes.LastIndexByte(data, '\n'); lastNewline != len(data)-1 {
+		size = int64(lastNewline + 1)
+		err = file.Truncate(size)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	_, err = file.Seek(size, io.SeekStart)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &journal{path: path, file: file, size: size}, nil
+}
+
+func (j *journal) close() error {
+	return j.file.Close()
+}
+
+// Appends a transaction's entries to the journal as one line and syncs it to disk. On failure the journal is restored to its previous length
+func (j *journal) append(entries []journalEntry) error {
+	buffer := bytes.Buffer{}
+	err := json.NewEncoder(&buffer).Encode(entries) // Encode terminates the line with a newline
+	if err != nil {
+		return err
+	}
+
+	_, err = j.file.Write(buffer.Bytes())
+	if err == nil {
+		err = j.file.Sync()
+	}
+	if err != nil {
+		return errors.Join(err, j.rewind())
+	}
+	j.size += int64(buffer.Len())
+	return nil
+}
+
+// Drops anything written past the last successful append
+func (j *journal) rewind() error {
+	err := j.file.Truncate(j.size)
+	if err != nil {
+		return err
+	}
+	_, err = j.file.Seek(j.size, io.SeekStart)
+	return err
+}
+
+// Empties the journal after its entries have been written to the database file
+func (j *journal) truncate() error {
+	j.size = 0
+	err := j.rewind()
+	if err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// Applies every transaction in the journal to the database structure, in order.
+//
+//	Journals written before transactions were grouped have one entry per line, and each line is applied on its own
+func (j *journal) replay(dbStructure *DBStructure) error {
+	data := make([]byte, j.size)
+	_, err := j.file.ReadAt(data, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	line := 0
+	for scanner.Scan() {
+		line++
+		entries := []storedJournalEntry{}
+		if bytes.HasPrefix(scanner.Bytes(), []byte("[")) {
+			err = json.Unmarshal(scanner.Bytes(), &entries)
+		} else {
+			entries = append(entries, storedJournalEntry{})
+			err = json.Unmarshal(scanner.Bytes(), &entries[0])
+		}
+		if err != nil {
+			return fmt.Errorf("%w: line %d: %v", ErrJournalCorrupt, line, err)
+		}
+		for _, entry := range entries {
+			err = dbStructure.apply(entry)
+			if err != nil {
+				return fmt.Errorf("%w: line %d: %v", ErrJournalCorrupt, line, err)
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// Applies a single journal entry to the database structure
+func (dbStructure *DBStructure) apply(entry storedJournalEntry) error {
+	if entry.Op != journalPut && entry.Op != journalDelete {
+		return fmt.Errorf("unknown operation '%s'", entry.Op)
+	}
+	deleting := entry.Op == journalDelete
+
+	switch entry.Table {
+	case chirpsTable:
+		id, err := strconv.Atoi(entry.Key)
+		if err != nil {
+			return err
+		}
+		if dbStructure.Chirps == nil {
+			dbStructure.Chirps = map[int]Chirp{}
+		}
+		if deleting {
+			delete(dbStructure.Chirps, id)
+			return nil
+		}
+		chirp := Chirp{}
+		err = json.Unmarshal(entry.Value, &chirp)
+		if err != nil {
+			return err
+		}
+		dbStructure.Chirps[id] = chirp
+
+	case usersTable:
+		id, err := strconv.Atoi(entry.Key)
+		if err != nil {
+			return err
+		}
+		if dbStructure.Users == nil {
+			dbStructure.Users = map[int]internalUser{}
+		}
+		if deleting {
+			delete(dbStructure.Users, id)
+			return nil
+		}
+		intUsr := internalUser{}
+		err = json.Unmarshal(entry.Value, &intUsr)
+		if err != nil {
+			return err
+		}
+		dbStructure.Users[id] = intUsr
+
+	case revokedUserTokensTable:
+		// Dropped in schema version 3. Revocations journaled before upgrading no longer matter
+
+	case refreshTokensTable:
+		if dbStructure.RefreshTokens == nil {
+			dbStructure.RefreshTokens = map[string]RefreshToken{}
+		}
+		if deleting {
+			delete(dbStructure.RefreshTokens, entry.Key)
+			return nil
+		}
+		refreshToken := RefreshToken{}
+		err := json.Unmarshal(entry.Value, &refreshToken)
+		if err != nil {
+			return err
+		}
+		dbStructure.RefreshTokens[entry.Key] = refreshToken
+
+	case auditEventsTable:
+		id, err := strconv.Atoi(entry.Key)
+		if err != nil {
+			return err
+		}
+		if dbStructure.AuditEvents == nil {
+			dbStructure.AuditEvents = map[int]AuditEvent{}
+		}
+		if deleting {
+			delete(dbStructure.AuditEvents, id)
+			return nil
+		}
+		event := AuditEvent{}
+		err = json.Unmarshal(entry.Value, &event)
+		if err != nil {
+			return err
+		}
+		dbStructure.AuditEvents[id] = event
+
+	case oneTimeTokensTable:
+		if dbStructure.OneTimeTokens == nil {
+			dbStructure.OneTimeTokens = map[string]OneTimeToken{}
+		}
+		if deleting {
+			delete(dbStructure.OneTimeTokens, entry.Key)
+			return nil
+		}
+		oneTimeToken := OneTimeToken{}
+		err := json.Unmarshal(entry.Value, &oneTimeToken)
+		if err != nil {
+			return err
+		}
+		dbStructure.OneTimeTokens[entry.Key] = oneTimeToken
+
+	case twoFactorTable:
+		userId, err := strconv.Atoi(entry.Key)
+		if err != nil {
+			return err
+		}
+		if dbStructure.TwoFactor == nil {
+			dbStructure.TwoFactor = map[int]TwoFactor{}
+		}
+		if deleting {
+			delete(dbStructure.TwoFactor, userId)
+			return nil
+		}
+		twoFactor := TwoFactor{}
+		err = json.Unmarshal(entry.Value, &twoFactor)
+		if err != nil {
+			return err
+		}
+		dbStructure.TwoFactor[userId] = twoFactor
+
+	case apiKeysTable:
+		if dbStructure.ApiKeys == nil {
+			dbStructure.ApiKeys = map[string]ApiKey{}
+		}
+		if deleting {
+			delete(dbStructure.ApiKeys, entry.Key)
+			return nil
+		}
+		apiKey := ApiKey{}
+		err := json.Unmarshal(entry.Value, &apiKey)
+		if err != nil {
+			return err
+		}
+		dbStructure.ApiKeys[entry.Key] = apiKey
+
+	case oauthClientsTable:
+		if dbStructure.OAuthClients == nil {
+			dbStructure.OAuthClients = map[string]internalOAuthClient{}
+		}
+		if deleting {
+			delete(dbStructure.OAuthClients, entry.Key)
+			return nil
+		}
+		client := internalOAuthClient{}
+		err := json.Unmarshal(entry.Value, &client)
+		if err != nil {
+			return err
+		}
+		dbStructure.OAuthClients[entry.Key] = client
+
+	case authorizationCodesTable:
+		if dbStructure.AuthorizationCodes == nil {
+			dbStructure.AuthorizationCodes = map[string]AuthorizationCode{}
+		}
+		if deleting {
+			delete(dbStructure.AuthorizationCodes, entry.Key)
+			return nil
+		}
+		authorizationCode := AuthorizationCode{}
+		err := json.Unmarshal(entry.Value, &authorizationCode)
+		if err != nil {
+			return err
+		}
+		dbStructure.AuthorizationCodes[entry.Key] = authorizationCode
+
+	case sequencesTable:
+		if dbStructure.Sequences == nil {
+			dbStructure.Sequences = map[string]int{}
+		}
+		if deleting {
+			delete(dbStructure.Sequences, entry.Key)
+			return nil
+		}
+		last := 0
+		err := json.Unmarshal(entry.Value, &last)
+		if err != nil {
+			return err
+		}
+		dbStructure.Sequences[entry.Key] = last
+
+	default:
+		return fmt.Errorf("unknown table '%s'", entry.Table)
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package database
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestOpenDBReplaysJournal(t *testing.T) {
+	path := "./testdatabase.json"
+	for _, file := range []string{path, path + ".journal"} {
+		err := cleanupDbFile(file)
+		if err != nil {
+			t.Fatalf("Error cleaning up database file: %v", err)
+		}
+	}
+
+	testDb, err := OpenDB(path, Options{Journal: true})
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	chirp, err := testDb.CreateChirp("Journaled chirp", 3)
+	if err != nil {
+		t.Fatalf("Error creating chirp: %v", err)
+	}
+
+	// Simulate a crash by dropping the journal without compacting it
+	testDb.journal.close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Error reading database file: %v", err)
+	}
+	if strings.Contains(string(data), chirp.Body) {
+		t.Fatal("Database file was rewritten while journaling")
+	}
+
+	testDb, err = OpenDB(path, Options{Journal: true})
+	if err != nil {
+		t.Fatalf("Error reopening database: %v", err)
+	}
+	defer testDb.Close()
+
+	_, found, err := testDb.GetChirp(chirp.Id)
+	if err != nil {
+		t.Fatalf("Error getting chirp: %v", err)
+	}
+	if !found {
+		t.Fatal("Journaled chirp was not recovered")
+	}
+	if testDb.journal.size != 0 {
+		t.Fatal("Journal was not compacted after recovery")
+	}
+}
+
+func TestOpenDBDiscardsTornJournalEntry(t *testing.T) {
+	path := "./testdatabase.json"
+	for _, file := range []string{path, path + ".journal"} {
+		err := cleanupDbFile(file)
+		if err != nil {
+			t.Fatalf("Error cleaning up database file: %v", err)
+		}
+	}
+
+	journal := `{"op":"put","table":"chirps","key":"1","value":{"id":1,"body":"Complete","author_id":1}}
+{"op":"put","table":"chirps","key":"2","value":{"id":2,"bo`
+	err := os.WriteFile(path+".journal", []byte(journal), 0644)
+	if err != nil {
+		t.Fatalf("Error writing journal: %v", err)
+	}
+
+	testDb, err := OpenDB(path, Options{Journal: true})
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	defer testDb.Close()
+
+	chirps, err := testDb.GetChirps()
+	if err != nil {
+		t.Fatalf("Error getting chirps: %v", err)
+	}
+	if len(chirps) != 1 || chirps[0].Body != "Complete" {
+		t.Fatalf("Unexpected chirps after recovery: %v", chirps)
+	}
+}
+
+func TestOpenDBRefusesCorruptJournal(t *testing.T) {
+	path := "./testdatabase.json"
+	for _, file := range []string{path, path + ".journal"} {
+		err := cleanupDbFile(file)
+		if err != nil {
+			t.Fatalf("Error cleaning up database file: %v", err)
+		}
+	}
+
+	journal := `{"op":"put","table":"chirps","key":"1","value":{"id":1,"body":"Complete","author_id":1}}
+not json at all
+`
+	err := os.WriteFile(path+".journal", []byte(journal), 0644)
+	if err != nil {
+		t.Fatalf("Error writing journal: %v", err)
+	}
+
+	_, err = OpenDB(path, Options{Journal: true})
+	if !errors.Is(err, ErrJournalCorrupt) {
+		t.Fatalf("Expected a corrupt journal error, actual: %v", err)
+	}
+}
+
+func TestOpenDBDiscardsTornJournalTransaction(t *testing.T) {
+	path := "./testdatabase.json"
+	for _, file := range []string{path, path + ".journal"} {
+		err := cleanupDbFile(file)
+		if err != nil {
+			t.Fatalf("Error cleaning up database file: %v", err)
+		}
+	}
+
+	testDb, err := OpenDB(path, Options{Journal: true})
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	_, err = testDb.CreateChirp("Complete", 1)
+	if err != nil {
+		t.Fatalf("Error creating chirp: %v", err)
+	}
+	complete := testDb.journal.size
+	_, err = testDb.CreateChirp("Torn", 1)
+	if err != nil {
+		t.Fatalf("Error creating chirp: %v", err)
+	}
+	testDb.journal.close()
+
+	// Simulate a crash partway through writing the second chirp's transaction, after its first entry but before its second
+	data, err := os.ReadFile(path + ".journal")
+	if err != nil {
+		t.Fatalf("Error reading journal: %v", err)
+	}
+	torn := string(data[complete:])
+	second := strings.Index(torn[1:], `{"op":`) + 1
+	if second == 0 {
+		t.Fatalf("Chirp and sequence not journaled together: %s", torn)
+	}
+	err = os.WriteFile(path+".journal", data[:int(complete)+second], 0644)
+	if err != nil {
+		t.Fatalf("Error writing journal: %v", err)
+	}
+
+	testDb, err = OpenDB(path, Options{Journal: true})
+	if err != nil {
+		t.Fatalf("Error reopening database: %v", err)
+	}
+	defer testDb.Close()
+
+	chirps, err := testDb.GetChirps()
+	if err != nil {
+		t.Fatalf("Error getting chirps: %v", err)
+	}
+	if len(chirps) != 1 || chirps[0].Body != "Complete" {
+		t.Fatalf("Expected only the complete transaction to be recovered, actual: %v", chirps)
+	}
+	chirp, err := testDb.CreateChirp("After recovery", 1)
+	if err != nil {
+		t.Fatalf("Error creating chirp: %v", err)
+	}
+	if chirp.Id != 2 {
+		t.Fatalf("Expected the chirp sequence to continue from the complete transaction, actual id: %d", chirp.Id)
+	}
+}
@@ -0,0 +1,352 @@
+// Defines the schema migrations that upgrade older database files when they're loaded
+
+package database
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+var ErrSchemaTooNew = errors.New("database was written by a newer version of Chirpy")
+
+// A migration upgrades a database file from the previous schema version to `Version`.
+//
+//	Migrations work on the raw top level JSON fields since older files don't match the current DBStructure
+type Migration struct {
+	Version     int    `json:"version"`
+	Description string `json:"description"`
+	migrate     func(raw map[string]json.RawMessage) (notes []string, err error)
+}
+
+// Every migration, in order. Files without a `schema_version` are version 0
+var migrations = []Migration{
+	{Version: 1, Description: "Store users in an object keyed by user id", migrate: migrateUsersToMap},
+	{Version: 2, Description: "Record when each revoked token expires", migrate: migrateRevokedTokenExpiry},
+	{Version: 3, Description: "Replace the revoked token list with stored refresh tokens. Users must log in again", migrate: migrateToRefreshTokens},
+	{Version: 4, Description: "Give each existing refresh token its own token family", migrate: migrateRefreshTokenFamilies},
+	{Version: 5, Description: "Record when each session started", migrate: migrateFamilyCreatedAt},
+	{Version: 6, Description: "Give every existing user the user role", migrate: migrateUserRoles},
+}
+
+// The schema version written by this version of Chirpy
+func CurrentSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// Result of planning or running the migrations for a database file
+type MigrationReport struct {
+	FromVersion int         `json:"from_version"`
+	ToVersion   int         `json:"to_version"`
+	Applied     []Migration `json:"applied"`
+	Notes       []string    `json:"notes"`
+	Backup      string      `json:"backup,omitempty"`
+}
+
+// Runs the pending migrations against the database file at `path` without writing anything.
+//
+//	Errors if the file can't be read or a migration fails, which is what loading it for real would do
+func DryRunMigrations(path string) (MigrationReport, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return MigrationReport{FromVersion: CurrentSchemaVersion(), ToVersion: CurrentSchemaVersion()}, nil
+	}
+	if err != nil {
+		return MigrationReport{}, err
+	}
+
+	_, report, err := migrate(data)
+	return report, err
+}
+
+// Upgrades the database file contents to the current schema version.
+//
+//	Returns the original data unchanged if no migrations are pending
+func migrate(data []byte) ([]byte, MigrationReport, error) {
+	raw := map[string]json.RawMessage{}
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, MigrationReport{}, err
+	}
+
+	version := 0
+	if rawVersion, found := raw["schema_version"]; found {
+		err = json.Unmarshal(rawVersion, &version)
+		if err != nil {
+			return nil, MigrationReport{}, fmt.Errorf("reading schema version: %w", err)
+		}
+	}
+	report := MigrationReport{FromVersion: version, ToVersion: version, Applied: []Migration{}, Notes: []string{}}
+	if version > CurrentSchemaVersion() {
+		return nil, report, fmt.Errorf("%w: schema version %d, expected at most %d", ErrSchemaTooNew, version, CurrentSchemaVersion())
+	}
+	if version == CurrentSchemaVersion() {
+		return data, report, nil
+	}
+
+	for _, migration := range migrations {
+		if migration.Version <= version {
+			continue
+		}
+		notes, err := migration.migrate(raw)
+		if err != nil {
+			return nil, report, fmt.Errorf("migrating to schema version %d (%s): %w", migration.Version, migration.Description, err)
+		}
+		report.Applied = append(report.Applied, migration)
+		report.Notes = append(report.Notes, notes...)
+		report.ToVersion = migration.Version
+	}
+
+	raw["schema_version"], err = json.Marshal(report.ToVersion)
+	if err != nil {
+		return nil, report, err
+	}
+	migrated, err := json.Marshal(raw)
+	if err != nil {
+		return nil, report, err
+	}
+	return migrated, report, nil
+}
+
+// Migrates the database file contents if needed, backing up the original file first.
+//
+//	The caller must hold the write lock and write the migrated state back to disk
+func (db *DB) migrate(data []byte) ([]byte, MigrationReport, error) {
+	migrated, report, err := migrate(data)
+	if err != nil || len(report.Applied) == 0 {
+		return migrated, report, err
+	}
+
+	report.Backup = fmt.Sprintf("%s.schema-v%d.%s.bak", db.path, report.FromVersion, time.Now().UTC().Format("20060102T150405Z"))
+	err = writeFileAtomic(report.Backup, data)
+	if err != nil {
+		return nil, report, fmt.Errorf("backing up database before migration: %w", err)
+	}
+
+	log.Printf("Migrated %s from schema version %d to %d. Backup written to %s", db.path, report.FromVersion, report.ToVersion, report.Backup)
+	for _, note := range report.Notes {
+		log.Printf("Migration note: %s", note)
+	}
+	return migrated, report, nil
+}
+
+// Version 1: Users were a list, which made every lookup a scan and allowed duplicate ids.
+//
+//	Duplicate ids, possible before id sequences existed, are reassigned to unused ids
+func migrateUsersToMap(raw map[string]json.RawMessage) ([]string, error) {
+	rawUsers, found := raw["users"]
+	if !found || string(rawUsers) == "null" {
+		return nil, nil
+	}
+
+	userList := []internalUser{}
+	err := json.Unmarshal(rawUsers, &userList)
+	if err != nil {
+		return nil, err
+	}
+
+	largestId := 0
+	for _, intUsr := range userList {
+		largestId = max(largestId, intUsr.Id)
+	}
+
+	notes := []string{}
+	users := map[int]internalUser{}
+	for _, intUsr := range userList {
+		if _, duplicate := users[intUsr.Id]; duplicate {
+			largestId++
+			notes = append(notes, fmt.Sprintf("user %s shared id %d and was reassigned id %d", intUsr.Email, intUsr.Id, largestId))
+			intUsr.Id = largestId
+		}
+		users[intUsr.Id] = intUsr
+	}
+
+	raw["users"], err = json.Marshal(users)
+	if err != nil {
+		return nil, err
+	}
+	// Keep new users from being assigned a reassigned id
+	if len(notes) > 0 {
+		sequences := map[string]int{}
+		if rawSequences, found := raw["sequences"]; found && string(rawSequences) != "null" {
+			err = json.Unmarshal(rawSequences, &sequences)
+			if err != nil {
+				return nil, err
+			}
+			sequences[userSequence] = max(sequences[userSequence], largestId)
+			raw["sequences"], err = json.Marshal(sequences)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return notes, nil
+}
+
+// Version 2: Revoked tokens only recorded when they were revoked, so they could never be forgotten.
+//
+//	The expiration is read from each token. A token without a readable expiration could never have been accepted,
+//	so it expires when it was revoked and is pruned on the next sweep
+func migrateRevokedTokenExpiry(raw map[string]json.RawMessage) ([]string, error) {
+	rawTokens, found := raw["revoked_user_tokens"]
+	if !found || string(rawTokens) == "null" {
+		return nil, nil
+	}
+
+	revokedAt := map[string]time.Time{}
+	err := json.Unmarshal(rawTokens, &revokedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	type revokedToken struct {
+		RevokedAt time.Time `json:"revoked_at"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	notes := []string{}
+	tokens := map[string]revokedToken{}
+	for token, at := range revokedAt {
+		expiresAt, ok := jwtExpiration(token)
+		if !ok {
+			expiresAt = at
+			notes = append(notes, fmt.Sprintf("revoked token revoked at %s has no readable expiration and will be pruned", at.Format(time.RFC3339)))
+		}
+		tokens[token] = revokedToken{RevokedAt: at, ExpiresAt: expiresAt}
+	}
+
+	raw["revoked_user_tokens"], err = json.Marshal(tokens)
+	if err != nil {
+		return nil, err
+	}
+	return notes, nil
+}
+
+// Reads the expiration claim from a JWT without verifying it. `ok` is false if the token isn't a JWT with an expiration
+func jwtExpiration(token string) (expiresAt time.Time, ok bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+	claims := struct {
+		ExpiresAt *float64 `json:"exp"`
+	}{}
+	err = json.Unmarshal(payload, &claims)
+	if err != nil || claims.ExpiresAt == nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(*claims.ExpiresAt), 0).UTC(), true
+}
+
+// Version 3: Refresh tokens were JWTs that stayed valid unless revoked. They're now random tokens stored by hash,
+// so the revoked token list is dropped and existing refresh tokens stop working
+func migrateToRefreshTokens(raw map[string]json.RawMessage) ([]string, error) {
+	delete(raw, "revoked_user_tokens")
+	raw["refresh_tokens"] = json.RawMessage("{}")
+	return nil, nil
+}
+
+// Version 4: Refresh tokens are grouped into families so a reused token can revoke every token descended from the same login.
+//
+//	Tokens from before families existed each start their own, named after the token hash
+func migrateRefreshTokenFamilies(raw map[string]json.RawMessage) ([]string, error) {
+	rawTokens, found := raw["refresh_tokens"]
+	if !found || string(rawTokens) == "null" {
+		return nil, nil
+	}
+
+	tokens := map[string]map[string]json.RawMessage{}
+	err := json.Unmarshal(rawTokens, &tokens)
+	if err != nil {
+		return nil, err
+	}
+	for tokenHash, refreshToken := range tokens {
+		refreshToken["family_id"], err = json.Marshal(tokenHash)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	raw["refresh_tokens"], err = json.Marshal(tokens)
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// A family's first token was issued at login, which is when its session started
+func migrateFamilyCreatedAt(raw map[string]json.RawMessage) ([]string, error) {
+	rawTokens, found := raw["refresh_tokens"]
+	if !found || string(rawTokens) == "null" {
+		return nil, nil
+	}
+
+	type familyToken struct {
+		FamilyId  string    `json:"family_id"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+	tokens := map[string]map[string]json.RawMessage{}
+	err := json.Unmarshal(rawTokens, &tokens)
+	if err != nil {
+		return nil, err
+	}
+	familyTokens := map[string]familyToken{}
+	familyCreatedAt := map[string]time.Time{}
+	for tokenHash, refreshToken := range tokens {
+		token := familyToken{}
+		err = json.Unmarshal(refreshToken["family_id"], &token.FamilyId)
+		if err == nil {
+			err = json.Unmarshal(refreshToken["created_at"], &token.CreatedAt)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading refresh token %s: %w", tokenHash, err)
+		}
+		familyTokens[tokenHash] = token
+		if earliest, found := familyCreatedAt[token.FamilyId]; !found || token.CreatedAt.Before(earliest) {
+			familyCreatedAt[token.FamilyId] = token.CreatedAt
+		}
+	}
+	for tokenHash, refreshToken := range tokens {
+		refreshToken["family_created_at"], err = json.Marshal(familyCreatedAt[familyTokens[tokenHash].FamilyId])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	raw["refresh_tokens"], err = json.Marshal(tokens)
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// Users from before roles existed are regular users. Admins are granted with the `admin grant` command
+func migrateUserRoles(raw map[string]json.RawMessage) ([]string, error) {
+	rawUsers, found := raw["users"]
+	if !found || string(rawUsers) == "null" {
+		return nil, nil
+	}
+
+	users := map[string]map[string]json.RawMessage{}
+	err := json.Unmarshal(rawUsers, &users)
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		user["role"] = json.RawMessage(`"user"`)
+	}
+
+	raw["users"], err = json.Marshal(users)
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
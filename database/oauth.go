@@ -0,0 +1,275 @@
+// Defines the OAuthClient and AuthorizationCode types and database functions for the OAuth2 authorization server
+
+package database
+
+import (
+	"crypto/subtle"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	ErrOAuthClientNotFound       = errors.New("OAuth client not found")
+	ErrInvalidClient             = errors.New("invalid client id or secret")
+	ErrAuthorizationCodeNotFound = errors.New("authorization code not found or already used")
+	ErrAuthorizationCodeExpired  = errors.New("authorization code has expired")
+	ErrAuthorizationCodeReused   = errors.New("authorization code was already used")
+)
+
+// A third-party app registered by a user, which can ask other users for scoped access to their accounts
+type OAuthClient struct {
+	Id           string    `json:"id"` // The `client_id`
+	OwnerId      int       `json:"owner_id"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirect_uris"` // Authorization codes are only ever sent to one of these
+	Confidential bool      `json:"confidential"`  // Confidential clients authenticate with a secret. Public ones, like mobile apps, rely on PKCE alone
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type internalOAuthClient struct {
+	OAuthClient
+	SecretHash string `json:"secret_hash"` // Empty for public clients
+}
+
+// A single-use code sent to a client's redirect URI once a user approves it, to be traded for tokens.
+//
+//	Only the code's hash is stored, like refresh tokens
+type AuthorizationCode struct {
+	ClientId      string    `json:"client_id"`
+	UserId        int       `json:"user_id"`
+	RedirectURI   string    `json:"redirect_uri"` // The token request has to name the same redirect URI
+	Scopes        []string  `json:"scopes"`
+	CodeChallenge string    `json:"code_challenge"` // The PKCE S256 challenge the token request's verifier must match
+	CreatedAt     time.Time `json:"created_at"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	FamilyId      string    `json:"family_id,omitempty"` // The refresh token family the code was traded for. Set once it's used
+}
+
+// Gets a copy of the client with the given id, or nil if there isn't one
+func (dbStructure *DBStructure) findOAuthClient(id string) *internalOAuthClient {
+	client, found := dbStructure.OAuthClients[id]
+	if !found {
+		return nil
+	}
+	client.RedirectURIs = slices.Clone(client.RedirectURIs)
+	return &client
+}
+
+// Gets a copy of the authorization code with the given hash, or nil if there isn't one
+func (dbStructure *DBStructure) findAuthorizationCode(codeHash string) *AuthorizationCode {
+	authorizationCode, found := dbStructure.AuthorizationCodes[codeHash]
+	if !found {
+		return nil
+	}
+	authorizationCode.Scopes = slices.Clone(authorizationCode.Scopes)
+	return &authorizationCode
+}
+
+// Orders clients oldest first, by id for clients created at the same time
+func sortOAuthClients(clients []OAuthClient) {
+	slices.SortFunc(clients, func(a, b OAuthClient) int {
+		if c := a.CreatedAt.Compare(b.CreatedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Id, b.Id)
+	})
+}
+
+// Checks a client's secret. Public clients have no secret, and must not send one
+func checkClientSecret(client internalOAuthClient, secret string) error {
+	if !client.Confidential {
+		if secret != "" {
+			return ErrInvalidClient
+		}
+		return nil
+	}
+	if subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(client.SecretHash)) != 1 {
+		return ErrInvalidClient
+	}
+	return nil
+}
+
+// Stores a new client.
+//
+//	`secret` is the plaintext secret given to a confidential client's owner, and must be empty for public clients. Only its hash is saved
+func (db *DB) CreateOAuthClient(secret string, client OAuthClient) error {
+	intClient := internalOAuthClient{OAuthClient: client}
+	if client.Confidential {
+		intClient.SecretHash = hashToken(secret)
+	}
+	return db.Update(func(tx *Tx) error {
+		return tx.putOAuthClient(intClient)
+	})
+}
+
+// Gets a client by its id
+func (db *DB) GetOAuthClient(id string) (client OAuthClient, found bool, err error) {
+	err = db.View(func(tx *Tx) error {
+		existing := tx.data.findOAuthClient(id)
+		if existing != nil {
+			client, found = existing.OAuthClient, true
+		}
+		return nil
+	})
+	if err != nil || !found {
+		return OAuthClient{}, false, err
+	}
+	return client, true, nil
+}
+
+// Gets a client after checking its secret.
+//
+//	Errors with `ErrInvalidClient` if the client doesn't exist or the secret is wrong
+func (db *DB) ValidateOAuthClient(id string, secret string) (OAuthClient, error) {
+	var client *internalOAuthClient
+	err := db.View(func(tx *Tx) error {
+		client = tx.data.findOAuthClient(id)
+		return nil
+	})
+	if err != nil {
+		return OAuthClient{}, err
+	}
+	if client == nil {
+		return OAuthClient{}, ErrInvalidClient
+	}
+	err = checkClientSecret(*client, secret)
+	if err != nil {
+		return OAuthClient{}, err
+	}
+	return client.OAuthClient, nil
+}
+
+// Lists the clients the user registered, oldest first
+func (db *DB) GetUserOAuthClients(ownerId int) ([]OAuthClient, error) {
+	clients := []OAuthClient{}
+	err := db.View(func(tx *Tx) error {
+		for id, client := range tx.data.OAuthClients {
+			if client.OwnerId == ownerId {
+				clients = append(clients, tx.data.findOAuthClient(id).OAuthClient)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortOAuthClients(clients)
+	return clients, nil
+}
+
+// Removes one of the user's clients, along with its unused authorization codes and every refresh token issued to it.
+//
+//	Errors with `ErrOAuthClientNotFound` if the user has no client with the id
+func (db *DB) DeleteOAuthClient(ownerId int, id string) error {
+	return db.Update(func(tx *Tx) error {
+		client := tx.data.findOAuthClient(id)
+		if client == nil || client.OwnerId != ownerId {
+			return ErrOAuthClientNotFound
+		}
+		for codeHash, authorizationCode := range tx.data.AuthorizationCodes {
+			if authorizationCode.ClientId != id {
+				continue
+			}
+			err := tx.deleteAuthorizationCode(codeHash)
+			if err != nil {
+				return err
+			}
+		}
+		for tokenHash, refreshToken := range tx.data.RefreshTokens {
+			if refreshToken.ClientId != id {
+				continue
+			}
+			err := tx.deleteRefreshToken(tokenHash)
+			if err != nil {
+				return err
+			}
+		}
+		return tx.deleteOAuthClient(id)
+	})
+}
+
+// Stores a new authorization code.
+//
+//	`code` is the plaintext code sent to the client. Only its hash is saved
+func (db *DB) CreateAuthorizationCode(code string, authorizationCode AuthorizationCode) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.putAuthorizationCode(hashToken(code), authorizationCode)
+	})
+}
+
+// Gets an authorization code, whether or not it's been used or has expired, so it can be checked before it's used up
+func (db *DB) GetAuthorizationCode(code string) (authorizationCode AuthorizationCode, found bool, err error) {
+	err = db.View(func(tx *Tx) error {
+		existing := tx.data.findAuthorizationCode(hashToken(code))
+		if existing != nil {
+			authorizationCode, found = *existing, true
+		}
+		return nil
+	})
+	if err != nil || !found {
+		return AuthorizationCode{}, false, err
+	}
+	return authorizationCode, true, nil
+}
+
+// Uses up an authorization code, recording the refresh token family `familyId` it was traded for. Expired codes are used up too.
+//
+//	The used code is kept until it expires, so using it again can revoke what it was traded for.
+//	Errors with `ErrAuthorizationCodeNotFound` if the code doesn't exist, with `ErrAuthorizationCodeExpired` if it expired before `now`,
+//	and with `ErrAuthorizationCodeReused` if it was already used, returning the code with the family it was first traded for
+func (db *DB) ConsumeAuthorizationCode(code string, now time.Time, familyId string) (authorizationCode AuthorizationCode, err error) {
+	codeHash := hashToken(code)
+	expired := false
+	err = db.Update(func(tx *Tx) error {
+		found := tx.data.findAuthorizationCode(codeHash)
+		if found == nil {
+			return ErrAuthorizationCodeNotFound
+		}
+		authorizationCode = *found
+		if authorizationCode.FamilyId != "" {
+			return ErrAuthorizationCodeReused
+		}
+		if !now.Before(authorizationCode.ExpiresAt) {
+			expired = true
+			return tx.deleteAuthorizationCode(codeHash)
+		}
+		authorizationCode.FamilyId = familyId
+		return tx.putAuthorizationCode(codeHash, authorizationCode)
+	})
+	if err == ErrAuthorizationCodeReused {
+		return authorizationCode, err
+	}
+	if err != nil {
+		return AuthorizationCode{}, err
+	}
+	if expired {
+		return AuthorizationCode{}, ErrAuthorizationCodeExpired
+	}
+	return authorizationCode, nil
+}
+
+// Removes authorization codes that expired before `now`, used or not.
+//
+//	Returns the number of codes removed
+func (db *DB) PruneAuthorizationCodes(now time.Time) (pruned int, err error) {
+	err = db.Update(func(tx *Tx) error {
+		pruned = 0
+		for codeHash, authorizationCode := range tx.data.AuthorizationCodes {
+			if !authorizationCode.ExpiresAt.Before(now) {
+				continue
+			}
+			err := tx.deleteAuthorizationCode(codeHash)
+			if err != nil {
+				return err
+			}
+			pruned++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return pruned, nil
+}
@@ -0,0 +1,175 @@
+package database
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestOAuthClients(t *testing.T) {
+	testDb := NewDB("./testdatabase.json")
+
+	err := cleanupDbFile(testDb.path)
+	if err != nil {
+		t.Fatalf("Error cleaning up database file: %v", err)
+	}
+	testOAuthClients(t, testDb)
+}
+
+// OAuth client behavior shared by the database backends
+func testOAuthClients(t *testing.T, store Store) {
+	now := time.Now().UTC()
+	redirectURIs := []string{"https://app.example.com/callback", "http://127.0.0.1:8000/callback"}
+	err := store.CreateOAuthClient("client-secret", OAuthClient{Id: "confidential", OwnerId: 3, Name: "App", RedirectURIs: redirectURIs, Confidential: true, CreatedAt: now})
+	if err != nil {
+		t.Fatalf("Error creating client: %v", err)
+	}
+	err = store.CreateOAuthClient("", OAuthClient{Id: "public", OwnerId: 3, Name: "Mobile", RedirectURIs: redirectURIs[:1], CreatedAt: now.Add(time.Minute)})
+	if err != nil {
+		t.Fatalf("Error creating client: %v", err)
+	}
+
+	client, found, err := store.GetOAuthClient("confidential")
+	if err != nil || !found {
+		t.Fatalf("Error getting client: %v, %v", found, err)
+	}
+	if client.Name != "App" || client.OwnerId != 3 || !client.Confidential || !slices.Equal(client.RedirectURIs, redirectURIs) {
+		t.Fatalf("Client read back with incorrect data: %+v", client)
+	}
+
+	_, err = store.ValidateOAuthClient("confidential", "client-secret")
+	if err != nil {
+		t.Fatalf("Error validating client: %v", err)
+	}
+	for name, secret := range map[string][2]string{
+		"wrong secret":         {"confidential", "wrong"},
+		"missing secret":       {"confidential", ""},
+		"public client secret": {"public", "client-secret"},
+		"missing client":       {"missing", ""},
+	} {
+		_, err = store.ValidateOAuthClient(secret[0], secret[1])
+		if err != ErrInvalidClient {
+			t.Fatalf("Expected an invalid client error for %s, actual: %v", name, err)
+		}
+	}
+	_, err = store.ValidateOAuthClient("public", "")
+	if err != nil {
+		t.Fatalf("Error validating public client: %v", err)
+	}
+
+	clients, err := store.GetUserOAuthClients(3)
+	if err != nil {
+		t.Fatalf("Error listing clients: %v", err)
+	}
+	if len(clients) != 2 || clients[0].Id != "confidential" || clients[1].Id != "public" {
+		t.Fatalf("Clients listed incorrectly: %+v", clients)
+	}
+
+	// Deleting a client revokes the refresh tokens issued to it, but not the owner's logins
+	err = store.CreateRefreshToken("client-token", RefreshToken{UserId: 5, FamilyId: "granted", ExpiresAt: now.Add(time.Hour), ClientId: "confidential", Scope: ScopeProfileWrite})
+	if err != nil {
+		t.Fatalf("Error creating refresh token: %v", err)
+	}
+	err = store.CreateRefreshToken("login-token", RefreshToken{UserId: 3, FamilyId: "login", ExpiresAt: now.Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("Error creating refresh token: %v", err)
+	}
+	session, found, err := store.GetSession("granted")
+	if err != nil || !found || session.ClientId != "confidential" || session.Scope != ScopeProfileWrite {
+		t.Fatalf("Granted session read back with incorrect data: %+v, %v, %v", session, found, err)
+	}
+	err = store.DeleteOAuthClient(4, "confidential")
+	if err != ErrOAuthClientNotFound {
+		t.Fatalf("Expected another user's client to be missing, actual: %v", err)
+	}
+	err = store.DeleteOAuthClient(3, "confidential")
+	if err != nil {
+		t.Fatalf("Error deleting client: %v", err)
+	}
+	_, found, err = store.GetOAuthClient("confidential")
+	if err != nil || found {
+		t.Fatalf("Deleted client still found: %v, %v", found, err)
+	}
+	_, found, err = store.GetRefreshToken("client-token")
+	if err != nil || found {
+		t.Fatalf("Deleted client's refresh token still found: %v, %v", found, err)
+	}
+	_, found, err = store.GetRefreshToken("login-token")
+	if err != nil || !found {
+		t.Fatalf("Owner's login revoked with their client: %v, %v", found, err)
+	}
+}
+
+func TestAuthorizationCodes(t *testing.T) {
+	testDb := NewDB("./testdatabase.json")
+
+	err := cleanupDbFile(testDb.path)
+	if err != nil {
+		t.Fatalf("Error cleaning up database file: %v", err)
+	}
+	testAuthorizationCodes(t, testDb)
+}
+
+// Authorization code behavior shared by the database backends
+func testAuthorizationCodes(t *testing.T, store Store) {
+	now := time.Now().UTC()
+	authorizationCode := AuthorizationCode{
+		ClientId:      "client",
+		UserId:        3,
+		RedirectURI:   "https://app.example.com/callback",
+		Scopes:        []string{ScopeChirpsWrite, ScopeProfileWrite},
+		CodeChallenge: "challenge",
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(time.Minute),
+	}
+	err := store.CreateAuthorizationCode("fresh", authorizationCode)
+	if err != nil {
+		t.Fatalf("Error creating authorization code: %v", err)
+	}
+	expired := authorizationCode
+	expired.ExpiresAt = now.Add(-time.Minute)
+	err = store.CreateAuthorizationCode("expired", expired)
+	if err != nil {
+		t.Fatalf("Error creating authorization code: %v", err)
+	}
+
+	found, ok, err := store.GetAuthorizationCode("fresh")
+	if err != nil || !ok || found.FamilyId != "" {
+		t.Fatalf("Expected an unused code to be found: %+v, %v, %v", found, ok, err)
+	}
+	consumed, err := store.ConsumeAuthorizationCode("fresh", now, "family")
+	if err != nil {
+		t.Fatalf("Error consuming authorization code: %v", err)
+	}
+	if consumed.ClientId != "client" || consumed.UserId != 3 || consumed.RedirectURI != authorizationCode.RedirectURI ||
+		consumed.CodeChallenge != "challenge" || !slices.Equal(consumed.Scopes, authorizationCode.Scopes) || consumed.FamilyId != "family" {
+		t.Fatalf("Authorization code read back with incorrect data: %+v", consumed)
+	}
+
+	// The used code is kept, so using it again finds the family it was traded for
+	reused, err := store.ConsumeAuthorizationCode("fresh", now, "second")
+	if err != ErrAuthorizationCodeReused || reused.FamilyId != "family" {
+		t.Fatalf("Expected a used code to be rejected with its family, actual: %+v, %v", reused, err)
+	}
+	found, ok, err = store.GetAuthorizationCode("fresh")
+	if err != nil || !ok || found.FamilyId != "family" {
+		t.Fatalf("Expected the used code to be kept with its family: %+v, %v, %v", found, ok, err)
+	}
+	_, err = store.ConsumeAuthorizationCode("expired", now, "family")
+	if err != ErrAuthorizationCodeExpired {
+		t.Fatalf("Expected an expired code to be rejected, actual: %v", err)
+	}
+	_, err = store.ConsumeAuthorizationCode("missing", now, "family")
+	if err != ErrAuthorizationCodeNotFound {
+		t.Fatalf("Expected a missing code to be rejected, actual: %v", err)
+	}
+
+	err = store.CreateAuthorizationCode("stale", expired)
+	if err != nil {
+		t.Fatalf("Error creating authorization code: %v", err)
+	}
+	pruned, err := store.PruneAuthorizationCodes(now)
+	if err != nil || pruned != 1 {
+		t.Fatalf("Expected one expired code to be pruned: %v, %v", pruned, err)
+	}
+}
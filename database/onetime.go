@@ -0,0 +1,102 @@
+// Defines the OneTimeToken type and database functions for single-use tokens, like password resets
+
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrOneTimeTokenNotFound = errors.New("token not found or already used")
+	ErrOneTimeTokenExpired  = errors.New("token has expired")
+)
+
+// What a one-time token can be used for. A token is only accepted for its own purpose
+const (
+	PurposePasswordReset     = "password_reset"
+	PurposeEmailVerification = "email_verification"
+)
+
+// A short-lived token sent to a user that can be used once. Only the token's hash is stored, like refresh tokens
+type OneTimeToken struct {
+	UserId    int       `json:"user_id"`
+	Purpose   string    `json:"purpose"`
+	Email     string    `json:"email,omitempty"` // The address the token was sent to, for email verification
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Gets a copy of the one-time token with the given hash, or nil if there isn't one
+func (dbStructure *DBStructure) findOneTimeToken(tokenHash string) *OneTimeToken {
+	oneTimeToken, found := dbStructure.OneTimeTokens[tokenHash]
+	if !found {
+		return nil
+	}
+	return &oneTimeToken
+}
+
+// Stores a new one-time token, replacing any of the user's other tokens for the same purpose so only the latest one works.
+//
+//	`token` is the plaintext token sent to the user. Only its hash is saved
+func (db *DB) CreateOneTimeToken(token string, oneTimeToken OneTimeToken) error {
+	return db.Update(func(tx *Tx) error {
+		for tokenHash, existing := range tx.data.OneTimeTokens {
+			if existing.UserId != oneTimeToken.UserId || existing.Purpose != oneTimeToken.Purpose {
+				continue
+			}
+			err := tx.deleteOneTimeToken(tokenHash)
+			if err != nil {
+				return err
+			}
+		}
+		return tx.putOneTimeToken(hashToken(token), oneTimeToken)
+	})
+}
+
+// Uses up a one-time token, so it can't be used again.
+//
+//	Errors with `ErrOneTimeTokenNotFound` if the token doesn't exist, was already used, or is for another purpose,
+//	and with `ErrOneTimeTokenExpired` if it expired before `now`
+func (db *DB) ConsumeOneTimeToken(token string, purpose string, now time.Time) (oneTimeToken OneTimeToken, err error) {
+	tokenHash := hashToken(token)
+	err = db.Update(func(tx *Tx) error {
+		found, ok := tx.data.OneTimeTokens[tokenHash]
+		if !ok || found.Purpose != purpose {
+			return ErrOneTimeTokenNotFound
+		}
+		if !now.Before(found.ExpiresAt) {
+			return ErrOneTimeTokenExpired
+		}
+		oneTimeToken = found
+		return tx.deleteOneTimeToken(tokenHash)
+	})
+	if err != nil {
+		return OneTimeToken{}, err
+	}
+	return oneTimeToken, nil
+}
+
+// Removes one-time tokens that expired before `now`.
+//
+//	Returns the number of tokens removed
+func (db *DB) PruneOneTimeTokens(now time.Time) (pruned int, err error) {
+	err = db.Update(func(tx *Tx) error {
+		pruned = 0
+		for tokenHash, oneTimeToken := range tx.data.OneTimeTokens {
+			if !oneTimeToken.ExpiresAt.Before(now) {
+				continue
+			}
+			err := tx.deleteOneTimeToken(tokenHash)
+			if err != nil {
+				return err
+			}
+			pruned++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return pruned, nil
+}
@@ -0,0 +1,62 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOneTimeTokens(t *testing.T) {
+	testDb := NewDB("./testdatabase.json")
+
+	err := cleanupDbFile(testDb.path)
+	if err != nil {
+		t.Fatalf("Error cleaning up database file: %v", err)
+	}
+	testOneTimeTokens(t, testDb)
+}
+
+// One-time token behavior shared by the database backends
+func testOneTimeTokens(t *testing.T, store Store) {
+	now := time.Now().UTC()
+	create := func(token string, userId int, expiresAt time.Time) {
+		err := store.CreateOneTimeToken(token, OneTimeToken{UserId: userId, Purpose: PurposePasswordReset, Email: "foobar@example.com", CreatedAt: now, ExpiresAt: expiresAt})
+		if err != nil {
+			t.Fatalf("Error creating one-time token: %v", err)
+		}
+	}
+	create("replaced", 5, now.Add(time.Hour))
+	create("current", 5, now.Add(time.Hour))
+	create("expired", 6, now.Add(-time.Minute))
+
+	_, err := store.ConsumeOneTimeToken("replaced", PurposePasswordReset, now)
+	if err != ErrOneTimeTokenNotFound {
+		t.Fatalf("Expected a replaced token to be not found, actual: %v", err)
+	}
+	_, err = store.ConsumeOneTimeToken("current", "another_purpose", now)
+	if err != ErrOneTimeTokenNotFound {
+		t.Fatalf("Expected a token for another purpose to be not found, actual: %v", err)
+	}
+	consumed, err := store.ConsumeOneTimeToken("current", PurposePasswordReset, now)
+	if err != nil {
+		t.Fatalf("Error consuming one-time token: %v", err)
+	}
+	if consumed.UserId != 5 || consumed.Purpose != PurposePasswordReset || consumed.Email != "foobar@example.com" {
+		t.Fatalf("One-time token read back with incorrect data: %+v", consumed)
+	}
+	_, err = store.ConsumeOneTimeToken("current", PurposePasswordReset, now)
+	if err != ErrOneTimeTokenNotFound {
+		t.Fatalf("Expected a used token to be not found, actual: %v", err)
+	}
+	_, err = store.ConsumeOneTimeToken("expired", PurposePasswordReset, now)
+	if err != ErrOneTimeTokenExpired {
+		t.Fatalf("Expected an expired token error, actual: %v", err)
+	}
+
+	pruned, err := store.PruneOneTimeTokens(now)
+	if err != nil {
+		t.Fatalf("Error pruning one-time tokens: %v", err)
+	}
+	if pruned != 1 {
+		t.Fatalf("Expected 1 pruned token, actual: %v", pruned)
+	}
+}
@@ -0,0 +1,136 @@
+// Hashes and checks passwords. Hashes name their algorithm and parameters, so they can be upgraded when the settings change
+
+package database
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	PasswordHashArgon2id = "argon2id"
+	PasswordHashBcrypt   = "bcrypt"
+)
+
+var ErrUnknownPasswordHash = errors.New("unknown password hash format")
+
+// How new password hashes are made
+type PasswordHashParams struct {
+	Algorithm     string
+	BcryptCost    int
+	Argon2Memory  uint32 // KiB
+	Argon2Time    uint32 // Passes over the memory
+	Argon2Threads uint8
+}
+
+// Argon2id with the OWASP recommended minimum settings
+var DefaultPasswordHashParams = PasswordHashParams{
+	Algorithm:     PasswordHashArgon2id,
+	BcryptCost:    bcrypt.DefaultCost,
+	Argon2Memory:  19 * 1024,
+	Argon2Time:    2,
+	Argon2Threads: 1,
+}
+
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+var passwordHashing = DefaultPasswordHashParams
+
+// Sets how new password hashes are made. Call it before opening a database.
+//
+//	Existing hashes made with other settings still work, and are replaced the next time their user logs in
+func SetPasswordHashing(params PasswordHashParams) error {
+	switch params.Algorithm {
+	case PasswordHashArgon2id:
+		if params.Argon2Memory == 0 || params.Argon2Time == 0 || params.Argon2Threads == 0 {
+			return errors.New("argon2id memory, time, and threads must be positive")
+		}
+	case PasswordHashBcrypt:
+		if params.BcryptCost < bcrypt.MinCost || params.BcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	default:
+		return fmt.Errorf("unknown password hash algorithm '%s'", params.Algorithm)
+	}
+	passwordHashing = params
+	return nil
+}
+
+// Hashes a password with the current settings
+func hashPassword(password string) (string, error) {
+	params := passwordHashing
+	if params.Algorithm == PasswordHashBcrypt {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), params.BcryptCost)
+		return string(hash), err
+	}
+
+	salt := make([]byte, argon2SaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, params.Argon2Time, params.Argon2Memory, params.Argon2Threads, argon2KeyLength)
+	// The PHC string format, as used by the reference implementation
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, params.Argon2Memory, params.Argon2Time, params.Argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Checks a password against a hash made by `hashPassword`.
+//
+//	`outdated` reports whether the hash was made with other settings than the current ones, and should be replaced
+func verifyPassword(hash string, password string) (match bool, outdated bool, err error) {
+	params := passwordHashing
+	if strings.HasPrefix(hash, "$2") {
+		err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, false, nil
+		}
+		if err != nil {
+			return false, false, err
+		}
+		cost, err := bcrypt.Cost([]byte(hash))
+		outdated = params.Algorithm != PasswordHashBcrypt || cost != params.BcryptCost
+		return true, outdated, err
+	}
+
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != PasswordHashArgon2id {
+		return false, false, ErrUnknownPasswordHash
+	}
+	var version int
+	var memory, time uint32
+	var threads uint8
+	_, err = fmt.Sscanf(parts[2], "v=%d", &version)
+	if err == nil {
+		_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads)
+	}
+	if err != nil || version != argon2.Version {
+		return false, false, ErrUnknownPasswordHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, false, ErrUnknownPasswordHash
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, false, ErrUnknownPasswordHash
+	}
+
+	key := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(expected)))
+	if subtle.ConstantTimeCompare(key, expected) != 1 {
+		return false, false, nil
+	}
+	outdated = params.Algorithm != PasswordHashArgon2id ||
+		memory != params.Argon2Memory || time != params.Argon2Time || threads != params.Argon2Threads
+	return true, outdated, nil
+}
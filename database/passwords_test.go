@@ -0,0 +1,104 @@
+package database
+
+import (
+	"strings"
+	"testing"
+)
+
+// Uses `params` for new password hashes until the test ends
+func usePasswordHashing(t *testing.T, params PasswordHashParams) {
+	previous := passwordHashing
+	err := SetPasswordHashing(params)
+	if err != nil {
+		t.Fatalf("Error setting password hashing: %v", err)
+	}
+	t.Cleanup(func() { passwordHashing = previous })
+}
+
+func TestPasswordHashes(t *testing.T) {
+	bcryptParams := PasswordHashParams{Algorithm: PasswordHashBcrypt, BcryptCost: 4}
+	argon2Params := PasswordHashParams{Algorithm: PasswordHashArgon2id, Argon2Memory: 64, Argon2Time: 1, Argon2Threads: 1}
+
+	for _, params := range []PasswordHashParams{bcryptParams, argon2Params} {
+		usePasswordHashing(t, params)
+		hash, err := hashPassword("correct horse")
+		if err != nil {
+			t.Fatalf("Error hashing with %s: %v", params.Algorithm, err)
+		}
+		match, outdated, err := verifyPassword(hash, "correct horse")
+		if err != nil || !match || outdated {
+			t.Fatalf("%s hash didn't verify: %v, %v, %v", params.Algorithm, match, outdated, err)
+		}
+		match, _, err = verifyPassword(hash, "wrong horse")
+		if err != nil || match {
+			t.Fatalf("%s hash matched the wrong password: %v", params.Algorithm, err)
+		}
+	}
+
+	hash, _ := hashPassword("correct horse")
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Fatalf("Argon2id hash doesn't describe its parameters: %s", hash)
+	}
+	usePasswordHashing(t, PasswordHashParams{Algorithm: PasswordHashArgon2id, Argon2Memory: 128, Argon2Time: 1, Argon2Threads: 1})
+	match, outdated, _ := verifyPassword(hash, "correct horse")
+	if !match || !outdated {
+		t.Fatal("Hash with old parameters not reported outdated")
+	}
+
+	_, _, err := verifyPassword("plaintext", "plaintext")
+	if err != ErrUnknownPasswordHash {
+		t.Fatalf("Expected an unknown hash error, actual: %v", err)
+	}
+	err = SetPasswordHashing(PasswordHashParams{Algorithm: "md5"})
+	if err == nil {
+		t.Fatal("Unknown algorithm accepted")
+	}
+}
+
+func TestRehashPasswordOnLogin(t *testing.T) {
+	testDb := NewDB("./testdatabase.json")
+
+	err := cleanupDbFile(testDb.path)
+	if err != nil {
+		t.Fatalf("Error cleaning up database file: %v", err)
+	}
+	testRehashPasswordOnLogin(t, testDb)
+}
+
+// Password hash upgrades shared by the database backends
+func testRehashPasswordOnLogin(t *testing.T, store Store) {
+	usePasswordHashing(t, PasswordHashParams{Algorithm: PasswordHashBcrypt, BcryptCost: 4})
+	user, err := store.CreateUser("foobar@example.com", "foobar")
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+
+	usePasswordHashing(t, PasswordHashParams{Algorithm: PasswordHashArgon2id, Argon2Memory: 64, Argon2Time: 1, Argon2Threads: 1})
+	_, err = store.ValidateCredentials("foobar@example.com", "wrong")
+	if err != ErrInvalidCredentials {
+		t.Fatalf("Expected invalid credentials, actual: %v", err)
+	}
+	dbStructure, err := store.Export()
+	if err != nil {
+		t.Fatalf("Error exporting database: %v", err)
+	}
+	if !strings.HasPrefix(dbStructure.Users[user.Id].Password, "$2") {
+		t.Fatal("Password rehashed after a failed login")
+	}
+
+	_, err = store.ValidateCredentials("foobar@example.com", "foobar")
+	if err != nil {
+		t.Fatalf("Error validating credentials: %v", err)
+	}
+	dbStructure, err = store.Export()
+	if err != nil {
+		t.Fatalf("Error exporting database: %v", err)
+	}
+	if !strings.HasPrefix(dbStructure.Users[user.Id].Password, "$argon2id$") {
+		t.Fatalf("Outdated password hash not replaced: %s", dbStructure.Users[user.Id].Password)
+	}
+	_, err = store.ValidateCredentials("foobar@example.com", "foobar")
+	if err != nil {
+		t.Fatalf("Error validating credentials with the new hash: %v", err)
+	}
+}
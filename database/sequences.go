@@ -0,0 +1,109 @@
+// Defines the id sequences used to assign chirp and user ids, and the repair pass for files that predate them
+
+package database
+
+import "fmt"
+
+const (
+	chirpSequence = "chirps"
+	userSequence  = "users"
+)
+
+// A record whose stored id doesn't match the id it's stored under
+type Collision struct {
+	Entity string `json:"entity"`
+	Id     int    `json:"id"`
+	Detail string `json:"detail"`
+}
+
+// Result of a sequence repair pass
+//
+//	`Repaired` is false if the database already had sequences and nothing was changed
+type RepairReport struct {
+	Repaired   bool           `json:"repaired"`
+	Collisions []Collision    `json:"collisions"`
+	Sequences  map[string]int `json:"sequences"`
+}
+
+// Gets the next id for the named sequence and advances the sequence. Ids are never reused, even after deletes.
+//
+//	A missing sequence is seeded from the largest id currently in use
+func (dbStructure *DBStructure) nextId(sequence string) int {
+	if dbStructure.Sequences == nil {
+		dbStructure.Sequences = map[string]int{}
+	}
+	last, found := dbStructure.Sequences[sequence]
+	if !found {
+		last = dbStructure.maxId(sequence)
+	}
+	dbStructure.Sequences[sequence] = last + 1
+	return last + 1
+}
+
+// Gets the largest id in use for the entity backing the named sequence
+func (dbStructure *DBStructure) maxId(sequence string) int {
+	largest := 0
+	switch sequence {
+	case chirpSequence:
+		for id, chirp := range dbStructure.Chirps {
+			largest = max(largest, id, chirp.Id)
+		}
+	case userSequence:
+		for id, intUsr := range dbStructure.Users {
+			largest = max(largest, id, intUsr.Id)
+		}
+	case auditEventSequence:
+		for id, event := range dbStructure.AuditEvents {
+			largest = max(largest, id, event.Id)
+		}
+	}
+	return largest
+}
+
+// Checks a database written before id sequences existed for id collisions and persists its sequences.
+//
+//	This only runs once: if the database already has sequences, nothing is checked or written.
+//	Collisions are reported, not fixed, since the overwritten data can't be recovered and ids may be referenced by clients.
+//	Errors if the database couldn't be loaded or written
+func (db *DB) RepairSequences() (report RepairReport, err error) {
+	err = db.Update(func(tx *Tx) error {
+		if tx.data.Sequences != nil {
+			report = RepairReport{Repaired: false, Collisions: []Collision{}, Sequences: tx.data.Sequences}
+			return nil
+		}
+
+		collisions := []Collision{}
+		for key, chirp := range tx.data.Chirps {
+			if key != chirp.Id {
+				collisions = append(collisions, Collision{
+					Entity: chirpSequence,
+					Id:     key,
+					Detail: fmt.Sprintf("chirp stored under id %d has id %d", key, chirp.Id),
+				})
+			}
+		}
+		// Users with duplicate ids are reassigned when the file is migrated to a map of users, which happens on load
+		for key, intUsr := range tx.data.Users {
+			if key != intUsr.Id {
+				collisions = append(collisions, Collision{
+					Entity: userSequence,
+					Id:     key,
+					Detail: fmt.Sprintf("user stored under id %d has id %d", key, intUsr.Id),
+				})
+			}
+		}
+
+		for _, sequence := range []string{chirpSequence, userSequence} {
+			err := tx.putSequence(sequence, tx.data.maxId(sequence))
+			if err != nil {
+				return err
+			}
+		}
+		report = RepairReport{Repaired: true, Collisions: collisions, Sequences: tx.data.Sequences}
+		return nil
+	})
+	if err != nil {
+		return RepairReport{}, err
+	}
+	return report, nil
+}
@@ -0,0 +1,65 @@
+package database
+
+import "testing"
+
+func TestRepairSequencesReportsCollisions(t *testing.T) {
+	testDb := NewDB("./testdatabase.json")
+
+	err := cleanupDbFile(testDb.path)
+	if err != nil {
+		t.Fatalf("Error cleaning up database file: %v", err)
+	}
+
+	err = testDb.writeDB(DBStructure{
+		Chirps: map[int]Chirp{
+			1: {Id: 1, Body: "First chirp"},
+			2: {Id: 5, Body: "Stored under the wrong id"},
+		},
+		Users: map[int]internalUser{
+			1: {User: User{Id: 1, Email: "first@example.com"}},
+			2: {User: User{Id: 1, Email: "second@example.com"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Error writing initial data to database: %v", err)
+	}
+
+	report, err := testDb.RepairSequences()
+	if err != nil {
+		t.Fatalf("Error repairing sequences: %v", err)
+	}
+	if !report.Repaired {
+		t.Fatal("Repair pass did not run on a database without sequences")
+	}
+	if len(report.Collisions) != 2 {
+		t.Fatalf("Expected 2 collisions, found %v", len(report.Collisions))
+	}
+	if report.Sequences[chirpSequence] != 5 || report.Sequences[userSequence] != 2 {
+		t.Fatalf("Unexpected sequences: %v", report.Sequences)
+	}
+
+	report, err = testDb.RepairSequences()
+	if err != nil {
+		t.Fatalf("Error repairing sequences a second time: %v", err)
+	}
+	if report.Repaired {
+		t.Fatal("Repair pass ran more than once")
+	}
+}
+
+func TestNextIdSeedsFromExistingIds(t *testing.T) {
+	dbStructure := DBStructure{Chirps: map[int]Chirp{
+		3: {Id: 3},
+		8: {Id: 8},
+	}}
+
+	if id := dbStructure.nextId(chirpSequence); id != 9 {
+		t.Fatalf("Expected id 9, actual %v", id)
+	}
+	if id := dbStructure.nextId(chirpSequence); id != 10 {
+		t.Fatalf("Expected id 10, actual %v", id)
+	}
+	if id := dbStructure.nextId(userSequence); id != 1 {
+		t.Fatalf("Expected id 1, actual %v", id)
+	}
+}
@@ -0,0 +1,119 @@
+package database
+
+import (
+	"sort"
+	"time"
+)
+
+// A login, as seen by the user who owns it. Each session is a refresh token family, described by its current token
+type Session struct {
+	Id         string    `json:"id"` // The refresh token family id
+	UserId     int       `json:"user_id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"` // When the refresh token was last rotated, or the login time if it never was
+	ExpiresAt  time.Time `json:"expires_at"`
+	UserAgent  string    `json:"user_agent"`
+	IpAddress  string    `json:"ip_address"`
+	ClientId   string    `json:"client_id,omitempty"` // The OAuth client the session was granted to, if it isn't a login
+	Scope      string    `json:"scope,omitempty"`     // The space separated scopes the client was granted
+}
+
+// Describes the session a family's current refresh token belongs to
+func newSession(current RefreshToken) Session {
+	return Session{
+		Id:         current.FamilyId,
+		UserId:     current.UserId,
+		CreatedAt:  current.FamilyCreatedAt,
+		LastUsedAt: current.CreatedAt,
+		ExpiresAt:  current.ExpiresAt,
+		UserAgent:  current.UserAgent,
+		IpAddress:  current.IpAddress,
+		ClientId:   current.ClientId,
+		Scope:      current.Scope,
+	}
+}
+
+// Sorts sessions with the most recently used first
+func sortSessions(sessions []Session) {
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt)
+	})
+}
+
+// Gets a session by its id, if it exists. Expired sessions are returned, and must be rejected by the caller
+func (db *DB) GetSession(sessionId string) (session Session, found bool, err error) {
+	err = db.View(func(tx *Tx) error {
+		for tokenHash := range tx.data.refreshTokensByFamily[sessionId] {
+			refreshToken := tx.data.RefreshTokens[tokenHash]
+			if refreshToken.RotatedAt == nil {
+				session, found = newSession(refreshToken), true
+				return nil
+			}
+		}
+		return nil
+	})
+	if err != nil || !found {
+		return Session{}, false, err
+	}
+	return session, true, nil
+}
+
+// Gets every session belonging to the user, most recently used first. Expired sessions are included
+func (db *DB) GetUserSessions(userId int) ([]Session, error) {
+	sessions := []Session{}
+	err := db.View(func(tx *Tx) error {
+		for _, refreshToken := range tx.data.RefreshTokens {
+			if refreshToken.UserId == userId && refreshToken.RotatedAt == nil {
+				sessions = append(sessions, newSession(refreshToken))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortSessions(sessions)
+	return sessions, nil
+}
+
+// Gets every user's sessions, most recently used first. Expired sessions are included
+func (db *DB) GetSessions() ([]Session, error) {
+	sessions := []Session{}
+	err := db.View(func(tx *Tx) error {
+		for _, refreshToken := range tx.data.RefreshTokens {
+			if refreshToken.RotatedAt == nil {
+				sessions = append(sessions, newSession(refreshToken))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortSessions(sessions)
+	return sessions, nil
+}
+
+// Revokes every session belonging to the user.
+//
+//	Returns the number of refresh tokens removed
+func (db *DB) DeleteUserSessions(userId int) (revoked int, err error) {
+	err = db.Update(func(tx *Tx) error {
+		revoked = 0
+		for tokenHash, refreshToken := range tx.data.RefreshTokens {
+			if refreshToken.UserId != userId {
+				continue
+			}
+			err := tx.deleteRefreshToken(tokenHash)
+			if err != nil {
+				return err
+			}
+			revoked++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return revoked, nil
+}
@@ -0,0 +1,105 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessions(t *testing.T) {
+	testDb := NewDB("./testdatabase.json")
+
+	err := cleanupDbFile(testDb.path)
+	if err != nil {
+		t.Fatalf("Error cleaning up database file: %v", err)
+	}
+	testSessions(t, testDb)
+}
+
+// Session behavior shared by the database backends
+func testSessions(t *testing.T, store Store) {
+	loginAt := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+	err := store.CreateRefreshToken("first", RefreshToken{
+		UserId: 5, FamilyId: "laptop", FamilyCreatedAt: loginAt, CreatedAt: loginAt, ExpiresAt: loginAt.Add(24 * time.Hour),
+		UserAgent: "laptop-agent", IpAddress: "192.0.2.1",
+	})
+	if err != nil {
+		t.Fatalf("Error creating refresh token: %v", err)
+	}
+	err = store.CreateRefreshToken("phone", RefreshToken{
+		UserId: 5, FamilyId: "phone", FamilyCreatedAt: loginAt, CreatedAt: loginAt, ExpiresAt: loginAt.Add(24 * time.Hour),
+		UserAgent: "phone-agent", IpAddress: "192.0.2.2",
+	})
+	if err != nil {
+		t.Fatalf("Error creating refresh token: %v", err)
+	}
+	err = store.CreateRefreshToken("other", RefreshToken{UserId: 6, FamilyId: "other", CreatedAt: loginAt, ExpiresAt: loginAt.Add(24 * time.Hour)})
+	if err != nil {
+		t.Fatalf("Error creating refresh token: %v", err)
+	}
+
+	// Rotating a token keeps its session, and records the latest client
+	usedAt := loginAt.Add(30 * time.Minute)
+	_, err = store.RotateRefreshToken("first", "second", RefreshToken{
+		CreatedAt: usedAt, ExpiresAt: usedAt.Add(24 * time.Hour), UserAgent: "laptop-agent", IpAddress: "192.0.2.3",
+	})
+	if err != nil {
+		t.Fatalf("Error rotating refresh token: %v", err)
+	}
+
+	sessions, err := store.GetUserSessions(5)
+	if err != nil {
+		t.Fatalf("Error getting sessions: %v", err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("Expected 2 sessions, actual: %+v", sessions)
+	}
+	laptop := sessions[0]
+	if laptop.Id != "laptop" || !laptop.CreatedAt.Equal(loginAt) || !laptop.LastUsedAt.Equal(usedAt) || laptop.IpAddress != "192.0.2.3" {
+		t.Fatalf("Most recently used session read back with incorrect data: %+v", laptop)
+	}
+
+	session, found, err := store.GetSession("laptop")
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	if !found || session != laptop {
+		t.Fatalf("Session read back with incorrect data: %+v", session)
+	}
+
+	sessions, err = store.GetSessions()
+	if err != nil {
+		t.Fatalf("Error getting every session: %v", err)
+	}
+	if len(sessions) != 3 || sessions[0] != laptop {
+		t.Fatalf("Expected every user's 3 sessions, most recently used first, actual: %+v", sessions)
+	}
+	rotated, err := store.GetRotatedRefreshTokens()
+	if err != nil {
+		t.Fatalf("Error getting rotated refresh tokens: %v", err)
+	}
+	if len(rotated) != 1 || rotated[0].FamilyId != "laptop" || rotated[0].RotatedAt == nil || rotated[0].IpAddress != "192.0.2.1" {
+		t.Fatalf("Expected the laptop's replaced refresh token, actual: %+v", rotated)
+	}
+
+	revoked, err := store.DeleteUserSessions(5)
+	if err != nil {
+		t.Fatalf("Error revoking sessions: %v", err)
+	}
+	if revoked != 3 {
+		t.Fatalf("Expected 3 revoked tokens, actual: %v", revoked)
+	}
+	_, found, err = store.GetSession("laptop")
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	if found {
+		t.Fatal("Found a revoked session")
+	}
+	_, found, err = store.GetSession("other")
+	if err != nil {
+		t.Fatalf("Error getting session: %v", err)
+	}
+	if !found {
+		t.Fatal("Revoked another user's session")
+	}
+}
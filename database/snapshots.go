@@ -0,0 +1,232 @@
+// Defines Snapshots, compressed point-in-time copies of a database that can be listed and restored
+
+package database
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrSnapshotNotFound = errors.New("snapshot not found")
+	ErrSnapshotCorrupt  = errors.New("snapshot is corrupt")
+)
+
+const (
+	snapshotPrefix     = "chirpy-"
+	snapshotSuffix     = ".json.gz"
+	snapshotTimeFormat = "20060102T150405.000000Z"
+)
+
+// A directory of snapshots. Snapshots hold every record as JSON, so one taken from either backend can be restored into the other
+type Snapshots struct {
+	dir    string
+	retain int
+}
+
+// Describes a snapshot file
+type SnapshotInfo struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	Size      int64     `json:"size"`
+}
+
+// Contents of a snapshot file, before compression.
+//
+//	`Checksum` is the hex SHA-256 of `Data`, so a truncated or altered snapshot is caught before it's restored
+type snapshotFile struct {
+	SchemaVersion int             `json:"schema_version"`
+	CreatedAt     time.Time       `json:"created_at"`
+	Checksum      string          `json:"checksum"`
+	Data          json.RawMessage `json:"data"`
+}
+
+// Snapshots stored in `dir`, which is created when the first snapshot is taken.
+//
+//	Only the newest `retain` snapshots are kept. Zero keeps every snapshot
+func NewSnapshots(dir string, retain int) *Snapshots {
+	return &Snapshots{dir: dir, retain: retain}
+}
+
+// Takes a consistent snapshot of the store, then removes snapshots past the retention limit
+func (snapshots *Snapshots) Create(store Store) (SnapshotInfo, error) {
+	dbStructure, err := store.Export()
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	dbStructure.SchemaVersion = CurrentSchemaVersion()
+	data, err := json.Marshal(dbStructure)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	createdAt := time.Now().UTC().Truncate(time.Microsecond) // The precision kept in the file name
+	checksum := sha256.Sum256(data)
+	contents, err := json.Marshal(snapshotFile{
+		SchemaVersion: dbStructure.SchemaVersion,
+		CreatedAt:     createdAt,
+		Checksum:      hex.EncodeToString(checksum[:]),
+		Data:          data,
+	})
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	compressed := bytes.Buffer{}
+	writer := gzip.NewWriter(&compressed)
+	_, err = writer.Write(contents)
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	err = os.MkdirAll(snapshots.dir, 0755)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	info := SnapshotInfo{
+		Name:      snapshotPrefix + createdAt.Format(snapshotTimeFormat) + snapshotSuffix,
+		CreatedAt: createdAt,
+		Size:      int64(compressed.Len()),
+	}
+	err = writeFileAtomic(filepath.Join(snapshots.dir, info.Name), compressed.Bytes())
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	return info, snapshots.prune()
+}
+
+// Lists the snapshots, newest first
+func (snapshots *Snapshots) List() ([]SnapshotInfo, error) {
+	entries, err := os.ReadDir(snapshots.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []SnapshotInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	infos := []SnapshotInfo{}
+	for _, entry := range entries {
+		createdAt, ok := parseSnapshotName(entry.Name())
+		if !ok || entry.IsDir() {
+			continue
+		}
+		fileInfo, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, SnapshotInfo{Name: entry.Name(), CreatedAt: createdAt, Size: fileInfo.Size()})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].CreatedAt.After(infos[j].CreatedAt)
+	})
+	return infos, nil
+}
+
+// Reads and verifies a snapshot, migrating its data if it was taken at an older schema version.
+//
+//	Errors with `ErrSnapshotCorrupt` if the checksum doesn't match, or `ErrSchemaTooNew` if it was taken by a newer version of Chirpy
+func (snapshots *Snapshots) Read(name string) (DBStructure, error) {
+	if _, ok := parseSnapshotName(name); !ok || filepath.Base(name) != name {
+		return DBStructure{}, ErrSnapshotNotFound
+	}
+	file, err := os.Open(filepath.Join(snapshots.dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return DBStructure{}, ErrSnapshotNotFound
+	}
+	if err != nil {
+		return DBStructure{}, err
+	}
+	defer file.Close()
+
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		return DBStructure{}, fmt.Errorf("%w: %v", ErrSnapshotCorrupt, err)
+	}
+	contents, err := io.ReadAll(reader)
+	if err != nil {
+		return DBStructure{}, fmt.Errorf("%w: %v", ErrSnapshotCorrupt, err)
+	}
+	snapshot := snapshotFile{}
+	err = json.Unmarshal(contents, &snapshot)
+	if err != nil {
+		return DBStructure{}, fmt.Errorf("%w: %v", ErrSnapshotCorrupt, err)
+	}
+
+	checksum := sha256.Sum256(snapshot.Data)
+	if hex.EncodeToString(checksum[:]) != snapshot.Checksum {
+		return DBStructure{}, fmt.Errorf("%w: checksum mismatch", ErrSnapshotCorrupt)
+	}
+	if snapshot.SchemaVersion > CurrentSchemaVersion() {
+		return DBStructure{}, fmt.Errorf("%w: schema version %d, expected at most %d", ErrSchemaTooNew, snapshot.SchemaVersion, CurrentSchemaVersion())
+	}
+
+	data, _, err := migrate(snapshot.Data)
+	if err != nil {
+		return DBStructure{}, err
+	}
+	dbStructure := DBStructure{}
+	err = json.Unmarshal(data, &dbStructure)
+	if err != nil {
+		return DBStructure{}, fmt.Errorf("%w: %v", ErrSnapshotCorrupt, err)
+	}
+	return dbStructure, nil
+}
+
+// Checks that a snapshot can be restored without restoring it
+func (snapshots *Snapshots) Verify(name string) error {
+	_, err := snapshots.Read(name)
+	return err
+}
+
+// Replaces every record in the store with the contents of a verified snapshot
+func (snapshots *Snapshots) Restore(store Store, name string) error {
+	dbStructure, err := snapshots.Read(name)
+	if err != nil {
+		return err
+	}
+	return store.Import(dbStructure)
+}
+
+// Removes the oldest snapshots past the retention limit
+func (snapshots *Snapshots) prune() error {
+	if snapshots.retain <= 0 {
+		return nil
+	}
+	infos, err := snapshots.List()
+	if err != nil {
+		return err
+	}
+	for _, info := range infos[min(snapshots.retain, len(infos)):] {
+		err = os.Remove(filepath.Join(snapshots.dir, info.Name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Gets the creation time from a snapshot file name. `ok` is false if the name isn't a snapshot's
+func parseSnapshotName(name string) (createdAt time.Time, ok bool) {
+	if !strings.HasPrefix(name, snapshotPrefix) || !strings.HasSuffix(name, snapshotSuffix) {
+		return time.Time{}, false
+	}
+	timestamp := strings.TrimSuffix(strings.TrimPrefix(name, snapshotPrefix), snapshotSuffix)
+	createdAt, err := time.Parse(snapshotTimeFormat, timestamp)
+	return createdAt, err == nil
+}
@@ -0,0 +1,208 @@
+package database
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Creates an empty snapshot directory, removing any left over from a previous run
+func newTestSnapshots(t *testing.T, retain int) *Snapshots {
+	dir := "./testdatabase-snapshots"
+	err := os.RemoveAll(dir)
+	if err != nil {
+		t.Fatalf("Error cleaning up snapshot directory: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return NewSnapshots(dir, retain)
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	testDb := NewDB("./testdatabase.json")
+	snapshots := newTestSnapshots(t, 0)
+
+	err := cleanupDbFile(testDb.path)
+	if err != nil {
+		t.Fatalf("Error cleaning up database file: %v", err)
+	}
+
+	kept, err := testDb.CreateChirp("Kept chirp", 1)
+	if err != nil {
+		t.Fatalf("Error creating chirp: %v", err)
+	}
+	info, err := snapshots.Create(testDb)
+	if err != nil {
+		t.Fatalf("Error creating snapshot: %v", err)
+	}
+	_, err = testDb.CreateChirp("Lost chirp", 1)
+	if err != nil {
+		t.Fatalf("Error creating chirp: %v", err)
+	}
+
+	err = snapshots.Restore(testDb, info.Name)
+	if err != nil {
+		t.Fatalf("Error restoring snapshot: %v", err)
+	}
+	chirps, err := testDb.GetUserChirps(1)
+	if err != nil {
+		t.Fatalf("Error getting chirps: %v", err)
+	}
+	if len(chirps) != 1 || chirps[0].Id != kept.Id {
+		t.Fatalf("Unexpected chirps after restore: %v", chirps)
+	}
+
+	// Ids handed out after the snapshot was taken may be reused, but never ids from before it
+	next, err := testDb.CreateChirp("Next chirp", 1)
+	if err != nil {
+		t.Fatalf("Error creating chirp: %v", err)
+	}
+	if next.Id <= kept.Id {
+		t.Fatalf("Restored database reused chirp id %v", next.Id)
+	}
+}
+
+func TestSnapshotRestoresIntoSQLite(t *testing.T) {
+	testDb := NewDB("./testdatabase.json")
+	snapshots := newTestSnapshots(t, 0)
+
+	err := cleanupDbFile(testDb.path)
+	if err != nil {
+		t.Fatalf("Error cleaning up database file: %v", err)
+	}
+
+	user, err := testDb.CreateUser("foobar@example.com", "foobar")
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	chirp, err := testDb.CreateChirp("Moved chirp", user.Id)
+	if err != nil {
+		t.Fatalf("Error creating chirp: %v", err)
+	}
+	_, err = testDb.DeleteChirp(chirp.Id)
+	if err != nil {
+		t.Fatalf("Error deleting chirp: %v", err)
+	}
+	info, err := snapshots.Create(testDb)
+	if err != nil {
+		t.Fatalf("Error creating snapshot: %v", err)
+	}
+
+	sqliteDb := newTestSQLiteDB(t)
+	err = snapshots.Restore(sqliteDb, info.Name)
+	if err != nil {
+		t.Fatalf("Error restoring snapshot: %v", err)
+	}
+	_, err = sqliteDb.ValidateCredentials("foobar@example.com", "foobar")
+	if err != nil {
+		t.Fatalf("Error validating restored credentials: %v", err)
+	}
+	next, err := sqliteDb.CreateChirp("Next chirp", user.Id)
+	if err != nil {
+		t.Fatalf("Error creating chirp: %v", err)
+	}
+	if next.Id <= chirp.Id {
+		t.Fatalf("Restored database reused deleted chirp id %v", next.Id)
+	}
+}
+
+func TestSnapshotRetention(t *testing.T) {
+	testDb := NewDB("./testdatabase.json")
+	snapshots := newTestSnapshots(t, 2)
+
+	err := cleanupDbFile(testDb.path)
+	if err != nil {
+		t.Fatalf("Error cleaning up database file: %v", err)
+	}
+
+	created := []SnapshotInfo{}
+	for i := 0; i < 3; i++ {
+		info, err := snapshots.Create(testDb)
+		if err != nil {
+			t.Fatalf("Error creating snapshot: %v", err)
+		}
+		created = append(created, info)
+	}
+
+	infos, err := snapshots.List()
+	if err != nil {
+		t.Fatalf("Error listing snapshots: %v", err)
+	}
+	if len(infos) != 2 || infos[0].Name != created[2].Name || infos[1].Name != created[1].Name {
+		t.Fatalf("Expected the two newest snapshots, newest first, actual: %v", infos)
+	}
+}
+
+func TestSnapshotVerification(t *testing.T) {
+	testDb := NewDB("./testdatabase.json")
+	snapshots := newTestSnapshots(t, 0)
+
+	err := cleanupDbFile(testDb.path)
+	if err != nil {
+		t.Fatalf("Error cleaning up database file: %v", err)
+	}
+
+	info, err := snapshots.Create(testDb)
+	if err != nil {
+		t.Fatalf("Error creating snapshot: %v", err)
+	}
+	err = snapshots.Verify(info.Name)
+	if err != nil {
+		t.Fatalf("Error verifying snapshot: %v", err)
+	}
+
+	// Rewrites the snapshot after `edit` changes its contents
+	rewrite := func(edit func(snapshot *snapshotFile)) {
+		path := filepath.Join(snapshots.dir, info.Name)
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatalf("Error opening snapshot: %v", err)
+		}
+		reader, err := gzip.NewReader(file)
+		if err != nil {
+			t.Fatalf("Error decompressing snapshot: %v", err)
+		}
+		snapshot := snapshotFile{}
+		err = json.NewDecoder(reader).Decode(&snapshot)
+		file.Close()
+		if err != nil {
+			t.Fatalf("Error decoding snapshot: %v", err)
+		}
+
+		edit(&snapshot)
+
+		file, err = os.Create(path)
+		if err != nil {
+			t.Fatalf("Error rewriting snapshot: %v", err)
+		}
+		writer := gzip.NewWriter(file)
+		err = json.NewEncoder(writer).Encode(snapshot)
+		writer.Close()
+		file.Close()
+		if err != nil {
+			t.Fatalf("Error encoding snapshot: %v", err)
+		}
+	}
+
+	rewrite(func(snapshot *snapshotFile) { snapshot.SchemaVersion = CurrentSchemaVersion() + 1 })
+	err = snapshots.Verify(info.Name)
+	if !errors.Is(err, ErrSchemaTooNew) {
+		t.Fatalf("Expected a schema too new error, actual: %v", err)
+	}
+
+	rewrite(func(snapshot *snapshotFile) {
+		snapshot.SchemaVersion = CurrentSchemaVersion()
+		snapshot.Data = json.RawMessage(`{"chirps": {}}`)
+	})
+	err = snapshots.Verify(info.Name)
+	if !errors.Is(err, ErrSnapshotCorrupt) {
+		t.Fatalf("Expected a corrupt snapshot error, actual: %v", err)
+	}
+
+	err = snapshots.Verify("../testdatabase.json")
+	if err != ErrSnapshotNotFound {
+		t.Fatalf("Expected a snapshot not found error for a path outside the directory, actual: %v", err)
+	}
+}
@@ -0,0 +1,1850 @@
+// Defines the SQLiteDB type, an embedded SQLite implementation of Store
+
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+type SQLiteDB struct {
+	path string
+	conn *sql.DB
+}
+
+// A SQLite schema migration. The database's `user_version` pragma holds the last applied version
+type sqliteMigration struct {
+	Migration
+	statements string
+	backfill   func(tx *sql.Tx) error // Optional. Runs after `statements` for changes that can't be made in SQL
+}
+
+// Every SQLite migration, in order
+var sqliteMigrations = []sqliteMigration{
+	{
+		Migration: Migration{Version: 1, Description: "Create chirps, users, and revoked token tables"},
+		statements: `
+CREATE TABLE IF NOT EXISTS chirps (
+	id        INTEGER PRIMARY KEY AUTOINCREMENT,
+	body      TEXT    NOT NULL,
+	author_id INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS users (
+	id            INTEGER PRIMARY KEY AUTOINCREMENT,
+	email         TEXT    NOT NULL UNIQUE,
+	password      TEXT    NOT NULL,
+	is_chirpy_red INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS revoked_user_tokens (
+	token      TEXT      PRIMARY KEY,
+	revoked_at TIMESTAMP NOT NULL
+);`,
+	},
+	{
+		Migration: Migration{Version: 2, Description: "Make emails unique ignoring case and index chirps by author"},
+		statements: `
+CREATE UNIQUE INDEX users_email_nocase ON users (email COLLATE NOCASE);
+CREATE INDEX chirps_author_id ON chirps (author_id);`,
+	},
+	{
+		Migration: Migration{Version: 3, Description: "Record when each revoked token expires"},
+		statements: `
+ALTER TABLE revoked_user_tokens ADD COLUMN expires_at INTEGER NOT NULL DEFAULT 0;
+CREATE INDEX revoked_user_tokens_expires_at ON revoked_user_tokens (expires_at);`,
+		backfill: backfillRevokedTokenExpiry,
+	},
+	{
+		// Expirations are stored as Unix seconds so they compare correctly in SQL
+		Migration: Migration{Version: 4, Description: "Replace the revoked token list with stored refresh tokens. Users must log in again"},
+		statements: `
+DROP TABLE revoked_user_tokens;
+CREATE TABLE refresh_tokens (
+	token_hash TEXT      PRIMARY KEY,
+	user_id    INTEGER   NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	expires_at INTEGER   NOT NULL,
+	user_agent TEXT      NOT NULL DEFAULT ''
+);
+CREATE INDEX refresh_tokens_expires_at ON refresh_tokens (expires_at);`,
+	},
+	{
+		// Tokens from before families existed each start their own, named after the token hash
+		Migration: Migration{Version: 5, Description: "Give each existing refresh token its own token family"},
+		statements: `
+ALTER TABLE refresh_tokens ADD COLUMN family_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE refresh_tokens ADD COLUMN rotated_at TIMESTAMP;
+UPDATE refresh_tokens SET family_id = token_hash;
+CREATE INDEX refresh_tokens_family_id ON refresh_tokens (family_id);`,
+	},
+	{
+		// A family's first token was issued at login, which is when its session started
+		Migration: Migration{Version: 6, Description: "Record when each session started and the client's IP address"},
+		statements: `
+ALTER TABLE refresh_tokens ADD COLUMN family_created_at TIMESTAMP;
+ALTER TABLE refresh_tokens ADD COLUMN ip_address TEXT NOT NULL DEFAULT '';
+UPDATE refresh_tokens SET family_created_at = (
+	SELECT MIN(created_at) FROM refresh_tokens AS family WHERE family.family_id = refresh_tokens.family_id
+);`,
+	},
+	{
+		Migration: Migration{Version: 7, Description: "Give every existing user the user role and record privileged actions"},
+		statements: `
+ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'user';
+CREATE TABLE audit_events (
+	id         INTEGER   PRIMARY KEY AUTOINCREMENT,
+	created_at TIMESTAMP NOT NULL,
+	actor_id   INTEGER   NOT NULL,
+	action     TEXT      NOT NULL,
+	target     TEXT      NOT NULL,
+	details    TEXT      NOT NULL,
+	ip_address TEXT      NOT NULL
+);`,
+	},
+	{
+		Migration: Migration{Version: 8, Description: "Store single-use tokens, like password resets"},
+		statements: `
+CREATE TABLE one_time_tokens (
+	token_hash TEXT      PRIMARY KEY,
+	user_id    INTEGER   NOT NULL,
+	purpose    TEXT      NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	expires_at INTEGER   NOT NULL
+);
+CREATE INDEX one_time_tokens_user_id ON one_time_tokens (user_id, purpose);
+CREATE INDEX one_time_tokens_expires_at ON one_time_tokens (expires_at);`,
+	},
+	{
+		// Existing users haven't verified their emails either
+		Migration: Migration{Version: 9, Description: "Track email verification and pending email changes"},
+		statements: `
+ALTER TABLE users ADD COLUMN email_verified INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN pending_email TEXT NOT NULL DEFAULT '';
+ALTER TABLE one_time_tokens ADD COLUMN email TEXT NOT NULL DEFAULT '';`,
+	},
+	{
+		Migration: Migration{Version: 10, Description: "Store TOTP secrets and recovery codes for two-factor authentication"},
+		statements: `
+CREATE TABLE two_factor (
+	user_id        INTEGER   PRIMARY KEY,
+	secret         TEXT      NOT NULL,
+	enabled        INTEGER   NOT NULL DEFAULT 0,
+	last_used_step INTEGER   NOT NULL DEFAULT 0,
+	created_at     TIMESTAMP NOT NULL
+);
+CREATE TABLE recovery_codes (
+	user_id   INTEGER NOT NULL,
+	code_hash TEXT    NOT NULL,
+	PRIMARY KEY (user_id, code_hash)
+);`,
+	},
+	{
+		Migration: Migration{Version: 11, Description: "Store hashed personal API keys"},
+		statements: `
+CREATE TABLE api_keys (
+	key_hash   TEXT      PRIMARY KEY,
+	id         TEXT      NOT NULL UNIQUE,
+	user_id    INTEGER   NOT NULL,
+	name       TEXT      NOT NULL,
+	prefix     TEXT      NOT NULL,
+	scopes     TEXT      NOT NULL,
+	created_at TIMESTAMP NOT NULL
+);
+CREATE INDEX api_keys_user_id ON api_keys (user_id);`,
+	},
+	{
+		// Existing refresh tokens were issued at login, not to a client
+		Migration: Migration{Version: 12, Description: "Store OAuth clients and authorization codes, and the client each refresh token was issued to"},
+		statements: `
+CREATE TABLE oauth_clients (
+	id            TEXT      PRIMARY KEY,
+	owner_id      INTEGER   NOT NULL,
+	name          TEXT      NOT NULL,
+	redirect_uris TEXT      NOT NULL,
+	confidential  INTEGER   NOT NULL DEFAULT 0,
+	secret_hash   TEXT      NOT NULL DEFAULT '',
+	created_at    TIMESTAMP NOT NULL
+);
+CREATE INDEX oauth_clients_owner_id ON oauth_clients (owner_id);
+CREATE TABLE authorization_codes (
+	code_hash      TEXT      PRIMARY KEY,
+	client_id      TEXT      NOT NULL,
+	user_id        INTEGER   NOT NULL,
+	redirect_uri   TEXT      NOT NULL,
+	scopes         TEXT      NOT NULL,
+	code_challenge TEXT      NOT NULL,
+	created_at     TIMESTAMP NOT NULL,
+	expires_at     INTEGER   NOT NULL
+);
+CREATE INDEX authorization_codes_expires_at ON authorization_codes (expires_at);
+ALTER TABLE refresh_tokens ADD COLUMN client_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE refresh_tokens ADD COLUMN scope TEXT NOT NULL DEFAULT '';
+CREATE INDEX refresh_tokens_client_id ON refresh_tokens (client_id);`,
+	},
+	{
+		Migration:  Migration{Version: 13, Description: "Add the disabled flag to users"},
+		statements: `ALTER TABLE users ADD COLUMN disabled INTEGER NOT NULL DEFAULT 0;`,
+	},
+	{
+		Migration:  Migration{Version: 14, Description: "Keep used authorization codes with the refresh token family they were traded for"},
+		statements: `ALTER TABLE authorization_codes ADD COLUMN family_id TEXT NOT NULL DEFAULT '';`,
+	},
+}
+
+// Opens (creating if necessary) the SQLite database at `path` and migrates it to the current schema.
+//
+//	An existing database is backed up before any migration runs
+func NewSQLiteDB(path string) (*SQLiteDB, error) {
+	// Transactions take the write lock when they begin, so concurrent ones wait their turn instead of failing when they go on to write
+	conn, err := sql.Open("sqlite3", path+"?_busy_timeout=5000&_journal_mode=WAL&_txlock=immediate")
+	if err != nil {
+		return nil, err
+	}
+
+	db := &SQLiteDB{path: path, conn: conn}
+	report, err := db.pendingMigrations()
+	if err == nil && len(report.Applied) > 0 {
+		err = db.migrate(report)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Lists the migrations that would run against the SQLite database at `path`, without changing it
+func DryRunSQLiteMigrations(path string) (MigrationReport, error) {
+	_, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		// A new database is created at the current version
+		version := sqliteMigrations[len(sqliteMigrations)-1].Version
+		return MigrationReport{FromVersion: version, ToVersion: version, Applied: []Migration{}}, nil
+	}
+
+	conn, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return MigrationReport{}, err
+	}
+	defer conn.Close()
+
+	return (&SQLiteDB{path: path, conn: conn}).pendingMigrations()
+}
+
+func (db *SQLiteDB) pendingMigrations() (MigrationReport, error) {
+	version := 0
+	err := db.conn.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return MigrationReport{}, err
+	}
+
+	latest := sqliteMigrations[len(sqliteMigrations)-1].Version
+	report := MigrationReport{FromVersion: version, ToVersion: version, Applied: []Migration{}}
+	if version > latest {
+		return report, fmt.Errorf("%w: schema version %d, expected at most %d", ErrSchemaTooNew, version, latest)
+	}
+	for _, migration := range sqliteMigrations {
+		if migration.Version > version {
+			report.Applied = append(report.Applied, migration.Migration)
+			report.ToVersion = migration.Version
+		}
+	}
+	return report, nil
+}
+
+// Backs up the database, then runs each pending migration in its own transaction
+func (db *SQLiteDB) migrate(report MigrationReport) error {
+	if report.FromVersion > 0 {
+		backup := fmt.Sprintf("%s.schema-v%d.%s.bak", db.path, report.FromVersion, time.Now().UTC().Format("20060102T150405Z"))
+		_, err := db.conn.Exec("VACUUM INTO ?", backup)
+		if err != nil {
+			return fmt.Errorf("backing up database before migration: %w", err)
+		}
+		log.Printf("Migrating %s from schema version %d to %d. Backup written to %s", db.path, report.FromVersion, report.ToVersion, backup)
+	}
+
+	for _, migration := range sqliteMigrations {
+		if migration.Version <= report.FromVersion {
+			continue
+		}
+		tx, err := db.conn.Begin()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(migration.statements)
+		if err == nil && migration.backfill != nil {
+			err = migration.backfill(tx)
+		}
+		if err == nil {
+			// PRAGMA doesn't accept bound parameters
+			_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", migration.Version))
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migrating to schema version %d (%s): %w", migration.Version, migration.Description, err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Closes the underlying database connection
+func (db *SQLiteDB) Close() error {
+	return db.conn.Close()
+}
+
+// Reports whether the error is a violation of a UNIQUE constraint
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
+
+// Creates a new chirp and saves it to the database
+func (db *SQLiteDB) CreateChirp(body string, authorId int) (Chirp, error) {
+	result, err := db.conn.Exec("INSERT INTO chirps (body, author_id) VALUES (?, ?)", body, authorId)
+	if err != nil {
+		return Chirp{}, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return Chirp{}, err
+	}
+	return Chirp{Id: int(id), Body: body, AuthorId: authorId}, nil
+}
+
+// Gets a chirp by its id, if it exists
+func (db *SQLiteDB) GetChirp(id int) (chirp Chirp, found bool, err error) {
+	row := db.conn.QueryRow("SELECT id, body, author_id FROM chirps WHERE id = ?", id)
+	err = row.Scan(&chirp.Id, &chirp.Body, &chirp.AuthorId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, false, nil
+	}
+	if err != nil {
+		return Chirp{}, false, err
+	}
+	return chirp, true, nil
+}
+
+// Gets all of the existing Chirps
+func (db *SQLiteDB) GetChirps() ([]Chirp, error) {
+	return db.queryChirps("SELECT id, body, author_id FROM chirps")
+}
+
+// Gets chirps with a specific user/author id
+func (db *SQLiteDB) GetUserChirps(authorId int) ([]Chirp, error) {
+	return db.queryChirps("SELECT id, body, author_id FROM chirps WHERE author_id = ?", authorId)
+}
+
+func (db *SQLiteDB) queryChirps(query string, args ...interface{}) ([]Chirp, error) {
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chirps := []Chirp{}
+	for rows.Next() {
+		chirp := Chirp{}
+		err = rows.Scan(&chirp.Id, &chirp.Body, &chirp.AuthorId)
+		if err != nil {
+			return nil, err
+		}
+		chirps = append(chirps, chirp)
+	}
+	return chirps, rows.Err()
+}
+
+// Deletes a chirp from the database.
+//
+//	`success` is true if the chirp was removed from the database, and false if the chirp was not found or an error occurred
+func (db *SQLiteDB) DeleteChirp(chirpId int) (success bool, err error) {
+	result, err := db.conn.Exec("DELETE FROM chirps WHERE id = ?", chirpId)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+// Creates a user with the specified email. Ids are assigned by SQLite and never reused. The email starts out unverified
+func (db *SQLiteDB) CreateUser(email string, password string) (User, error) {
+	if !ValidEmail(email) {
+		return User{}, ErrInvalidEmail
+	}
+	hashedPassword, err := hashPassword(password)
+	if err != nil {
+		return User{}, err
+	}
+
+	result, err := db.conn.Exec("INSERT INTO users (email, password) VALUES (?, ?)", email, hashedPassword)
+	if isUniqueViolation(err) {
+		return User{}, ErrEmailInUse
+	}
+	if err != nil {
+		return User{}, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return User{}, err
+	}
+	return User{Id: int(id), Email: email, Role: RoleUser}, nil
+}
+
+// Validates login credentials against a user's stored credentials in the database.
+//
+//	Returns the user if found and valid credentials provided.
+//	Errors with `ErrInvalidCredentials` whether the email wasn't found or the password was wrong.
+//	A password hash made with outdated settings is replaced with a new one
+func (db *SQLiteDB) ValidateCredentials(email string, password string) (User, error) {
+	intUsr, err := scanUser(db.conn.QueryRow("SELECT "+userColumns+" FROM users WHERE email = ? COLLATE NOCASE", email))
+	found := err == nil
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return User{}, err
+	}
+
+	outdated, err := checkPassword(intUsr, found, password)
+	if err != nil {
+		return User{}, err
+	}
+	if outdated {
+		err = db.rehashPassword(intUsr, password)
+		if err != nil {
+			log.Printf("Error upgrading the password hash for user %d: %v", intUsr.Id, err)
+		}
+	}
+	return intUsr.User, nil
+}
+
+// Replaces a user's password hash with one made with the current settings, unless the password changed since it was checked
+func (db *SQLiteDB) rehashPassword(intUsr internalUser, password string) error {
+	hashedPassword, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = db.conn.Exec("UPDATE users SET password = ? WHERE id = ? AND password = ?", hashedPassword, intUsr.Id, intUsr.Password)
+	return err
+}
+
+// Updates a user entry in the database based on provided values for the email and password.
+//
+//	Empty values will not update the corresponding field in the database.
+//	A new email replaces the old one immediately and is unverified. Use `SetPendingEmail` to keep the old email until the new one is verified.
+//	Update should be authorized prior to calling this method
+func (db *SQLiteDB) UpdateUser(id int, email string, password string) (User, error) {
+	if email != "" && !ValidEmail(email) {
+		return User{}, ErrInvalidEmail
+	}
+	hashedPassword := ""
+	if password != "" {
+		hashed, err := hashPassword(password)
+		if err != nil {
+			return User{}, err
+		}
+		hashedPassword = hashed
+	}
+
+	// Every expression sees the row as it was before the update
+	_, err := db.conn.Exec(`
+UPDATE users SET
+	email_verified = CASE WHEN ?1 <> '' AND ?1 <> email COLLATE NOCASE THEN 0 ELSE email_verified END,
+	pending_email = CASE WHEN ?1 <> '' AND ?1 <> email COLLATE NOCASE THEN '' ELSE pending_email END,
+	email = COALESCE(NULLIF(?1, ''), email),
+	password = COALESCE(NULLIF(?2, ''), password)
+WHERE id = ?3`,
+		email, hashedPassword, id)
+	if isUniqueViolation(err) {
+		return User{}, ErrEmailInUse
+	}
+	if err != nil {
+		return User{}, err
+	}
+	return db.getUser(id)
+}
+
+// Upgrades a specified user to Chirpy Red
+//
+//	Returns the upgraded user on success. Returns an error if the user doesn't exist or the update failed
+func (db *SQLiteDB) UpgradeUser(id int) (User, error) {
+	_, err := db.conn.Exec("UPDATE users SET is_chirpy_red = 1 WHERE id = ?", id)
+	if err != nil {
+		return User{}, err
+	}
+	return db.getUser(id)
+}
+
+// Removes Chirpy Red from a specified user
+//
+//	Returns the downgraded user on success. Returns an error if the user doesn't exist or the update failed
+func (db *SQLiteDB) DowngradeUser(id int) (User, error) {
+	_, err := db.conn.Exec("UPDATE users SET is_chirpy_red = 0 WHERE id = ?", id)
+	if err != nil {
+		return User{}, err
+	}
+	return db.getUser(id)
+}
+
+// Disables or re-enables a user. Disabling doesn't end the user's sessions, which the caller revokes with `DeleteUserSessions`
+//
+//	Returns the updated user on success. Errors with `ErrUserNotFound`
+func (db *SQLiteDB) SetUserDisabled(id int, disabled bool) (User, error) {
+	_, err := db.conn.Exec("UPDATE users SET disabled = ? WHERE id = ?", disabled, id)
+	if err != nil {
+		return User{}, err
+	}
+	return db.getUser(id)
+}
+
+// Gets every user, ordered by id
+func (db *SQLiteDB) GetUsers() ([]User, error) {
+	rows, err := db.conn.Query("SELECT " + userColumns + " FROM users ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		intUsr, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, intUsr.User)
+	}
+	return users, rows.Err()
+}
+
+func (db *SQLiteDB) getUser(id int) (User, error) {
+	intUsr, err := scanUser(db.conn.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrUserNotFound
+	}
+	if err != nil {
+		return User{}, err
+	}
+	return intUsr.User, nil
+}
+
+// Columns read by `scanUser`
+const userColumns = "id, email, is_chirpy_red, role, email_verified, pending_email, disabled, password"
+
+// Scans the `userColumns` of a row
+func scanUser(row sqlScanner) (internalUser, error) {
+	intUsr := internalUser{}
+	err := row.Scan(&intUsr.Id, &intUsr.Email, &intUsr.IsChirpyRed, &intUsr.Role, &intUsr.EmailVerified, &intUsr.PendingEmail, &intUsr.Disabled, &intUsr.Password)
+	return intUsr, err
+}
+
+// Gets a user by id, if they exist
+func (db *SQLiteDB) GetUser(id int) (user User, found bool, err error) {
+	user, err = db.getUser(id)
+	if err == ErrUserNotFound {
+		return User{}, false, nil
+	}
+	if err != nil {
+		return User{}, false, err
+	}
+	return user, true, nil
+}
+
+// Gets a user by email, ignoring case, if they exist
+func (db *SQLiteDB) GetUserByEmail(email string) (user User, found bool, err error) {
+	intUsr, err := scanUser(db.conn.QueryRow("SELECT "+userColumns+" FROM users WHERE email = ? COLLATE NOCASE", email))
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, false, nil
+	}
+	if err != nil {
+		return User{}, false, err
+	}
+	return intUsr.User, true, nil
+}
+
+// Sets a user's role.
+//
+//	Returns the updated user on success. Errors with `ErrInvalidRole` for an unknown role, or `ErrUserNotFound`
+func (db *SQLiteDB) SetUserRole(id int, role string) (User, error) {
+	if !ValidRole(role) {
+		return User{}, ErrInvalidRole
+	}
+	_, err := db.conn.Exec("UPDATE users SET role = ? WHERE id = ?", role, id)
+	if err != nil {
+		return User{}, err
+	}
+	return db.getUser(id)
+}
+
+// Sets the email a user is changing to. Their current email stays in use until the new one is verified with `VerifyEmail`.
+//
+//	Setting the user's current email cancels the change. Errors with `ErrInvalidEmail`, `ErrEmailInUse`, or `ErrUserNotFound`
+func (db *SQLiteDB) SetPendingEmail(id int, email string) (User, error) {
+	if !ValidEmail(email) {
+		return User{}, ErrInvalidEmail
+	}
+	return db.ChangeCredentials(id, email, "")
+}
+
+// Sets the email a user is changing to, like `SetPendingEmail`, and their password, in one transaction. Either may be empty to leave it unchanged.
+//
+//	Nothing is changed if either fails, so a taken email doesn't leave the password changed
+func (db *SQLiteDB) ChangeCredentials(id int, email string, password string) (User, error) {
+	if email != "" && !ValidEmail(email) {
+		return User{}, ErrInvalidEmail
+	}
+	hashedPassword := ""
+	if password != "" {
+		hashed, err := hashPassword(password)
+		if err != nil {
+			return User{}, err
+		}
+		hashedPassword = hashed
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	pendingEmail := sql.NullString{} // Left unchanged when no email is given
+	if email != "" {
+		var ownerId int
+		err = tx.QueryRow("SELECT id FROM users WHERE email = ? COLLATE NOCASE", email).Scan(&ownerId)
+		if err == nil && ownerId != id {
+			return User{}, ErrEmailInUse
+		}
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return User{}, err
+		}
+		pendingEmail = sql.NullString{String: email, Valid: true}
+		if err == nil {
+			pendingEmail.String = "" // The user's current email
+		}
+	}
+
+	result, err := tx.Exec("UPDATE users SET pending_email = COALESCE(?, pending_email), password = COALESCE(NULLIF(?, ''), password) WHERE id = ?", pendingEmail, hashedPassword, id)
+	if err != nil {
+		return User{}, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return User{}, err
+	}
+	if affected == 0 {
+		return User{}, ErrUserNotFound
+	}
+	err = tx.Commit()
+	if err != nil {
+		return User{}, err
+	}
+	return db.getUser(id)
+}
+
+// Marks `email` as verified for the user. If it's their pending email, it replaces their current one.
+//
+//	Errors with `ErrEmailChanged` if `email` is neither the user's email nor their pending email,
+//	and with `ErrEmailInUse` if another user took the pending email first
+func (db *SQLiteDB) VerifyEmail(id int, email string) (User, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	intUsr, err := scanUser(tx.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrUserNotFound
+	}
+	if err != nil {
+		return User{}, err
+	}
+	if intUsr.PendingEmail != "" && strings.EqualFold(email, intUsr.PendingEmail) {
+		_, err = tx.Exec("UPDATE users SET email = pending_email, pending_email = '', email_verified = 1 WHERE id = ?", id)
+	} else if strings.EqualFold(email, intUsr.Email) {
+		_, err = tx.Exec("UPDATE users SET email_verified = 1 WHERE id = ?", id)
+	} else {
+		return User{}, ErrEmailChanged
+	}
+	if isUniqueViolation(err) {
+		return User{}, ErrEmailInUse
+	}
+	if err != nil {
+		return User{}, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return User{}, err
+	}
+	return db.getUser(id)
+}
+
+// Columns read by `scanAuditEvent`
+const auditEventColumns = "id, created_at, actor_id, action, target, details, ip_address"
+
+func scanAuditEvent(row sqlScanner) (AuditEvent, error) {
+	event := AuditEvent{}
+	err := row.Scan(&event.Id, &event.CreatedAt, &event.ActorId, &event.Action, &event.Target, &event.Details, &event.IpAddress)
+	event.CreatedAt = event.CreatedAt.UTC()
+	return event, err
+}
+
+func insertAuditEvent(execer sqlExecer, event AuditEvent) (sql.Result, error) {
+	return execer.Exec("INSERT INTO audit_events ("+auditEventColumns+") VALUES (NULLIF(?, 0), ?, ?, ?, ?, ?, ?)",
+		event.Id, event.CreatedAt.UTC(), event.ActorId, event.Action, event.Target, event.Details, event.IpAddress)
+}
+
+// Records an audit event. Ids are assigned by SQLite and never reused
+func (db *SQLiteDB) CreateAuditEvent(event AuditEvent) (AuditEvent, error) {
+	event.Id = 0
+	result, err := insertAuditEvent(db.conn, event)
+	if err != nil {
+		return AuditEvent{}, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return AuditEvent{}, err
+	}
+	event.Id = int(id)
+	return event, nil
+}
+
+// Gets the most recent audit events, newest first. A `limit` of 0 gets every event
+func (db *SQLiteDB) GetAuditEvents(limit int) ([]AuditEvent, error) {
+	if limit <= 0 {
+		limit = -1 // No limit
+	}
+	rows, err := db.conn.Query("SELECT "+auditEventColumns+" FROM audit_events ORDER BY id DESC LIMIT ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []AuditEvent{}
+	for rows.Next() {
+		event, err := scanAuditEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// Columns read by `scanRefreshToken`
+const refreshTokenColumns = "user_id, family_id, family_created_at, created_at, expires_at, user_agent, ip_address, rotated_at, client_id, scope"
+
+// Something a query can be run against, either the database connection or a transaction
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// A row or rows a query returned
+type sqlScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// Stores a new refresh token.
+//
+//	`token` is the plaintext token given to the client. Only its hash is saved
+func (db *SQLiteDB) CreateRefreshToken(token string, refreshToken RefreshToken) error {
+	return insertRefreshToken(db.conn, hashToken(token), refreshToken)
+}
+
+func insertRefreshToken(execer sqlExecer, tokenHash string, refreshToken RefreshToken) error {
+	var rotatedAt sql.NullTime
+	if refreshToken.RotatedAt != nil {
+		rotatedAt = sql.NullTime{Time: refreshToken.RotatedAt.UTC(), Valid: true}
+	}
+	_, err := execer.Exec("INSERT INTO refresh_tokens (token_hash, "+refreshTokenColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		tokenHash, refreshToken.UserId, refreshToken.FamilyId, refreshToken.FamilyCreatedAt.UTC(), refreshToken.CreatedAt.UTC(),
+		refreshToken.ExpiresAt.Unix(), refreshToken.UserAgent, refreshToken.IpAddress, rotatedAt, refreshToken.ClientId, refreshToken.Scope)
+	return err
+}
+
+// Gets a refresh token by its plaintext value, if it exists. Expired tokens are returned, and must be rejected by the caller
+func (db *SQLiteDB) GetRefreshToken(token string) (refreshToken RefreshToken, found bool, err error) {
+	row := db.conn.QueryRow("SELECT "+refreshTokenColumns+" FROM refresh_tokens WHERE token_hash = ?", hashToken(token))
+	refreshToken, err = scanRefreshToken(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return RefreshToken{}, false, nil
+	}
+	if err != nil {
+		return RefreshToken{}, false, err
+	}
+	return refreshToken, true, nil
+}
+
+// Scans the `refreshTokenColumns` of a row, after scanning any leading columns into `leading`
+func scanRefreshToken(row sqlScanner, leading ...interface{}) (RefreshToken, error) {
+	refreshToken := RefreshToken{}
+	var expiresAt int64
+	var rotatedAt sql.NullTime
+	dest := append(leading, &refreshToken.UserId, &refreshToken.FamilyId, &refreshToken.FamilyCreatedAt, &refreshToken.CreatedAt,
+		&expiresAt, &refreshToken.UserAgent, &refreshToken.IpAddress, &rotatedAt, &refreshToken.ClientId, &refreshToken.Scope)
+	err := row.Scan(dest...)
+	refreshToken.FamilyCreatedAt = refreshToken.FamilyCreatedAt.UTC()
+	refreshToken.CreatedAt = refreshToken.CreatedAt.UTC()
+	refreshToken.ExpiresAt = time.Unix(expiresAt, 0).UTC()
+	if rotatedAt.Valid {
+		at := rotatedAt.Time.UTC()
+		refreshToken.RotatedAt = &at
+	}
+	return refreshToken, err
+}
+
+// Replaces a refresh token with `newToken`, which joins the same family and belongs to the same user.
+//
+//	`next` holds the new token's creation time, expiration, user agent, and IP address. Its creation time is also used as the current time.
+//	If `token` was already replaced, it has been stolen or replayed: its whole family is revoked and
+//	`ErrRefreshTokenReused` is returned along with the reused token
+func (db *SQLiteDB) RotateRefreshToken(token string, newToken string, next RefreshToken) (RefreshToken, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	defer tx.Rollback()
+
+	tokenHash := hashToken(token)
+	current, err := scanRefreshToken(tx.QueryRow("SELECT "+refreshTokenColumns+" FROM refresh_tokens WHERE token_hash = ?", tokenHash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return RefreshToken{}, ErrRefreshTokenNotFound
+	}
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	if !next.CreatedAt.Before(current.ExpiresAt) {
+		return RefreshToken{}, ErrRefreshTokenExpired
+	}
+	revokeFamily := func() (RefreshToken, error) {
+		_, err := tx.Exec("DELETE FROM refresh_tokens WHERE family_id = ?", current.FamilyId)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			return RefreshToken{}, err
+		}
+		return current, ErrRefreshTokenReused
+	}
+	if current.RotatedAt != nil {
+		return revokeFamily()
+	}
+
+	// Only an unrotated token is updated, so if another rotation got there first this one is treated as reuse
+	result, err := tx.Exec("UPDATE refresh_tokens SET rotated_at = ? WHERE token_hash = ? AND rotated_at IS NULL", next.CreatedAt.UTC(), tokenHash)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	if updated == 0 {
+		return revokeFamily()
+	}
+	next.UserId = current.UserId
+	next.FamilyId = current.FamilyId
+	next.FamilyCreatedAt = current.FamilyCreatedAt
+	next.ClientId = current.ClientId
+	next.Scope = current.Scope
+	next.RotatedAt = nil
+	err = insertRefreshToken(tx, hashToken(newToken), next)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	return next, nil
+}
+
+// Revokes every token in a refresh token family.
+//
+//	Returns the number of tokens removed
+func (db *SQLiteDB) DeleteRefreshTokenFamily(familyId string) (revoked int, err error) {
+	result, err := db.conn.Exec("DELETE FROM refresh_tokens WHERE family_id = ?", familyId)
+	if err != nil {
+		return 0, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(affected), nil
+}
+
+// Removes refresh tokens that expired before `now`.
+//
+//	Returns the number of tokens removed
+func (db *SQLiteDB) PruneRefreshTokens(now time.Time) (pruned int, err error) {
+	result, err := db.conn.Exec("DELETE FROM refresh_tokens WHERE expires_at < ?", now.Unix())
+	if err != nil {
+		return 0, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(affected), nil
+}
+
+// Gets the refresh tokens that have been replaced, and are only kept to detect reuse, most recently rotated first
+func (db *SQLiteDB) GetRotatedRefreshTokens() ([]RefreshToken, error) {
+	rows, err := db.conn.Query("SELECT " + refreshTokenColumns + " FROM refresh_tokens WHERE rotated_at IS NOT NULL")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rotated := []RefreshToken{}
+	for rows.Next() {
+		refreshToken, err := scanRefreshToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		rotated = append(rotated, refreshToken)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	sortRotatedRefreshTokens(rotated)
+	return rotated, nil
+}
+
+// Gets a session by its id, if it exists. Expired sessions are returned, and must be rejected by the caller
+func (db *SQLiteDB) GetSession(sessionId string) (session Session, found bool, err error) {
+	row := db.conn.QueryRow("SELECT "+refreshTokenColumns+" FROM refresh_tokens WHERE family_id = ? AND rotated_at IS NULL", sessionId)
+	current, err := scanRefreshToken(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Session{}, false, nil
+	}
+	if err != nil {
+		return Session{}, false, err
+	}
+	return newSession(current), true, nil
+}
+
+// Gets every session belonging to the user, most recently used first. Expired sessions are included
+func (db *SQLiteDB) GetUserSessions(userId int) ([]Session, error) {
+	return db.querySessions("SELECT "+refreshTokenColumns+" FROM refresh_tokens WHERE user_id = ? AND rotated_at IS NULL", userId)
+}
+
+// Gets every user's sessions, most recently used first. Expired sessions are included
+func (db *SQLiteDB) GetSessions() ([]Session, error) {
+	return db.querySessions("SELECT " + refreshTokenColumns + " FROM refresh_tokens WHERE rotated_at IS NULL")
+}
+
+func (db *SQLiteDB) querySessions(query string, args ...interface{}) ([]Session, error) {
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		current, err := scanRefreshToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, newSession(current))
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	sortSessions(sessions)
+	return sessions, nil
+}
+
+// Revokes every session belonging to the user.
+//
+//	Returns the number of refresh tokens removed
+func (db *SQLiteDB) DeleteUserSessions(userId int) (revoked int, err error) {
+	result, err := db.conn.Exec("DELETE FROM refresh_tokens WHERE user_id = ?", userId)
+	if err != nil {
+		return 0, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(affected), nil
+}
+
+// Columns read by `scanOneTimeToken`
+const oneTimeTokenColumns = "user_id, purpose, email, created_at, expires_at"
+
+// Scans the `oneTimeTokenColumns` of a row, after scanning any leading columns into `leading`
+func scanOneTimeToken(row sqlScanner, leading ...interface{}) (OneTimeToken, error) {
+	oneTimeToken := OneTimeToken{}
+	var expiresAt int64
+	dest := append(leading, &oneTimeToken.UserId, &oneTimeToken.Purpose, &oneTimeToken.Email, &oneTimeToken.CreatedAt, &expiresAt)
+	err := row.Scan(dest...)
+	oneTimeToken.CreatedAt = oneTimeToken.CreatedAt.UTC()
+	oneTimeToken.ExpiresAt = time.Unix(expiresAt, 0).UTC()
+	return oneTimeToken, err
+}
+
+func insertOneTimeToken(execer sqlExecer, tokenHash string, oneTimeToken OneTimeToken) error {
+	_, err := execer.Exec("INSERT INTO one_time_tokens (token_hash, "+oneTimeTokenColumns+") VALUES (?, ?, ?, ?, ?, ?)",
+		tokenHash, oneTimeToken.UserId, oneTimeToken.Purpose, oneTimeToken.Email, oneTimeToken.CreatedAt.UTC(), oneTimeToken.ExpiresAt.Unix())
+	return err
+}
+
+// Stores a new one-time token, replacing any of the user's other tokens for the same purpose so only the latest one works.
+//
+//	`token` is the plaintext token sent to the user. Only its hash is saved
+func (db *SQLiteDB) CreateOneTimeToken(token string, oneTimeToken OneTimeToken) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM one_time_tokens WHERE user_id = ? AND purpose = ?", oneTimeToken.UserId, oneTimeToken.Purpose)
+	if err != nil {
+		return err
+	}
+	err = insertOneTimeToken(tx, hashToken(token), oneTimeToken)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Uses up a one-time token, so it can't be used again.
+//
+//	Errors with `ErrOneTimeTokenNotFound` if the token doesn't exist, was already used, or is for another purpose,
+//	and with `ErrOneTimeTokenExpired` if it expired before `now`
+func (db *SQLiteDB) ConsumeOneTimeToken(token string, purpose string, now time.Time) (OneTimeToken, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return OneTimeToken{}, err
+	}
+	defer tx.Rollback()
+
+	tokenHash := hashToken(token)
+	oneTimeToken, err := scanOneTimeToken(tx.QueryRow("SELECT "+oneTimeTokenColumns+" FROM one_time_tokens WHERE token_hash = ?", tokenHash))
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && oneTimeToken.Purpose != purpose) {
+		return OneTimeToken{}, ErrOneTimeTokenNotFound
+	}
+	if err != nil {
+		return OneTimeToken{}, err
+	}
+	if !now.Before(oneTimeToken.ExpiresAt) {
+		return OneTimeToken{}, ErrOneTimeTokenExpired
+	}
+	// Deleting only succeeds once, so concurrent uses of the same token can't both get through
+	result, err := tx.Exec("DELETE FROM one_time_tokens WHERE token_hash = ?", tokenHash)
+	if err != nil {
+		return OneTimeToken{}, err
+	}
+	deleted, err := result.RowsAffected()
+	if err == nil && deleted == 0 {
+		return OneTimeToken{}, ErrOneTimeTokenNotFound
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return OneTimeToken{}, err
+	}
+	return oneTimeToken, nil
+}
+
+// Removes one-time tokens that expired before `now`.
+//
+//	Returns the number of tokens removed
+func (db *SQLiteDB) PruneOneTimeTokens(now time.Time) (pruned int, err error) {
+	result, err := db.conn.Exec("DELETE FROM one_time_tokens WHERE expires_at < ?", now.Unix())
+	if err != nil {
+		return 0, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(affected), nil
+}
+
+// Version 3: reads each revoked token's expiration from the token. Tokens without one expire when they were revoked
+func backfillRevokedTokenExpiry(tx *sql.Tx) error {
+	revokedAt := map[string]time.Time{}
+	err := exportRows(tx, "SELECT token, revoked_at FROM revoked_user_tokens", func(rows *sql.Rows) error {
+		var token string
+		var at time.Time
+		err := rows.Scan(&token, &at)
+		revokedAt[token] = at
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for token, at := range revokedAt {
+		expiresAt, ok := jwtExpiration(token)
+		if !ok {
+			expiresAt = at
+		}
+		_, err = tx.Exec("UPDATE revoked_user_tokens SET expires_at = ? WHERE token = ?", expiresAt.Unix(), token)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Columns read by `scanTwoFactor`. Recovery codes are kept in their own table
+const twoFactorColumns = "user_id, secret, enabled, last_used_step, created_at"
+
+// Scans the `twoFactorColumns` of a row
+func scanTwoFactor(row sqlScanner) (TwoFactor, error) {
+	twoFactor := TwoFactor{RecoveryCodes: []string{}}
+	err := row.Scan(&twoFactor.UserId, &twoFactor.Secret, &twoFactor.Enabled, &twoFactor.LastUsedStep, &twoFactor.CreatedAt)
+	twoFactor.CreatedAt = twoFactor.CreatedAt.UTC()
+	return twoFactor, err
+}
+
+func insertTwoFactor(execer sqlExecer, twoFactor TwoFactor) error {
+	_, err := execer.Exec("INSERT OR REPLACE INTO two_factor ("+twoFactorColumns+") VALUES (?, ?, ?, ?, ?)",
+		twoFactor.UserId, twoFactor.Secret, twoFactor.Enabled, twoFactor.LastUsedStep, twoFactor.CreatedAt.UTC())
+	return err
+}
+
+// Stores recovery code hashes for the user
+func insertRecoveryCodes(execer sqlExecer, userId int, codeHashes []string) error {
+	for _, codeHash := range codeHashes {
+		_, err := execer.Exec("INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)", userId, codeHash)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stores a new, unconfirmed TOTP secret for the user, replacing any earlier unconfirmed one.
+//
+//	Errors with `ErrTwoFactorEnabled` if the user already confirmed one
+func (db *SQLiteDB) StartTwoFactorEnrollment(twoFactor TwoFactor) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var enabled bool
+	err = tx.QueryRow("SELECT enabled FROM two_factor WHERE user_id = ?", twoFactor.UserId).Scan(&enabled)
+	if err == nil && enabled {
+		return ErrTwoFactorEnabled
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	twoFactor.Enabled = false
+	twoFactor.LastUsedStep = 0
+	err = insertTwoFactor(tx, twoFactor)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", twoFactor.UserId)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Gets the user's two-factor settings, if they've started enrolling
+func (db *SQLiteDB) GetTwoFactor(userId int) (twoFactor TwoFactor, found bool, err error) {
+	twoFactor, err = scanTwoFactor(db.conn.QueryRow("SELECT "+twoFactorColumns+" FROM two_factor WHERE user_id = ?", userId))
+	if errors.Is(err, sql.ErrNoRows) {
+		return TwoFactor{}, false, nil
+	}
+	if err != nil {
+		return TwoFactor{}, false, err
+	}
+
+	rows, err := db.conn.Query("SELECT code_hash FROM recovery_codes WHERE user_id = ?", userId)
+	if err != nil {
+		return TwoFactor{}, false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var codeHash string
+		err = rows.Scan(&codeHash)
+		if err != nil {
+			return TwoFactor{}, false, err
+		}
+		twoFactor.RecoveryCodes = append(twoFactor.RecoveryCodes, codeHash)
+	}
+	if err = rows.Err(); err != nil {
+		return TwoFactor{}, false, err
+	}
+	return twoFactor, true, nil
+}
+
+// Turns on two-factor authentication once the user has entered a code for the time step `step`.
+//
+//	`recoveryCodes` are the plaintext codes given to the user. Only their hashes are saved
+func (db *SQLiteDB) EnableTwoFactor(userId int, step int64, recoveryCodes []string) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var enabled bool
+	err = tx.QueryRow("SELECT enabled FROM two_factor WHERE user_id = ?", userId).Scan(&enabled)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrTwoFactorNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if enabled {
+		return ErrTwoFactorEnabled
+	}
+	_, err = tx.Exec("UPDATE two_factor SET enabled = 1, last_used_step = ? WHERE user_id = ?", step, userId)
+	if err != nil {
+		return err
+	}
+	err = insertRecoveryCodes(tx, userId, hashRecoveryCodes(recoveryCodes))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Records that a code for the time step `step` was used.
+//
+//	Errors with `ErrTwoFactorCodeReused` if a code for that step or a later one was already used,
+//	and with `ErrTwoFactorNotFound` if two-factor authentication isn't enabled
+func (db *SQLiteDB) UseTwoFactorStep(userId int, step int64) error {
+	result, err := db.conn.Exec("UPDATE two_factor SET last_used_step = ? WHERE user_id = ? AND enabled = 1 AND last_used_step < ?", step, userId, step)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated > 0 {
+		return nil
+	}
+
+	var enabled bool
+	err = db.conn.QueryRow("SELECT enabled FROM two_factor WHERE user_id = ?", userId).Scan(&enabled)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !enabled) {
+		return ErrTwoFactorNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return ErrTwoFactorCodeReused
+}
+
+// Uses up one of the user's recovery codes, so it can't be used again.
+//
+//	Returns the number of codes left. Errors with `ErrRecoveryCodeNotFound` if the code doesn't exist or was already used
+func (db *SQLiteDB) UseRecoveryCode(userId int, recoveryCode string) (remaining int, err error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+DELETE FROM recovery_codes WHERE user_id = ?1 AND code_hash = ?2
+	AND EXISTS (SELECT 1 FROM two_factor WHERE user_id = ?1 AND enabled = 1)`, userId, hashToken(recoveryCode))
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if deleted == 0 {
+		return 0, ErrRecoveryCodeNotFound
+	}
+	err = tx.QueryRow("SELECT COUNT(*) FROM recovery_codes WHERE user_id = ?", userId).Scan(&remaining)
+	if err != nil {
+		return 0, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	return remaining, nil
+}
+
+// Turns off two-factor authentication for the user and removes their secret and recovery codes.
+//
+//	Returns false if they didn't have any
+func (db *SQLiteDB) DeleteTwoFactor(userId int) (found bool, err error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM two_factor WHERE user_id = ?", userId)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userId)
+	if err != nil {
+		return false, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return false, err
+	}
+	return deleted > 0, nil
+}
+
+// Columns read by `scanApiKey`. Scopes are stored space separated
+const apiKeyColumns = "id, user_id, name, prefix, scopes, created_at"
+
+// Scans the `apiKeyColumns` of a row, after scanning any leading columns into `leading`
+func scanApiKey(row sqlScanner, leading ...interface{}) (ApiKey, error) {
+	apiKey := ApiKey{}
+	var scopes string
+	dest := append(leading, &apiKey.Id, &apiKey.UserId, &apiKey.Name, &apiKey.Prefix, &scopes, &apiKey.CreatedAt)
+	err := row.Scan(dest...)
+	apiKey.Scopes = strings.Fields(scopes)
+	apiKey.CreatedAt = apiKey.CreatedAt.UTC()
+	return apiKey, err
+}
+
+func insertApiKey(execer sqlExecer, keyHash string, apiKey ApiKey) error {
+	_, err := execer.Exec("INSERT INTO api_keys (key_hash, "+apiKeyColumns+") VALUES (?, ?, ?, ?, ?, ?, ?)",
+		keyHash, apiKey.Id, apiKey.UserId, apiKey.Name, apiKey.Prefix, strings.Join(apiKey.Scopes, " "), apiKey.CreatedAt.UTC())
+	return err
+}
+
+// Stores a new API key.
+//
+//	`key` is the plaintext key given to the user. Only its hash is saved
+func (db *SQLiteDB) CreateApiKey(key string, apiKey ApiKey) error {
+	return insertApiKey(db.conn, hashToken(key), apiKey)
+}
+
+// Gets the API key matching the plaintext `key`
+func (db *SQLiteDB) GetApiKey(key string) (apiKey ApiKey, found bool, err error) {
+	apiKey, err = scanApiKey(db.conn.QueryRow("SELECT "+apiKeyColumns+" FROM api_keys WHERE key_hash = ?", hashToken(key)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return ApiKey{}, false, nil
+	}
+	if err != nil {
+		return ApiKey{}, false, err
+	}
+	return apiKey, true, nil
+}
+
+// Lists the user's API keys, oldest first
+func (db *SQLiteDB) GetUserApiKeys(userId int) ([]ApiKey, error) {
+	rows, err := db.conn.Query("SELECT "+apiKeyColumns+" FROM api_keys WHERE user_id = ?", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	apiKeys := []ApiKey{}
+	for rows.Next() {
+		apiKey, err := scanApiKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		apiKeys = append(apiKeys, apiKey)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	sortApiKeys(apiKeys)
+	return apiKeys, nil
+}
+
+// Revokes one of the user's API keys.
+//
+//	Errors with `ErrApiKeyNotFound` if the user has no key with the id
+func (db *SQLiteDB) DeleteApiKey(userId int, id string) error {
+	result, err := db.conn.Exec("DELETE FROM api_keys WHERE user_id = ? AND id = ?", userId, id)
+	if err != nil {
+		return err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrApiKeyNotFound
+	}
+	return nil
+}
+
+// Columns read by `scanOAuthClient`. Redirect URIs are stored space separated
+const oauthClientColumns = "id, owner_id, name, redirect_uris, confidential, secret_hash, created_at"
+
+// Scans the `oauthClientColumns` of a row
+func scanOAuthClient(row sqlScanner) (internalOAuthClient, error) {
+	client := internalOAuthClient{}
+	var redirectURIs string
+	err := row.Scan(&client.Id, &client.OwnerId, &client.Name, &redirectURIs, &client.Confidential, &client.SecretHash, &client.CreatedAt)
+	client.RedirectURIs = strings.Fields(redirectURIs)
+	client.CreatedAt = client.CreatedAt.UTC()
+	return client, err
+}
+
+func insertOAuthClient(execer sqlExecer, client internalOAuthClient) error {
+	_, err := execer.Exec("INSERT INTO oauth_clients ("+oauthClientColumns+") VALUES (?, ?, ?, ?, ?, ?, ?)",
+		client.Id, client.OwnerId, client.Name, strings.Join(client.RedirectURIs, " "), client.Confidential, client.SecretHash, client.CreatedAt.UTC())
+	return err
+}
+
+// Columns read by `scanAuthorizationCode`. Scopes are stored space separated
+const authorizationCodeColumns = "client_id, user_id, redirect_uri, scopes, code_challenge, created_at, expires_at, family_id"
+
+// Scans the `authorizationCodeColumns` of a row, after scanning any leading columns into `leading`
+func scanAuthorizationCode(row sqlScanner, leading ...interface{}) (AuthorizationCode, error) {
+	authorizationCode := AuthorizationCode{}
+	var scopes string
+	var expiresAt int64
+	dest := append(leading, &authorizationCode.ClientId, &authorizationCode.UserId, &authorizationCode.RedirectURI, &scopes,
+		&authorizationCode.CodeChallenge, &authorizationCode.CreatedAt, &expiresAt, &authorizationCode.FamilyId)
+	err := row.Scan(dest...)
+	authorizationCode.Scopes = strings.Fields(scopes)
+	authorizationCode.CreatedAt = authorizationCode.CreatedAt.UTC()
+	authorizationCode.ExpiresAt = time.Unix(expiresAt, 0).UTC()
+	return authorizationCode, err
+}
+
+func insertAuthorizationCode(execer sqlExecer, codeHash string, authorizationCode AuthorizationCode) error {
+	_, err := execer.Exec("INSERT INTO authorization_codes (code_hash, "+authorizationCodeColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		codeHash, authorizationCode.ClientId, authorizationCode.UserId, authorizationCode.RedirectURI, strings.Join(authorizationCode.Scopes, " "),
+		authorizationCode.CodeChallenge, authorizationCode.CreatedAt.UTC(), authorizationCode.ExpiresAt.Unix(), authorizationCode.FamilyId)
+	return err
+}
+
+// Stores a new client.
+//
+//	`secret` is the plaintext secret given to a confidential client's owner, and must be empty for public clients. Only its hash is saved
+func (db *SQLiteDB) CreateOAuthClient(secret string, client OAuthClient) error {
+	intClient := internalOAuthClient{OAuthClient: client}
+	if client.Confidential {
+		intClient.SecretHash = hashToken(secret)
+	}
+	return insertOAuthClient(db.conn, intClient)
+}
+
+// Gets a client by its id, including its secret hash
+func (db *SQLiteDB) getOAuthClient(id string) (client internalOAuthClient, found bool, err error) {
+	client, err = scanOAuthClient(db.conn.QueryRow("SELECT "+oauthClientColumns+" FROM oauth_clients WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return internalOAuthClient{}, false, nil
+	}
+	if err != nil {
+		return internalOAuthClient{}, false, err
+	}
+	return client, true, nil
+}
+
+// Gets a client by its id
+func (db *SQLiteDB) GetOAuthClient(id string) (client OAuthClient, found bool, err error) {
+	intClient, found, err := db.getOAuthClient(id)
+	return intClient.OAuthClient, found, err
+}
+
+// Gets a client after checking its secret.
+//
+//	Errors with `ErrInvalidClient` if the client doesn't exist or the secret is wrong
+func (db *SQLiteDB) ValidateOAuthClient(id string, secret string) (OAuthClient, error) {
+	client, found, err := db.getOAuthClient(id)
+	if err != nil {
+		return OAuthClient{}, err
+	}
+	if !found {
+		return OAuthClient{}, ErrInvalidClient
+	}
+	err = checkClientSecret(client, secret)
+	if err != nil {
+		return OAuthClient{}, err
+	}
+	return client.OAuthClient, nil
+}
+
+// Lists the clients the user registered, oldest first
+func (db *SQLiteDB) GetUserOAuthClients(ownerId int) ([]OAuthClient, error) {
+	rows, err := db.conn.Query("SELECT "+oauthClientColumns+" FROM oauth_clients WHERE owner_id = ?", ownerId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clients := []OAuthClient{}
+	for rows.Next() {
+		client, err := scanOAuthClient(rows)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, client.OAuthClient)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	sortOAuthClients(clients)
+	return clients, nil
+}
+
+// Removes one of the user's clients, along with its unused authorization codes and every refresh token issued to it.
+//
+//	Errors with `ErrOAuthClientNotFound` if the user has no client with the id
+func (db *SQLiteDB) DeleteOAuthClient(ownerId int, id string) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM oauth_clients WHERE owner_id = ? AND id = ?", ownerId, id)
+	if err != nil {
+		return err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrOAuthClientNotFound
+	}
+	_, err = tx.Exec("DELETE FROM authorization_codes WHERE client_id = ?", id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM refresh_tokens WHERE client_id = ?", id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Stores a new authorization code.
+//
+//	`code` is the plaintext code sent to the client. Only its hash is saved
+func (db *SQLiteDB) CreateAuthorizationCode(code string, authorizationCode AuthorizationCode) error {
+	return insertAuthorizationCode(db.conn, hashToken(code), authorizationCode)
+}
+
+// Gets an authorization code, whether or not it's been used or has expired, so it can be checked before it's used up
+func (db *SQLiteDB) GetAuthorizationCode(code string) (AuthorizationCode, bool, error) {
+	authorizationCode, err := scanAuthorizationCode(db.conn.QueryRow("SELECT "+authorizationCodeColumns+" FROM authorization_codes WHERE code_hash = ?", hashToken(code)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return AuthorizationCode{}, false, nil
+	}
+	if err != nil {
+		return AuthorizationCode{}, false, err
+	}
+	return authorizationCode, true, nil
+}
+
+// Uses up an authorization code, recording the refresh token family `familyId` it was traded for. Expired codes are used up too.
+//
+//	The used code is kept until it expires, so using it again can revoke what it was traded for.
+//	Errors with `ErrAuthorizationCodeNotFound` if the code doesn't exist, with `ErrAuthorizationCodeExpired` if it expired before `now`,
+//	and with `ErrAuthorizationCodeReused` if it was already used, returning the code with the family it was first traded for
+func (db *SQLiteDB) ConsumeAuthorizationCode(code string, now time.Time, familyId string) (AuthorizationCode, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return AuthorizationCode{}, err
+	}
+	defer tx.Rollback()
+
+	codeHash := hashToken(code)
+	authorizationCode, err := scanAuthorizationCode(tx.QueryRow("SELECT "+authorizationCodeColumns+" FROM authorization_codes WHERE code_hash = ?", codeHash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return AuthorizationCode{}, ErrAuthorizationCodeNotFound
+	}
+	if err != nil {
+		return AuthorizationCode{}, err
+	}
+	if authorizationCode.FamilyId != "" {
+		return authorizationCode, ErrAuthorizationCodeReused
+	}
+	if !now.Before(authorizationCode.ExpiresAt) {
+		_, err = tx.Exec("DELETE FROM authorization_codes WHERE code_hash = ?", codeHash)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			return AuthorizationCode{}, err
+		}
+		return AuthorizationCode{}, ErrAuthorizationCodeExpired
+	}
+	// Only an unused code is updated, so concurrent uses of the same code can't both get through
+	result, err := tx.Exec("UPDATE authorization_codes SET family_id = ? WHERE code_hash = ? AND family_id = ''", familyId, codeHash)
+	if err != nil {
+		return AuthorizationCode{}, err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return AuthorizationCode{}, err
+	}
+	if updated == 0 {
+		return AuthorizationCode{}, ErrAuthorizationCodeReused
+	}
+	err = tx.Commit()
+	if err != nil {
+		return AuthorizationCode{}, err
+	}
+	authorizationCode.FamilyId = familyId
+	return authorizationCode, nil
+}
+
+// Removes authorization codes that expired before `now`, used or not.
+//
+//	Returns the number of codes removed
+func (db *SQLiteDB) PruneAuthorizationCodes(now time.Time) (pruned int, err error) {
+	result, err := db.conn.Exec("DELETE FROM authorization_codes WHERE expires_at < ?", now.Unix())
+	if err != nil {
+		return 0, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(affected), nil
+}
+
+// Copies every record in the database. Every table is read in one transaction, so the copy is consistent
+func (db *SQLiteDB) Export() (DBStructure, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return DBStructure{}, err
+	}
+	defer tx.Rollback()
+
+	dbStructure := DBStructure{
+		SchemaVersion:      CurrentSchemaVersion(),
+		Chirps:             map[int]Chirp{},
+		Users:              map[int]internalUser{},
+		RefreshTokens:      map[string]RefreshToken{},
+		AuditEvents:        map[int]AuditEvent{},
+		OneTimeTokens:      map[string]OneTimeToken{},
+		TwoFactor:          map[int]TwoFactor{},
+		ApiKeys:            map[string]ApiKey{},
+		OAuthClients:       map[string]internalOAuthClient{},
+		AuthorizationCodes: map[string]AuthorizationCode{},
+		Sequences:          map[string]int{},
+	}
+	err = exportRows(tx, "SELECT id, body, author_id FROM chirps", func(rows *sql.Rows) error {
+		chirp := Chirp{}
+		err := rows.Scan(&chirp.Id, &chirp.Body, &chirp.AuthorId)
+		dbStructure.Chirps[chirp.Id] = chirp
+		return err
+	})
+	if err == nil {
+		err = exportRows(tx, "SELECT "+userColumns+" FROM users", func(rows *sql.Rows) error {
+			intUsr, err := scanUser(rows)
+			dbStructure.Users[intUsr.Id] = intUsr
+			return err
+		})
+	}
+	if err == nil {
+		err = exportRows(tx, "SELECT "+auditEventColumns+" FROM audit_events", func(rows *sql.Rows) error {
+			event, err := scanAuditEvent(rows)
+			dbStructure.AuditEvents[event.Id] = event
+			return err
+		})
+	}
+	if err == nil {
+		err = exportRows(tx, "SELECT token_hash, "+refreshTokenColumns+" FROM refresh_tokens", func(rows *sql.Rows) error {
+			var tokenHash string
+			refreshToken, err := scanRefreshToken(rows, &tokenHash)
+			dbStructure.RefreshTokens[tokenHash] = refreshToken
+			return err
+		})
+	}
+	if err == nil {
+		err = exportRows(tx, "SELECT token_hash, "+oneTimeTokenColumns+" FROM one_time_tokens", func(rows *sql.Rows) error {
+			var tokenHash string
+			oneTimeToken, err := scanOneTimeToken(rows, &tokenHash)
+			dbStructure.OneTimeTokens[tokenHash] = oneTimeToken
+			return err
+		})
+	}
+	if err == nil {
+		err = exportRows(tx, "SELECT "+twoFactorColumns+" FROM two_factor", func(rows *sql.Rows) error {
+			twoFactor, err := scanTwoFactor(rows)
+			dbStructure.TwoFactor[twoFactor.UserId] = twoFactor
+			return err
+		})
+	}
+	if err == nil {
+		err = exportRows(tx, "SELECT user_id, code_hash FROM recovery_codes", func(rows *sql.Rows) error {
+			var userId int
+			var codeHash string
+			err := rows.Scan(&userId, &codeHash)
+			twoFactor, found := dbStructure.TwoFactor[userId]
+			if found {
+				twoFactor.RecoveryCodes = append(twoFactor.RecoveryCodes, codeHash)
+				dbStructure.TwoFactor[userId] = twoFactor
+			}
+			return err
+		})
+	}
+	if err == nil {
+		err = exportRows(tx, "SELECT key_hash, "+apiKeyColumns+" FROM api_keys", func(rows *sql.Rows) error {
+			var keyHash string
+			apiKey, err := scanApiKey(rows, &keyHash)
+			dbStructure.ApiKeys[keyHash] = apiKey
+			return err
+		})
+	}
+	if err == nil {
+		err = exportRows(tx, "SELECT "+oauthClientColumns+" FROM oauth_clients", func(rows *sql.Rows) error {
+			client, err := scanOAuthClient(rows)
+			dbStructure.OAuthClients[client.Id] = client
+			return err
+		})
+	}
+	if err == nil {
+		err = exportRows(tx, "SELECT code_hash, "+authorizationCodeColumns+" FROM authorization_codes", func(rows *sql.Rows) error {
+			var codeHash string
+			authorizationCode, err := scanAuthorizationCode(rows, &codeHash)
+			dbStructure.AuthorizationCodes[codeHash] = authorizationCode
+			return err
+		})
+	}
+	if err == nil {
+		// SQLite tracks AUTOINCREMENT ids per table, and the table names match the sequence names
+		err = exportRows(tx, "SELECT name, seq FROM sqlite_sequence", func(rows *sql.Rows) error {
+			var name string
+			var last int
+			err := rows.Scan(&name, &last)
+			dbStructure.Sequences[name] = last
+			return err
+		})
+	}
+	if err != nil {
+		return DBStructure{}, err
+	}
+	return dbStructure, nil
+}
+
+func exportRows(tx *sql.Tx, query string, scan func(rows *sql.Rows) error) error {
+	rows, err := tx.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		err = scan(rows)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Replaces every record in the database with the contents of `dbStructure` in a single transaction
+func (db *SQLiteDB) Import(dbStructure DBStructure) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM chirps; DELETE FROM users; DELETE FROM refresh_tokens; DELETE FROM audit_events; DELETE FROM one_time_tokens; DELETE FROM two_factor; DELETE FROM recovery_codes; DELETE FROM api_keys; DELETE FROM oauth_clients; DELETE FROM authorization_codes; DELETE FROM sqlite_sequence;")
+	if err != nil {
+		return err
+	}
+	for _, chirp := range dbStructure.Chirps {
+		_, err = tx.Exec("INSERT INTO chirps (id, body, author_id) VALUES (?, ?, ?)", chirp.Id, chirp.Body, chirp.AuthorId)
+		if err != nil {
+			return err
+		}
+	}
+	for _, intUsr := range dbStructure.Users {
+		_, err = tx.Exec("INSERT INTO users ("+userColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+			intUsr.Id, intUsr.Email, intUsr.IsChirpyRed, intUsr.Role, intUsr.EmailVerified, intUsr.PendingEmail, intUsr.Disabled, intUsr.Password)
+		if isUniqueViolation(err) {
+			return fmt.Errorf("importing user %d: %w", intUsr.Id, ErrEmailInUse)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for tokenHash, refreshToken := range dbStructure.RefreshTokens {
+		err = insertRefreshToken(tx, tokenHash, refreshToken)
+		if err != nil {
+			return err
+		}
+	}
+	for _, event := range dbStructure.AuditEvents {
+		_, err = insertAuditEvent(tx, event)
+		if err != nil {
+			return err
+		}
+	}
+	for tokenHash, oneTimeToken := range dbStructure.OneTimeTokens {
+		err = insertOneTimeToken(tx, tokenHash, oneTimeToken)
+		if err != nil {
+			return err
+		}
+	}
+	for _, twoFactor := range dbStructure.TwoFactor {
+		err = insertTwoFactor(tx, twoFactor)
+		if err != nil {
+			return err
+		}
+		err = insertRecoveryCodes(tx, twoFactor.UserId, twoFactor.RecoveryCodes)
+		if err != nil {
+			return err
+		}
+	}
+	for keyHash, apiKey := range dbStructure.ApiKeys {
+		err = insertApiKey(tx, keyHash, apiKey)
+		if err != nil {
+			return err
+		}
+	}
+	for _, client := range dbStructure.OAuthClients {
+		err = insertOAuthClient(tx, client)
+		if err != nil {
+			return err
+		}
+	}
+	for codeHash, authorizationCode := range dbStructure.AuthorizationCodes {
+		err = insertAuthorizationCode(tx, codeHash, authorizationCode)
+		if err != nil {
+			return err
+		}
+	}
+	// Inserting rows already moved each table's sequence up to its largest id. Ids handed out and then deleted are kept from reuse too
+	for sequence, last := range dbStructure.Sequences {
+		result, err := tx.Exec("UPDATE sqlite_sequence SET seq = MAX(seq, ?) WHERE name = ?", last, sequence)
+		if err != nil {
+			return err
+		}
+		updated, err := result.RowsAffected()
+		if err == nil && updated == 0 {
+			_, err = tx.Exec("INSERT INTO sqlite_sequence (name, seq) VALUES (?, ?)", sequence, last)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,90 @@
+// Defines the Store interface shared by the database backends
+
+package database
+
+import "time"
+
+// Store is the set of database operations the API depends on.
+//
+//	`DB` (JSON file) and `SQLiteDB` (embedded SQLite) both implement it, and the backend is chosen at startup
+type Store interface {
+	CreateChirp(body string, authorId int) (Chirp, error)
+	GetChirp(id int) (chirp Chirp, found bool, err error)
+	GetChirps() ([]Chirp, error)
+	GetUserChirps(authorId int) ([]Chirp, error)
+	DeleteChirp(chirpId int) (success bool, err error)
+
+	CreateUser(email string, password string) (User, error)
+	ValidateCredentials(email string, password string) (User, error)
+	UpdateUser(id int, email string, password string) (User, error)
+	UpgradeUser(id int) (User, error)
+	DowngradeUser(id int) (User, error)
+	SetUserDisabled(id int, disabled bool) (User, error)
+	GetUsers() ([]User, error)
+	GetUser(id int) (user User, found bool, err error)
+	GetUserByEmail(email string) (user User, found bool, err error)
+	SetUserRole(id int, role string) (User, error)
+	SetPendingEmail(id int, email string) (User, error)
+	ChangeCredentials(id int, email string, password string) (User, error)
+	VerifyEmail(id int, email string) (User, error)
+
+	// Refresh tokens are passed in plaintext, and only their hashes are stored
+	CreateRefreshToken(token string, refreshToken RefreshToken) error
+	GetRefreshToken(token string) (refreshToken RefreshToken, found bool, err error)
+	RotateRefreshToken(token string, newToken string, next RefreshToken) (RefreshToken, error)
+	DeleteRefreshTokenFamily(familyId string) (revoked int, err error)
+	PruneRefreshTokens(now time.Time) (pruned int, err error)
+	GetRotatedRefreshTokens() ([]RefreshToken, error)
+
+	// One-time tokens are passed in plaintext, and only their hashes are stored
+	CreateOneTimeToken(token string, oneTimeToken OneTimeToken) error
+	ConsumeOneTimeToken(token string, purpose string, now time.Time) (OneTimeToken, error)
+	PruneOneTimeTokens(now time.Time) (pruned int, err error)
+
+	// Recovery codes are passed in plaintext, and only their hashes are stored
+	StartTwoFactorEnrollment(twoFactor TwoFactor) error
+	GetTwoFactor(userId int) (twoFactor TwoFactor, found bool, err error)
+	EnableTwoFactor(userId int, step int64, recoveryCodes []string) error
+	UseTwoFactorStep(userId int, step int64) error
+	UseRecoveryCode(userId int, recoveryCode string) (remaining int, err error)
+	DeleteTwoFactor(userId int) (found bool, err error)
+
+	// API keys are passed in plaintext, and only their hashes are stored
+	CreateApiKey(key string, apiKey ApiKey) error
+	GetApiKey(key string) (apiKey ApiKey, found bool, err error)
+	GetUserApiKeys(userId int) ([]ApiKey, error)
+	DeleteApiKey(userId int, id string) error
+
+	// Client secrets and authorization codes are passed in plaintext, and only their hashes are stored
+	CreateOAuthClient(secret string, client OAuthClient) error
+	GetOAuthClient(id string) (client OAuthClient, found bool, err error)
+	ValidateOAuthClient(id string, secret string) (OAuthClient, error)
+	GetUserOAuthClients(ownerId int) ([]OAuthClient, error)
+	DeleteOAuthClient(ownerId int, id string) error
+	CreateAuthorizationCode(code string, authorizationCode AuthorizationCode) error
+	GetAuthorizationCode(code string) (authorizationCode AuthorizationCode, found bool, err error)
+	ConsumeAuthorizationCode(code string, now time.Time, familyId string) (AuthorizationCode, error)
+	PruneAuthorizationCodes(now time.Time) (pruned int, err error)
+
+	// A session is a refresh token family, identified by the family id
+	GetSession(sessionId string) (session Session, found bool, err error)
+	GetUserSessions(userId int) ([]Session, error)
+	GetSessions() ([]Session, error)
+	DeleteUserSessions(userId int) (revoked int, err error)
+
+	CreateAuditEvent(event AuditEvent) (AuditEvent, error)
+	GetAuditEvents(limit int) ([]AuditEvent, error)
+
+	// Copies every record, consistently, for a snapshot
+	Export() (DBStructure, error)
+	// Replaces every record with the contents of a snapshot
+	Import(dbStructure DBStructure) error
+
+	// Releases any resources held by the backend
+	Close() error
+}
+
+var (
+	_ Store = (*DB)(nil)
+	_ Store = (*SQLiteDB)(nil)
+)
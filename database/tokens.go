@@ -1,45 +1,177 @@
 package database
 
-import "time"
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"time"
+)
 
-// Revokes the specified refresh token and records the revokation in the database.
+var (
+	ErrRefreshTokenNotFound = errors.New("refresh token not found")
+	ErrRefreshTokenExpired  = errors.New("refresh token has expired")
+	ErrRefreshTokenReused   = errors.New("refresh token was already used")
+)
+
+// A refresh token issued at login. Only the token's hash is stored, so the database can't be used to impersonate a user.
 //
-//	`token` is the plaintext refresh token from the authorization header
-//	Errors if there was an error while loading or updating the database
-func (db *DB) RevokeToken(token string) error {
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return err
-	}
+//	Each use replaces the token with a new one in the same family. Replaced tokens are kept until they expire so reuse can be detected
+type RefreshToken struct {
+	UserId          int        `json:"user_id"`
+	FamilyId        string     `json:"family_id"`
+	FamilyCreatedAt time.Time  `json:"family_created_at"` // When the family's first token was issued, at login
+	CreatedAt       time.Time  `json:"created_at"`
+	ExpiresAt       time.Time  `json:"expires_at"`
+	UserAgent       string     `json:"user_agent"`
+	IpAddress       string     `json:"ip_address"`
+	RotatedAt       *time.Time `json:"rotated_at,omitempty"` // When the token was replaced, or nil if it's the family's current token
+	// The OAuth client the token was issued to, and the space separated scopes the user granted it. Empty for logins
+	ClientId string `json:"client_id,omitempty"`
+	Scope    string `json:"scope,omitempty"`
+}
 
-	if dbStructure.RevokedUserTokens == nil {
-		dbStructure.RevokedUserTokens = make(map[string]time.Time)
+// Gets a copy of the refresh token with the given hash, or nil if there isn't one
+func (dbStructure *DBStructure) findRefreshToken(tokenHash string) *RefreshToken {
+	refreshToken, found := dbStructure.RefreshTokens[tokenHash]
+	if !found {
+		return nil
 	}
+	return &refreshToken
+}
 
-	if _, found := dbStructure.RevokedUserTokens[token]; found {
+// Hashes an opaque token for storage. The tokens are random, so an unsalted hash is enough
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// Stores a new refresh token.
+//
+//	`token` is the plaintext token given to the client. Only its hash is saved
+func (db *DB) CreateRefreshToken(token string, refreshToken RefreshToken) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.putRefreshToken(hashToken(token), refreshToken)
+	})
+}
+
+// Gets a refresh token by its plaintext value, if it exists. Expired tokens are returned, and must be rejected by the caller
+func (db *DB) GetRefreshToken(token string) (refreshToken RefreshToken, found bool, err error) {
+	err = db.View(func(tx *Tx) error {
+		refreshToken, found = tx.data.RefreshTokens[hashToken(token)]
 		return nil
+	})
+	if err != nil || !found {
+		return RefreshToken{}, false, err
 	}
+	return refreshToken, true, nil
+}
+
+// Replaces a refresh token with `newToken`, which joins the same family and belongs to the same user.
+//
+//	`next` holds the new token's creation time, expiration, user agent, and IP address. Its creation time is also used as the current time.
+//	If `token` was already replaced, it has been stolen or replayed: its whole family is revoked and
+//	`ErrRefreshTokenReused` is returned along with the reused token
+func (db *DB) RotateRefreshToken(token string, newToken string, next RefreshToken) (RefreshToken, error) {
+	tokenHash := hashToken(token)
+	reused := false
+	err := db.Update(func(tx *Tx) error {
+		current, found := tx.data.RefreshTokens[tokenHash]
+		if !found {
+			return ErrRefreshTokenNotFound
+		}
+		if !next.CreatedAt.Before(current.ExpiresAt) {
+			return ErrRefreshTokenExpired
+		}
+		if current.RotatedAt != nil {
+			reused = true
+			next = current
+			_, err := tx.deleteRefreshTokenFamily(current.FamilyId)
+			return err
+		}
 
-	dbStructure.RevokedUserTokens[token] = time.Now().UTC()
+		rotatedAt := next.CreatedAt
+		current.RotatedAt = &rotatedAt
+		err := tx.putRefreshToken(tokenHash, current)
+		if err != nil {
+			return err
+		}
+		next.UserId = current.UserId
+		next.FamilyId = current.FamilyId
+		next.FamilyCreatedAt = current.FamilyCreatedAt
+		next.ClientId = current.ClientId
+		next.Scope = current.Scope
+		next.RotatedAt = nil
+		return tx.putRefreshToken(hashToken(newToken), next)
+	})
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	if reused {
+		return next, ErrRefreshTokenReused
+	}
+	return next, nil
+}
 
-	err = db.writeDB(dbStructure)
-	return err
+// Revokes every token in a refresh token family.
+//
+//	Returns the number of tokens removed
+func (db *DB) DeleteRefreshTokenFamily(familyId string) (revoked int, err error) {
+	err = db.Update(func(tx *Tx) error {
+		revoked, err = tx.deleteRefreshTokenFamily(familyId)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return revoked, nil
 }
 
-// Checks the database to see if the refresh token has been revoked.
+// Removes refresh tokens that expired before `now`.
 //
-//	`token` is the plaintext refresh token from the authorization header
-//	Errors if there was an error while loading the database
-func (db *DB) IsTokenRevoked(token string) (bool, error) {
-	dbStructure, err := db.loadDB()
+//	Returns the number of tokens removed
+func (db *DB) PruneRefreshTokens(now time.Time) (pruned int, err error) {
+	err = db.Update(func(tx *Tx) error {
+		pruned = 0
+		for tokenHash, refreshToken := range tx.data.RefreshTokens {
+			if !refreshToken.ExpiresAt.Before(now) {
+				continue
+			}
+			err := tx.deleteRefreshToken(tokenHash)
+			if err != nil {
+				return err
+			}
+			pruned++
+		}
+		return nil
+	})
 	if err != nil {
-		return false, err
+		return 0, err
 	}
+	return pruned, nil
+}
 
-	if dbStructure.RevokedUserTokens == nil || len(dbStructure.RevokedUserTokens) == 0 {
-		return false, nil
+// Gets the refresh tokens that have been replaced, and are only kept to detect reuse, most recently rotated first
+func (db *DB) GetRotatedRefreshTokens() ([]RefreshToken, error) {
+	rotated := []RefreshToken{}
+	err := db.View(func(tx *Tx) error {
+		for _, refreshToken := range tx.data.RefreshTokens {
+			if refreshToken.RotatedAt != nil {
+				rotated = append(rotated, refreshToken)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	sortRotatedRefreshTokens(rotated)
+	return rotated, nil
+}
 
-	_, found := dbStructure.RevokedUserTokens[token]
-	return found, nil
+// Sorts rotated refresh tokens with the most recently rotated first
+func sortRotatedRefreshTokens(rotated []RefreshToken) {
+	sort.Slice(rotated, func(i, j int) bool {
+		return rotated[i].RotatedAt.After(*rotated[j].RotatedAt)
+	})
 }
@@ -0,0 +1,154 @@
+// Defines the TwoFactor type and database functions for TOTP two-factor authentication
+
+package database
+
+import (
+	"errors"
+	"slices"
+	"time"
+)
+
+var (
+	ErrTwoFactorNotFound    = errors.New("two-factor authentication isn't set up")
+	ErrTwoFactorEnabled     = errors.New("two-factor authentication is already enabled")
+	ErrTwoFactorCodeReused  = errors.New("that code was already used")
+	ErrRecoveryCodeNotFound = errors.New("recovery code not found or already used")
+)
+
+// A user's TOTP authenticator. Each user has at most one
+type TwoFactor struct {
+	UserId        int       `json:"user_id"`
+	Secret        string    `json:"secret"`         // Base32 encoded. Codes are checked against it, so it can't be hashed
+	Enabled       bool      `json:"enabled"`        // False until the user confirms enrollment with a code
+	LastUsedStep  int64     `json:"last_used_step"` // The TOTP time step of the last accepted code, so no code works twice
+	RecoveryCodes []string  `json:"recovery_codes"` // Hashes of the unused recovery codes
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// Gets a copy of the user's two-factor settings, or nil if there aren't any
+func (dbStructure *DBStructure) findTwoFactor(userId int) *TwoFactor {
+	twoFactor, found := dbStructure.TwoFactor[userId]
+	if !found {
+		return nil
+	}
+	twoFactor.RecoveryCodes = slices.Clone(twoFactor.RecoveryCodes)
+	return &twoFactor
+}
+
+// Hashes each recovery code for storage
+func hashRecoveryCodes(recoveryCodes []string) []string {
+	hashes := make([]string, len(recoveryCodes))
+	for i, code := range recoveryCodes {
+		hashes[i] = hashToken(code)
+	}
+	return hashes
+}
+
+// Stores a new, unconfirmed TOTP secret for the user, replacing any earlier unconfirmed one.
+//
+//	Errors with `ErrTwoFactorEnabled` if the user already confirmed one
+func (db *DB) StartTwoFactorEnrollment(twoFactor TwoFactor) error {
+	return db.Update(func(tx *Tx) error {
+		existing := tx.data.findTwoFactor(twoFactor.UserId)
+		if existing != nil && existing.Enabled {
+			return ErrTwoFactorEnabled
+		}
+		twoFactor.Enabled = false
+		twoFactor.LastUsedStep = 0
+		twoFactor.RecoveryCodes = []string{}
+		return tx.putTwoFactor(twoFactor)
+	})
+}
+
+// Gets the user's two-factor settings, if they've started enrolling
+func (db *DB) GetTwoFactor(userId int) (twoFactor TwoFactor, found bool, err error) {
+	err = db.View(func(tx *Tx) error {
+		existing := tx.data.findTwoFactor(userId)
+		if existing != nil {
+			twoFactor, found = *existing, true
+		}
+		return nil
+	})
+	if err != nil || !found {
+		return TwoFactor{}, false, err
+	}
+	return twoFactor, true, nil
+}
+
+// Turns on two-factor authentication once the user has entered a code for the time step `step`.
+//
+//	`recoveryCodes` are the plaintext codes given to the user. Only their hashes are saved
+func (db *DB) EnableTwoFactor(userId int, step int64, recoveryCodes []string) error {
+	return db.Update(func(tx *Tx) error {
+		twoFactor := tx.data.findTwoFactor(userId)
+		if twoFactor == nil {
+			return ErrTwoFactorNotFound
+		}
+		if twoFactor.Enabled {
+			return ErrTwoFactorEnabled
+		}
+		twoFactor.Enabled = true
+		twoFactor.LastUsedStep = step
+		twoFactor.RecoveryCodes = hashRecoveryCodes(recoveryCodes)
+		return tx.putTwoFactor(*twoFactor)
+	})
+}
+
+// Records that a code for the time step `step` was used.
+//
+//	Errors with `ErrTwoFactorCodeReused` if a code for that step or a later one was already used,
+//	and with `ErrTwoFactorNotFound` if two-factor authentication isn't enabled
+func (db *DB) UseTwoFactorStep(userId int, step int64) error {
+	return db.Update(func(tx *Tx) error {
+		twoFactor := tx.data.findTwoFactor(userId)
+		if twoFactor == nil || !twoFactor.Enabled {
+			return ErrTwoFactorNotFound
+		}
+		if step <= twoFactor.LastUsedStep {
+			return ErrTwoFactorCodeReused
+		}
+		twoFactor.LastUsedStep = step
+		return tx.putTwoFactor(*twoFactor)
+	})
+}
+
+// Uses up one of the user's recovery codes, so it can't be used again.
+//
+//	Returns the number of codes left. Errors with `ErrRecoveryCodeNotFound` if the code doesn't exist or was already used
+func (db *DB) UseRecoveryCode(userId int, recoveryCode string) (remaining int, err error) {
+	codeHash := hashToken(recoveryCode)
+	err = db.Update(func(tx *Tx) error {
+		twoFactor := tx.data.findTwoFactor(userId)
+		if twoFactor == nil || !twoFactor.Enabled {
+			return ErrRecoveryCodeNotFound
+		}
+		i := slices.Index(twoFactor.RecoveryCodes, codeHash)
+		if i == -1 {
+			return ErrRecoveryCodeNotFound
+		}
+		twoFactor.RecoveryCodes = slices.Delete(twoFactor.RecoveryCodes, i, i+1)
+		remaining = len(twoFactor.RecoveryCodes)
+		return tx.putTwoFactor(*twoFactor)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return remaining, nil
+}
+
+// Turns off two-factor authentication for the user and removes their secret and recovery codes.
+//
+//	Returns false if they didn't have any
+func (db *DB) DeleteTwoFactor(userId int) (found bool, err error) {
+	err = db.Update(func(tx *Tx) error {
+		found = tx.data.findTwoFactor(userId) != nil
+		if !found {
+			return nil
+		}
+		return tx.deleteTwoFactor(userId)
+	})
+	if err != nil {
+		return false, err
+	}
+	return found, nil
+}
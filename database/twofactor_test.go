@@ -0,0 +1,85 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTwoFactor(t *testing.T) {
+	testDb := NewDB("./testdatabase.json")
+
+	err := cleanupDbFile(testDb.path)
+	if err != nil {
+		t.Fatalf("Error cleaning up database file: %v", err)
+	}
+	testTwoFactor(t, testDb)
+}
+
+// Two-factor behavior shared by the database backends
+func testTwoFactor(t *testing.T, store Store) {
+	now := time.Now().UTC()
+	err := store.StartTwoFactorEnrollment(TwoFactor{UserId: 3, Secret: "FIRSTSECRET", CreatedAt: now})
+	if err != nil {
+		t.Fatalf("Error starting enrollment: %v", err)
+	}
+	err = store.UseTwoFactorStep(3, 100)
+	if err != ErrTwoFactorNotFound {
+		t.Fatalf("Expected an unconfirmed secret to be rejected, actual: %v", err)
+	}
+	err = store.StartTwoFactorEnrollment(TwoFactor{UserId: 3, Secret: "SECONDSECRET", CreatedAt: now})
+	if err != nil {
+		t.Fatalf("Error restarting enrollment: %v", err)
+	}
+	err = store.EnableTwoFactor(3, 100, []string{"code-one", "code-two"})
+	if err != nil {
+		t.Fatalf("Error enabling two-factor: %v", err)
+	}
+	err = store.StartTwoFactorEnrollment(TwoFactor{UserId: 3, Secret: "THIRDSECRET", CreatedAt: now})
+	if err != ErrTwoFactorEnabled {
+		t.Fatalf("Expected enrollment to fail once enabled, actual: %v", err)
+	}
+
+	twoFactor, found, err := store.GetTwoFactor(3)
+	if err != nil || !found {
+		t.Fatalf("Error getting two-factor: %v, %v", found, err)
+	}
+	if twoFactor.Secret != "SECONDSECRET" || !twoFactor.Enabled || twoFactor.LastUsedStep != 100 || len(twoFactor.RecoveryCodes) != 2 {
+		t.Fatalf("Two-factor read back with incorrect data: %+v", twoFactor)
+	}
+	for _, codeHash := range twoFactor.RecoveryCodes {
+		if codeHash == "code-one" || codeHash == "code-two" {
+			t.Fatal("Recovery code stored in plaintext")
+		}
+	}
+
+	err = store.UseTwoFactorStep(3, 100)
+	if err != ErrTwoFactorCodeReused {
+		t.Fatalf("Expected a used step to be rejected, actual: %v", err)
+	}
+	err = store.UseTwoFactorStep(3, 101)
+	if err != nil {
+		t.Fatalf("Error using a new step: %v", err)
+	}
+
+	remaining, err := store.UseRecoveryCode(3, "code-one")
+	if err != nil || remaining != 1 {
+		t.Fatalf("Error using recovery code: %v, %v remaining", err, remaining)
+	}
+	_, err = store.UseRecoveryCode(3, "code-one")
+	if err != ErrRecoveryCodeNotFound {
+		t.Fatalf("Expected a used recovery code to be rejected, actual: %v", err)
+	}
+	_, err = store.UseRecoveryCode(4, "code-two")
+	if err != ErrRecoveryCodeNotFound {
+		t.Fatalf("Expected another user's recovery code to be rejected, actual: %v", err)
+	}
+
+	found, err = store.DeleteTwoFactor(3)
+	if err != nil || !found {
+		t.Fatalf("Error deleting two-factor: %v, %v", found, err)
+	}
+	_, found, err = store.GetTwoFactor(3)
+	if err != nil || found {
+		t.Fatalf("Two-factor not deleted: %v, %v", found, err)
+	}
+}
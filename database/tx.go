@@ -0,0 +1,432 @@
+// Defines the Tx type and the transaction functions used by every DB operation
+
+package database
+
+import (
+	"errors"
+	"strconv"
+)
+
+var ErrTxReadOnly = errors.New("cannot write in a read-only transaction")
+
+// A database transaction. The database lock is held for the life of the transaction.
+//
+//	Changes made in an `Update` transaction are only persisted if its function returns nil
+type Tx struct {
+	data     *DBStructure
+	writable bool
+	changes  []journalEntry
+	undo     []func() // Reverts each change to `data`, in the order the changes were made
+}
+
+// Runs `fn` in a read-only transaction against the in-memory copy of the database. Concurrent `View` transactions are allowed
+func (db *DB) View(fn func(tx *Tx) error) error {
+	err := db.refresh()
+	if err != nil {
+		return err
+	}
+
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	return fn(&Tx{data: db.state})
+}
+
+// Runs `fn` in a read-write transaction with exclusive access to the database.
+//
+//	If `fn` returns an error, none of its changes are kept and the error is returned.
+//	Otherwise the changes are journaled or written to the database file, unless the database flushes on an interval
+func (db *DB) Update(fn func(tx *Tx) error) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	err := db.refreshLocked()
+	if err != nil {
+		return err
+	}
+
+	tx := &Tx{data: db.state, writable: true}
+	err = fn(tx)
+	if err == nil && len(tx.changes) > 0 {
+		err = db.persist(tx)
+	}
+	if err != nil {
+		tx.rollback()
+		return err
+	}
+	return nil
+}
+
+// Persists a transaction's changes. The caller must hold the write lock
+func (db *DB) persist(tx *Tx) error {
+	if db.journal != nil {
+		return db.journal.append(tx.changes)
+	}
+	if db.flushInterval > 0 {
+		db.dirty = true
+		return nil
+	}
+	return db.writeState(*tx.data)
+}
+
+// Reverts every change made in the transaction, most recent first
+func (tx *Tx) rollback() {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		tx.undo[i]()
+	}
+}
+
+// Gets the next id for the named sequence
+func (tx *Tx) nextId(sequence string) (int, error) {
+	if !tx.writable {
+		return 0, ErrTxReadOnly
+	}
+	tx.undo = append(tx.undo, tx.restoreSequence(sequence))
+	id := tx.data.nextId(sequence)
+	tx.changes = append(tx.changes, putEntry(sequencesTable, sequence, id))
+	return id, nil
+}
+
+// Sets the last id handed out by the named sequence
+func (tx *Tx) putSequence(sequence string, last int) error {
+	if !tx.writable {
+		return ErrTxReadOnly
+	}
+	tx.undo = append(tx.undo, tx.restoreSequence(sequence))
+	if tx.data.Sequences == nil {
+		tx.data.Sequences = map[string]int{}
+	}
+	tx.data.Sequences[sequence] = last
+	tx.changes = append(tx.changes, putEntry(sequencesTable, sequence, last))
+	return nil
+}
+
+func (tx *Tx) restoreSequence(sequence string) func() {
+	previous, existed := tx.data.Sequences[sequence]
+	return func() {
+		if existed {
+			tx.data.Sequences[sequence] = previous
+		} else {
+			delete(tx.data.Sequences, sequence)
+		}
+	}
+}
+
+// Inserts or replaces a chirp
+func (tx *Tx) putChirp(chirp Chirp) error {
+	if !tx.writable {
+		return ErrTxReadOnly
+	}
+	if tx.data.Chirps == nil {
+		tx.data.Chirps = map[int]Chirp{}
+	}
+	tx.undo = append(tx.undo, tx.restoreChirp(chirp.Id))
+	previous := tx.data.findChirp(chirp.Id)
+	tx.data.Chirps[chirp.Id] = chirp
+	tx.data.indexChirp(previous, &chirp)
+	tx.changes = append(tx.changes, putEntry(chirpsTable, strconv.Itoa(chirp.Id), chirp))
+	return nil
+}
+
+func (tx *Tx) deleteChirp(id int) error {
+	if !tx.writable {
+		return ErrTxReadOnly
+	}
+	tx.undo = append(tx.undo, tx.restoreChirp(id))
+	previous := tx.data.findChirp(id)
+	delete(tx.data.Chirps, id)
+	tx.data.indexChirp(previous, nil)
+	tx.changes = append(tx.changes, deleteEntry(chirpsTable, strconv.Itoa(id)))
+	return nil
+}
+
+func (tx *Tx) restoreChirp(id int) func() {
+	previous := tx.data.findChirp(id)
+	return func() {
+		current := tx.data.findChirp(id)
+		if previous != nil {
+			tx.data.Chirps[id] = *previous
+		} else {
+			delete(tx.data.Chirps, id)
+		}
+		tx.data.indexChirp(current, previous)
+	}
+}
+
+// Inserts or replaces a user.
+//
+//	Errors with `ErrEmailInUse` if another user has the same email, ignoring case
+func (tx *Tx) putUser(intUsr internalUser) error {
+	if !tx.writable {
+		return ErrTxReadOnly
+	}
+	if owner, found := tx.data.userIdsByEmail[normalizeEmail(intUsr.Email)]; found && owner != intUsr.Id {
+		return ErrEmailInUse
+	}
+	if tx.data.Users == nil {
+		tx.data.Users = map[int]internalUser{}
+	}
+
+	previous := tx.data.findUser(intUsr.Id)
+	tx.undo = append(tx.undo, func() {
+		if previous != nil {
+			tx.data.Users[intUsr.Id] = *previous
+		} else {
+			delete(tx.data.Users, intUsr.Id)
+		}
+		tx.data.indexUser(&intUsr, previous)
+	})
+	tx.data.Users[intUsr.Id] = intUsr
+	tx.data.indexUser(previous, &intUsr)
+	tx.changes = append(tx.changes, putEntry(usersTable, strconv.Itoa(intUsr.Id), intUsr))
+	return nil
+}
+
+// Inserts or replaces an audit event
+func (tx *Tx) putAuditEvent(event AuditEvent) error {
+	if !tx.writable {
+		return ErrTxReadOnly
+	}
+	if tx.data.AuditEvents == nil {
+		tx.data.AuditEvents = map[int]AuditEvent{}
+	}
+	previous, existed := tx.data.AuditEvents[event.Id]
+	tx.undo = append(tx.undo, func() {
+		if existed {
+			tx.data.AuditEvents[event.Id] = previous
+		} else {
+			delete(tx.data.AuditEvents, event.Id)
+		}
+	})
+	tx.data.AuditEvents[event.Id] = event
+	tx.changes = append(tx.changes, putEntry(auditEventsTable, strconv.Itoa(event.Id), event))
+	return nil
+}
+
+// Inserts or replaces a one-time token, keyed by the token's hash
+func (tx *Tx) putOneTimeToken(tokenHash string, oneTimeToken OneTimeToken) error {
+	if !tx.writable {
+		return ErrTxReadOnly
+	}
+	if tx.data.OneTimeTokens == nil {
+		tx.data.OneTimeTokens = map[string]OneTimeToken{}
+	}
+	tx.undo = append(tx.undo, tx.restoreOneTimeToken(tokenHash))
+	tx.data.OneTimeTokens[tokenHash] = oneTimeToken
+	tx.changes = append(tx.changes, putEntry(oneTimeTokensTable, tokenHash, oneTimeToken))
+	return nil
+}
+
+func (tx *Tx) deleteOneTimeToken(tokenHash string) error {
+	if !tx.writable {
+		return ErrTxReadOnly
+	}
+	tx.undo = append(tx.undo, tx.restoreOneTimeToken(tokenHash))
+	delete(tx.data.OneTimeTokens, tokenHash)
+	tx.changes = append(tx.changes, deleteEntry(oneTimeTokensTable, tokenHash))
+	return nil
+}
+
+func (tx *Tx) restoreOneTimeToken(tokenHash string) func() {
+	previous := tx.data.findOneTimeToken(tokenHash)
+	return func() {
+		if previous != nil {
+			tx.data.OneTimeTokens[tokenHash] = *previous
+		} else {
+			delete(tx.data.OneTimeTokens, tokenHash)
+		}
+	}
+}
+
+// Inserts or replaces a user's two-factor settings
+func (tx *Tx) putTwoFactor(twoFactor TwoFactor) error {
+	if !tx.writable {
+		return ErrTxReadOnly
+	}
+	if tx.data.TwoFactor == nil {
+		tx.data.TwoFactor = map[int]TwoFactor{}
+	}
+	tx.undo = append(tx.undo, tx.restoreTwoFactor(twoFactor.UserId))
+	tx.data.TwoFactor[twoFactor.UserId] = twoFactor
+	tx.changes = append(tx.changes, putEntry(twoFactorTable, strconv.Itoa(twoFactor.UserId), twoFactor))
+	return nil
+}
+
+func (tx *Tx) deleteTwoFactor(userId int) error {
+	if !tx.writable {
+		return ErrTxReadOnly
+	}
+	tx.undo = append(tx.undo, tx.restoreTwoFactor(userId))
+	delete(tx.data.TwoFactor, userId)
+	tx.changes = append(tx.changes, deleteEntry(twoFactorTable, strconv.Itoa(userId)))
+	return nil
+}
+
+func (tx *Tx) restoreTwoFactor(userId int) func() {
+	previous := tx.data.findTwoFactor(userId)
+	return func() {
+		if previous != nil {
+			tx.data.TwoFactor[userId] = *previous
+		} else {
+			delete(tx.data.TwoFactor, userId)
+		}
+	}
+}
+
+// Inserts or replaces an API key, keyed by the key's hash
+func (tx *Tx) putApiKey(keyHash string, apiKey ApiKey) error {
+	if !tx.writable {
+		return ErrTxReadOnly
+	}
+	if tx.data.ApiKeys == nil {
+		tx.data.ApiKeys = map[string]ApiKey{}
+	}
+	tx.undo = append(tx.undo, tx.restoreApiKey(keyHash))
+	tx.data.ApiKeys[keyHash] = apiKey
+	tx.changes = append(tx.changes, putEntry(apiKeysTable, keyHash, apiKey))
+	return nil
+}
+
+func (tx *Tx) deleteApiKey(keyHash string) error {
+	if !tx.writable {
+		return ErrTxReadOnly
+	}
+	tx.undo = append(tx.undo, tx.restoreApiKey(keyHash))
+	delete(tx.data.ApiKeys, keyHash)
+	tx.changes = append(tx.changes, deleteEntry(apiKeysTable, keyHash))
+	return nil
+}
+
+func (tx *Tx) restoreApiKey(keyHash string) func() {
+	previous := tx.data.findApiKey(keyHash)
+	return func() {
+		if previous != nil {
+			tx.data.ApiKeys[keyHash] = *previous
+		} else {
+			delete(tx.data.ApiKeys, keyHash)
+		}
+	}
+}
+
+// Inserts or replaces an OAuth client, keyed by its id
+func (tx *Tx) putOAuthClient(client internalOAuthClient) error {
+	if !tx.writable {
+		return ErrTxReadOnly
+	}
+	if tx.data.OAuthClients == nil {
+		tx.data.OAuthClients = map[string]internalOAuthClient{}
+	}
+	tx.undo = append(tx.undo, tx.restoreOAuthClient(client.Id))
+	tx.data.OAuthClients[client.Id] = client
+	tx.changes = append(tx.changes, putEntry(oauthClientsTable, client.Id, client))
+	return nil
+}
+
+func (tx *Tx) deleteOAuthClient(id string) error {
+	if !tx.writable {
+		return ErrTxReadOnly
+	}
+	tx.undo = append(tx.undo, tx.restoreOAuthClient(id))
+	delete(tx.data.OAuthClients, id)
+	tx.changes = append(tx.changes, deleteEntry(oauthClientsTable, id))
+	return nil
+}
+
+func (tx *Tx) restoreOAuthClient(id string) func() {
+	previous := tx.data.findOAuthClient(id)
+	return func() {
+		if previous != nil {
+			tx.data.OAuthClients[id] = *previous
+		} else {
+			delete(tx.data.OAuthClients, id)
+		}
+	}
+}
+
+// Inserts or replaces an authorization code, keyed by the code's hash
+func (tx *Tx) putAuthorizationCode(codeHash string, authorizationCode AuthorizationCode) error {
+	if !tx.writable {
+		return ErrTxReadOnly
+	}
+	if tx.data.AuthorizationCodes == nil {
+		tx.data.AuthorizationCodes = map[string]AuthorizationCode{}
+	}
+	tx.undo = append(tx.undo, tx.restoreAuthorizationCode(codeHash))
+	tx.data.AuthorizationCodes[codeHash] = authorizationCode
+	tx.changes = append(tx.changes, putEntry(authorizationCodesTable, codeHash, authorizationCode))
+	return nil
+}
+
+func (tx *Tx) deleteAuthorizationCode(codeHash string) error {
+	if !tx.writable {
+		return ErrTxReadOnly
+	}
+	tx.undo = append(tx.undo, tx.restoreAuthorizationCode(codeHash))
+	delete(tx.data.AuthorizationCodes, codeHash)
+	tx.changes = append(tx.changes, deleteEntry(authorizationCodesTable, codeHash))
+	return nil
+}
+
+func (tx *Tx) restoreAuthorizationCode(codeHash string) func() {
+	previous := tx.data.findAuthorizationCode(codeHash)
+	return func() {
+		if previous != nil {
+			tx.data.AuthorizationCodes[codeHash] = *previous
+		} else {
+			delete(tx.data.AuthorizationCodes, codeHash)
+		}
+	}
+}
+
+// Inserts or replaces a refresh token, keyed by the token's hash
+func (tx *Tx) putRefreshToken(tokenHash string, refreshToken RefreshToken) error {
+	if !tx.writable {
+		return ErrTxReadOnly
+	}
+	if tx.data.RefreshTokens == nil {
+		tx.data.RefreshTokens = map[string]RefreshToken{}
+	}
+	tx.undo = append(tx.undo, tx.restoreRefreshToken(tokenHash))
+	previous := tx.data.findRefreshToken(tokenHash)
+	tx.data.RefreshTokens[tokenHash] = refreshToken
+	tx.data.indexRefreshToken(tokenHash, previous, &refreshToken)
+	tx.changes = append(tx.changes, putEntry(refreshTokensTable, tokenHash, refreshToken))
+	return nil
+}
+
+func (tx *Tx) deleteRefreshToken(tokenHash string) error {
+	if !tx.writable {
+		return ErrTxReadOnly
+	}
+	tx.undo = append(tx.undo, tx.restoreRefreshToken(tokenHash))
+	previous := tx.data.findRefreshToken(tokenHash)
+	delete(tx.data.RefreshTokens, tokenHash)
+	tx.data.indexRefreshToken(tokenHash, previous, nil)
+	tx.changes = append(tx.changes, deleteEntry(refreshTokensTable, tokenHash))
+	return nil
+}
+
+// Deletes every token in a refresh token family
+func (tx *Tx) deleteRefreshTokenFamily(familyId string) (revoked int, err error) {
+	for tokenHash := range tx.data.refreshTokensByFamily[familyId] {
+		err = tx.deleteRefreshToken(tokenHash)
+		if err != nil {
+			return 0, err
+		}
+		revoked++
+	}
+	return revoked, nil
+}
+
+func (tx *Tx) restoreRefreshToken(tokenHash string) func() {
+	previous := tx.data.findRefreshToken(tokenHash)
+	return func() {
+		current := tx.data.findRefreshToken(tokenHash)
+		if previous != nil {
+			tx.data.RefreshTokens[tokenHash] = *previous
+		} else {
+			delete(tx.data.RefreshTokens, tokenHash)
+		}
+		tx.data.indexRefreshToken(tokenHash, current, previous)
+	}
+}
@@ -0,0 +1,212 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The concurrency tests are most useful when run with the race detector: go test -race ./database
+
+func TestUpdateRollsBackOnError(t *testing.T) {
+	testDb := NewDB("./testdatabase.json")
+
+	err := cleanupDbFile(testDb.path)
+	if err != nil {
+		t.Fatalf("Error cleaning up database file: %v", err)
+	}
+
+	errAbort := errors.New("abort")
+	err = testDb.Update(func(tx *Tx) error {
+		err := tx.putChirp(Chirp{Id: 1, Body: "Never saved"})
+		if err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if err != errAbort {
+		t.Fatalf("Expected the transaction error, actual: %v", err)
+	}
+
+	_, found, err := testDb.GetChirp(1)
+	if err != nil {
+		t.Fatalf("Error getting chirp: %v", err)
+	}
+	if found {
+		t.Fatal("Changes from a failed transaction were persisted")
+	}
+}
+
+func TestViewRejectsWrites(t *testing.T) {
+	testDb := NewDB("./testdatabase.json")
+
+	err := cleanupDbFile(testDb.path)
+	if err != nil {
+		t.Fatalf("Error cleaning up database file: %v", err)
+	}
+
+	err = testDb.View(func(tx *Tx) error {
+		return tx.putChirp(Chirp{Id: 1, Body: "Never saved"})
+	})
+	if err != ErrTxReadOnly {
+		t.Fatalf("Expected a read-only error, actual: %v", err)
+	}
+}
+
+func TestConcurrentCreateUserSameEmail(t *testing.T) {
+	testDb := NewDB("./testdatabase.json")
+
+	err := cleanupDbFile(testDb.path)
+	if err != nil {
+		t.Fatalf("Error cleaning up database file: %v", err)
+	}
+
+	attempts := 16
+	errs := make(chan error, attempts)
+	wg := sync.WaitGroup{}
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := testDb.CreateUser("same@example.com", "foobar")
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	created := 0
+	for err := range errs {
+		if err == nil {
+			created++
+		} else if err != ErrEmailInUse {
+			t.Fatalf("Unexpected error creating user: %v", err)
+		}
+	}
+	if created != 1 {
+		t.Fatalf("Expected exactly one user to be created, actual: %v", created)
+	}
+}
+
+func TestConcurrentCreateChirpKeepsEveryChirp(t *testing.T) {
+	for _, journaled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("journal=%v", journaled), func(t *testing.T) {
+			path := "./testdatabase.json"
+			for _, file := range []string{path, path + ".journal"} {
+				err := cleanupDbFile(file)
+				if err != nil {
+					t.Fatalf("Error cleaning up database file: %v", err)
+				}
+			}
+			testDb, err := OpenDB(path, Options{Journal: journaled})
+			if err != nil {
+				t.Fatalf("Error opening database: %v", err)
+			}
+			defer testDb.Close()
+
+			writers, chirpsPerWriter := 8, 10
+			wg := sync.WaitGroup{}
+			for i := 0; i < writers; i++ {
+				wg.Add(1)
+				go func(author int) {
+					defer wg.Done()
+					for j := 0; j < chirpsPerWriter; j++ {
+						_, err := testDb.CreateChirp("Concurrent chirp", author)
+						if err != nil {
+							t.Errorf("Error creating chirp: %v", err)
+						}
+						_, err = testDb.GetChirps()
+						if err != nil {
+							t.Errorf("Error getting chirps: %v", err)
+						}
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			chirps, err := testDb.GetChirps()
+			if err != nil {
+				t.Fatalf("Error getting chirps: %v", err)
+			}
+			if len(chirps) != writers*chirpsPerWriter {
+				t.Fatalf("Expected %v chirps, actual: %v", writers*chirpsPerWriter, len(chirps))
+			}
+		})
+	}
+}
+
+func TestConcurrentMixedUpdates(t *testing.T) {
+	testDb := NewDB("./testdatabase.json")
+
+	err := cleanupDbFile(testDb.path)
+	if err != nil {
+		t.Fatalf("Error cleaning up database file: %v", err)
+	}
+
+	users := 4
+	initial := DBStructure{Chirps: map[int]Chirp{}, Users: map[int]internalUser{}}
+	for id := 1; id <= users; id++ {
+		initial.Users[id] = internalUser{User: User{Id: id, Email: fmt.Sprintf("user%d@example.com", id)}}
+		initial.Chirps[id] = Chirp{Id: id, Body: "Delete me", AuthorId: id}
+	}
+	err = testDb.writeDB(initial)
+	if err != nil {
+		t.Fatalf("Error writing initial data to database: %v", err)
+	}
+
+	wg := sync.WaitGroup{}
+	for id := 1; id <= users; id++ {
+		wg.Add(4)
+		go func(id int) {
+			defer wg.Done()
+			_, err := testDb.UpdateUser(id, fmt.Sprintf("updated%d@example.com", id), "")
+			if err != nil {
+				t.Errorf("Error updating user: %v", err)
+			}
+		}(id)
+		go func(id int) {
+			defer wg.Done()
+			_, err := testDb.UpgradeUser(id)
+			if err != nil {
+				t.Errorf("Error upgrading user: %v", err)
+			}
+		}(id)
+		go func(id int) {
+			defer wg.Done()
+			err := testDb.CreateRefreshToken(fmt.Sprintf("token%d", id), RefreshToken{UserId: id, ExpiresAt: time.Now().Add(time.Hour)})
+			if err != nil {
+				t.Errorf("Error creating refresh token: %v", err)
+			}
+		}(id)
+		go func(id int) {
+			defer wg.Done()
+			_, err := testDb.DeleteChirp(id)
+			if err != nil {
+				t.Errorf("Error deleting chirp: %v", err)
+			}
+		}(id)
+	}
+	wg.Wait()
+
+	dbStructure, err := testDb.loadDB()
+	if err != nil {
+		t.Fatalf("Error loading database: %v", err)
+	}
+	if len(dbStructure.Chirps) != 0 {
+		t.Fatalf("Expected every chirp to be deleted, %v remain", len(dbStructure.Chirps))
+	}
+	if len(dbStructure.RefreshTokens) != users {
+		t.Fatalf("Expected %v refresh tokens, actual: %v", users, len(dbStructure.RefreshTokens))
+	}
+	for id := 1; id <= users; id++ {
+		intUsr, found := dbStructure.getUserFromId(id)
+		if !found {
+			t.Fatalf("User %v is missing", id)
+		}
+		if !intUsr.IsChirpyRed || intUsr.Email != fmt.Sprintf("updated%d@example.com", id) {
+			t.Fatalf("Lost an update to user %v: %+v", id, intUsr.User)
+		}
+	}
+}
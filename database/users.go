@@ -4,19 +4,57 @@ package database
 
 import (
 	"errors"
-
-	"golang.org/x/crypto/bcrypt"
+	"log"
+	"net/mail"
+	"sort"
+	"sync"
 )
 
 var (
 	ErrEmailInUse   = errors.New("that email is already in use")
 	ErrUserNotFound = errors.New("user not found")
+	ErrInvalidRole  = errors.New("invalid role")
+	ErrInvalidEmail = errors.New("invalid email address")
+	ErrEmailChanged = errors.New("that email is no longer the user's address")
+	// Returned for an unknown email and for a wrong password alike, so logins can't be used to find accounts
+	ErrInvalidCredentials = errors.New("invalid email or password")
+)
+
+// Roles, from least to most privileged. Each role can do everything the roles before it can
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator" // Can delete any chirp
+	RoleAdmin     = "admin"     // Can use the admin routes and change roles
 )
 
+var roleRanks = map[string]int{RoleUser: 0, RoleModerator: 1, RoleAdmin: 2}
+
+// Reports whether `role` is one of the defined roles
+func ValidRole(role string) bool {
+	_, found := roleRanks[role]
+	return found
+}
+
+// Reports whether `role` grants everything `required` does. Unknown roles grant nothing
+func RoleAtLeast(role string, required string) bool {
+	rank, found := roleRanks[role]
+	return found && rank >= roleRanks[required]
+}
+
+// Reports whether `email` is a bare email address, like `user@example.com`, without a display name or angle brackets
+func ValidEmail(email string) bool {
+	address, err := mail.ParseAddress(email)
+	return err == nil && address.Name == "" && address.Address == email
+}
+
 type User struct {
-	Id          int    `json:"id"`
-	Email       string `json:"email"`
-	IsChirpyRed bool   `json:"is_chirpy_red" default:"false"`
+	Id            int    `json:"id"`
+	Email         string `json:"email"`
+	IsChirpyRed   bool   `json:"is_chirpy_red" default:"false"`
+	Role          string `json:"role"`
+	EmailVerified bool   `json:"email_verified"`
+	PendingEmail  string `json:"pending_email,omitempty"` // A new address that replaces Email once it's verified
+	Disabled      bool   `json:"disabled"`                // Disabled users can't log in, and their credentials are rejected
 }
 
 type internalUser struct {
@@ -24,43 +62,43 @@ type internalUser struct {
 	Password string `json:"password"`
 }
 
-func (dbStructure *DBStructure) getUserFromEmail(email string) (intUsr *internalUser, found bool) {
-	intUsr, found = dbStructure.getUser(func(intUsr internalUser) bool {
-		return intUsr.Email == email
-	})
-
-	return intUsr, found
+// Gets a user by email, ignoring case
+func (dbStructure *DBStructure) getUserFromEmail(email string) (intUsr internalUser, found bool) {
+	id, found := dbStructure.userIdsByEmail[normalizeEmail(email)]
+	if !found {
+		return internalUser{}, false
+	}
+	return dbStructure.getUserFromId(id)
 }
 
-// Creates a user with the specified email and an incremented id
+// Creates a user with the specified email and the next id in the user sequence. The email starts out unverified
 func (db *DB) CreateUser(email string, password string) (User, error) {
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return User{}, err
-	}
-
-	if dbStructure.Users == nil {
-		dbStructure.Users = []internalUser{}
-	}
-
-	_, found := dbStructure.getUserFromEmail(email)
-	if found {
-		return User{}, ErrEmailInUse
+	if !ValidEmail(email) {
+		return User{}, ErrInvalidEmail
 	}
-
-	userId := len(dbStructure.Users) + 1
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	// Hashing is slow, so it's done before taking the database lock
+	hashedPassword, err := hashPassword(password)
 	if err != nil {
 		return User{}, err
 	}
 	intUsr := internalUser{
 		User: User{
-			Id:    userId,
-			Email: email},
-		Password: string(hashedPassword)}
-	dbStructure.Users = append(dbStructure.Users, intUsr)
+			Email: email,
+			Role:  RoleUser},
+		Password: hashedPassword}
+
+	err = db.Update(func(tx *Tx) error {
+		if _, found := tx.data.getUserFromEmail(email); found {
+			return ErrEmailInUse // Checked before taking an id, though putUser enforces it too
+		}
 
-	err = db.writeDB(dbStructure)
+		userId, err := tx.nextId(userSequence)
+		if err != nil {
+			return err
+		}
+		intUsr.Id = userId
+		return tx.putUser(intUsr)
+	})
 	if err != nil {
 		return User{}, err
 	}
@@ -68,106 +106,336 @@ func (db *DB) CreateUser(email string, password string) (User, error) {
 	return intUsr.User, nil
 }
 
+// A hash that matches no password, checked when a login's email isn't found
+var dummyPasswordHash = sync.OnceValue(func() string {
+	hash, _ := hashPassword("not a real password")
+	return hash
+})
+
+// Checks a password against the user's hash, or against a dummy hash if no user was found,
+// so a login takes as long whether or not the account exists.
+//
+//	Errors with `ErrInvalidCredentials` for a missing user and a wrong password alike. `outdated` reports whether the hash should be replaced
+func checkPassword(intUsr internalUser, found bool, password string) (outdated bool, err error) {
+	hash := intUsr.Password
+	if !found {
+		hash = dummyPasswordHash()
+	}
+	match, outdated, err := verifyPassword(hash, password)
+	if err != nil {
+		return false, err
+	}
+	if !found || !match {
+		return false, ErrInvalidCredentials
+	}
+	return outdated, nil
+}
+
 // Validates login credentials against a user's stored credentials in the database.
 //
 //	Returns the user if found and valid credentials provided.
-//	Err is nil on successful validation or an error on failure
-//	TODO: Should probably split the user exists validation and credentials validation for more granular response codes
+//	Errors with `ErrInvalidCredentials` whether the email wasn't found or the password was wrong.
+//	A password hash made with outdated settings is replaced with a new one
 func (db *DB) ValidateCredentials(email string, password string) (User, error) {
-	dbStructure, err := db.loadDB()
+	intrnlUser, found := internalUser{}, false
+	err := db.View(func(tx *Tx) error {
+		intrnlUser, found = tx.data.getUserFromEmail(email)
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
 
-	intrnlUser, found := dbStructure.getUserFromEmail(email)
-	if !found {
-		return User{}, ErrUserNotFound
-	}
-
-	err = bcrypt.CompareHashAndPassword([]byte(intrnlUser.Password), []byte(password))
+	outdated, err := checkPassword(intrnlUser, found, password)
 	if err != nil {
 		return User{}, err
 	}
-
+	if outdated {
+		err = db.rehashPassword(intrnlUser, password)
+		if err != nil {
+			log.Printf("Error upgrading the password hash for user %d: %v", intrnlUser.Id, err)
+		}
+	}
 	return intrnlUser.User, nil
 }
 
+// Replaces a user's password hash with one made with the current settings, unless the password changed since it was checked
+func (db *DB) rehashPassword(intUsr internalUser, password string) error {
+	hashedPassword, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *Tx) error {
+		current, found := tx.data.getUserFromId(intUsr.Id)
+		if !found || current.Password != intUsr.Password {
+			return nil
+		}
+		current.Password = hashedPassword
+		return tx.putUser(current)
+	})
+}
+
 // Updates a user entry in the database based on provided values for the email and password.
 //
 //	Empty values will not update the corresponding field in the database.
+//	A new email replaces the old one immediately and is unverified. Use `SetPendingEmail` to keep the old email until the new one is verified.
 //	Update should be authorized prior to calling this method
 func (db *DB) UpdateUser(id int, email string, password string) (User, error) {
 	// TODO: Reconsider how updates are performed.
 	// How do updates happen when more fields are present? Keep each field update separate or execute all at once?
-	dbStructure, err := db.loadDB()
+	if email != "" && !ValidEmail(email) {
+		return User{}, ErrInvalidEmail
+	}
+	hashedPassword := ""
+	if password != "" {
+		hashed, err := hashPassword(password)
+		if err != nil {
+			return User{}, err
+		}
+		hashedPassword = hashed
+	}
+
+	updated := internalUser{}
+	err := db.Update(func(tx *Tx) error {
+		intUsr, found := tx.data.getUserFromId(id)
+		if !found {
+			return ErrUserNotFound
+		}
+		updated = intUsr
+
+		if email != "" && normalizeEmail(email) != normalizeEmail(updated.Email) {
+			updated.EmailVerified = false
+			updated.PendingEmail = ""
+		}
+		if email != "" {
+			updated.Email = email
+		}
+		if hashedPassword != "" {
+			updated.Password = hashedPassword
+		}
+		return tx.putUser(updated)
+	})
 	if err != nil {
 		return User{}, err
 	}
+	return updated.User, nil
+}
 
-	intUsr, found := dbStructure.getUserFromId(id)
+// Gets a copy of the user with the given id, or nil if there isn't one
+func (dbStructure *DBStructure) findUser(id int) *internalUser {
+	intUsr, found := dbStructure.Users[id]
 	if !found {
-		return User{}, ErrUserNotFound
+		return nil
 	}
+	return &intUsr
+}
 
-	if email != "" {
-		intUsr.Email = email
-	}
-	if password != "" {
-		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-		if err != nil {
-			return User{}, err
+func (dbStructure *DBStructure) getUserFromId(id int) (intUsr internalUser, found bool) {
+	intUsr, found = dbStructure.Users[id]
+	return intUsr, found
+}
+
+// Upgrades a specified user to Chirpy Red
+//
+//	Returns the upgraded user on success. Returns an error if the database read/writer failed
+func (db *DB) UpgradeUser(id int) (User, error) {
+	upgraded := internalUser{}
+	err := db.Update(func(tx *Tx) error {
+		intUsr, found := tx.data.getUserFromId(id)
+		if !found {
+			return ErrUserNotFound
 		}
-		intUsr.Password = string(hashedPassword)
+		upgraded = intUsr
+		upgraded.IsChirpyRed = true
+		return tx.putUser(upgraded)
+	})
+	if err != nil {
+		return User{}, err
 	}
+	return upgraded.User, nil
+}
 
-	err = db.writeDB(dbStructure)
+// Removes Chirpy Red from a specified user
+//
+//	Returns the downgraded user on success. Returns an error if the database read/writer failed
+func (db *DB) DowngradeUser(id int) (User, error) {
+	downgraded := internalUser{}
+	err := db.Update(func(tx *Tx) error {
+		intUsr, found := tx.data.getUserFromId(id)
+		if !found {
+			return ErrUserNotFound
+		}
+		downgraded = intUsr
+		downgraded.IsChirpyRed = false
+		return tx.putUser(downgraded)
+	})
 	if err != nil {
 		return User{}, err
 	}
-	return intUsr.User, nil
+	return downgraded.User, nil
 }
 
-// Gets a user via a supplied selector function. The selector function defines which user field to select on
-func (dbStructure *DBStructure) getUser(selector func(intUsr internalUser) bool) (intUsr *internalUser, found bool) {
-	if dbStructure.Users == nil || len(dbStructure.Users) == 0 {
-		return &internalUser{}, false
+// Disables or re-enables a user. Disabling doesn't end the user's sessions, which the caller revokes with `DeleteUserSessions`
+//
+//	Returns the updated user on success. Errors with `ErrUserNotFound`
+func (db *DB) SetUserDisabled(id int, disabled bool) (User, error) {
+	updated := internalUser{}
+	err := db.Update(func(tx *Tx) error {
+		intUsr, found := tx.data.getUserFromId(id)
+		if !found {
+			return ErrUserNotFound
+		}
+		updated = intUsr
+		updated.Disabled = disabled
+		return tx.putUser(updated)
+	})
+	if err != nil {
+		return User{}, err
 	}
+	return updated.User, nil
+}
 
-	for i := 0; i < len(dbStructure.Users); i++ {
-		if selector(dbStructure.Users[i]) {
-			return &dbStructure.Users[i], true
+// Gets every user, ordered by id
+func (db *DB) GetUsers() ([]User, error) {
+	users := []User{}
+	err := db.View(func(tx *Tx) error {
+		for _, intUsr := range tx.data.Users {
+			users = append(users, intUsr.User)
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return &internalUser{}, false
+	sort.Slice(users, func(i, j int) bool { return users[i].Id < users[j].Id })
+	return users, nil
 }
 
-func (dbStructure *DBStructure) getUserFromId(id int) (intUsr *internalUser, found bool) {
-	intUsr, found = dbStructure.getUser(func(intUsr internalUser) bool {
-		return intUsr.Id == id
+// Gets a user by id, if they exist
+func (db *DB) GetUser(id int) (user User, found bool, err error) {
+	err = db.View(func(tx *Tx) error {
+		intUsr, ok := tx.data.getUserFromId(id)
+		user, found = intUsr.User, ok
+		return nil
 	})
+	if err != nil || !found {
+		return User{}, false, err
+	}
+	return user, true, nil
+}
 
-	return intUsr, found
+// Gets a user by email, ignoring case, if they exist
+func (db *DB) GetUserByEmail(email string) (user User, found bool, err error) {
+	err = db.View(func(tx *Tx) error {
+		intUsr, ok := tx.data.getUserFromEmail(email)
+		user, found = intUsr.User, ok
+		return nil
+	})
+	if err != nil || !found {
+		return User{}, false, err
+	}
+	return user, true, nil
 }
 
-// Upgrades a specified user to Chirpy Red
+// Sets a user's role.
 //
-//	Returns the upgraded user on success. Returns an error if the database read/writer failed
-func (db *DB) UpgradeUser(id int) (User, error) {
-	dbStructure, err := db.loadDB()
+//	Returns the updated user on success. Errors with `ErrInvalidRole` for an unknown role, or `ErrUserNotFound`
+func (db *DB) SetUserRole(id int, role string) (User, error) {
+	if !ValidRole(role) {
+		return User{}, ErrInvalidRole
+	}
+	updated := internalUser{}
+	err := db.Update(func(tx *Tx) error {
+		intUsr, found := tx.data.getUserFromId(id)
+		if !found {
+			return ErrUserNotFound
+		}
+		updated = intUsr
+		updated.Role = role
+		return tx.putUser(updated)
+	})
 	if err != nil {
 		return User{}, err
 	}
+	return updated.User, nil
+}
+
+// Sets the email a user is changing to. Their current email stays in use until the new one is verified with `VerifyEmail`.
+//
+//	Setting the user's current email cancels the change. Errors with `ErrInvalidEmail`, `ErrEmailInUse`, or `ErrUserNotFound`
+func (db *DB) SetPendingEmail(id int, email string) (User, error) {
+	if !ValidEmail(email) {
+		return User{}, ErrInvalidEmail
+	}
+	return db.ChangeCredentials(id, email, "")
+}
 
-	intUsr, found := dbStructure.getUserFromId(id)
-	if !found {
-		return User{}, ErrUserNotFound
+// Sets the email a user is changing to, like `SetPendingEmail`, and their password, in one transaction. Either may be empty to leave it unchanged.
+//
+//	Nothing is changed if either fails, so a taken email doesn't leave the password changed
+func (db *DB) ChangeCredentials(id int, email string, password string) (User, error) {
+	if email != "" && !ValidEmail(email) {
+		return User{}, ErrInvalidEmail
+	}
+	hashedPassword := ""
+	if password != "" {
+		hashed, err := hashPassword(password)
+		if err != nil {
+			return User{}, err
+		}
+		hashedPassword = hashed
 	}
 
-	intUsr.IsChirpyRed = true
+	updated := internalUser{}
+	err := db.Update(func(tx *Tx) error {
+		intUsr, found := tx.data.getUserFromId(id)
+		if !found {
+			return ErrUserNotFound
+		}
+		updated = intUsr
+		if email != "" {
+			updated.PendingEmail = ""
+			if normalizeEmail(email) != normalizeEmail(intUsr.Email) {
+				if _, found := tx.data.getUserFromEmail(email); found {
+					return ErrEmailInUse
+				}
+				updated.PendingEmail = email
+			}
+		}
+		if hashedPassword != "" {
+			updated.Password = hashedPassword
+		}
+		return tx.putUser(updated)
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return updated.User, nil
+}
 
-	err = db.writeDB(dbStructure)
+// Marks `email` as verified for the user. If it's their pending email, it replaces their current one.
+//
+//	Errors with `ErrEmailChanged` if `email` is neither the user's email nor their pending email,
+//	and with `ErrEmailInUse` if another user took the pending email first
+func (db *DB) VerifyEmail(id int, email string) (User, error) {
+	updated := internalUser{}
+	err := db.Update(func(tx *Tx) error {
+		intUsr, found := tx.data.getUserFromId(id)
+		if !found {
+			return ErrUserNotFound
+		}
+		updated = intUsr
+		if intUsr.PendingEmail != "" && normalizeEmail(email) == normalizeEmail(intUsr.PendingEmail) {
+			updated.Email = intUsr.PendingEmail
+			updated.PendingEmail = ""
+		} else if normalizeEmail(email) != normalizeEmail(intUsr.Email) {
+			return ErrEmailChanged
+		}
+		updated.EmailVerified = true
+		return tx.putUser(updated)
+	})
 	if err != nil {
 		return User{}, err
 	}
-	return intUsr.User, nil
+	return updated.User, nil
 }
@@ -125,8 +125,8 @@ func TestUpdateUser(t *testing.T) {
 
 	testDb.writeDB(DBStructure{
 		Chirps: map[int]Chirp{},
-		Users: []internalUser{
-			{
+		Users: map[int]internalUser{
+			targetUserId: {
 				User: User{
 					Email: "initial@example.com",
 					Id:    targetUserId,
@@ -162,8 +162,8 @@ func TestUpgradeUser(t *testing.T) {
 
 	testDb.writeDB(DBStructure{
 		Chirps: map[int]Chirp{},
-		Users: []internalUser{
-			{
+		Users: map[int]internalUser{
+			targetUserId: {
 				User: User{
 					Email:       "initial@example.com",
 					Id:          targetUserId,
@@ -194,3 +194,284 @@ func TestUpgradeUser(t *testing.T) {
 		t.Fatal("Failed to update database record for user upgrade")
 	}
 }
+
+func TestUserRoles(t *testing.T) {
+	testDb := NewDB("./testdatabase.json")
+
+	err := cleanupDbFile(testDb.path)
+	if err != nil {
+		t.Fatalf("Error cleaning up database file: %v", err)
+	}
+	testUserRoles(t, testDb)
+}
+
+// Role behavior shared by the database backends
+func testUserRoles(t *testing.T, store Store) {
+	user, err := store.CreateUser("foobar@example.com", "foobar")
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	if user.Role != RoleUser {
+		t.Fatalf("New user created with role %s", user.Role)
+	}
+
+	_, err = store.SetUserRole(user.Id, "superuser")
+	if err != ErrInvalidRole {
+		t.Fatalf("Expected an invalid role error, actual: %v", err)
+	}
+	_, err = store.SetUserRole(user.Id, RoleModerator)
+	if err != nil {
+		t.Fatalf("Error setting role: %v", err)
+	}
+	found, ok, err := store.GetUserByEmail("FOOBAR@example.com")
+	if err != nil {
+		t.Fatalf("Error getting user: %v", err)
+	}
+	if !ok || found.Id != user.Id || found.Role != RoleModerator {
+		t.Fatalf("User read back with incorrect data: %+v", found)
+	}
+	_, ok, err = store.GetUser(user.Id + 1)
+	if err != nil {
+		t.Fatalf("Error getting user: %v", err)
+	}
+	if ok {
+		t.Fatal("Found a user that doesn't exist")
+	}
+}
+
+func TestManageUsers(t *testing.T) {
+	testDb := NewDB("./testdatabase.json")
+
+	err := cleanupDbFile(testDb.path)
+	if err != nil {
+		t.Fatalf("Error cleaning up database file: %v", err)
+	}
+	testManageUsers(t, testDb)
+}
+
+// Admin user management shared by the database backends
+func testManageUsers(t *testing.T, store Store) {
+	for _, email := range []string{"first@example.com", "second@example.com", "third@example.com"} {
+		_, err := store.CreateUser(email, "password")
+		if err != nil {
+			t.Fatalf("Error creating user: %v", err)
+		}
+	}
+	users, err := store.GetUsers()
+	if err != nil {
+		t.Fatalf("Error getting users: %v", err)
+	}
+	if len(users) != 3 || users[0].Email != "first@example.com" || users[2].Email != "third@example.com" {
+		t.Fatalf("Users read back out of order or with incorrect data: %+v", users)
+	}
+
+	user, err := store.UpgradeUser(2)
+	if err != nil || !user.IsChirpyRed {
+		t.Fatalf("Error upgrading user: %+v, %v", user, err)
+	}
+	user, err = store.DowngradeUser(2)
+	if err != nil || user.IsChirpyRed {
+		t.Fatalf("Error downgrading user: %+v, %v", user, err)
+	}
+
+	user, err = store.SetUserDisabled(2, true)
+	if err != nil || !user.Disabled {
+		t.Fatalf("Error disabling user: %+v, %v", user, err)
+	}
+	found, _, err := store.GetUser(2)
+	if err != nil || !found.Disabled || found.IsChirpyRed {
+		t.Fatalf("Disabled user read back with incorrect data: %+v, %v", found, err)
+	}
+	user, err = store.SetUserDisabled(2, false)
+	if err != nil || user.Disabled {
+		t.Fatalf("Error enabling user: %+v, %v", user, err)
+	}
+
+	_, err = store.DowngradeUser(4)
+	if err != ErrUserNotFound {
+		t.Fatalf("Expected a user not found error, actual: %v", err)
+	}
+	_, err = store.SetUserDisabled(4, true)
+	if err != ErrUserNotFound {
+		t.Fatalf("Expected a user not found error, actual: %v", err)
+	}
+}
+
+func TestRoleAtLeast(t *testing.T) {
+	if !RoleAtLeast(RoleAdmin, RoleModerator) || !RoleAtLeast(RoleModerator, RoleModerator) {
+		t.Fatal("Role didn't grant a lesser or equal role")
+	}
+	if RoleAtLeast(RoleUser, RoleModerator) || RoleAtLeast("", RoleUser) {
+		t.Fatal("Role granted a greater role")
+	}
+}
+
+func TestValidEmail(t *testing.T) {
+	for _, email := range []string{"foobar@example.com", "foo.bar+chirpy@mail.example.com"} {
+		if !ValidEmail(email) {
+			t.Fatalf("Rejected valid email %s", email)
+		}
+	}
+	for _, email := range []string{"", "foobar", "foobar@", "@example.com", "Foo <foobar@example.com>", " foobar@example.com"} {
+		if ValidEmail(email) {
+			t.Fatalf("Accepted invalid email %q", email)
+		}
+	}
+}
+
+func TestEmailVerification(t *testing.T) {
+	testDb := NewDB("./testdatabase.json")
+
+	err := cleanupDbFile(testDb.path)
+	if err != nil {
+		t.Fatalf("Error cleaning up database file: %v", err)
+	}
+	testEmailVerification(t, testDb)
+}
+
+// Email verification behavior shared by the database backends
+func testEmailVerification(t *testing.T, store Store) {
+	_, err := store.CreateUser("not an email", "foobar")
+	if err != ErrInvalidEmail {
+		t.Fatalf("Expected an invalid email error, actual: %v", err)
+	}
+	user, err := store.CreateUser("foobar@example.com", "foobar")
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	other, err := store.CreateUser("other@example.com", "foobar")
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	if user.EmailVerified {
+		t.Fatal("New user created with a verified email")
+	}
+
+	user, err = store.VerifyEmail(user.Id, "FOOBAR@example.com")
+	if err != nil {
+		t.Fatalf("Error verifying email: %v", err)
+	}
+	if !user.EmailVerified {
+		t.Fatal("Email not marked verified")
+	}
+
+	_, err = store.SetPendingEmail(user.Id, "other@example.com")
+	if err != ErrEmailInUse {
+		t.Fatalf("Expected an email in use error, actual: %v", err)
+	}
+	user, err = store.SetPendingEmail(user.Id, "new@example.com")
+	if err != nil {
+		t.Fatalf("Error setting pending email: %v", err)
+	}
+	if user.Email != "foobar@example.com" || user.PendingEmail != "new@example.com" || !user.EmailVerified {
+		t.Fatalf("Pending email replaced the current email: %+v", user)
+	}
+	_, err = store.VerifyEmail(user.Id, "stale@example.com")
+	if err != ErrEmailChanged {
+		t.Fatalf("Expected an email changed error, actual: %v", err)
+	}
+	user, err = store.VerifyEmail(user.Id, "new@example.com")
+	if err != nil {
+		t.Fatalf("Error verifying pending email: %v", err)
+	}
+	if user.Email != "new@example.com" || user.PendingEmail != "" || !user.EmailVerified {
+		t.Fatalf("Verified pending email didn't replace the current email: %+v", user)
+	}
+	_, found, err := store.GetUserByEmail("foobar@example.com")
+	if err != nil || found {
+		t.Fatalf("Old email still in use: %v, %v", found, err)
+	}
+
+	user, err = store.UpdateUser(user.Id, "direct@example.com", "")
+	if err != nil {
+		t.Fatalf("Error updating user: %v", err)
+	}
+	if user.EmailVerified {
+		t.Fatal("Email changed without verification stayed verified")
+	}
+	_, err = store.UpdateUser(other.Id, "not an email", "")
+	if err != ErrInvalidEmail {
+		t.Fatalf("Expected an invalid email error, actual: %v", err)
+	}
+}
+
+func TestChangeCredentials(t *testing.T) {
+	testDb := NewDB("./testdatabase.json")
+
+	err := cleanupDbFile(testDb.path)
+	if err != nil {
+		t.Fatalf("Error cleaning up database file: %v", err)
+	}
+	testChangeCredentials(t, testDb)
+}
+
+// Changing the email and password together, shared by the database backends
+func testChangeCredentials(t *testing.T, store Store) {
+	user, err := store.CreateUser("foobar@example.com", "foobar")
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	_, err = store.CreateUser("other@example.com", "foobar")
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+
+	_, err = store.ChangeCredentials(user.Id, "OTHER@example.com", "new password")
+	if err != ErrEmailInUse {
+		t.Fatalf("Expected an email in use error, actual: %v", err)
+	}
+	_, err = store.ValidateCredentials("foobar@example.com", "foobar")
+	if err != nil {
+		t.Fatalf("Password changed even though the email was taken: %v", err)
+	}
+
+	user, err = store.ChangeCredentials(user.Id, "new@example.com", "new password")
+	if err != nil {
+		t.Fatalf("Error changing credentials: %v", err)
+	}
+	if user.Email != "foobar@example.com" || user.PendingEmail != "new@example.com" {
+		t.Fatalf("New email not held as pending: %+v", user)
+	}
+	_, err = store.ValidateCredentials("foobar@example.com", "new password")
+	if err != nil {
+		t.Fatalf("Password not changed: %v", err)
+	}
+
+	user, err = store.ChangeCredentials(user.Id, "", "newer password")
+	if err != nil {
+		t.Fatalf("Error changing password: %v", err)
+	}
+	if user.PendingEmail != "new@example.com" {
+		t.Fatalf("Changing only the password dropped the pending email: %+v", user)
+	}
+	_, err = store.ChangeCredentials(999, "", "newer password")
+	if err != ErrUserNotFound {
+		t.Fatalf("Expected a user not found error, actual: %v", err)
+	}
+}
+
+func TestValidateCredentialsUniformFailure(t *testing.T) {
+	testDb := NewDB("./testdatabase.json")
+
+	err := cleanupDbFile(testDb.path)
+	if err != nil {
+		t.Fatalf("Error cleaning up database file: %v", err)
+	}
+	testValidateCredentialsUniformFailure(t, testDb)
+}
+
+// Login failures shared by the database backends
+func testValidateCredentialsUniformFailure(t *testing.T, store Store) {
+	_, err := store.CreateUser("foobar@example.com", "foobar")
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	_, err = store.ValidateCredentials("foobar@example.com", "wrong")
+	if err != ErrInvalidCredentials {
+		t.Fatalf("Expected invalid credentials for a wrong password, actual: %v", err)
+	}
+	_, err = store.ValidateCredentials("missing@example.com", "foobar")
+	if err != ErrInvalidCredentials {
+		t.Fatalf("Expected invalid credentials for a missing user, actual: %v", err)
+	}
+}
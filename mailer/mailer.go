@@ -0,0 +1,86 @@
+// Defines the Mailer interface used to send email, and implementations for local development
+
+package mailer
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sends email to users
+type Mailer interface {
+	Send(message Message) error
+}
+
+// Formats a message as an RFC 5322 email, with CRLF line endings
+func (message Message) format(from string, date time.Time) []byte {
+	// Header values come from users, so line breaks are removed to keep them from adding headers
+	clean := strings.NewReplacer("\r", "", "\n", "").Replace
+	lines := []string{
+		"From: " + clean(from),
+		"To: " + clean(message.To),
+		"Subject: " + clean(message.Subject),
+		"Date: " + date.Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+	}
+	body := strings.ReplaceAll(strings.ReplaceAll(message.Body, "\r\n", "\n"), "\n", "\r\n")
+	return []byte(strings.Join(lines, "\r\n") + "\r\n" + body + "\r\n")
+}
+
+// Writes messages to the log instead of sending them. Meant for development.
+//
+//	Bodies carry password reset and verification tokens, which anyone who can read the log could use, so they're left out unless `ShowBodies` is set
+type LogMailer struct {
+	ShowBodies bool
+}
+
+func (mailer LogMailer) Send(message Message) error {
+	if !mailer.ShowBodies {
+		log.Printf("MAIL to %s: %s (%d byte body not logged)", message.To, message.Subject, len(message.Body))
+		return nil
+	}
+	log.Printf("MAIL to %s: %s\n%s", message.To, message.Subject, message.Body)
+	return nil
+}
+
+// Writes each message to its own `.eml` file in a directory instead of sending it. Meant for development and tests
+type FileMailer struct {
+	dir  string
+	from string
+	mux  *sync.Mutex
+	sent int
+}
+
+func NewFileMailer(dir string, from string) *FileMailer {
+	return &FileMailer{dir: dir, from: from, mux: &sync.Mutex{}}
+}
+
+func (mailer *FileMailer) Send(message Message) error {
+	err := os.MkdirAll(mailer.dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	mailer.mux.Lock()
+	mailer.sent++
+	sent := mailer.sent
+	mailer.mux.Unlock()
+
+	now := time.Now().UTC()
+	name := fmt.Sprintf("%s-%d.eml", now.Format("20060102T150405.000000Z"), sent)
+	return os.WriteFile(filepath.Join(mailer.dir, name), message.format(mailer.from, now), 0600)
+}
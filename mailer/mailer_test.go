@@ -0,0 +1,33 @@
+package mailer
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLogMailerHidesBodies(t *testing.T) {
+	output := bytes.Buffer{}
+	log.SetOutput(&output)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	message := Message{To: "foobar@example.com", Subject: "Reset your password", Body: "secret-reset-token"}
+	err := LogMailer{}.Send(message)
+	if err != nil {
+		t.Fatalf("Error logging mail: %v", err)
+	}
+	if strings.Contains(output.String(), message.Body) || !strings.Contains(output.String(), message.Subject) {
+		t.Fatalf("Expected only the message's recipient and subject to be logged: %q", output.String())
+	}
+
+	output.Reset()
+	err = LogMailer{ShowBodies: true}.Send(message)
+	if err != nil {
+		t.Fatalf("Error logging mail: %v", err)
+	}
+	if !strings.Contains(output.String(), message.Body) {
+		t.Fatalf("Expected the body to be logged when asked for: %q", output.String())
+	}
+}
@@ -0,0 +1,29 @@
+package mailer
+
+import (
+	"net"
+	"net/smtp"
+	"time"
+)
+
+// Sends messages through an SMTP server.
+//
+//	STARTTLS is used when the server offers it. Credentials are only sent over TLS or to localhost, which `net/smtp` enforces
+type SMTPMailer struct {
+	addr string
+	from string
+	auth smtp.Auth // nil when the server doesn't need authentication
+}
+
+// Creates a mailer for the SMTP server at `host:port`. Leave `username` empty if the server doesn't need authentication
+func NewSMTPMailer(host string, port string, username string, password string, from string) *SMTPMailer {
+	mailer := &SMTPMailer{addr: net.JoinHostPort(host, port), from: from}
+	if username != "" {
+		mailer.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return mailer
+}
+
+func (mailer *SMTPMailer) Send(message Message) error {
+	return smtp.SendMail(mailer.addr, mailer.auth, mailer.from, []string{message.To}, message.format(mailer.from, time.Now()))
+}
@@ -0,0 +1,115 @@
+package mailer
+
+import (
+	"bufio"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A message received by the fake SMTP server
+type receivedMail struct {
+	from string
+	to   []string
+	data string
+}
+
+// Starts an SMTP server on a random local port that accepts every message and sends it to the returned channel
+func startFakeSMTPServer(t *testing.T) (host string, port string, received chan receivedMail) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting fake SMTP server: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	received = make(chan receivedMail, 1)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeSMTP(conn, received)
+		}
+	}()
+
+	host, port, _ = net.SplitHostPort(listener.Addr().String())
+	return host, port, received
+}
+
+func serveFakeSMTP(conn net.Conn, received chan receivedMail) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 localhost fake SMTP")
+
+	mail := receivedMail{}
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch command {
+		case "EHLO", "HELO":
+			text.PrintfLine("250-localhost")
+			text.PrintfLine("250 AUTH PLAIN")
+		case "AUTH":
+			text.PrintfLine("235 Authenticated")
+		case "MAIL":
+			mail.from = line[len("MAIL FROM:"):]
+			text.PrintfLine("250 OK")
+		case "RCPT":
+			mail.to = append(mail.to, line[len("RCPT TO:"):])
+			text.PrintfLine("250 OK")
+		case "DATA":
+			text.PrintfLine("354 Send the message")
+			data, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			mail.data = string(data)
+			received <- mail
+			text.PrintfLine("250 Queued")
+		case "QUIT":
+			text.PrintfLine("221 Bye")
+			return
+		default:
+			text.PrintfLine("250 OK")
+		}
+	}
+}
+
+func TestSMTPMailerSend(t *testing.T) {
+	host, port, received := startFakeSMTPServer(t)
+	mailer := NewSMTPMailer(host, port, "chirpy", "password", "chirpy@example.com")
+
+	err := mailer.Send(Message{To: "foobar@example.com", Subject: "Reset your password", Body: "First line\nSecond line"})
+	if err != nil {
+		t.Fatalf("Error sending mail: %v", err)
+	}
+
+	mail := <-received
+	if mail.from != "<chirpy@example.com>" || len(mail.to) != 1 || mail.to[0] != "<foobar@example.com>" {
+		t.Fatalf("Mail sent with the wrong envelope: %+v", mail)
+	}
+	reader := textproto.NewReader(bufio.NewReader(strings.NewReader(mail.data)))
+	header, err := reader.ReadMIMEHeader()
+	if err != nil {
+		t.Fatalf("Error reading mail headers: %v", err)
+	}
+	if header.Get("Subject") != "Reset your password" || header.Get("To") != "foobar@example.com" {
+		t.Fatalf("Mail sent with the wrong headers: %v", header)
+	}
+	if !strings.Contains(mail.data, "First line\nSecond line") {
+		t.Fatalf("Mail sent with the wrong body: %q", mail.data)
+	}
+}
+
+func TestMessageHeadersStripLineBreaks(t *testing.T) {
+	formatted := string(Message{To: "foobar@example.com", Subject: "Hello\r\nBcc: victim@example.com"}.format("chirpy@example.com", time.Now()))
+	if strings.Contains(formatted, "\r\nBcc:") {
+		t.Fatalf("Subject added a header: %q", formatted)
+	}
+}
@@ -1,14 +1,23 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"io/fs"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/joho/godotenv"
 	"github.com/trolfu/boot-dev-web-servers-course/apiConfig"
+	"github.com/trolfu/boot-dev-web-servers-course/database"
+	"github.com/trolfu/boot-dev-web-servers-course/mailer"
 )
 
 func main() {
@@ -18,57 +27,489 @@ func main() {
 	}
 
 	debug := flag.Bool("debug", false, "Enable debug mode")
+	storage := flag.String("storage", "json", "Database backend to use: `json` or `sqlite`")
+	journal := flag.Bool("journal", false, "Journal changes to the JSON database instead of rewriting the file on every change")
+	compactInterval := flag.Duration("compact-interval", time.Minute, "How often the JSON database journal is compacted")
+	flushInterval := flag.Duration("flush-interval", 0, "How often changes are written to the JSON database. 0 writes every change immediately")
+	migrateDryRun := flag.Bool("migrate-dry-run", false, "Print the schema migrations the database needs and exit without changing it")
+	snapshotDir := flag.String("snapshot-dir", "./snapshots", "Directory database snapshots are stored in")
+	snapshotRetain := flag.Int("snapshot-retain", 10, "Number of database snapshots to keep. 0 keeps every snapshot")
+	tokenSweepInterval := flag.Duration("token-sweep-interval", time.Hour, "How often expired refresh tokens are removed from the database. 0 disables the sweep")
+	jwtKeyDir := flag.String("jwt-key-dir", "", "Directory of PEM keys to sign and verify JWTs with, named `<key id>.pem`. JWT_SECRET is also accepted if it's set")
+	jwtActiveKey := flag.String("jwt-active-key", "", "Id of the key new JWTs are signed with. Defaults to the last private key by name in -jwt-key-dir, then JWT_SECRET")
+	mailerKind := flag.String("mailer", "log", "How email is sent: `log` (message bodies are only logged with -debug), `file` (to -mail-dir), or `smtp` (configured by the SMTP_* variables)")
+	mailDir := flag.String("mail-dir", "./mail", "Directory emails are written to when -mailer is file")
+	unverifiedRestrictions := flag.String("unverified-restrictions", "", "Comma separated things users can't do until they verify their email: `chirps` (posting chirps) and `upgrades` (Chirpy Red)")
+	passwordHash := flag.String("password-hash", database.DefaultPasswordHashParams.Algorithm, "Algorithm new password hashes are made with: `argon2id` or `bcrypt`. Older hashes are upgraded when their user logs in")
+	passwordMinLength := flag.Int("password-min-length", apiConfig.DefaultPasswordPolicy.MinLength, "Minimum number of characters in a new password")
+	passwordAllowCommon := flag.Bool("password-allow-common", false, "Allow new passwords that are on the bundled list of common passwords")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [snapshot create|list|restore <name> | admin grant <email>]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
-	databasePath := "./database.json"
+	if *migrateDryRun {
+		err = printPendingMigrations(*storage)
+		if err != nil {
+			log.Fatalf("Migration dry run failed: %v", err)
+		}
+		return
+	}
+
+	hashParams := database.DefaultPasswordHashParams
+	hashParams.Algorithm = *passwordHash
+	err = database.SetPasswordHashing(hashParams)
+	if err != nil {
+		log.Fatalf("Invalid -password-hash: %v", err)
+	}
+	passwordPolicy := apiConfig.PasswordPolicy{MinLength: *passwordMinLength, RejectCommon: !*passwordAllowCommon}
+
+	opts := database.Options{
+		Journal:         *journal,
+		CompactInterval: *compactInterval,
+		FlushInterval:   *flushInterval,
+	}
+	snapshots := database.NewSnapshots(*snapshotDir, *snapshotRetain)
+
+	if flag.Arg(0) == "snapshot" {
+		err = runSnapshotCommand(flag.Args()[1:], snapshots, *storage, opts)
+		if err != nil {
+			log.Fatalf("Snapshot command failed: %v", err)
+		}
+		return
+	}
+	if flag.Arg(0) == "admin" {
+		err = runAdminCommand(flag.Args()[1:], *storage, opts)
+		if err != nil {
+			log.Fatalf("Admin command failed: %v", err)
+		}
+		return
+	}
+	if flag.NArg() > 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	keyring, err := apiConfig.LoadKeyring(*jwtKeyDir, *jwtActiveKey, os.Getenv("JWT_SECRET"))
+	if err != nil {
+		log.Fatalf("Failed to load JWT keys: %v", err)
+	}
+
+	mail, err := openMailer(*mailerKind, *mailDir, *debug)
+	if err != nil {
+		log.Fatalf("Failed to configure email: %v", err)
+	}
+	restrictions, err := apiConfig.ParseUnverifiedRestrictions(*unverifiedRestrictions)
+	if err != nil {
+		log.Fatalf("Invalid -unverified-restrictions: %v", err)
+	}
 
-	if _, err := os.Stat(databasePath); err == nil && *debug {
-		os.Remove(databasePath)
+	db, err := openDatabase(*storage, *debug, opts)
+	if err != nil {
+		log.Fatalf("Failed to open the database: %v", err)
 	}
+	defer db.Close()
+	verifySnapshots(snapshots)
 
 	router := chi.NewRouter()
-	apiConfig := apiConfig.NewAPIConfig(databasePath, os.Getenv("JWT_SECRET"), os.Getenv("POLKA_API_KEY"))
+	apiConfig := apiConfig.NewAPIConfig(db, snapshots, keyring, mail, restrictions, passwordPolicy, os.Getenv("POLKA_API_KEY"))
+	router.Use(apiConfig.MiddlewareRecordRequests)
 
 	// Fileserver handler
 	fileServerHandler := apiConfig.MiddlewareIncrementMetrics(http.StripPrefix("/app", http.FileServer(http.Dir("."))))
 	router.Handle("/app", fileServerHandler)
 	router.Handle("/app/*", fileServerHandler)
+	router.Get("/.well-known/jwks.json", apiConfig.GetJWKS)
 
 	// API handlers
 	apiRouter := chi.NewRouter()
 	apiRouter.Get("/healthz", healthCheck)
 	apiRouter.Get("/metrics", apiConfig.ApiMetrics)
-	apiRouter.HandleFunc("/reset", apiConfig.ResetMetrics)
-	apiRouter.Post("/chirps", apiConfig.CreateChirp)
 	apiRouter.Get("/chirps", apiConfig.GetChirps)
 	apiRouter.Get("/chirps/{chirpId}", apiConfig.GetChirp)
-	apiRouter.Delete("/chirps/{chirpId}", apiConfig.DeleteChirp)
 	apiRouter.Post("/users", apiConfig.CreateUser)
-	apiRouter.Put("/users", apiConfig.UpdateUser)
 	apiRouter.Post("/login", apiConfig.Login)
-	apiRouter.Post("/refresh", apiConfig.RefreshAuth)
-	apiRouter.Post("/revoke", apiConfig.RevokeAuth)
+	apiRouter.Post("/login/2fa", apiConfig.LoginTwoFactor)
+	apiRouter.Post("/password-reset", apiConfig.RequestPasswordReset)
+	apiRouter.Post("/password-reset/confirm", apiConfig.ConfirmPasswordReset)
+	apiRouter.Post("/email-verification/confirm", apiConfig.ConfirmEmailVerification)
 	apiRouter.Post("/polka/webhooks", apiConfig.UpgradeUser)
 
+	// Routes that need an access token, or an API key with the route's scope
+	apiRouter.Group(func(authRouter chi.Router) {
+		authRouter.Use(apiConfig.MiddlewareRequireAuth)
+		authRouter.With(apiConfig.MiddlewareRequireScope(database.ScopeChirpsWrite)).Post("/chirps", apiConfig.CreateChirp)
+		authRouter.With(apiConfig.MiddlewareRequireScope(database.ScopeChirpsWrite)).Delete("/chirps/{chirpId}", apiConfig.DeleteChirp)
+		authRouter.With(apiConfig.MiddlewareRequireScope(database.ScopeProfileWrite)).Put("/users", apiConfig.UpdateUser)
+
+		// Routes that manage the account itself, which API keys can't use
+		authRouter.Group(func(accountRouter chi.Router) {
+			accountRouter.Use(apiConfig.MiddlewareRequireFullAccess)
+			accountRouter.Post("/email-verification", apiConfig.RequestEmailVerification)
+			accountRouter.Get("/2fa", apiConfig.GetTwoFactor)
+			accountRouter.Post("/2fa/enroll", apiConfig.EnrollTwoFactor)
+			accountRouter.Post("/2fa/confirm", apiConfig.ConfirmTwoFactor)
+			accountRouter.Delete("/2fa", apiConfig.DisableTwoFactor)
+			accountRouter.Get("/sessions", apiConfig.GetSessions)
+			accountRouter.Delete("/sessions", apiConfig.DeleteSessions)
+			accountRouter.Delete("/sessions/{sessionId}", apiConfig.DeleteSession)
+			accountRouter.Get("/api-keys", apiConfig.GetApiKeys)
+			accountRouter.Post("/api-keys", apiConfig.CreateApiKey)
+			accountRouter.Delete("/api-keys/{apiKeyId}", apiConfig.DeleteApiKey)
+			accountRouter.Get("/oauth/clients", apiConfig.GetOAuthClients)
+			accountRouter.Post("/oauth/clients", apiConfig.CreateOAuthClient)
+			accountRouter.Delete("/oauth/clients/{clientId}", apiConfig.DeleteOAuthClient)
+		})
+	})
+	// Routes that need an admin's access token
+	apiRouter.Group(func(adminOnlyRouter chi.Router) {
+		adminOnlyRouter.Use(apiConfig.MiddlewareRequireAuth, apiConfig.MiddlewareRequireFullAccess, apiConfig.MiddlewareRequireAdmin)
+		adminOnlyRouter.HandleFunc("/reset", apiConfig.ResetMetrics)
+	})
+	// Routes that need a refresh token
+	apiRouter.Group(func(refreshRouter chi.Router) {
+		refreshRouter.Use(apiConfig.MiddlewareRequireRefreshToken)
+		refreshRouter.Post("/refresh", apiConfig.RefreshAuth)
+		refreshRouter.Post("/revoke", apiConfig.RevokeAuth)
+	})
+
 	router.Mount("/api", apiRouter)
 
 	// Admin handlers
 	adminRouter := chi.NewRouter()
-	adminRouter.Get("/metrics", apiConfig.AdminApiMetrics)
+	adminRouter.Group(func(adminApiRouter chi.Router) {
+		adminApiRouter.Use(apiConfig.MiddlewareRequireAuth, apiConfig.MiddlewareRequireFullAccess, apiConfig.MiddlewareRequireAdmin)
+		adminApiRouter.Get("/snapshots", apiConfig.GetSnapshots)
+		adminApiRouter.Post("/snapshots", apiConfig.CreateSnapshot)
+		adminApiRouter.Post("/snapshots/{snapshotName}/restore", apiConfig.RestoreSnapshot)
+		adminApiRouter.Post("/refresh-tokens/sweep", apiConfig.SweepRefreshTokens)
+		adminApiRouter.Put("/users/{userId}/role", apiConfig.SetUserRole)
+		adminApiRouter.Get("/audit-events", apiConfig.GetAuditEvents)
+		adminApiRouter.Get("/lockouts", apiConfig.GetLockouts)
+		adminApiRouter.Delete("/lockouts/{key}", apiConfig.DeleteLockout)
+	})
+	// The admin dashboard's pages, which send logged out browsers to the login page instead of responding with JSON
+	adminRouter.Group(func(dashboardRouter chi.Router) {
+		dashboardRouter.Use(apiConfig.MiddlewareAdminDashboard)
+		dashboardRouter.Handle("/assets/*", apiConfig.AdminAssets())
+		dashboardRouter.Get("/", apiConfig.AdminOverview)
+		dashboardRouter.Get("/users", apiConfig.AdminUsers)
+		dashboardRouter.Get("/users/{userId}", apiConfig.AdminUser)
+		dashboardRouter.Post("/users/{userId}/upgrade", apiConfig.AdminUpgradeUser)
+		dashboardRouter.Post("/users/{userId}/downgrade", apiConfig.AdminDowngradeUser)
+		dashboardRouter.Post("/users/{userId}/disable", apiConfig.AdminDisableUser)
+		dashboardRouter.Post("/users/{userId}/enable", apiConfig.AdminEnableUser)
+		dashboardRouter.Get("/chirps", apiConfig.AdminChirps)
+		dashboardRouter.Delete("/chirps/{chirpId}", apiConfig.AdminDeleteChirp)
+		dashboardRouter.Get("/tokens", apiConfig.AdminTokens)
+		dashboardRouter.Post("/tokens/sweep", apiConfig.AdminSweepTokens)
+		dashboardRouter.Delete("/sessions/{sessionId}", apiConfig.AdminRevokeSession)
+		dashboardRouter.Get("/metrics", apiConfig.AdminMetrics)
+		dashboardRouter.Get("/audit", apiConfig.AdminAudit)
+	})
 
 	router.Mount("/admin", adminRouter)
 
+	// OAuth2 authorization server handlers. Clients authenticate themselves at the token and revocation endpoints
+	oauthRouter := chi.NewRouter()
+	oauthRouter.Get("/authorize", apiConfig.Authorize)
+	oauthRouter.Post("/authorize", apiConfig.ApproveAuthorization)
+	oauthRouter.Post("/token", apiConfig.OAuthToken)
+	oauthRouter.Post("/revoke", apiConfig.RevokeOAuthToken)
+
+	router.Mount("/oauth", oauthRouter)
+
+	// Web pages, which browsers use with session cookies
+	router.Group(func(webRouter chi.Router) {
+		webRouter.Use(apiConfig.MiddlewareWebSession)
+		webRouter.Get("/", apiConfig.WebTimeline)
+		webRouter.Get("/users/{userId}", apiConfig.WebProfile)
+		webRouter.Get("/chirps", apiConfig.WebChirps)
+		webRouter.Post("/chirps", apiConfig.WebPostChirp)
+		webRouter.Delete("/chirps/{chirpId}", apiConfig.WebDeleteChirp)
+		webRouter.Get("/login", apiConfig.WebLoginPage)
+		webRouter.Post("/login", apiConfig.WebLogin)
+		webRouter.Get("/signup", apiConfig.WebSignupPage)
+		webRouter.Post("/signup", apiConfig.WebSignup)
+		webRouter.Post("/logout", apiConfig.WebLogout)
+	})
+
+	janitorCtx, stopJanitor := context.WithCancel(context.Background())
+	defer stopJanitor()
+	if *tokenSweepInterval > 0 {
+		go apiConfig.RunTokenJanitor(janitorCtx, *tokenSweepInterval)
+	}
+
 	corsMux := middlewareCors(router)
 	server := http.Server{Handler: corsMux, Addr: "localhost:8080"}
-	server.ListenAndServe()
+
+	// Shut down cleanly on interrupt so the deferred database close can write any pending changes
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-shutdown
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+
+	err = server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("Server error: %v", err)
+	}
+}
+
+// Gets the database file path for the storage backend
+func databasePath(storage string) (string, error) {
+	switch storage {
+	case "json":
+		return "./database.json", nil
+	case "sqlite":
+		return "./database.db", nil
+	default:
+		return "", fmt.Errorf("unknown storage backend '%s'", storage)
+	}
+}
+
+// Prints the migrations that would run against the database without running them
+func printPendingMigrations(storage string) error {
+	path, err := databasePath(storage)
+	if err != nil {
+		return err
+	}
+
+	var report database.MigrationReport
+	if storage == "sqlite" {
+		report, err = database.DryRunSQLiteMigrations(path)
+	} else {
+		report, err = database.DryRunMigrations(path)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s is at schema version %d\n", path, report.FromVersion)
+	if len(report.Applied) == 0 {
+		fmt.Println("No migrations pending")
+		return nil
+	}
+	for _, migration := range report.Applied {
+		fmt.Printf("  -> %d: %s\n", migration.Version, migration.Description)
+	}
+	for _, note := range report.Notes {
+		fmt.Printf("  note: %s\n", note)
+	}
+	return nil
+}
+
+// Deletes the database at `path` along with the files its backend keeps beside it: the JSON journal, or SQLite's write-ahead log and its index.
+//
+//	Leaving a WAL behind would replay old pages into the new database. Files that don't exist are skipped
+func removeDatabase(path string) error {
+	for _, name := range []string{path, path + ".journal", path + "-wal", path + "-shm"} {
+		err := os.Remove(name)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("removing debug database: %w", err)
+		}
+	}
+	return nil
+}
+
+// Opens the database backend selected by the `storage` flag. Debug mode starts from an empty database
+//
+//	`opts` only applies to the JSON backend. Errors if the database (or its journal) can't be recovered
+func openDatabase(storage string, debug bool, opts database.Options) (database.Store, error) {
+	path, err := databasePath(storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if debug {
+		err = removeDatabase(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if storage == "sqlite" {
+		return database.NewSQLiteDB(path)
+	}
+
+	db, err := database.OpenDB(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	report, err := db.RepairSequences()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("repairing id sequences: %w", err)
+	}
+	if report.Repaired {
+		log.Printf("Initialized id sequences %v", report.Sequences)
+		for _, collision := range report.Collisions {
+			log.Printf("WARNING: %s id collision: %s", collision.Entity, collision.Detail)
+		}
+	}
+	return db, nil
+}
+
+// Creates the mailer selected by the `mailer` flag. Messages are sent from MAIL_FROM
+//
+//	The log mailer only logs message bodies, which hold one-time tokens, in debug mode.
+//	The SMTP mailer connects to SMTP_HOST and SMTP_PORT, and logs in with SMTP_USERNAME and SMTP_PASSWORD if they're set
+func openMailer(kind string, dir string, debug bool) (mailer.Mailer, error) {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "chirpy@localhost"
+	}
+
+	switch kind {
+	case "log":
+		return mailer.LogMailer{ShowBodies: debug}, nil
+	case "file":
+		return mailer.NewFileMailer(dir, from), nil
+	case "smtp":
+		host := os.Getenv("SMTP_HOST")
+		if host == "" {
+			return nil, errors.New("SMTP_HOST must be set to send email over SMTP")
+		}
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		return mailer.NewSMTPMailer(host, port, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), from), nil
+	default:
+		return nil, fmt.Errorf("unknown mailer '%s'", kind)
+	}
 }
 
-// Copied (as directed) from ch1.4
+// Runs a `snapshot` subcommand against the database, which must not be in use by a running server
+func runSnapshotCommand(args []string, snapshots *database.Snapshots, storage string, opts database.Options) error {
+	if len(args) == 0 {
+		return errors.New("expected create, list, or restore <name>")
+	}
+
+	switch args[0] {
+	case "list":
+		infos, err := snapshots.List()
+		if err != nil {
+			return err
+		}
+		if len(infos) == 0 {
+			fmt.Println("No snapshots")
+		}
+		for _, info := range infos {
+			fmt.Printf("%s\t%s\t%d bytes\n", info.Name, info.CreatedAt.Format(time.RFC3339), info.Size)
+		}
+		return nil
+
+	case "create":
+		db, err := openDatabase(storage, false, opts)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		info, err := snapshots.Create(db)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Created snapshot %s\n", info.Name)
+		return nil
+
+	case "restore":
+		if len(args) != 2 {
+			return errors.New("expected the name of the snapshot to restore")
+		}
+		// Checked before opening the database so a bad snapshot doesn't trigger any migrations
+		err := snapshots.Verify(args[1])
+		if err != nil {
+			return err
+		}
+		db, err := openDatabase(storage, false, opts)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		err = snapshots.Restore(db, args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Restored snapshot %s\n", args[1])
+		return nil
+
+	default:
+		return fmt.Errorf("unknown snapshot command '%s'", args[0])
+	}
+}
+
+// Runs an `admin` subcommand against the database, which must not be in use by a running server.
+//
+//	`admin grant <email>` makes an existing user an admin, which is how the first admin is created
+func runAdminCommand(args []string, storage string, opts database.Options) error {
+	if len(args) != 2 || args[0] != "grant" {
+		return errors.New("expected grant <email>")
+	}
+
+	db, err := openDatabase(storage, false, opts)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	user, found, err := db.GetUserByEmail(args[1])
+	if err != nil {
+		return err
+	}
+	if !found {
+		return database.ErrUserNotFound
+	}
+	previousRole := user.Role
+	user, err = db.SetUserRole(user.Id, database.RoleAdmin)
+	if err != nil {
+		return err
+	}
+	_, err = db.CreateAuditEvent(database.AuditEvent{
+		CreatedAt: time.Now().UTC(),
+		Action:    "user.role",
+		Target:    fmt.Sprintf("user:%d", user.Id),
+		Details:   fmt.Sprintf("Changed role from %s to %s from the command line", previousRole, user.Role),
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s is now an admin. The role applies from their next login or refresh\n", user.Email)
+	return nil
+}
+
+// Checks every retained snapshot's checksum and schema version, so a broken snapshot is noticed before it's needed
+func verifySnapshots(snapshots *database.Snapshots) {
+	infos, err := snapshots.List()
+	if err != nil {
+		log.Printf("WARNING: unable to list snapshots: %v", err)
+		return
+	}
+	for _, info := range infos {
+		err = snapshots.Verify(info.Name)
+		if err != nil {
+			log.Printf("WARNING: snapshot %s can't be restored: %v", info.Name, err)
+		}
+	}
+}
+
+// Copied (as directed) from ch1.4.
+//
+//	Requests carrying a browser session's cookies don't get the wildcard origin, so only Chirpy's own pages can read their responses
 func middlewareCors(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "*")
+		if !apiConfig.HasSessionCookie(r) {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, DELETE")
+			w.Header().Set("Access-Control-Allow-Headers", "*")
+		}
+		w.Header().Add("Vary", "Cookie")
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
 			return